@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+const headerAdminToken = "X-Admin-Token"
+
+// DBやサーバーの設定を書き換える運用系のAPIの認証
+// SRVNO=1以外のサーバーは:3000で直接受けるので，セッションのない運用系のグループに置くと誰でも叩ける
+// ADMIN_TOKENがあればX-Admin-Tokenの一致を求め，なければ同じホストから(loopbackかunix domain socket)だけ受ける
+var adminToken = getEnv("ADMIN_TOKEN", "")
+
+func adminAuthMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !adminAuthorized(c.Request()) {
+				return c.String(http.StatusForbidden, "forbidden")
+			}
+			return next(c)
+		}
+	}
+}
+
+func adminAuthorized(req *http.Request) bool {
+	if adminToken != "" {
+		return subtle.ConstantTimeCompare([]byte(req.Header.Get(headerAdminToken)), []byte(adminToken)) == 1
+	}
+	// X-Forwarded-Forなどは偽れるので見ず，接続元だけで判定する
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		// unix domain socketの接続元はアドレスを持たない(nginxは/internalを流さないので，同じホストから)
+		return req.RemoteAddr == "" || req.RemoteAddr == "@"
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// 他のサーバーの運用系APIを呼ぶときに，このサーバーと同じADMIN_TOKENを載せる
+func setAdminToken(req *http.Request) {
+	if adminToken != "" {
+		req.Header.Set(headerAdminToken, adminToken)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	backupDir = getEnv("BACKUP_DIR", "/tmp/isucondition-backups")
+	// 同じ秒に取っても別の名前になるようナノ秒まで付ける(以前の秒までの名前も読める)
+	backupNamePattern = regexp.MustCompile(`^[0-9]{8}-[0-9]{6}(\.[0-9]{9})?\.sql$`)
+)
+
+type BackupInfo struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func mysqlCommand(name string, args ...string) *exec.Cmd {
+	conn := getMySQLConnectionEnv()
+	cmd := exec.Command(name, append([]string{
+		"--defaults-file=/dev/null",
+		"-h", conn.Host,
+		"-P", conn.Port,
+		"-u", conn.User,
+	}, args...)...)
+	cmd.Env = append(os.Environ(), "MYSQL_PWD="+conn.Password)
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// キューに残っているコンディションを書き出してからmysqldumpでスナップショットを取る
+func createBackup() (BackupInfo, error) {
+	err := flushInsertQueue()
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	err = os.MkdirAll(backupDir, 0755)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+
+	name := time.Now().Format("20060102-150405.000000000") + ".sql"
+	path := filepath.Join(backupDir, name)
+	// 既にあるスナップショットは上書きしない
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	defer f.Close()
+
+	cmd := mysqlCommand("mysqldump", "--single-transaction", "--quick", getMySQLConnectionEnv().DBName)
+	cmd.Stdout = f
+	err = cmd.Run()
+	if err != nil {
+		os.Remove(path)
+		return BackupInfo{}, fmt.Errorf("mysqldump: %w", err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	return BackupInfo{Name: name, Size: stat.Size(), CreatedAt: stat.ModTime()}, nil
+}
+
+func listBackups() ([]BackupInfo, error) {
+	entries, err := os.ReadDir(backupDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []BackupInfo{}, nil
+		}
+		return nil, err
+	}
+	backups := []BackupInfo{}
+	for _, entry := range entries {
+		if !backupNamePattern.MatchString(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, BackupInfo{Name: entry.Name(), Size: info.Size(), CreatedAt: info.ModTime()})
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Name > backups[j].Name
+	})
+	return backups, nil
+}
+
+// スナップショットを流し込み，DBの中身が変わるのでメモリ上のキャッシュを捨てる
+// 他のサーバーのキャッシュも/initializeと同じく全サーバーに届くまで待って捨てさせる
+func restoreBackup(name string) error {
+	f, err := os.Open(filepath.Join(backupDir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	flushLock.Lock()
+	defer flushLock.Unlock()
+	discardInsertQueue()
+	cmd := mysqlCommand("mysql", getMySQLConnectionEnv().DBName)
+	cmd.Stdin = f
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("mysql: %w", err)
+	}
+
+	resetInMemoryState()
+	broadcastReset()
+	return nil
+}
+
+// GET /internal/backups
+// スナップショットの一覧を取得
+func getBackups(c echo.Context) error {
+	backups, err := listBackups()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, backups)
+}
+
+// POST /internal/backups
+// スナップショットを作成
+func postBackup(c echo.Context) error {
+	initializeLock.Lock()
+	defer initializeLock.Unlock()
+
+	backup, err := createBackup()
+	if err != nil {
+		c.Logger().Errorf("failed to create backup: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusCreated, backup)
+}
+
+// POST /internal/backups/:name/restore
+// スナップショットから復元
+func postRestore(c echo.Context) error {
+	name := c.Param("name")
+	if !backupNamePattern.MatchString(name) {
+		return c.String(http.StatusBadRequest, "bad format: name")
+	}
+
+	initializeLock.Lock()
+	defer initializeLock.Unlock()
+
+	err := restoreBackup(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c.String(http.StatusNotFound, "not found: backup")
+		}
+		c.Logger().Errorf("failed to restore backup: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// キャッシュの分割や事前シリアライズなどを入れる前後で数字を比べるための，DBを使わないベンチマーク
+//
+//	go test -run '^$' -bench . -benchmem
+const benchIsus = 1000
+
+func benchUUID(i int) string {
+	return fmt.Sprintf("00000000-0000-4000-8000-%012d", i)
+}
+
+func benchCondition(i int) IsuCondition {
+	return IsuCondition{
+		JIAIsuUUID: benchUUID(i % benchIsus),
+		Timestamp:  time.Unix(1627916400+int64(i), 0),
+		IsSitting:  i%2 == 0,
+		Condition:  "is_dirty=true,is_overweight=false,is_broken=false",
+		Message:    "bench",
+		Level:      conditionLevelWarning,
+	}
+}
+
+func benchConditions(n int) []IsuCondition {
+	conds := make([]IsuCondition, n)
+	for i := range conds {
+		conds[i] = benchCondition(i)
+	}
+	return conds
+}
+
+// DBを引かないように全ISU分を先に入れておき，ヒットだけを測る
+func newBenchConditionCache() *IsuConditionCache {
+	cc := NewIsuConditionCache(0)
+	for i := 0; i < benchIsus; i++ {
+		cond := benchCondition(i)
+		cc.Set(&cond)
+	}
+	return cc
+}
+
+func BenchmarkIsuConditionCachePeek(b *testing.B) {
+	cc := newBenchConditionCache()
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			_, ok := cc.Peek(benchUUID(i % benchIsus))
+			if !ok {
+				b.Error("cache miss")
+				return
+			}
+			i++
+		}
+	})
+}
+
+// 書き込み(flush時のForgetとGetでの詰め直し)が1割混ざる場合
+func BenchmarkIsuConditionCachePeekSet(b *testing.B) {
+	cc := newBenchConditionCache()
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if i%10 == 0 {
+				cond := benchCondition(i)
+				cc.Set(&cond)
+			} else {
+				cc.Peek(benchUUID(i % benchIsus))
+			}
+			i++
+		}
+	})
+}
+
+// 上限を超えて入れ続け，LRUでの追い出しが毎回起きる場合
+func BenchmarkIsuConditionCacheEvict(b *testing.B) {
+	cc := NewIsuConditionCache(benchIsus / 2)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			cond := benchCondition(i)
+			cc.Set(&cond)
+			i++
+		}
+	})
+}
+
+func benchmarkInsertQueue(b *testing.B, batchSize int) {
+	batch := benchConditions(batchSize)
+	iq := NewQueue()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// 1回のflushの間にISU10台分のPOSTが届く想定
+		for j := 0; j < 10; j++ {
+			iq.Insert(batch)
+		}
+		if len(iq.PopAll()) != batchSize*10 {
+			b.Fatal("unexpected queue length")
+		}
+	}
+}
+
+func BenchmarkInsertQueueBatch100(b *testing.B) {
+	benchmarkInsertQueue(b, 100)
+}
+
+func BenchmarkInsertQueueBatch10000(b *testing.B) {
+	benchmarkInsertQueue(b, 10000)
+}
+
+// flushの最中にPOSTが並行して積まれる場合
+func BenchmarkInsertQueueParallel(b *testing.B) {
+	batch := benchConditions(100)
+	iq := NewQueue()
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if i%100 == 0 {
+				iq.PopAll()
+			} else {
+				iq.Insert(batch)
+			}
+			i++
+		}
+	})
+}
+
+// DBには送らず，文と引数を組み立てるところまでを比べる(namedは以前のNamedExecと同じ展開)
+func BenchmarkBuildIsuConditionInsert(b *testing.B) {
+	batch := benchConditions(2000)
+	b.Run("values_builder", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buildIsuConditionInsert(batch)
+		}
+	})
+	b.Run("named", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _, err := sqlx.Named("INSERT INTO `isu_condition`"+
+				"	(`jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`, `message_code`, `sequence`)"+
+				"	VALUES (:jia_isu_uuid, :timestamp, :is_sitting, :condition, :message, :message_code, :sequence)", batch)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func benchTrend() []TrendResponse {
+	trend := []TrendResponse{}
+	for c := 0; c < 10; c++ {
+		res := TrendResponse{
+			Character: "character" + strconv.Itoa(c),
+			Info:      []*TrendCondition{},
+			Warning:   []*TrendCondition{},
+			Critical:  []*TrendCondition{},
+		}
+		for i := 0; i < benchIsus/10; i++ {
+			cond := &TrendCondition{ID: c*benchIsus + i, Timestamp: 1627916400 + int64(i)}
+			switch i % 3 {
+			case 0:
+				res.Info = append(res.Info, cond)
+			case 1:
+				res.Warning = append(res.Warning, cond)
+			default:
+				res.Critical = append(res.Critical, cond)
+			}
+		}
+		trend = append(trend, res)
+	}
+	return trend
+}
+
+func benchGraph() []GraphResponse {
+	graph := emptyIsuGraphResponse(time.Unix(1627916400, 0))
+	for i := range graph {
+		timestamps := make([]int64, 0, 60)
+		for j := 0; j < 60; j++ {
+			timestamps = append(timestamps, graph[i].StartAt+int64(j*60))
+		}
+		graph[i].Data = &GraphDataPoint{
+			Score:      80,
+			Percentage: ConditionsPercentage{Sitting: 50, IsBroken: 10, IsDirty: 20, IsOverweight: 30},
+		}
+		graph[i].ConditionTimestamps = timestamps
+	}
+	return graph
+}
+
+func BenchmarkTrendGraphEncode(b *testing.B) {
+	for _, bench := range []struct {
+		name string
+		v    interface{}
+	}{
+		{"trend", benchTrend()},
+		{"graph", benchGraph()},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				body, err := json.Marshal(bench.v)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.SetBytes(int64(len(body)))
+			}
+		})
+	}
+}
+
+// リクエスト毎に作るロガー．IDはログを出すときに付けるので，ここではロガー1つ分しか割り当てない
+func BenchmarkNewRequestLogger(b *testing.B) {
+	base := newEchoLogger(apiLogger)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		benchLoggerSink = newRequestLogger(base, "01HZXREQUESTID0000000000000")
+	}
+}
+
+var benchLoggerSink echo.Logger
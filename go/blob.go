@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// キャッシュしているバイト列を，コピーや中間バッファを挟まずにそのままレスポンスに書く
+// bはキャッシュと共有しているので，呼び出し側もこの後も書き換えないこと
+func writeBlob(c echo.Context, code int, contentType string, b []byte) error {
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, contentType)
+	res.Header().Set(echo.HeaderContentLength, strconv.Itoa(len(b)))
+	res.WriteHeader(code)
+	if c.Request().Method == http.MethodHead {
+		return nil
+	}
+	_, err := res.Write(b)
+	return err
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+
+	"github.com/goccy/go-json"
+	"github.com/labstack/echo/v4"
+)
+
+// キャッシュの破棄を伝える他のサーバー(CACHE_PEERS=http://192.168.0.12:3000,...)
+// 受け取る側は運用系の認証を通すので，全サーバーで同じADMIN_TOKENを設定しておく
+var cachePeers = parseURLList(getEnv("CACHE_PEERS", ""))
+
+type CacheInvalidation struct {
+	JIAUserIDs  []string `json:"jia_user_ids"`
+	JIAIsuUUIDs []string `json:"jia_isu_uuids"`
+	// 退会したユーザー．キャッシュに加えて利用状況やイベントの履歴も捨てる
+	DeletedJIAUserIDs []string `json:"deleted_jia_user_ids,omitempty"`
+	// /initializeでDBが作り直されたので，キューもキャッシュもすべて捨てる
+	Reset bool `json:"reset,omitempty"`
+}
+
+// このサーバーのキャッシュから，ユーザーとISUに関するものを捨てる
+func invalidateCaches(inv CacheInvalidation) {
+	for _, jiaUserID := range inv.JIAUserIDs {
+		userCache.Forget(jiaUserID)
+		userIsuListCache.Forget(jiaUserID)
+		userTrendCache.Forget(jiaUserID)
+	}
+	for _, jiaUserID := range inv.DeletedJIAUserIDs {
+		userCache.Forget(jiaUserID)
+		userIsuListCache.Forget(jiaUserID)
+		userTrendCache.Forget(jiaUserID)
+		usageStats.Forget(jiaUserID)
+		eventHub.Forget(jiaUserID)
+	}
+	for _, jiaIsuUUID := range inv.JIAIsuUUIDs {
+		isuCache.Forget(jiaIsuUUID)
+		isuAuthCache.Forget(jiaIsuUUID)
+		isuConditionCache.Forget(jiaIsuUUID)
+		iconCache.Forget(jiaIsuUUID)
+		isuSettingsCache.Forget(jiaIsuUUID)
+		muteCache.Forget(jiaIsuUUID)
+		reportCache.Forget(jiaIsuUUID)
+		incidentTracker.Forget(jiaIsuUUID)
+		routeCache.Bust(graphRoutePolicy.Name, jiaIsuUUID)
+		graphEmptyCache.Forget(jiaIsuUUID)
+		characterMembership.Forget(jiaIsuUUID)
+	}
+}
+
+// 他のサーバーにもキャッシュを捨てさせる．届かなかったサーバーはTTL切れ(本番向けの設定の場合)まで古いものを返しうる
+func broadcastCacheInvalidation(inv CacheInvalidation) {
+	if len(cachePeers) == 0 {
+		return
+	}
+	body, err := json.Marshal(inv)
+	if err != nil {
+		systemLogger.Error().Err(err).Msg("failed to marshal cache invalidation")
+		return
+	}
+	go forEachPeerByZone(cachePeers, func(peer string) {
+		err := pushCacheInvalidation(peer, body)
+		if err != nil {
+			systemLogger.Error().Err(err).Str("peer", peer).Msg("failed to invalidate peer cache")
+		}
+	})
+}
+
+// /initializeの後，ベンチマーカーが他のサーバーに来る前に捨てさせたいので，全サーバーに届くまで待つ
+func broadcastReset() {
+	if len(cachePeers) == 0 {
+		return
+	}
+	body, err := json.Marshal(CacheInvalidation{Reset: true})
+	if err != nil {
+		systemLogger.Error().Err(err).Msg("failed to marshal cache invalidation")
+		return
+	}
+	forEachPeerByZone(cachePeers, func(peer string) {
+		err := pushCacheInvalidation(peer, body)
+		if err != nil {
+			systemLogger.Error().Err(err).Str("peer", peer).Msg("failed to reset peer state")
+		}
+	})
+}
+
+func pushCacheInvalidation(peer string, body []byte) error {
+	res, err := outbound(outboundPeer).Do(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, peer+"/internal/cache/invalidate", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		setAdminToken(req)
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected status code: %v", res.StatusCode)
+	}
+	return nil
+}
+
+// POST /internal/cache/invalidate
+// 他のサーバーで変更されたユーザーとISUのキャッシュを捨てる．/initializeされた場合はすべて捨てる
+func postCacheInvalidate(c echo.Context) error {
+	inv := CacheInvalidation{}
+	err := c.Bind(&inv)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad request body")
+	}
+	if inv.Reset {
+		flushLock.Lock()
+		discardInsertQueue()
+		resetInMemoryState()
+		flushLock.Unlock()
+	}
+	invalidateCaches(inv)
+	return c.NoContent(http.StatusNoContent)
+}
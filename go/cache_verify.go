@@ -0,0 +1,174 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const defaultCacheVerifySample = 100
+
+// キャッシュとDBの食い違い
+type CacheDivergence struct {
+	Cache      string `json:"cache"`
+	JIAIsuUUID string `json:"jia_isu_uuid"`
+	Detail     string `json:"detail"`
+}
+
+type CacheVerifyReport struct {
+	Sampled     int               `json:"sampled"`
+	Divergences []CacheDivergence `json:"divergences"`
+	ElapsedMs   int64             `json:"elapsed_ms"`
+}
+
+// ISUをいくつか選んでキャッシュの中身をDBと突き合わせ，食い違っていたらキャッシュを捨てる
+// Forgetと更新の順序の誤りなどで，DBにないISUや古い値がキャッシュに残り続けるのを見つけるためのもの
+// キャッシュにないものはDBから読まずに飛ばすので，キャッシュを温める副作用はない
+func verifyCaches(sample int) (CacheVerifyReport, error) {
+	start := time.Now()
+	report := CacheVerifyReport{Divergences: []CacheDivergence{}}
+
+	jiaIsuUUIDs := []string{}
+	err := getDB().Select(&jiaIsuUUIDs, "SELECT `jia_isu_uuid` FROM `isu` ORDER BY RAND() LIMIT ?", sample)
+	if err != nil {
+		return report, fmt.Errorf("db error: %v", err)
+	}
+	// DBから消えたISUはDB側から選んでも出てこないので，キャッシュ側からも選ぶ
+	jiaIsuUUIDs = append(jiaIsuUUIDs, isuCache.Keys(sample)...)
+
+	seen := make(map[string]struct{}, len(jiaIsuUUIDs))
+	for _, jiaIsuUUID := range jiaIsuUUIDs {
+		if _, ok := seen[jiaIsuUUID]; ok {
+			continue
+		}
+		seen[jiaIsuUUID] = struct{}{}
+		report.Sampled++
+
+		divergences, err := verifyIsuCaches(jiaIsuUUID)
+		if err != nil {
+			return report, err
+		}
+		report.Divergences = append(report.Divergences, divergences...)
+	}
+
+	for _, d := range report.Divergences {
+		systemLogger.Warn().
+			Str("cache", d.Cache).
+			Str("jia_isu_uuid", d.JIAIsuUUID).
+			Str("detail", d.Detail).
+			Msg("cache divergence fixed")
+	}
+	report.ElapsedMs = time.Since(start).Milliseconds()
+	return report, nil
+}
+
+func verifyIsuCaches(jiaIsuUUID string) ([]CacheDivergence, error) {
+	divergences := []CacheDivergence{}
+	diverged := func(cache string, format string, args ...interface{}) {
+		divergences = append(divergences, CacheDivergence{
+			Cache:      cache,
+			JIAIsuUUID: jiaIsuUUID,
+			Detail:     fmt.Sprintf(format, args...),
+		})
+	}
+
+	if cached, ok := isuCache.Peek(jiaIsuUUID); ok {
+		var isu IsuMeta
+		err := getDB().Get(
+			&isu,
+			"SELECT `id`, `jia_isu_uuid`, `name`, `character`, `jia_user_id` FROM `isu` WHERE `jia_isu_uuid` = ?",
+			jiaIsuUUID,
+		)
+		if errors.Is(err, sql.ErrNoRows) {
+			diverged("isu", "isu does not exist in db")
+			isuCache.Forget(jiaIsuUUID)
+		} else if err != nil {
+			return nil, fmt.Errorf("db error: %v", err)
+		} else if cached.ID != isu.ID || cached.Name != isu.Name || cached.Character != isu.Character || cached.JIAUserID != isu.JIAUserID {
+			diverged("isu", "cached=%+v db=%+v", *cached, isu)
+			isuCache.Forget(jiaIsuUUID)
+		}
+	}
+
+	if cached, ok := isuConditionCache.Peek(jiaIsuUUID); ok {
+		var latest IsuCondition
+		err := getDB().Get(
+			&latest,
+			"SELECT `jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`, `level` FROM `isu_condition` WHERE `jia_isu_uuid` = ? ORDER BY `timestamp` DESC LIMIT 1",
+			jiaIsuUUID,
+		)
+		if errors.Is(err, sql.ErrNoRows) {
+			if cached != nil {
+				diverged("isu_condition", "no condition in db")
+				isuConditionCache.Forget(jiaIsuUUID)
+			}
+		} else if err != nil {
+			return nil, fmt.Errorf("db error: %v", err)
+		} else if cached == nil {
+			diverged("isu_condition", "cached=none db=%v", latest.Timestamp.Unix())
+			isuConditionCache.Forget(jiaIsuUUID)
+		} else if !cached.Timestamp.Equal(latest.Timestamp) || cached.Condition != latest.Condition {
+			diverged("isu_condition", "cached=%v db=%v", cached.Timestamp.Unix(), latest.Timestamp.Unix())
+			isuConditionCache.Forget(jiaIsuUUID)
+		}
+	}
+
+	if cached, ok := isuSettingsCache.Peek(jiaIsuUUID); ok {
+		var count int
+		err := getDB().Get(&count, "SELECT COUNT(*) FROM `isu_settings` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
+		if err != nil {
+			return nil, fmt.Errorf("db error: %v", err)
+		}
+		if (cached != nil) != (count > 0) {
+			diverged("isu_settings", "cached=%v db=%v", cached != nil, count > 0)
+			isuSettingsCache.Forget(jiaIsuUUID)
+		}
+	}
+	return divergences, nil
+}
+
+// CACHE_VERIFY_AFTER_INITIALIZE=30s のように指定すると，/initializeからその時間後に1回検証する
+// 直後はキャッシュが空なので，ベンチマークが一通り走ってからにする
+var cacheVerifyAfterInitialize, _ = time.ParseDuration(getEnv("CACHE_VERIFY_AFTER_INITIALIZE", "0"))
+
+func scheduleCacheVerify() {
+	if cacheVerifyAfterInitialize <= 0 {
+		return
+	}
+	time.AfterFunc(cacheVerifyAfterInitialize, func() {
+		report, err := verifyCaches(defaultCacheVerifySample)
+		if err != nil {
+			systemLogger.Error().Err(err).Msg("cache verification failed")
+			return
+		}
+		systemLogger.Info().
+			Int("sampled", report.Sampled).
+			Int("divergences", len(report.Divergences)).
+			Int64("elapsed_ms", report.ElapsedMs).
+			Msg("cache verification")
+	})
+}
+
+// POST /internal/cache/verify?sample=
+// キャッシュをDBと突き合わせ，食い違いを直して報告する
+func postCacheVerify(c echo.Context) error {
+	sample := defaultCacheVerifySample
+	if sampleStr := c.QueryParam("sample"); sampleStr != "" {
+		var err error
+		sample, err = strconv.Atoi(sampleStr)
+		if err != nil || sample <= 0 {
+			return c.String(http.StatusBadRequest, "bad format: sample")
+		}
+	}
+	report, err := verifyCaches(sample)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, report)
+}
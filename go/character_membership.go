@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 性格→ISUの対応．性格は登録(有効化)のときにしか決まらないので，毎回isuをSELECTせずにここから引く
+// 登録したサーバーではAddで直接足し，他のサーバーで登録・削除されたものはキャッシュの破棄を受けてForgetし，次に引くときに読み直す
+type CharacterMembership struct {
+	members map[string]map[string]IsuMeta
+	// jia_isu_uuid→性格．Forgetで古い性格から外すのに使う
+	characters map[string]string
+	// 読み直しが必要なISU
+	pending   map[string]struct{}
+	loaded    bool
+	expiresAt time.Time
+	Lock      sync.Mutex
+}
+
+var characterMembership = NewCharacterMembership()
+
+func NewCharacterMembership() *CharacterMembership {
+	return &CharacterMembership{
+		members:    make(map[string]map[string]IsuMeta),
+		characters: make(map[string]string),
+		pending:    make(map[string]struct{}),
+	}
+}
+
+// 性格の一覧(空の性格は除く)を名前順に返す
+func (cm *CharacterMembership) Characters() ([]string, error) {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+	err := cm.sync()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0, len(cm.members))
+	for character := range cm.members {
+		res = append(res, character)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// 性格のISU(idとjia_isu_uuidだけ)
+func (cm *CharacterMembership) Members(character string) ([]IsuMeta, error) {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+	err := cm.sync()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]IsuMeta, 0, len(cm.members[character]))
+	for _, isu := range cm.members[character] {
+		res = append(res, isu)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ID < res[j].ID
+	})
+	return res, nil
+}
+
+// 登録・有効化したISUを足す．まだ読み込んでいなければ次に読むときに入るので何もしない
+func (cm *CharacterMembership) Add(isu IsuMeta) {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+	if !cm.loaded {
+		return
+	}
+	cm.remove(isu.JIAIsuUUID)
+	delete(cm.pending, isu.JIAIsuUUID)
+	cm.add(isu)
+}
+
+func (cm *CharacterMembership) Forget(jiaIsuUUID string) {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+	if !cm.loaded {
+		return
+	}
+	cm.pending[jiaIsuUUID] = struct{}{}
+}
+
+func (cm *CharacterMembership) Reset() {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+	cm.members = make(map[string]map[string]IsuMeta)
+	cm.characters = make(map[string]string)
+	cm.pending = make(map[string]struct{})
+	cm.loaded = false
+}
+
+func (cm *CharacterMembership) add(isu IsuMeta) {
+	if isu.Character == "" {
+		return
+	}
+	if cm.members[isu.Character] == nil {
+		cm.members[isu.Character] = make(map[string]IsuMeta)
+	}
+	cm.members[isu.Character][isu.JIAIsuUUID] = IsuMeta{ID: isu.ID, JIAIsuUUID: isu.JIAIsuUUID, Character: isu.Character}
+	cm.characters[isu.JIAIsuUUID] = isu.Character
+}
+
+func (cm *CharacterMembership) remove(jiaIsuUUID string) {
+	character, ok := cm.characters[jiaIsuUUID]
+	if !ok {
+		return
+	}
+	delete(cm.characters, jiaIsuUUID)
+	delete(cm.members[character], jiaIsuUUID)
+	if len(cm.members[character]) == 0 {
+		delete(cm.members, character)
+	}
+}
+
+// 読み込んでいないかTTLが切れていれば全部，そうでなければForgetされたISUだけ読み直す
+func (cm *CharacterMembership) sync() error {
+	if !cm.loaded || cacheExpired(cm.expiresAt) {
+		isuList := []IsuMeta{}
+		err := getDB().Select(&isuList, "SELECT `id`, `jia_isu_uuid`, `character` FROM `isu` WHERE `character` <> ''")
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		cm.members = make(map[string]map[string]IsuMeta)
+		cm.characters = make(map[string]string, len(isuList))
+		cm.pending = make(map[string]struct{})
+		for _, isu := range isuList {
+			cm.add(isu)
+		}
+		cm.loaded = true
+		cm.expiresAt = cacheExpiresAt()
+		return nil
+	}
+	if len(cm.pending) == 0 {
+		return nil
+	}
+
+	jiaIsuUUIDs := make([]string, 0, len(cm.pending))
+	for jiaIsuUUID := range cm.pending {
+		jiaIsuUUIDs = append(jiaIsuUUIDs, jiaIsuUUID)
+	}
+	query, args, err := sqlx.In("SELECT `id`, `jia_isu_uuid`, `character` FROM `isu` WHERE `jia_isu_uuid` IN (?)", jiaIsuUUIDs)
+	if err != nil {
+		return err
+	}
+	isuList := []IsuMeta{}
+	err = getDB().Select(&isuList, query, args...)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	// 見つからなかったものは削除されている
+	for _, jiaIsuUUID := range jiaIsuUUIDs {
+		cm.remove(jiaIsuUUID)
+	}
+	for _, isu := range isuList {
+		cm.add(isu)
+	}
+	cm.pending = make(map[string]struct{})
+	return nil
+}
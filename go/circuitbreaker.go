@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+// 連続でthreshold回失敗したらcooldownの間は呼び出しを止める
+// cooldown後は1回だけ試し(half-open)，成功すれば元に戻し，失敗すればまた止める
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	state     string
+	failures  int
+	openedAt  time.Time
+	probing   bool
+	Lock      sync.Mutex
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     circuitClosed,
+	}
+}
+
+var jiaCircuitBreaker = NewCircuitBreaker(
+	getEnvInt("JIA_BREAKER_THRESHOLD", 5),
+	time.Duration(getEnvInt("JIA_BREAKER_COOLDOWN_MS", 10000))*time.Millisecond,
+)
+
+// 呼び出してよいか．trueを返したら必ずSuccessかFailureを呼ぶ
+func (cb *CircuitBreaker) Allow() bool {
+	cb.Lock.Lock()
+	defer cb.Lock.Unlock()
+	switch cb.state {
+	case circuitOpen:
+		if time.Since(cb.openedAt) < cb.cooldown {
+			return false
+		}
+		cb.state = circuitHalfOpen
+		cb.probing = true
+		return true
+	case circuitHalfOpen:
+		// 様子見の1回が終わるまでは他は通さない
+		if cb.probing {
+			return false
+		}
+		cb.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (cb *CircuitBreaker) Success() {
+	cb.Lock.Lock()
+	defer cb.Lock.Unlock()
+	cb.state = circuitClosed
+	cb.failures = 0
+	cb.probing = false
+}
+
+func (cb *CircuitBreaker) Failure() {
+	cb.Lock.Lock()
+	defer cb.Lock.Unlock()
+	cb.probing = false
+	cb.failures++
+	if cb.state == circuitHalfOpen || cb.failures >= cb.threshold {
+		cb.state = circuitOpen
+		cb.openedAt = time.Now()
+	}
+}
+
+func (cb *CircuitBreaker) State() string {
+	cb.Lock.Lock()
+	defer cb.Lock.Unlock()
+	return cb.state
+}
@@ -0,0 +1,41 @@
+// isuctl は動いているisuconditionに対する運用向けのコマンドをまとめたもの
+//
+//	go run ./cmd/isuctl smoke -target http://localhost:3000 -key ec256-private.pem
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) int
+}
+
+var commands = []command{
+	{name: "smoke", usage: "ログインからトレンドまで一通り触って，デプロイしたものが動くか確かめる", run: runSmoke},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		printUsage()
+		os.Exit(2)
+	}
+	for _, cmd := range commands {
+		if cmd.name == os.Args[1] {
+			os.Exit(cmd.run(os.Args[2:]))
+		}
+	}
+	fmt.Fprintf(os.Stderr, "unknown command: %v\n", os.Args[1])
+	printUsage()
+	os.Exit(2)
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "usage: isuctl COMMAND [flags]")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %v\n", cmd.name, cmd.usage)
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/goccy/go-json"
+)
+
+const smokeCharacter = "いじっぱり"
+
+type smokeConfig struct {
+	target     string
+	jiaListen  string
+	jiaURL     string
+	restoreJIA string
+	jiaUserID  string
+	timeout    time.Duration
+	cleanup    bool
+}
+
+type smokeClient struct {
+	config smokeConfig
+	client *http.Client
+}
+
+type smokeCondition struct {
+	IsSitting bool   `json:"is_sitting"`
+	Condition string `json:"condition"`
+	Message   string `json:"message"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// 本番と同じ流れで一通り叩き，どれか一つでも期待と違えば1で終わる
+// JIAのサービスの代わりを立ててアプリの向き先をそちらに変えるので，ベンチマーク中には使わない
+func runSmoke(args []string) int {
+	fs := flag.NewFlagSet("smoke", flag.ExitOnError)
+	config := smokeConfig{}
+	keyPath := fs.String("key", "", "JWTに署名するES256の秘密鍵(PEM)")
+	fs.StringVar(&config.target, "target", "http://localhost:3000", "確かめるアプリのベースURL")
+	fs.StringVar(&config.jiaListen, "jia-listen", ":5050", "JIAのサービスの代わりが待ち受けるアドレス")
+	fs.StringVar(&config.jiaURL, "jia-url", "", "アプリから見たJIAのサービスの代わりのURL(省略時はホスト名とjia-listenのポートから作る)")
+	fs.StringVar(&config.restoreJIA, "restore-jia-url", "", "終わった後にアプリに設定し直すJIAのサービスのURL")
+	fs.StringVar(&config.jiaUserID, "user", "isuctl-smoke", "ログインするユーザー")
+	fs.DurationVar(&config.timeout, "timeout", 30*time.Second, "書き込みがグラフやトレンドに反映されるまで待つ時間")
+	fs.BoolVar(&config.cleanup, "cleanup", true, "終わった後にユーザーごと消す")
+	fs.Parse(args)
+	if *keyPath == "" {
+		fmt.Fprintln(os.Stderr, "usage: isuctl smoke -key PEM [-target URL] [-jia-listen ADDR] [-jia-url URL]")
+		return 2
+	}
+	config.target = strings.TrimSuffix(config.target, "/")
+
+	pem, err := os.ReadFile(*keyPath)
+	if err != nil {
+		log.Printf("failed to read key: %v", err)
+		return 1
+	}
+	key, err := jwt.ParseECPrivateKeyFromPEM(pem)
+	if err != nil {
+		log.Printf("failed to parse key: %v", err)
+		return 1
+	}
+	if config.jiaURL == "" {
+		config.jiaURL, err = defaultJIAURL(config.jiaListen)
+		if err != nil {
+			log.Printf("failed to build jia url: %v", err)
+			return 1
+		}
+	}
+
+	stop, err := serveMockJIA(config.jiaListen)
+	if err != nil {
+		log.Printf("failed to start mock jia service: %v", err)
+		return 1
+	}
+	defer stop()
+
+	jar, _ := cookiejar.New(nil)
+	sc := &smokeClient{config: config, client: &http.Client{Jar: jar, Timeout: 10 * time.Second}}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"jia_user_id": config.jiaUserID,
+		"iat":         time.Now().Unix(),
+	}).SignedString(key)
+	if err != nil {
+		log.Printf("failed to sign jwt: %v", err)
+		return 1
+	}
+
+	jiaIsuUUID := newUUID()
+	base := time.Now().Truncate(time.Hour).Add(-time.Hour)
+	var isuID int
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{"point app at mock jia", func() error { return sc.setJIAServiceURL(config.jiaURL) }},
+		{"auth", func() error { return sc.auth(token) }},
+		{"register isu", func() (err error) { isuID, err = sc.registerIsu(jiaIsuUUID); return err }},
+		{"post conditions", func() error { return sc.postConditions(jiaIsuUUID, base) }},
+		{"condition list", func() error { return sc.waitConditions(jiaIsuUUID, 3) }},
+		{"graph", func() error { return sc.waitGraph(jiaIsuUUID, base) }},
+		{"trend", func() error { return sc.waitTrend(isuID) }},
+	}
+
+	failed := false
+	for _, step := range steps {
+		start := time.Now()
+		err := step.run()
+		if err != nil {
+			log.Printf("FAIL %-24s %v", step.name, err)
+			failed = true
+			break
+		}
+		log.Printf("ok   %-24s %v", step.name, time.Since(start).Round(time.Millisecond))
+	}
+
+	if config.cleanup {
+		err := sc.deleteMe()
+		if err != nil {
+			log.Printf("failed to clean up: %v", err)
+		}
+	}
+	if config.restoreJIA != "" {
+		err := sc.setJIAServiceURL(config.restoreJIA)
+		if err != nil {
+			log.Printf("failed to restore jia service url: %v", err)
+			failed = true
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+func defaultJIAURL(listen string) (string, error) {
+	_, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "", err
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	return "http://" + net.JoinHostPort(host, port), nil
+}
+
+// /api/activateに常に同じ性格で202を返す
+func serveMockJIA(listen string) (func(), error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/activate", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"character": smokeCharacter})
+	})
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	return func() { server.Close() }, nil
+}
+
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+func (sc *smokeClient) do(req *http.Request, want int, out interface{}) error {
+	res, err := sc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != want {
+		return fmt.Errorf("%v %v: unexpected status code %v: %s", req.Method, req.URL.Path, res.StatusCode, bytes.TrimSpace(body))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+func (sc *smokeClient) request(method string, path string, body interface{}) (*http.Request, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, sc.config.target+path, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+func (sc *smokeClient) setJIAServiceURL(jiaURL string) error {
+	req, err := sc.request(http.MethodPut, "/internal/config/jia_service_url", map[string]string{"jia_service_url": jiaURL})
+	if err != nil {
+		return err
+	}
+	return sc.do(req, http.StatusNoContent, nil)
+}
+
+func (sc *smokeClient) auth(token string) error {
+	req, err := sc.request(http.MethodPost, "/api/auth", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return sc.do(req, http.StatusOK, nil)
+}
+
+func (sc *smokeClient) registerIsu(jiaIsuUUID string) (int, error) {
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	w.WriteField("jia_isu_uuid", jiaIsuUUID)
+	w.WriteField("isu_name", "smoke")
+	w.Close()
+	req, err := http.NewRequest(http.MethodPost, sc.config.target+"/api/isu", body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	isu := struct {
+		ID         int    `json:"id"`
+		JIAIsuUUID string `json:"jia_isu_uuid"`
+		Character  string `json:"character"`
+	}{}
+	err = sc.do(req, http.StatusCreated, &isu)
+	if err != nil {
+		return 0, err
+	}
+	if isu.JIAIsuUUID != jiaIsuUUID || isu.Character != smokeCharacter {
+		return 0, fmt.Errorf("unexpected isu: %+v", isu)
+	}
+	return isu.ID, nil
+}
+
+func (sc *smokeClient) postConditions(jiaIsuUUID string, base time.Time) error {
+	conds := []smokeCondition{}
+	for i, condition := range []string{
+		"is_dirty=false,is_overweight=false,is_broken=false",
+		"is_dirty=true,is_overweight=false,is_broken=false",
+		"is_dirty=true,is_overweight=true,is_broken=true",
+	} {
+		conds = append(conds, smokeCondition{
+			IsSitting: i%2 == 0,
+			Condition: condition,
+			Message:   "smoke",
+			Timestamp: base.Add(time.Duration(i) * 10 * time.Minute).Unix(),
+		})
+	}
+	req, err := sc.request(http.MethodPost, "/api/condition/"+jiaIsuUUID, conds)
+	if err != nil {
+		return err
+	}
+	return sc.do(req, http.StatusAccepted, nil)
+}
+
+// 書き込みは裏でまとめて行われるので，反映されるまで待つ
+func (sc *smokeClient) poll(check func() error) error {
+	deadline := time.Now().Add(sc.config.timeout)
+	for {
+		err := check()
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+func (sc *smokeClient) waitConditions(jiaIsuUUID string, want int) error {
+	query := url.Values{}
+	query.Set("end_time", strconv.FormatInt(time.Now().Unix()+1, 10))
+	query.Set("condition_level", "info,warning,critical")
+	return sc.poll(func() error {
+		req, err := sc.request(http.MethodGet, "/api/condition/"+jiaIsuUUID+"?"+query.Encode(), nil)
+		if err != nil {
+			return err
+		}
+		conds := []json.RawMessage{}
+		err = sc.do(req, http.StatusOK, &conds)
+		if err != nil {
+			return err
+		}
+		if len(conds) != want {
+			return fmt.Errorf("got %d conditions, want %d", len(conds), want)
+		}
+		return nil
+	})
+}
+
+func (sc *smokeClient) waitGraph(jiaIsuUUID string, base time.Time) error {
+	path := "/api/isu/" + jiaIsuUUID + "/graph?datetime=" + strconv.FormatInt(base.Unix(), 10)
+	return sc.poll(func() error {
+		req, err := sc.request(http.MethodGet, path, nil)
+		if err != nil {
+			return err
+		}
+		graph := []struct {
+			StartAt int64           `json:"start_at"`
+			Data    json.RawMessage `json:"data"`
+		}{}
+		err = sc.do(req, http.StatusOK, &graph)
+		if err != nil {
+			return err
+		}
+		for _, point := range graph {
+			if point.StartAt == base.Unix() && len(point.Data) > 0 && string(point.Data) != "null" {
+				return nil
+			}
+		}
+		return errors.New("no graph data for the posted hour")
+	})
+}
+
+// トレンドは定期的に計算し直されるので，計算されるまで待つ
+func (sc *smokeClient) waitTrend(isuID int) error {
+	return sc.poll(func() error {
+		req, err := sc.request(http.MethodGet, "/api/trend", nil)
+		if err != nil {
+			return err
+		}
+		type trendCondition struct {
+			ID int `json:"isu_id"`
+		}
+		trend := []struct {
+			Character string           `json:"character"`
+			Info      []trendCondition `json:"info"`
+			Warning   []trendCondition `json:"warning"`
+			Critical  []trendCondition `json:"critical"`
+		}{}
+		err = sc.do(req, http.StatusOK, &trend)
+		if err != nil {
+			return err
+		}
+		for _, t := range trend {
+			if t.Character != smokeCharacter {
+				continue
+			}
+			for _, conds := range [][]trendCondition{t.Info, t.Warning, t.Critical} {
+				for _, cond := range conds {
+					if cond.ID == isuID {
+						return nil
+					}
+				}
+			}
+		}
+		return fmt.Errorf("isu %d is not in the trend", isuID)
+	})
+}
+
+func (sc *smokeClient) deleteMe() error {
+	req, err := sc.request(http.MethodDelete, "/api/user/me", nil)
+	if err != nil {
+		return err
+	}
+	return sc.do(req, http.StatusOK, nil)
+}
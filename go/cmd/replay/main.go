@@ -0,0 +1,192 @@
+// replay は記録しておいたコンディションのPOSTを，記録時の間隔(またはその倍率)で送り直す
+//
+// キューや書き込みを作り直したときに，ベンチマーカーに近い書き込みのパターンでプロファイルを取るためのもの
+//
+//	go run ./cmd/replay -target http://localhost:3000 -speed 2 traffic.ndjson
+//
+// 入力はNDJSON(1行に {"time": RFC3339, "path": "/api/condition/<uuid>", "content_type": ..., "body": ...})か，
+// ブラウザなどで保存したHAR(拡張子 .har)．HARからは /api/condition/ へのPOSTだけを取り出す
+// pcapは読まないので，tcpdumpで取ったものはWiresharkなどでHARに書き出してから渡す
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+const conditionPathPrefix = "/api/condition/"
+
+type Record struct {
+	Time        time.Time       `json:"time"`
+	Path        string          `json:"path"`
+	ContentType string          `json:"content_type"`
+	Body        json.RawMessage `json:"body"`
+}
+
+type harFile struct {
+	Log struct {
+		Entries []struct {
+			StartedDateTime time.Time `json:"startedDateTime"`
+			Request         struct {
+				Method   string `json:"method"`
+				URL      string `json:"url"`
+				PostData struct {
+					MimeType string `json:"mimeType"`
+					Text     string `json:"text"`
+				} `json:"postData"`
+			} `json:"request"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+func main() {
+	target := flag.String("target", "http://localhost:3000", "送り先のベースURL")
+	speed := flag.Float64("speed", 1, "再生速度の倍率(0なら間隔を空けずに送る)")
+	concurrency := flag.Int("concurrency", 64, "同時に送るリクエストの上限")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: replay [-target URL] [-speed N] [-concurrency N] FILE")
+		os.Exit(2)
+	}
+
+	records, err := load(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("failed to load %v: %v", flag.Arg(0), err)
+	}
+	if len(records) == 0 {
+		log.Fatalf("no condition requests in %v", flag.Arg(0))
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	sem := make(chan struct{}, *concurrency)
+	var wg sync.WaitGroup
+	var sent, failed atomic.Int64
+	statuses := sync.Map{}
+
+	start := time.Now()
+	origin := records[0].Time
+	for _, record := range records {
+		if *speed > 0 {
+			at := start.Add(time.Duration(float64(record.Time.Sub(origin)) / *speed))
+			time.Sleep(time.Until(at))
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(record Record) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			status, err := send(client, *target, record)
+			sent.Add(1)
+			if err != nil {
+				failed.Add(1)
+				log.Printf("failed to send %v: %v", record.Path, err)
+				return
+			}
+			n, _ := statuses.LoadOrStore(status, new(atomic.Int64))
+			n.(*atomic.Int64).Add(1)
+		}(record)
+	}
+	wg.Wait()
+
+	log.Printf("sent %d requests in %v (%d failed)", sent.Load(), time.Since(start), failed.Load())
+	statuses.Range(func(status, n any) bool {
+		log.Printf("  %d: %d", status, n.(*atomic.Int64).Load())
+		return true
+	})
+}
+
+func send(client *http.Client, target string, record Record) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(target, "/")+record.Path, bytes.NewReader(record.Body))
+	if err != nil {
+		return 0, err
+	}
+	contentType := record.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	req.Header.Set("Content-Type", contentType)
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	return res.StatusCode, nil
+}
+
+func load(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if strings.EqualFold(filepath.Ext(path), ".har") {
+		return loadHAR(f)
+	}
+	return loadNDJSON(f)
+}
+
+func loadNDJSON(r io.Reader) ([]Record, error) {
+	records := []Record{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		record := Record{}
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if !strings.HasPrefix(record.Path, conditionPathPrefix) {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+func loadHAR(r io.Reader) ([]Record, error) {
+	har := harFile{}
+	err := json.NewDecoder(r).Decode(&har)
+	if err != nil {
+		return nil, err
+	}
+	records := []Record{}
+	for _, entry := range har.Log.Entries {
+		if entry.Request.Method != http.MethodPost {
+			continue
+		}
+		i := strings.Index(entry.Request.URL, conditionPathPrefix)
+		if i < 0 {
+			continue
+		}
+		records = append(records, Record{
+			Time:        entry.StartedDateTime,
+			Path:        entry.Request.URL[i:],
+			ContentType: entry.Request.PostData.MimeType,
+			Body:        json.RawMessage(entry.Request.PostData.Text),
+		})
+	}
+	return records, nil
+}
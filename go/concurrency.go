@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 重い読み込みのルートが同時に使うDB接続の上限
+// 一度に集中しても，コンディションの書き出しに使う接続が残るようにする
+type ConcurrencyLimiter struct {
+	name string
+	// nilなら上限なし
+	slots chan struct{}
+	// 空きを待つ時間．0なら待たずに断る
+	wait     time.Duration
+	rejected atomic.Int64
+}
+
+func NewConcurrencyLimiter(name string, limit int, wait time.Duration) *ConcurrencyLimiter {
+	cl := &ConcurrencyLimiter{name: name, wait: wait}
+	if limit > 0 {
+		cl.slots = make(chan struct{}, limit)
+	}
+	return cl
+}
+
+var (
+	concurrencyWait = time.Duration(getEnvInt("CONCURRENCY_WAIT_MS", 100)) * time.Millisecond
+	// 0なら上限なし
+	graphLimiter      = NewConcurrencyLimiter("graph", getEnvInt("GRAPH_CONCURRENCY", 0), concurrencyWait)
+	conditionsLimiter = NewConcurrencyLimiter("conditions", getEnvInt("CONDITIONS_CONCURRENCY", 0), concurrencyWait)
+)
+
+func (cl *ConcurrencyLimiter) acquire() bool {
+	select {
+	case cl.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if cl.wait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(cl.wait)
+	defer timer.Stop()
+	select {
+	case cl.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (cl *ConcurrencyLimiter) release() {
+	<-cl.slots
+}
+
+// 上限を超えた分は少し待ち，それでも空かなければ503で断る
+func concurrencyLimitMiddleware(cl *ConcurrencyLimiter) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if cl.slots == nil {
+			return next
+		}
+		return func(c echo.Context) error {
+			if !cl.acquire() {
+				n := cl.rejected.Add(1)
+				c.Logger().Debugf("concurrency limit exceeded: route=%v rejected=%v", cl.name, n)
+				c.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(1))
+				return c.String(http.StatusServiceUnavailable, "too many requests")
+			}
+			defer cl.release()
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	isuConditionInsertPrefix = "INSERT INTO `isu_condition`" +
+		"	(`jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`, `message_code`, `sequence`) VALUES "
+	isuConditionInsertRow     = "(?, ?, ?, ?, ?, ?, ?)"
+	isuConditionInsertColumns = 7
+	// MySQLのプレースホルダの上限
+	mysqlMaxPlaceholders = 65535
+)
+
+// 1文あたりのパラメーター数の上限(CONDITION_INSERT_MAX_PARAMS)．大きなバッチはこれを超えないように分けてINSERTする
+// interpolateParams=trueで文字列に埋め込むので，max_allowed_packetにも収まるよう小さめにしておく
+var conditionInsertMaxParams = min(getEnvInt("CONDITION_INSERT_MAX_PARAMS", 14000), mysqlMaxPlaceholders)
+
+// NamedExecのリフレクションでの展開の代わりに，VALUESと引数を手で組み立ててINSERTする
+// 複数の文に分ける場合は，途中で失敗しても一部だけ入ることのないようトランザクションにする
+func insertIsuConditions(db *sqlx.DB, conds []IsuCondition) error {
+	rowsPerStmt := max(conditionInsertMaxParams/isuConditionInsertColumns, 1)
+	if len(conds) <= rowsPerStmt {
+		q, args := buildIsuConditionInsert(conds)
+		_, err := db.Exec(q, args...)
+		return err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for start := 0; start < len(conds); start += rowsPerStmt {
+		end := min(start+rowsPerStmt, len(conds))
+		q, args := buildIsuConditionInsert(conds[start:end])
+		_, err = tx.Exec(q, args...)
+		if err != nil {
+			return fmt.Errorf("rows %d-%d: %w", start, end, err)
+		}
+	}
+	return tx.Commit()
+}
+
+func buildIsuConditionInsert(conds []IsuCondition) (string, []interface{}) {
+	var b strings.Builder
+	b.Grow(len(isuConditionInsertPrefix) + len(conds)*(len(isuConditionInsertRow)+1))
+	b.WriteString(isuConditionInsertPrefix)
+	args := make([]interface{}, 0, len(conds)*isuConditionInsertColumns)
+	for i, cond := range conds {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(isuConditionInsertRow)
+		args = append(args, cond.JIAIsuUUID, cond.Timestamp, cond.IsSitting, cond.Condition, cond.Message, cond.MessageCode, cond.Sequence)
+	}
+	return b.String(), args
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// levelで絞るコンディション取得のもう一つのやり方
+// IN (level)があるとMySQLが(jia_isu_uuid, timestamp)の順に読めなくなることがあるので，
+// 主キーの範囲でlimit*k件をlevelで絞らずに読み，Goでlevelを絞る
+// kは実際に読んだ行のうち指定のlevelだった割合(選択率)から決め，選択率が低すぎてkが大きくなる場合はIN (level)で引く
+const (
+	// 選択率が分かるまでのk
+	conditionLevelFilterInitialK = 4
+	// 1回で足りるよう，選択率から求めた件数より多めに読む
+	conditionLevelFilterMargin = 1.5
+	// 選択率を信用するのに必要な，読んだ行数
+	conditionLevelFilterMinSamples = 200
+	// 1回の記録毎に過去の分を減衰させ，データの偏りが変わったら追従する
+	conditionLevelFilterDecay = 0.9
+	// IN (level)を使っている間も，この回数に1回はGoで絞って選択率を測り直す
+	conditionLevelFilterProbeInterval = 64
+	// Goで絞るときに読む回数の上限．これで足りなければ残りはIN (level)で引く
+	conditionLevelFilterMaxRounds = 3
+)
+
+// kの上限(CONDITION_LEVEL_FILTER_MAX_K)．これを超えるならIN (level)の方が読む行が少ない
+var conditionLevelFilterMaxK = getEnvInt("CONDITION_LEVEL_FILTER_MAX_K", 16)
+
+type levelSelectivityStat struct {
+	scanned float64
+	matched float64
+	// IN (level)を選んだ回数．測り直しの間隔に使う
+	skipped int
+}
+
+// 指定されたlevelの組み合わせ毎の選択率
+type LevelSelectivity struct {
+	stats map[string]*levelSelectivityStat
+	Lock  sync.Mutex
+}
+
+var levelSelectivity = &LevelSelectivity{stats: make(map[string]*levelSelectivityStat)}
+
+func levelSelectivityKey(levels []string) string {
+	sorted := append([]string(nil), levels...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+// Goで絞るならそのkを，IN (level)で引くなら0を返す
+func (ls *LevelSelectivity) Plan(key string) int {
+	ls.Lock.Lock()
+	defer ls.Lock.Unlock()
+	stat, ok := ls.stats[key]
+	if !ok || stat.scanned < conditionLevelFilterMinSamples {
+		return conditionLevelFilterInitialK
+	}
+	k := conditionLevelFilterMaxK + 1
+	if stat.matched > 0 {
+		k = int(math.Ceil(conditionLevelFilterMargin * stat.scanned / stat.matched))
+	}
+	if k <= conditionLevelFilterMaxK {
+		return max(k, 1)
+	}
+	stat.skipped++
+	if stat.skipped%conditionLevelFilterProbeInterval == 0 {
+		return conditionLevelFilterMaxK
+	}
+	return 0
+}
+
+func (ls *LevelSelectivity) Record(key string, scanned int, matched int) {
+	if scanned == 0 {
+		return
+	}
+	ls.Lock.Lock()
+	defer ls.Lock.Unlock()
+	stat, ok := ls.stats[key]
+	if !ok {
+		stat = &levelSelectivityStat{}
+		ls.stats[key] = stat
+	}
+	stat.scanned = stat.scanned*conditionLevelFilterDecay + float64(scanned)
+	stat.matched = stat.matched*conditionLevelFilterDecay + float64(matched)
+}
+
+func (ls *LevelSelectivity) Reset() {
+	ls.Lock.Lock()
+	defer ls.Lock.Unlock()
+	ls.stats = make(map[string]*levelSelectivityStat)
+}
+
+type LevelSelectivityResponse struct {
+	Levels      string  `json:"levels"`
+	Scanned     float64 `json:"scanned"`
+	Matched     float64 `json:"matched"`
+	Selectivity float64 `json:"selectivity"`
+}
+
+func (ls *LevelSelectivity) List() []LevelSelectivityResponse {
+	ls.Lock.Lock()
+	defer ls.Lock.Unlock()
+	res := make([]LevelSelectivityResponse, 0, len(ls.stats))
+	for key, stat := range ls.stats {
+		var selectivity float64
+		if stat.scanned > 0 {
+			selectivity = stat.matched / stat.scanned
+		}
+		res = append(res, LevelSelectivityResponse{Levels: key, Scanned: stat.scanned, Matched: stat.matched, Selectivity: selectivity})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Levels < res[j].Levels
+	})
+	return res
+}
+
+// levelで絞るコンディションをkの見積もりに従って取得する．kが0(選択率が低い)ならIN (level)で引く
+func selectIsuConditionsByLevel(
+	db *sqlx.DB,
+	jiaIsuUUID string,
+	endTime time.Time,
+	conditionLevel map[string]interface{},
+	levels []string,
+	startTime time.Time,
+	limit int,
+) ([]IsuCondition, error) {
+	key := levelSelectivityKey(levels)
+	k := levelSelectivity.Plan(key)
+	if k == 0 || limit <= 0 {
+		q, args, err := buildIsuConditionsQuery(jiaIsuUUID, endTime, levels, startTime, limit, false)
+		if err != nil {
+			return nil, err
+		}
+		conditions := []IsuCondition{}
+		err = db.Select(&conditions, q, args...)
+		return conditions, err
+	}
+
+	conditions, scanned, err := selectIsuConditionsFilteredInGo(db, jiaIsuUUID, endTime, conditionLevel, levels, startTime, limit, limit*k)
+	if err != nil {
+		return nil, err
+	}
+	levelSelectivity.Record(key, scanned, len(conditions))
+	return conditions, nil
+}
+
+// 主キーの範囲でbatch件ずつ新しい順に読み，Goでlevelを絞る
+// 足りなければ最後に読んだ時刻より前を続けて読む(ISU毎にtimestampは一意なので重複も抜けもない)
+// 読む件数はlimit*conditionLevelFilterMaxKまで，回数はconditionLevelFilterMaxRoundsまでとし，
+// それでも足りなければ残りはIN (level)で引く
+// 返す件数とは別に，Goで絞るために見た行数を返す
+func selectIsuConditionsFilteredInGo(
+	db *sqlx.DB,
+	jiaIsuUUID string,
+	endTime time.Time,
+	conditionLevel map[string]interface{},
+	levels []string,
+	startTime time.Time,
+	limit int,
+	batch int,
+) ([]IsuCondition, int, error) {
+	allLevels := []string{conditionLevelInfo, conditionLevelWarning, conditionLevelCritical}
+	maxBatch := limit * conditionLevelFilterMaxK
+	conditions := []IsuCondition{}
+	scanned := 0
+	for round := 0; round < conditionLevelFilterMaxRounds; round++ {
+		q, args, err := buildIsuConditionsQuery(jiaIsuUUID, endTime, allLevels, startTime, batch, true)
+		if err != nil {
+			return nil, 0, err
+		}
+		rows := []IsuCondition{}
+		err = db.Select(&rows, q, args...)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, cond := range rows {
+			scanned++
+			if _, ok := conditionLevel[cond.Level]; !ok {
+				continue
+			}
+			conditions = append(conditions, cond)
+			if len(conditions) >= limit {
+				return conditions, scanned, nil
+			}
+		}
+		if len(rows) < batch {
+			return conditions, scanned, nil
+		}
+		endTime = rows[len(rows)-1].Timestamp
+		// 見積もりより選択率が低かったので，次は多めに読む
+		batch = min(batch*2, maxBatch)
+	}
+
+	q, args, err := buildIsuConditionsQuery(jiaIsuUUID, endTime, levels, startTime, limit-len(conditions), false)
+	if err != nil {
+		return nil, 0, err
+	}
+	rest := []IsuCondition{}
+	err = db.Select(&rest, q, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return append(conditions, rest...), scanned, nil
+}
+
+// GET /internal/conditions/level_selectivity
+// levelの組み合わせ毎に測った選択率を取得
+func getLevelSelectivity(c echo.Context) error {
+	return c.JSON(http.StatusOK, levelSelectivity.List())
+}
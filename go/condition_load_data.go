@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// 止まっていた後などでキューが大きく溜まったときは，INSERTの代わりにLOAD DATA LOCAL INFILEで流し込む
+// condition_load_dataフラグが有効で，CONDITION_LOAD_DATA_THRESHOLD件以上のときだけ使う(DB側でlocal_infile=ONが必要)
+// ファイルには書き出さず，ドライバーのReaderハンドラでメモリ上のTSVを渡す
+// LOCALの場合，主キーが重複した行は(INSERTと違って)エラーにならず捨てられる
+var (
+	conditionLoadDataThreshold = getEnvInt("CONDITION_LOAD_DATA_THRESHOLD", 20000)
+	conditionLoadDataSeq       atomic.Int64
+)
+
+// DSNのloc=Asia/Tokyoと同じく，DATETIMEは日本時間で書く(夏時間がないので固定の時差でよい)
+var conditionLoadDataLocation = time.FixedZone("Asia/Tokyo", 9*60*60)
+
+func useConditionLoadData(n int) bool {
+	return n >= conditionLoadDataThreshold && featureFlags.Enabled(flagConditionLoadData)
+}
+
+func loadIsuConditions(db *sqlx.DB, conds []IsuCondition) error {
+	body := buildConditionLoadData(conds)
+	name := "isu_condition_" + strconv.FormatInt(conditionLoadDataSeq.Add(1), 10)
+	mysql.RegisterReaderHandler(name, func() io.Reader {
+		return bytes.NewReader(body)
+	})
+	defer mysql.DeregisterReaderHandler(name)
+
+	_, err := db.Exec("LOAD DATA LOCAL INFILE 'Reader::" + name + "' INTO TABLE `isu_condition`" +
+		"	FIELDS TERMINATED BY '\\t' ESCAPED BY '\\\\' LINES TERMINATED BY '\\n'" +
+		"	(`jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`, `message_code`, `sequence`)")
+	if err != nil {
+		return fmt.Errorf("load data %d conditions: %w", len(conds), err)
+	}
+	return nil
+}
+
+func buildConditionLoadData(conds []IsuCondition) []byte {
+	b := make([]byte, 0, len(conds)*160)
+	for _, cond := range conds {
+		b = appendLoadDataField(b, cond.JIAIsuUUID)
+		b = append(b, '\t')
+		b = cond.Timestamp.In(conditionLoadDataLocation).AppendFormat(b, "2006-01-02 15:04:05")
+		b = append(b, '\t')
+		if cond.IsSitting {
+			b = append(b, '1')
+		} else {
+			b = append(b, '0')
+		}
+		b = append(b, '\t')
+		b = appendLoadDataField(b, cond.Condition)
+		b = append(b, '\t')
+		b = appendLoadDataField(b, cond.Message)
+		b = append(b, '\t')
+		b = appendLoadDataField(b, cond.MessageCode)
+		b = append(b, '\t')
+		if cond.Sequence.Valid {
+			b = strconv.AppendInt(b, cond.Sequence.Int64, 10)
+		} else {
+			b = append(b, '\\', 'N')
+		}
+		b = append(b, '\n')
+	}
+	return b
+}
+
+// 区切り文字とエスケープ文字をESCAPED BY '\\'の形式でエスケープする
+func appendLoadDataField(b []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\':
+			b = append(b, '\\', '\\')
+		case '\t':
+			b = append(b, '\\', 't')
+		case '\n':
+			b = append(b, '\\', 'n')
+		case '\r':
+			b = append(b, '\\', 'r')
+		case 0:
+			b = append(b, '\\', '0')
+		default:
+			b = append(b, c)
+		}
+	}
+	return b
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// スキーマはproto/condition.proto
+// 生成コードを持ち込むほどのものではないので，ワイヤーフォーマットを直接読む
+const (
+	mimeApplicationProtobuf = "application/x-protobuf"
+
+	maxConditionBatchBytes = 1 << 20
+)
+
+var errInvalidProtobuf = errors.New("invalid protobuf")
+
+func isProtobufRequest(c echo.Context) bool {
+	contentType, _, _ := strings.Cut(c.Request().Header.Get(echo.HeaderContentType), ";")
+	return strings.TrimSpace(contentType) == mimeApplicationProtobuf
+}
+
+func bindConditionBatch(c echo.Context) ([]PostIsuConditionRequest, error) {
+	b, err := io.ReadAll(io.LimitReader(c.Request().Body, maxConditionBatchBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxConditionBatchBytes {
+		return nil, errInvalidProtobuf
+	}
+	return decodeConditionBatch(b)
+}
+
+// ConditionBatchを読む
+func decodeConditionBatch(b []byte) ([]PostIsuConditionRequest, error) {
+	conds := []PostIsuConditionRequest{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, errInvalidProtobuf
+		}
+		b = b[n:]
+		if num == 1 && typ == protowire.BytesType {
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, errInvalidProtobuf
+			}
+			cond, err := decodeCondition(v)
+			if err != nil {
+				return nil, err
+			}
+			conds = append(conds, cond)
+			b = b[n:]
+			continue
+		}
+		// 知らないフィールドは読み飛ばす
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return nil, errInvalidProtobuf
+		}
+		b = b[n:]
+	}
+	return conds, nil
+}
+
+// Conditionを読む
+func decodeCondition(b []byte) (PostIsuConditionRequest, error) {
+	cond := PostIsuConditionRequest{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return cond, errInvalidProtobuf
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return cond, errInvalidProtobuf
+			}
+			cond.IsSitting = protowire.DecodeBool(v)
+			b = b[n:]
+		case (num == 2 || num == 3 || num == 5) && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return cond, errInvalidProtobuf
+			}
+			switch num {
+			case 2:
+				cond.Condition = v
+			case 3:
+				cond.Message = v
+			case 5:
+				cond.MessageCode = v
+			}
+			b = b[n:]
+		case num == 4 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return cond, errInvalidProtobuf
+			}
+			cond.Timestamp = int64(v)
+			b = b[n:]
+		case num == 6 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return cond, errInvalidProtobuf
+			}
+			sequence := int64(v)
+			cond.Sequence = &sequence
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return cond, fmt.Errorf("%w: field %v", errInvalidProtobuf, num)
+			}
+			b = b[n:]
+		}
+	}
+	return cond, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// INSERTのフラッシュと認証だけが使う小さいプール(DB_PRIORITY_MAX_OPEN_CONNS=16)
+// グラフなどの重い読み込みで本体のプールが埋まっても，書き込みとログインは待たされない
+var (
+	currentPriorityDB    atomic.Pointer[sqlx.DB]
+	priorityMaxOpenConns = getEnvInt("DB_PRIORITY_MAX_OPEN_CONNS", 16)
+)
+
+// 優先プールを作っていないとき(CLIなど)は本体のプールを使う
+func getPriorityDB() *sqlx.DB {
+	if db := currentPriorityDB.Load(); db != nil {
+		return db
+	}
+	return getDB()
+}
+
+func connectPriorityDB(conn *MySQLConnectionEnv) (*sqlx.DB, error) {
+	db, err := conn.ConnectDB()
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(priorityMaxOpenConns)
+	db.SetMaxIdleConns(priorityMaxOpenConns)
+	return db, nil
+}
+
+type DBPoolStats struct {
+	Name               string `json:"name"`
+	MaxOpenConnections int    `json:"max_open_connections"`
+	OpenConnections    int    `json:"open_connections"`
+	InUse              int    `json:"in_use"`
+	Idle               int    `json:"idle"`
+	// 空きを待った回数と合計時間．ここが伸びているプールは足りていない
+	WaitCount          int64 `json:"wait_count"`
+	WaitDurationMillis int64 `json:"wait_duration_ms"`
+}
+
+func dbPoolStats(name string, db *sqlx.DB) DBPoolStats {
+	stats := db.Stats()
+	return DBPoolStats{
+		Name:               name,
+		MaxOpenConnections: stats.MaxOpenConnections,
+		OpenConnections:    stats.OpenConnections,
+		InUse:              stats.InUse,
+		Idle:               stats.Idle,
+		WaitCount:          stats.WaitCount,
+		WaitDurationMillis: stats.WaitDuration.Milliseconds(),
+	}
+}
+
+// GET /internal/db/pools
+// プール毎の接続数と待ち時間を取得
+func getDBPools(c echo.Context) error {
+	pools := []DBPoolStats{dbPoolStats("default", getDB())}
+	if db := currentPriorityDB.Load(); db != nil {
+		pools = append(pools, dbPoolStats("priority", db))
+	}
+	return c.JSON(http.StatusOK, pools)
+}
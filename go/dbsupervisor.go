@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const dbPingTimeout = time.Second
+
+// DBへの疎通を定期的に確かめ，続けて失敗したら接続先を順に試して繋ぎ直す
+// 繋ぎ直している間はINSERTのフラッシュを止め，キューに溜めておく
+type DBSupervisor struct {
+	hosts        []string
+	threshold    int
+	maxOpenConns int
+	failures     int
+	paused       atomic.Bool
+}
+
+var dbSupervisor *DBSupervisor
+
+func NewDBSupervisor(hosts []string, threshold int, maxOpenConns int) *DBSupervisor {
+	return &DBSupervisor{
+		hosts:        hosts,
+		threshold:    threshold,
+		maxOpenConns: maxOpenConns,
+	}
+}
+
+// MYSQL_HOSTSは優先順のカンマ区切り．未指定ならMYSQL_HOSTだけ
+func parseDBHosts(csv string, defaultHost string) []string {
+	hosts := []string{}
+	for _, host := range strings.Split(csv, ",") {
+		host = strings.TrimSpace(host)
+		if host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) == 0 {
+		hosts = append(hosts, defaultHost)
+	}
+	return hosts
+}
+
+func (s *DBSupervisor) Paused() bool {
+	return s != nil && s.paused.Load()
+}
+
+func (s *DBSupervisor) superviseScheduled(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := pingDB()
+			if err == nil {
+				s.failures = 0
+				continue
+			}
+			s.failures++
+			systemLogger.Warn().Err(err).Int("failures", s.failures).Msg("db ping failed")
+			if s.failures >= s.threshold {
+				s.failover()
+			}
+		}
+	}
+}
+
+func pingDB() error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbPingTimeout)
+	defer cancel()
+	return getDB().PingContext(ctx)
+}
+
+// 優先順に接続を試し，繋がったところに切り替える．全滅なら次の周期でまた試す
+func (s *DBSupervisor) failover() {
+	s.paused.Store(true)
+	defer s.paused.Store(false)
+
+	for _, host := range s.hosts {
+		conn := *getMySQLConnectionEnv()
+		conn.Host = host
+		newDB, err := conn.ConnectDB()
+		if err != nil {
+			systemLogger.Error().Err(err).Str("host", host).Msg("failed to connect db")
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), dbPingTimeout)
+		err = newDB.PingContext(ctx)
+		cancel()
+		if err != nil {
+			systemLogger.Error().Err(err).Str("host", host).Msg("failed to connect db")
+			newDB.Close()
+			continue
+		}
+		newDB.SetMaxOpenConns(s.maxOpenConns)
+		newDB.SetMaxIdleConns(s.maxOpenConns)
+		newPriorityDB, err := connectPriorityDB(&conn)
+		if err != nil {
+			systemLogger.Error().Err(err).Str("host", host).Msg("failed to connect db")
+			newDB.Close()
+			continue
+		}
+
+		oldDB := currentDB.Swap(newDB)
+		oldPriorityDB := currentPriorityDB.Swap(newPriorityDB)
+		currentMySQLConnectionData.Store(&conn)
+		s.failures = 0
+		systemLogger.Warn().Str("host", host).Msg("db failover completed")
+		// 実行中のクエリが終わるのを待ってから閉じる
+		go oldDB.Close()
+		if oldPriorityDB != nil {
+			go oldPriorityDB.Close()
+		}
+		return
+	}
+	systemLogger.Error().Msg("db failover failed: no host available")
+}
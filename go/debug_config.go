@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// getEnv/getEnvIntで読んだ設定を，既定値を使ったかどうかと一緒に覚えておく
+// サーバー毎に挙動が違うときに，/debug/configの結果を並べて比べる
+type ResolvedConfig struct {
+	values map[string]resolvedConfigValue
+	Lock   sync.Mutex
+}
+
+type resolvedConfigValue struct {
+	value     string
+	isDefault bool
+}
+
+var resolvedConfig = &ResolvedConfig{values: make(map[string]resolvedConfigValue)}
+
+// getEnvを通さずに読んでいる設定
+var directConfigKeys = []string{
+	"SRVNO",
+	"STARTUP_PROBE",
+	"MYSQL_HOSTS",
+	"UDP_INGEST_ADDR",
+	"GOLDEN_RECORD_DIR",
+	"POST_ISUCONDITION_TARGET_BASE_URL",
+	"GOMAXPROCS",
+	"GOGC",
+	"GOMEMLIMIT",
+}
+
+// 名前にこれを含む設定は値を返さない
+var secretConfigMarkers = []string{"PASS", "SECRET", "TOKEN", "KEY"}
+
+const redactedConfigValue = "<redacted>"
+
+func (rc *ResolvedConfig) Record(key string, value string, isDefault bool) {
+	rc.Lock.Lock()
+	defer rc.Lock.Unlock()
+	rc.values[key] = resolvedConfigValue{value: value, isDefault: isDefault}
+}
+
+type ConfigEntry struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Default bool   `json:"default"`
+}
+
+func (rc *ResolvedConfig) List() []ConfigEntry {
+	rc.Lock.Lock()
+	entries := make([]ConfigEntry, 0, len(rc.values)+len(directConfigKeys))
+	for key, v := range rc.values {
+		entries = append(entries, ConfigEntry{Key: key, Value: v.value, Default: v.isDefault})
+	}
+	rc.Lock.Unlock()
+
+	for _, key := range directConfigKeys {
+		value := os.Getenv(key)
+		entries = append(entries, ConfigEntry{Key: key, Value: value, Default: value == ""})
+	}
+	for i := range entries {
+		if entries[i].Value != "" && isSecretConfigKey(entries[i].Key) {
+			entries[i].Value = redactedConfigValue
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+	return entries
+}
+
+func isSecretConfigKey(key string) bool {
+	for _, marker := range secretConfigMarkers {
+		if strings.Contains(key, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+type BuildInfo struct {
+	Revision  string `json:"revision"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
+
+func readBuildInfo() BuildInfo {
+	res := BuildInfo{Revision: metricsBuild, BuildTime: "unknown", GoVersion: runtime.Version()}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return res
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.time" {
+			res.BuildTime = setting.Value
+		}
+	}
+	return res
+}
+
+type RuntimeConfig struct {
+	GOMAXPROCS   int    `json:"gomaxprocs"`
+	MemoryLimit  int64  `json:"memory_limit"`
+	MySQLHost    string `json:"mysql_host"`
+	MaxOpenConns int    `json:"max_open_conns"`
+}
+
+type DebugConfigResponse struct {
+	Build        BuildInfo             `json:"build"`
+	Runtime      RuntimeConfig         `json:"runtime"`
+	Config       []ConfigEntry         `json:"config"`
+	FeatureFlags []FeatureFlagResponse `json:"feature_flags"`
+}
+
+// GET /debug/config
+// 実際に使っている設定(秘密の値は伏せる)，ビルドの情報，フィーチャーフラグを取得
+func getDebugConfig(c echo.Context) error {
+	return c.JSON(http.StatusOK, DebugConfigResponse{
+		Build: readBuildInfo(),
+		Runtime: RuntimeConfig{
+			GOMAXPROCS: runtime.GOMAXPROCS(0),
+			// 負の値を渡すと変更せずに今の値を返す
+			MemoryLimit:  debug.SetMemoryLimit(-1),
+			MySQLHost:    getMySQLConnectionEnv().Host,
+			MaxOpenConns: getDB().Stats().MaxOpenConnections,
+		},
+		Config:       resolvedConfig.List(),
+		FeatureFlags: featureFlags.List(),
+	})
+}
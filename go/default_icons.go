@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// アイコンを登録しなかったISUに，NoImage.jpgの代わりに性格毎のアイコンを返す
+// DEFAULT_ICON_DIR=/home/isucon/default-icons に「性格名.拡張子」(例: いじっぱり.png)を置く
+// 置いていない性格はNoImage.jpgのまま．DBには登録時のNoImage.jpgが入っているので，返すときに差し替える
+type DefaultIconSet struct {
+	dir   string
+	icons map[string][]byte
+	// ディレクトリの中身が変わったかを見るための，ファイル名・サイズ・更新時刻をつなげたもの
+	signature string
+	Lock      sync.Mutex
+}
+
+var defaultIconSet = &DefaultIconSet{
+	dir:   getEnv("DEFAULT_ICON_DIR", ""),
+	icons: make(map[string][]byte),
+}
+
+func (ds *DefaultIconSet) Enabled() bool {
+	return ds.dir != ""
+}
+
+func (ds *DefaultIconSet) Get(character string) ([]byte, bool) {
+	ds.Lock.Lock()
+	defer ds.Lock.Unlock()
+	icon, ok := ds.icons[character]
+	return icon, ok
+}
+
+// ディレクトリの中身が前回から変わっていれば読み直す
+func (ds *DefaultIconSet) Reload() (bool, error) {
+	entries, err := os.ReadDir(ds.dir)
+	if err != nil {
+		return false, err
+	}
+	var sig strings.Builder
+	files := []os.DirEntry{}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return false, err
+		}
+		fmt.Fprintf(&sig, "%v:%v:%v;", entry.Name(), info.Size(), info.ModTime().UnixNano())
+		files = append(files, entry)
+	}
+	ds.Lock.Lock()
+	unchanged := sig.String() == ds.signature
+	ds.Lock.Unlock()
+	if unchanged {
+		return false, nil
+	}
+
+	icons := make(map[string][]byte, len(files))
+	for _, entry := range files {
+		icon, err := os.ReadFile(filepath.Join(ds.dir, entry.Name()))
+		if err != nil {
+			return false, err
+		}
+		character := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+		icons[character] = icon
+	}
+	ds.Lock.Lock()
+	ds.icons = icons
+	ds.signature = sig.String()
+	ds.Lock.Unlock()
+	return true, nil
+}
+
+func (ds *DefaultIconSet) reloadScheduled(ctx context.Context, interval time.Duration) {
+	if !ds.Enabled() {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := ds.Reload()
+			if err != nil {
+				workerLogger.Error().Err(err).Str("dir", ds.dir).Msg("failed to reload default icons")
+				continue
+			}
+			if reloaded {
+				workerLogger.Info().Str("dir", ds.dir).Msg("reloaded default icons")
+			}
+		}
+	}
+}
+
+// 登録時のNoImage.jpgのままなら，性格毎のアイコンに差し替える
+func characterDefaultIcon(jiaIsuUUID string, image []byte) ([]byte, bool, error) {
+	if !defaultIconSet.Enabled() || !bytes.Equal(image, defaultIcon) {
+		return image, false, nil
+	}
+	isu, err := isuCache.Get(jiaIsuUUID)
+	if err != nil {
+		return nil, false, err
+	}
+	icon, ok := defaultIconSet.Get(isu.Character)
+	if !ok {
+		return image, false, nil
+	}
+	return icon, true, nil
+}
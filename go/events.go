@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	eventTypeConditionLevelChanged = "condition.level_changed"
+
+	eventHistorySize       = 1000
+	eventSubscriberBuffer  = 64
+	eventHeartbeatInterval = 15 * time.Second
+	// バッファから古いものを続けて捨てた回数がこれを超えたら切断する
+	eventSlowConsumerMaxDrops = eventSubscriberBuffer
+	// 止まったタブへの書き込みで接続を抱え続けないようにする
+	eventWriteTimeout = 10 * time.Second
+)
+
+type Event struct {
+	ID int64 `json:"id"`
+	IsuEvent
+}
+
+type eventSubscriber struct {
+	ch chan Event
+	// 続けて捨てた回数と，遅すぎて切断するときに閉じるチャネル(どちらもEventHubのロックの中で触る)
+	// 捨てずに入ったら0に戻すので，追いついている長時間の接続は切らない
+	dropped int
+	kicked  chan struct{}
+}
+
+// ユーザーに見える変更をユーザー毎に保持し，購読者に配る
+type EventHub struct {
+	nextID      int64
+	history     map[string][]Event
+	subscribers map[string]map[*eventSubscriber]struct{}
+	Lock        sync.Mutex
+}
+
+var eventHub = NewEventHub()
+
+func NewEventHub() *EventHub {
+	return &EventHub{
+		nextID:      1,
+		history:     make(map[string][]Event),
+		subscribers: make(map[string]map[*eventSubscriber]struct{}),
+	}
+}
+
+// イベントを履歴と購読者に流す
+// webhookはコンディションやインシデントの通知は送らず，ISUの登録だけ送る
+func publishEvent(event IsuEvent) {
+	eventHub.Publish(event)
+	if event.Type == eventTypeIsuRegistered {
+		webhookDispatcher.Enqueue(event)
+	}
+}
+
+func (eh *EventHub) Publish(isuEvent IsuEvent) {
+	eh.Lock.Lock()
+	defer eh.Lock.Unlock()
+	event := Event{ID: eh.nextID, IsuEvent: isuEvent}
+	eh.nextID++
+
+	history := append(eh.history[isuEvent.JIAUserID], event)
+	if len(history) > eventHistorySize {
+		history = history[len(history)-eventHistorySize:]
+	}
+	eh.history[isuEvent.JIAUserID] = history
+
+	// 送信はブロックしない．詰まっている購読者は古いものから捨て，捨てすぎたら切断する
+	// 切断されたクライアントはLast-Event-IDで繋ぎ直せば，捨てた分も履歴から受け取れる
+	for sub := range eh.subscribers[isuEvent.JIAUserID] {
+		select {
+		case sub.ch <- event:
+			sub.dropped = 0
+			continue
+		default:
+		}
+		select {
+		case <-sub.ch:
+		default:
+		}
+		select {
+		case sub.ch <- event:
+		default:
+		}
+		sub.dropped++
+		if sub.dropped > eventSlowConsumerMaxDrops {
+			close(sub.kicked)
+			delete(eh.subscribers[isuEvent.JIAUserID], sub)
+		}
+	}
+}
+
+// afterIDより後の履歴を返す
+func (eh *EventHub) Since(jiaUserID string, afterID int64) []Event {
+	eh.Lock.Lock()
+	defer eh.Lock.Unlock()
+	return eh.since(jiaUserID, afterID)
+}
+
+func (eh *EventHub) since(jiaUserID string, afterID int64) []Event {
+	res := []Event{}
+	for _, event := range eh.history[jiaUserID] {
+		if event.ID > afterID {
+			res = append(res, event)
+		}
+	}
+	return res
+}
+
+// 履歴の取得と購読の開始を同じロックの中で行い，その間のイベントを取りこぼさないようにする
+func (eh *EventHub) Subscribe(jiaUserID string, afterID int64) ([]Event, *eventSubscriber) {
+	eh.Lock.Lock()
+	defer eh.Lock.Unlock()
+	sub := &eventSubscriber{ch: make(chan Event, eventSubscriberBuffer), kicked: make(chan struct{})}
+	if eh.subscribers[jiaUserID] == nil {
+		eh.subscribers[jiaUserID] = make(map[*eventSubscriber]struct{})
+	}
+	eh.subscribers[jiaUserID][sub] = struct{}{}
+	return eh.since(jiaUserID, afterID), sub
+}
+
+func (eh *EventHub) Unsubscribe(jiaUserID string, sub *eventSubscriber) {
+	eh.Lock.Lock()
+	defer eh.Lock.Unlock()
+	delete(eh.subscribers[jiaUserID], sub)
+	if len(eh.subscribers[jiaUserID]) == 0 {
+		delete(eh.subscribers, jiaUserID)
+	}
+}
+
+// ユーザーの履歴を捨てる(購読中の接続はそのまま)
+func (eh *EventHub) Forget(jiaUserID string) {
+	eh.Lock.Lock()
+	defer eh.Lock.Unlock()
+	delete(eh.history, jiaUserID)
+}
+
+func (eh *EventHub) Reset() {
+	eh.Lock.Lock()
+	defer eh.Lock.Unlock()
+	eh.history = make(map[string][]Event)
+}
+
+// GET /api/events?after=
+// 自分のISUに関する変更を取得．Accept: text/event-streamならSSEで流し続ける
+func getEvents(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	afterStr := c.QueryParam("after")
+	if lastEventID := c.Request().Header.Get("Last-Event-ID"); lastEventID != "" {
+		afterStr = lastEventID
+	}
+	var afterID int64
+	if afterStr != "" {
+		afterID, err = strconv.ParseInt(afterStr, 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "bad format: after")
+		}
+	}
+
+	if !strings.Contains(c.Request().Header.Get(echo.HeaderAccept), "text/event-stream") {
+		return respondJSONArray(c, http.StatusOK, eventHub.Since(jiaUserID, afterID))
+	}
+
+	backlog, sub := eventHub.Subscribe(jiaUserID, afterID)
+	defer eventHub.Unsubscribe(jiaUserID, sub)
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(res)
+
+	rc.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+	for _, event := range backlog {
+		err = writeSSEEvent(res, event)
+		if err != nil {
+			return nil
+		}
+	}
+	res.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-sub.kicked:
+			c.Logger().Warnf("disconnected slow event consumer: %v", jiaUserID)
+			return nil
+		case event := <-sub.ch:
+			rc.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+			err = writeSSEEvent(res, event)
+			if err != nil {
+				return nil
+			}
+			res.Flush()
+		case <-heartbeat.C:
+			rc.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+			_, err = fmt.Fprint(res, ": heartbeat\n\n")
+			if err != nil {
+				return nil
+			}
+			res.Flush()
+		}
+	}
+}
+
+func writeSSEEvent(res *echo.Response, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(res, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
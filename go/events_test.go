@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func drainEvents(sub *eventSubscriber) {
+	for {
+		select {
+		case <-sub.ch:
+		default:
+			return
+		}
+	}
+}
+
+// ときどき詰まっても追いついている購読者は切らず，続けて捨て続けたら切る
+func TestEventHubSlowConsumer(t *testing.T) {
+	eh := NewEventHub()
+	_, sub := eh.Subscribe("user", 0)
+
+	for round := 0; round < eventSlowConsumerMaxDrops*4; round++ {
+		// バッファより1件多く送るので，毎回1件だけ捨てる
+		for i := 0; i < eventSubscriberBuffer+1; i++ {
+			eh.Publish(IsuEvent{JIAUserID: "user"})
+		}
+		drainEvents(sub)
+		// 取り出したあとは捨てずに入る
+		eh.Publish(IsuEvent{JIAUserID: "user"})
+		select {
+		case <-sub.kicked:
+			t.Fatalf("kicked a consumer that keeps up after %d rounds", round)
+		default:
+		}
+	}
+
+	drainEvents(sub)
+	for i := 0; i < eventSubscriberBuffer+eventSlowConsumerMaxDrops+1; i++ {
+		eh.Publish(IsuEvent{JIAUserID: "user"})
+	}
+	select {
+	case <-sub.kicked:
+	default:
+		t.Fatal("did not kick a consumer that stopped reading")
+	}
+}
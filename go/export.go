@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/labstack/echo/v4"
+)
+
+const exportFlushEvery = 1000
+
+// ユーザーIDとISUのUUIDを匿名化するときの鍵．未指定なら起動毎にランダムにして，別の起動で出したものと突き合わせられないようにする
+var exportSalt = newExportSalt(getEnv("EXPORT_SALT", ""))
+
+func newExportSalt(salt string) []byte {
+	if salt != "" {
+		return []byte(salt)
+	}
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// 分析用に書き出すコンディション．メッセージは個人の情報を含みうるので出さない
+type AnonymizedCondition struct {
+	IsuHash   string `json:"isu_hash"`
+	UserHash  string `json:"user_hash"`
+	Character string `json:"character"`
+	Timestamp int64  `json:"timestamp"`
+	IsSitting bool   `json:"is_sitting"`
+	Condition string `json:"condition"`
+	Level     string `json:"level"`
+}
+
+type exportConditionRow struct {
+	JIAIsuUUID string    `db:"jia_isu_uuid"`
+	JIAUserID  string    `db:"jia_user_id"`
+	Character  string    `db:"character"`
+	Timestamp  time.Time `db:"timestamp"`
+	IsSitting  bool      `db:"is_sitting"`
+	Condition  string    `db:"condition"`
+	Level      string    `db:"level"`
+}
+
+func anonymize(id string) string {
+	mac := hmac.New(sha256.New, exportSalt)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// GET /internal/export/conditions?since=&until=
+// 匿名化したコンディションをNDJSONで返す．DBから1行ずつ読んで書くので，件数によらずメモリは一定
+func getConditionExport(c echo.Context) error {
+	since := time.Unix(0, 0)
+	until := time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+	if s := c.QueryParam("since"); s != "" {
+		sec, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "bad format: since")
+		}
+		since = time.Unix(sec, 0)
+	}
+	if s := c.QueryParam("until"); s != "" {
+		sec, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "bad format: until")
+		}
+		until = time.Unix(sec, 0)
+	}
+
+	rows, err := getDB().Queryx(
+		"SELECT `isu_condition`.`jia_isu_uuid`, `isu`.`jia_user_id`, `isu`.`character`,"+
+			" `isu_condition`.`timestamp`, `isu_condition`.`is_sitting`, `isu_condition`.`condition`, `isu_condition`.`level`"+
+			" FROM `isu_condition` INNER JOIN `isu` ON `isu`.`jia_isu_uuid` = `isu_condition`.`jia_isu_uuid`"+
+			" WHERE `isu_condition`.`timestamp` >= ? AND `isu_condition`.`timestamp` < ?",
+		since, until,
+	)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer rows.Close()
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	res.WriteHeader(http.StatusOK)
+
+	// 書き始めた後はステータスを変えられないので，途中で失敗したら接続ごと打ち切る
+	enc := json.NewEncoder(res)
+	hashes := map[string]string{}
+	hash := func(id string) string {
+		h, ok := hashes[id]
+		if !ok {
+			h = anonymize(id)
+			hashes[id] = h
+		}
+		return h
+	}
+	n := 0
+	for rows.Next() {
+		row := exportConditionRow{}
+		err = rows.StructScan(&row)
+		if err != nil {
+			return err
+		}
+		err = enc.Encode(AnonymizedCondition{
+			IsuHash:   hash(row.JIAIsuUUID),
+			UserHash:  hash(row.JIAUserID),
+			Character: row.Character,
+			Timestamp: row.Timestamp.Unix(),
+			IsSitting: row.IsSitting,
+			Condition: row.Condition,
+			Level:     row.Level,
+		})
+		if err != nil {
+			return err
+		}
+		n++
+		if n%exportFlushEvery == 0 {
+			res.Flush()
+		}
+	}
+	return rows.Err()
+}
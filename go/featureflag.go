@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	flagTrendDistribution      = "trend_distribution"
+	flagIconSendfile           = "icon_sendfile"
+	flagConditionQueryPushdown = "condition_query_pushdown"
+	flagShadowConditionQuery   = "shadow_condition_query"
+	flagConditionIndexHints    = "condition_index_hints"
+	flagGraphSQLAggregation    = "graph_sql_aggregation"
+	flagConditionLoadData      = "condition_load_data"
+	flagConditionLevelGoFilter = "condition_level_go_filter"
+)
+
+type FeatureFlag struct {
+	Name        string
+	Description string
+	enabled     atomic.Bool
+	// 有効にする割合(0-100)．新しいコードパスを一部のリクエストだけで試すのに使う
+	percentage atomic.Int32
+}
+
+// キーのハッシュで振り分けるので，同じISUやユーザーは常に同じ側に入る
+// キーがない場合はリクエスト毎にランダムに振り分ける
+func (f *FeatureFlag) enabledFor(key string) bool {
+	if !f.enabled.Load() {
+		return false
+	}
+	percentage := f.percentage.Load()
+	if percentage >= 100 {
+		return true
+	}
+	if percentage <= 0 {
+		return false
+	}
+	if key == "" {
+		return rand.Int32N(100) < percentage
+	}
+	h := fnv.New32a()
+	h.Write([]byte(f.Name))
+	h.Write([]byte(key))
+	return int32(h.Sum32()%100) < percentage
+}
+
+// 機能の有効・無効を実行中に切り替えるためのレジストリ
+// 初期値はFEATURE_FLAGS="name=true,other=false,canary=25%"で上書きでき，/internal/flagsで変更できる
+type FeatureFlags struct {
+	flags map[string]*FeatureFlag
+	Lock  sync.Mutex
+}
+
+var featureFlags = NewFeatureFlags(getEnv("FEATURE_FLAGS", ""))
+
+func NewFeatureFlags(overrides string) *FeatureFlags {
+	ff := &FeatureFlags{flags: make(map[string]*FeatureFlag)}
+	ff.Register(flagTrendDistribution, "push computed trend to TREND_FOLLOWERS", true)
+	ff.Register(flagIconSendfile, "let nginx send icons via X-Accel-Redirect/X-Sendfile when ICON_SENDFILE is set", true)
+	ff.Register(flagConditionQueryPushdown, "omit the level predicate when every level is requested (per isu)", true)
+	ff.Register(flagShadowConditionQuery, "also run the other condition query variant and diff the responses", false)
+	ff.Register(flagConditionIndexHints, "pin the isu_condition range queries to an index with FORCE INDEX", false)
+	ff.Register(flagGraphSQLAggregation, "aggregate graph data points in SQL for isu without condition level overrides", true)
+	ff.Register(flagConditionLoadData, "flush huge condition batches with LOAD DATA LOCAL INFILE (needs local_infile=ON)", false)
+	ff.Register(flagConditionLevelGoFilter, "filter condition levels in Go over a primary key range when the measured selectivity allows (per isu)", false)
+
+	for _, spec := range strings.Split(overrides, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		name, valueStr, _ := strings.Cut(spec, "=")
+		var err error
+		if percentageStr, ok := strings.CutSuffix(valueStr, "%"); ok {
+			var percentage int
+			percentage, err = strconv.Atoi(percentageStr)
+			if err == nil {
+				err = ff.SetPercentage(name, true, percentage)
+			}
+		} else {
+			var value bool
+			value, err = strconv.ParseBool(valueStr)
+			if err == nil {
+				err = ff.Set(name, value)
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid FEATURE_FLAGS %q: %v\n", spec, err)
+		}
+	}
+	return ff
+}
+
+func (ff *FeatureFlags) Register(name string, description string, defaultValue bool) {
+	ff.Lock.Lock()
+	defer ff.Lock.Unlock()
+	flag := &FeatureFlag{Name: name, Description: description}
+	flag.enabled.Store(defaultValue)
+	flag.percentage.Store(100)
+	ff.flags[name] = flag
+}
+
+// 未登録のフラグは無効として扱う
+func (ff *FeatureFlags) Enabled(name string) bool {
+	return ff.EnabledFor(name, "")
+}
+
+func (ff *FeatureFlags) EnabledFor(name string, key string) bool {
+	ff.Lock.Lock()
+	flag, ok := ff.flags[name]
+	ff.Lock.Unlock()
+	return ok && flag.enabledFor(key)
+}
+
+func (ff *FeatureFlags) Set(name string, value bool) error {
+	ff.Lock.Lock()
+	flag, ok := ff.flags[name]
+	ff.Lock.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown feature flag: %v", name)
+	}
+	flag.enabled.Store(value)
+	return nil
+}
+
+func (ff *FeatureFlags) SetPercentage(name string, value bool, percentage int) error {
+	if percentage < 0 || 100 < percentage {
+		return fmt.Errorf("percentage out of range: %v", percentage)
+	}
+	ff.Lock.Lock()
+	flag, ok := ff.flags[name]
+	ff.Lock.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown feature flag: %v", name)
+	}
+	flag.enabled.Store(value)
+	flag.percentage.Store(int32(percentage))
+	return nil
+}
+
+type FeatureFlagResponse struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Enabled     bool   `json:"enabled"`
+	Percentage  int    `json:"percentage"`
+}
+
+func (ff *FeatureFlags) List() []FeatureFlagResponse {
+	ff.Lock.Lock()
+	defer ff.Lock.Unlock()
+	res := make([]FeatureFlagResponse, 0, len(ff.flags))
+	for _, flag := range ff.flags {
+		res = append(res, FeatureFlagResponse{
+			Name:        flag.Name,
+			Description: flag.Description,
+			Enabled:     flag.enabled.Load(),
+			Percentage:  int(flag.percentage.Load()),
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+type PutFeatureFlagRequest struct {
+	Enabled    bool `json:"enabled"`
+	Percentage *int `json:"percentage"`
+}
+
+// GET /internal/flags
+// フィーチャーフラグの一覧を取得
+func getFeatureFlags(c echo.Context) error {
+	return c.JSON(http.StatusOK, featureFlags.List())
+}
+
+// PUT /internal/flags/:name
+// フィーチャーフラグを切り替える
+func putFeatureFlag(c echo.Context) error {
+	var request PutFeatureFlagRequest
+	err := c.Bind(&request)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad request body")
+	}
+	percentage := 100
+	if request.Percentage != nil {
+		percentage = *request.Percentage
+		if percentage < 0 || 100 < percentage {
+			return c.String(http.StatusBadRequest, "bad format: percentage")
+		}
+	}
+	err = featureFlags.SetPercentage(c.Param("name"), request.Enabled, percentage)
+	if err != nil {
+		return c.String(http.StatusNotFound, "not found: flag")
+	}
+	return c.JSON(http.StatusOK, featureFlags.List())
+}
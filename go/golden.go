@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/goccy/go-json"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// ゴールデンファイルに記録する1レスポンス
+type GoldenResponse struct {
+	Method string          `json:"method"`
+	URI    string          `json:"uri"`
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body,omitempty"`
+	Text   string          `json:"text,omitempty"`
+}
+
+// GETのレスポンスをリクエスト毎にファイルへ書き出す
+// 同じシナリオを別ビルドで流して出力ディレクトリをdiffすれば，レスポンスの差分が分かる
+func goldenRecorderMiddleware(dir string) echo.MiddlewareFunc {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		systemLogger.Fatal().Err(err).Str("dir", dir).Msg("failed to create golden record dir")
+	}
+	return middleware.BodyDumpWithConfig(middleware.BodyDumpConfig{
+		Skipper: func(c echo.Context) bool {
+			return c.Request().Method != echo.GET
+		},
+		Handler: func(c echo.Context, reqBody []byte, resBody []byte) {
+			res := GoldenResponse{
+				Method: c.Request().Method,
+				URI:    c.Request().RequestURI,
+				Status: c.Response().Status,
+			}
+			if json.Valid(resBody) {
+				res.Body = resBody
+			} else if strings.HasPrefix(c.Response().Header().Get(echo.HeaderContentType), "text/") {
+				res.Text = string(resBody)
+			}
+			b, err := json.MarshalIndent(res, "", "  ")
+			if err != nil {
+				c.Logger().Errorf("failed to marshal golden response: %v", err)
+				return
+			}
+			err = os.WriteFile(filepath.Join(dir, goldenFileName(res.Method, res.URI)), b, 0644)
+			if err != nil {
+				c.Logger().Errorf("failed to write golden response: %v", err)
+			}
+		},
+	})
+}
+
+func goldenFileName(method string, uri string) string {
+	sum := sha1.Sum([]byte(method + " " + uri))
+	path, _, _ := strings.Cut(uri, "?")
+	path = strings.Trim(strings.ReplaceAll(path, "/", "_"), "_")
+	return method + "_" + path + "_" + hex.EncodeToString(sum[:4]) + ".json"
+}
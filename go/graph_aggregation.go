@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+type graphAggregationRow struct {
+	// graphDateから何時間目か．graphDateは正時にそろえてあるので，このままバケットの番号になる
+	HourOffset        int `db:"hour_offset"`
+	Count             int `db:"count"`
+	SittingCount      int `db:"sitting_count"`
+	IsBrokenCount     int `db:"is_broken_count"`
+	IsOverweightCount int `db:"is_overweight_count"`
+	IsDirtyCount      int `db:"is_dirty_count"`
+	RawScore          int `db:"raw_score"`
+}
+
+// scanIsuGraphDataPointsと同じ集計をSQLで行う．levelはDBの生成列を使うので，判定ルールの上書きがないISUだけに使える
+// condition_timestampsのために時刻だけは別に読むが，conditionやmessageの文字列は転送しない
+func aggregateIsuGraphDataPoints(jiaIsuUUID string, graphDate time.Time, endTime time.Time) ([]GraphDataPointWithInfo, error) {
+	rows := []graphAggregationRow{}
+	err := getDB().Select(
+		&rows,
+		"SELECT TIMESTAMPDIFF(HOUR, ?, `timestamp`) AS `hour_offset`, COUNT(*) AS `count`,"+
+			"	SUM(`is_sitting`) AS `sitting_count`,"+
+			"	SUM(`condition` LIKE '%is_broken=true%') AS `is_broken_count`,"+
+			"	SUM(`condition` LIKE '%is_overweight=true%') AS `is_overweight_count`,"+
+			"	SUM(`condition` LIKE '%is_dirty=true%') AS `is_dirty_count`,"+
+			"	SUM(CASE `level` WHEN ? THEN ? WHEN ? THEN ? ELSE ? END) AS `raw_score`"+
+			"	FROM `isu_condition`"+isuConditionRangeHint()+
+			"	WHERE `jia_isu_uuid` = ? AND ? <= `timestamp` AND `timestamp` < ?"+
+			"	GROUP BY `hour_offset` ORDER BY `hour_offset`",
+		graphDate,
+		conditionLevelCritical, scoreConditionLevelCritical,
+		conditionLevelWarning, scoreConditionLevelWarning,
+		scoreConditionLevelInfo,
+		jiaIsuUUID, graphDate, endTime,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	if len(rows) == 0 {
+		return []GraphDataPointWithInfo{}, nil
+	}
+
+	timestamps := []time.Time{}
+	err = getDB().Select(
+		&timestamps,
+		"SELECT `timestamp` FROM `isu_condition`"+isuConditionRangeHint()+
+			"	WHERE `jia_isu_uuid` = ? AND ? <= `timestamp` AND `timestamp` < ? ORDER BY `timestamp` ASC",
+		jiaIsuUUID, graphDate, endTime,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	timestampsByHour := make(map[int][]int64, len(rows))
+	for _, timestamp := range timestamps {
+		hourOffset := int(timestamp.Sub(graphDate) / time.Hour)
+		timestampsByHour[hourOffset] = append(timestampsByHour[hourOffset], timestamp.Unix())
+	}
+
+	dataPoints := make([]GraphDataPointWithInfo, 0, len(rows))
+	for _, row := range rows {
+		hour := graphHourAccumulator{
+			count:             row.Count,
+			sittingCount:      row.SittingCount,
+			isBrokenCount:     row.IsBrokenCount,
+			isOverweightCount: row.IsOverweightCount,
+			isDirtyCount:      row.IsDirtyCount,
+			rawScore:          row.RawScore,
+		}
+		// 二つのクエリの間に書き込まれた分で食い違っても，nullにはしない
+		hourTimestamps := timestampsByHour[row.HourOffset]
+		if hourTimestamps == nil {
+			hourTimestamps = []int64{}
+		}
+		dataPoints = append(dataPoints, GraphDataPointWithInfo{
+			JIAIsuUUID:          jiaIsuUUID,
+			StartAt:             graphDate.Add(time.Duration(row.HourOffset) * time.Hour),
+			Data:                hour.dataPoint(),
+			ConditionTimestamps: hourTimestamps,
+		})
+	}
+	return dataPoints, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/isucon/isucon11-qualify/isucondition/internal/timeutil"
+)
+
+const graphWindowHours = 24
+
+// コンディションが1件もなかったグラフの範囲(ISUと開始の時間)
+// ベンチマーカーはデータのない日をよく聞くので，そのたびにインデックスを走査しないようにする
+// INSERTで消せるのはキューを書き出すSRVNO=1のサーバーだけなので，他のサーバーでは使わない
+// 書き出し側でも取りこぼしが残り続けないよう，プロファイルによらず短い期限を付ける
+type GraphEmptyCache struct {
+	enabled bool
+	ttl     time.Duration
+	// jia_isu_uuid -> 範囲の最初の時間(timeutil.HourIndex) -> 期限
+	cache map[string]map[int64]time.Time
+	// コンディションが入る度に増える．読んでいる間に書き込まれたものを空として覚えないようにする
+	versions map[string]uint64
+	Lock     sync.Mutex
+}
+
+var graphEmptyCache = NewGraphEmptyCache(
+	os.Getenv("SRVNO") == "1",
+	time.Duration(getEnvInt("GRAPH_EMPTY_CACHE_TTL_MS", 1000))*time.Millisecond,
+)
+
+func NewGraphEmptyCache(enabled bool, ttl time.Duration) *GraphEmptyCache {
+	return &GraphEmptyCache{
+		enabled:  enabled,
+		ttl:      ttl,
+		cache:    make(map[string]map[int64]time.Time),
+		versions: make(map[string]uint64),
+	}
+}
+
+// DBを読む前に取っておき，SetEmptyに渡す
+func (gc *GraphEmptyCache) Version(jiaIsuUUID string) uint64 {
+	gc.Lock.Lock()
+	defer gc.Lock.Unlock()
+	return gc.versions[jiaIsuUUID]
+}
+
+func (gc *GraphEmptyCache) Empty(jiaIsuUUID string, graphDate time.Time) bool {
+	if !gc.enabled {
+		return false
+	}
+	gc.Lock.Lock()
+	defer gc.Lock.Unlock()
+	windows := gc.cache[jiaIsuUUID]
+	hourIndex := timeutil.HourIndex(graphDate.Unix())
+	expiresAt, ok := windows[hourIndex]
+	if !ok {
+		return false
+	}
+	if !time.Now().Before(expiresAt) {
+		delete(windows, hourIndex)
+		return false
+	}
+	return true
+}
+
+func (gc *GraphEmptyCache) SetEmpty(jiaIsuUUID string, graphDate time.Time, version uint64) {
+	if !gc.enabled {
+		return
+	}
+	gc.Lock.Lock()
+	defer gc.Lock.Unlock()
+	if gc.versions[jiaIsuUUID] != version {
+		return
+	}
+	windows, ok := gc.cache[jiaIsuUUID]
+	if !ok {
+		windows = make(map[int64]time.Time)
+		gc.cache[jiaIsuUUID] = windows
+	}
+	windows[timeutil.HourIndex(graphDate.Unix())] = time.Now().Add(gc.ttl)
+}
+
+// timestampのコンディションをINSERTしたので，それを含む範囲を消す
+func (gc *GraphEmptyCache) Observe(jiaIsuUUID string, timestamp time.Time) {
+	gc.Lock.Lock()
+	defer gc.Lock.Unlock()
+	gc.versions[jiaIsuUUID]++
+	windows, ok := gc.cache[jiaIsuUUID]
+	if !ok {
+		return
+	}
+	hourIndex := timeutil.HourIndex(timestamp.Unix())
+	for start := range windows {
+		if start <= hourIndex && hourIndex < start+graphWindowHours {
+			delete(windows, start)
+		}
+	}
+}
+
+func (gc *GraphEmptyCache) Forget(jiaIsuUUID string) {
+	gc.Lock.Lock()
+	defer gc.Lock.Unlock()
+	gc.versions[jiaIsuUUID]++
+	delete(gc.cache, jiaIsuUUID)
+}
+
+func (gc *GraphEmptyCache) Reset() {
+	gc.Lock.Lock()
+	defer gc.Lock.Unlock()
+	gc.cache = make(map[string]map[int64]time.Time)
+	gc.versions = make(map[string]uint64)
+}
+
+// データ点のない24時間分のグラフ
+func emptyIsuGraphResponse(graphDate time.Time) []GraphResponse {
+	res := make([]GraphResponse, 0, graphWindowHours)
+	for i := 0; i < graphWindowHours; i++ {
+		thisTime := graphDate.Add(time.Duration(i) * time.Hour)
+		res = append(res, GraphResponse{
+			StartAt:             thisTime.Unix(),
+			EndAt:               thisTime.Add(time.Hour).Unix(),
+			ConditionTimestamps: []int64{},
+		})
+	}
+	return res
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+type graphTestCondition struct {
+	unix      int64
+	isSitting bool
+	condition string
+}
+
+// 起点の前後2時間を含む範囲に，時刻の重なりも許してランダムにコンディションを作る
+// 起点ちょうど，終点ちょうど，終点の1秒前は境界の確認のため必ず入れる
+func randomGraphConditions(rng *rand.Rand, start int64) []graphTestCondition {
+	n := rng.Intn(300)
+	unixes := []int64{start, start + graphWindowHours*3600, start + graphWindowHours*3600 - 1}
+	for i := 0; i < n; i++ {
+		unixes = append(unixes, start-2*3600+rng.Int63n((graphWindowHours+4)*3600))
+	}
+	sort.Slice(unixes, func(i, j int) bool { return unixes[i] < unixes[j] })
+
+	conds := make([]graphTestCondition, 0, len(unixes))
+	for _, unix := range unixes {
+		conds = append(conds, graphTestCondition{
+			unix:      unix,
+			isSitting: rng.Intn(2) == 0,
+			condition: fmt.Sprintf("is_dirty=%v,is_overweight=%v,is_broken=%v", rng.Intn(2) == 0, rng.Intn(2) == 0, rng.Intn(2) == 0),
+		})
+	}
+	return conds
+}
+
+func TestBuildIsuGraphResponseProperties(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for iter := 0; iter < 500; iter++ {
+		// 半分は正時からずれた起点にする
+		graphDate := time.Unix(1600000000+rng.Int63n(100*24*3600), 0)
+		if iter%2 == 0 {
+			graphDate = graphDate.Truncate(time.Hour)
+		}
+		start, end := graphWindow(graphDate)
+		conds := randomGraphConditions(rng, start.Unix())
+
+		builder := newGraphDataPointsBuilder("uuid", nil)
+		for _, cond := range conds {
+			err := builder.add(cond.unix, cond.isSitting, []byte(cond.condition))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		res := buildIsuGraphResponse(graphDate, builder.finish())
+
+		if len(res) != graphWindowHours {
+			t.Fatalf("graphDate=%v: got %d buckets, want %d", graphDate, len(res), graphWindowHours)
+		}
+
+		// バケットは起点から1時間ずつ隙間なく並び，対象の範囲をちょうど覆う
+		for i, bucket := range res {
+			wantStart := start.Add(time.Duration(i) * time.Hour).Unix()
+			if bucket.StartAt != wantStart || bucket.EndAt != wantStart+3600 {
+				t.Fatalf("graphDate=%v bucket %d: got [%d, %d), want [%d, %d)", graphDate, i, bucket.StartAt, bucket.EndAt, wantStart, wantStart+3600)
+			}
+			if bucket.StartAt != time.Unix(bucket.StartAt, 0).Truncate(time.Hour).Unix() {
+				t.Fatalf("graphDate=%v bucket %d starts at %d, not on the hour", graphDate, i, bucket.StartAt)
+			}
+		}
+		if res[len(res)-1].EndAt != end.Unix() {
+			t.Fatalf("graphDate=%v: last bucket ends at %d, want %d", graphDate, res[len(res)-1].EndAt, end.Unix())
+		}
+
+		// 範囲内のコンディションはちょうど一度，自分の時刻を含むバケットで数えられる
+		seen := map[int64]int{}
+		for i, bucket := range res {
+			if (bucket.Data == nil) != (len(bucket.ConditionTimestamps) == 0) {
+				t.Fatalf("graphDate=%v bucket %d: data=%v with %d timestamps", graphDate, i, bucket.Data, len(bucket.ConditionTimestamps))
+			}
+			for _, unix := range bucket.ConditionTimestamps {
+				if unix < bucket.StartAt || bucket.EndAt <= unix {
+					t.Fatalf("graphDate=%v bucket %d [%d, %d) has timestamp %d", graphDate, i, bucket.StartAt, bucket.EndAt, unix)
+				}
+				seen[unix]++
+			}
+			if bucket.Data != nil {
+				checkGraphDataPoint(t, conds, bucket)
+			}
+		}
+		want := map[int64]int{}
+		for _, cond := range conds {
+			if start.Unix() <= cond.unix && cond.unix < end.Unix() {
+				want[cond.unix]++
+			}
+		}
+		if len(seen) != len(want) {
+			t.Fatalf("graphDate=%v: counted %d distinct timestamps, want %d", graphDate, len(seen), len(want))
+		}
+		for unix, n := range want {
+			if seen[unix] != n {
+				t.Fatalf("graphDate=%v: timestamp %d counted %d times, want %d", graphDate, unix, seen[unix], n)
+			}
+		}
+	}
+}
+
+// バケットの値を，そのバケットに入るコンディションから数え直したものと比べる
+func checkGraphDataPoint(t *testing.T, conds []graphTestCondition, bucket GraphResponse) {
+	t.Helper()
+	var hour graphHourAccumulator
+	infos := newGraphConditionInfos(nil)
+	for _, cond := range conds {
+		if bucket.StartAt <= cond.unix && cond.unix < bucket.EndAt {
+			info, err := infos.lookup(cond.condition)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hour.add(cond.isSitting, info)
+		}
+	}
+	if *bucket.Data != hour.dataPoint() {
+		t.Fatalf("bucket [%d, %d): got %+v, want %+v", bucket.StartAt, bucket.EndAt, *bucket.Data, hour.dataPoint())
+	}
+	p := bucket.Data.Percentage
+	for _, v := range []int{bucket.Data.Score, p.Sitting, p.IsBroken, p.IsOverweight, p.IsDirty} {
+		if v < 0 || 100 < v {
+			t.Fatalf("bucket [%d, %d): value %d out of 0-100 in %+v", bucket.StartAt, bucket.EndAt, v, *bucket.Data)
+		}
+	}
+}
+
+func TestEmptyIsuGraphResponseMatchesBuild(t *testing.T) {
+	graphDate := time.Unix(1600000000, 0).Truncate(time.Hour)
+	empty := emptyIsuGraphResponse(graphDate)
+	built := buildIsuGraphResponse(graphDate, []GraphDataPointWithInfo{})
+	if len(empty) != len(built) {
+		t.Fatalf("got %d buckets, want %d", len(empty), len(built))
+	}
+	for i := range empty {
+		if empty[i].StartAt != built[i].StartAt || empty[i].EndAt != built[i].EndAt || empty[i].Data != nil || len(empty[i].ConditionTimestamps) != 0 {
+			t.Fatalf("bucket %d: got %+v, want %+v", i, empty[i], built[i])
+		}
+	}
+}
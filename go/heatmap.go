@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	heatmapDefaultWeeks = 4
+	heatmapMaxWeeks     = 52
+)
+
+type GetIsuHeatmapResponse struct {
+	Weeks   int   `json:"weeks"`
+	StartAt int64 `json:"start_at"`
+	EndAt   int64 `json:"end_at"`
+	// [曜日(0: 月曜)][時(0-23)]のグラフと同じ計算のスコア．コンディションがない枠はnull
+	Scores [7][24]*int `json:"scores"`
+	Counts [7][24]int  `json:"counts"`
+}
+
+type heatmapRow struct {
+	Weekday   int    `db:"weekday"`
+	Hour      int    `db:"hour"`
+	Condition string `db:"condition"`
+	Count     int    `db:"count"`
+}
+
+// GET /api/isu/:jia_isu_uuid/heatmap?weeks=
+// 曜日×時間帯毎のコンディションのスコアを取得
+// 期間は最新のコンディションから遡ってweeks週分．曜日と時はDBの時刻(Asia/Tokyo)で数える
+func getIsuHeatmap(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	weeks, err := parsePositiveIntParam(c.QueryParam("weeks"), heatmapDefaultWeeks)
+	if err != nil || weeks > heatmapMaxWeeks {
+		return c.String(http.StatusBadRequest, "bad format: weeks")
+	}
+
+	allowed, err := authorizeIsu(jiaUserID, jiaIsuUUID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if !allowed {
+		return c.String(http.StatusNotFound, "not found: isu")
+	}
+
+	res := GetIsuHeatmapResponse{Weeks: weeks}
+	latest, err := isuConditionCache.Get(jiaIsuUUID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c.JSON(http.StatusOK, res)
+	}
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	endAt := latest.Timestamp.Add(time.Second)
+	startAt := endAt.Add(-time.Duration(weeks) * 7 * 24 * time.Hour)
+	res.StartAt = startAt.Unix()
+	res.EndAt = endAt.Unix()
+
+	settings, err := isuSettingsCache.Get(jiaIsuUUID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	// conditionの種類は8通りしかないので，conditionごとに数えてからレベルはアプリで決める(判定ルールの上書きに対応するため)
+	rows := []heatmapRow{}
+	err = getDB().Select(
+		&rows,
+		"SELECT WEEKDAY(`timestamp`) AS `weekday`, HOUR(`timestamp`) AS `hour`, `condition`, COUNT(*) AS `count`"+
+			"	FROM `isu_condition`"+isuConditionRangeHint()+" WHERE `jia_isu_uuid` = ? AND ? <= `timestamp` AND `timestamp` < ?"+
+			"	GROUP BY `weekday`, `hour`, `condition`",
+		jiaIsuUUID, startAt, endAt,
+	)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	rawScores := [7][24]int{}
+	for _, row := range rows {
+		level, err := calculateConditionLevel(row.Condition, settings)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		score := scoreConditionLevelInfo
+		switch level {
+		case conditionLevelCritical:
+			score = scoreConditionLevelCritical
+		case conditionLevelWarning:
+			score = scoreConditionLevelWarning
+		}
+		rawScores[row.Weekday][row.Hour] += score * row.Count
+		res.Counts[row.Weekday][row.Hour] += row.Count
+	}
+	for weekday := range res.Counts {
+		for hour, count := range res.Counts[weekday] {
+			if count == 0 {
+				continue
+			}
+			score := rawScores[weekday][hour] * 100 / 3 / count
+			res.Scores[weekday][hour] = &score
+		}
+	}
+	return c.JSON(http.StatusOK, res)
+}
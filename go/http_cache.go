@@ -0,0 +1,19 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// コンディション一覧をブラウザにキャッシュさせる秒数．短い間隔のポーリングをブラウザ側で吸収する(0なら付けない)
+var conditionsMaxAge = getEnvInt("CONDITIONS_MAX_AGE_SECONDS", 1)
+
+// Last-Modified/If-Modified-Sinceは使わない
+// 最新のコンディションの時刻は，遅れて届いたものや範囲外のものを反映しないので304の判定に使えない
+// flush毎の版数はキューを持つSRVNO=1のサーバーにしかなく，GETを受ける他のサーバーでは分からない
+func applyConditionCacheHeaders(c echo.Context) {
+	if conditionsMaxAge > 0 {
+		c.Response().Header().Set(echo.HeaderCacheControl, "private, max-age="+strconv.Itoa(conditionsMaxAge))
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const maxMessageCodeLength = 64
+
+// メッセージコード毎の翻訳
+// 未知のコードや対応していない言語は翻訳せず，元のmessageだけを返す
+var messageCatalog = map[string]map[string]string{
+	"ja": {
+		"ok":            "問題ありません",
+		"is_dirty":      "汚れています",
+		"is_overweight": "重量オーバーです",
+		"is_broken":     "壊れています",
+		"sitting":       "着席中です",
+	},
+	"en": {
+		"ok":            "No problems",
+		"is_dirty":      "Dirty",
+		"is_overweight": "Overweight",
+		"is_broken":     "Broken",
+		"sitting":       "Someone is sitting",
+	},
+}
+
+// Accept-Languageから対応している言語を選ぶ．対応する言語がなければ空文字列
+func negotiateLanguage(acceptLanguage string) string {
+	type candidate struct {
+		lang string
+		q    float64
+	}
+	candidates := []candidate{}
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		// "ja-JP"は"ja"として扱う
+		lang, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		if _, ok := messageCatalog[lang]; ok && q > 0 {
+			candidates = append(candidates, candidate{lang: lang, q: q})
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].q > candidates[j].q
+	})
+	return candidates[0].lang
+}
+
+// レスポンスのmessageはそのままに，翻訳をlocalized_messageに入れる
+func localizeConditions(conditions []*GetIsuConditionResponse, lang string) {
+	catalog, ok := messageCatalog[lang]
+	if !ok {
+		return
+	}
+	for _, cond := range conditions {
+		if cond.MessageCode == "" {
+			continue
+		}
+		if localized, ok := catalog[cond.MessageCode]; ok {
+			cond.LocalizedMessage = localized
+		}
+	}
+}
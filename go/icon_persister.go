@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+const iconPersistQueueSize = 1024
+
+// アイコンのBLOBがまだisuテーブルに書かれていない
+var errIconNotPersisted = errors.New("icon is not persisted yet")
+
+// 登録時のアイコンの書き込みをリクエストの外で行う
+// 書き終わるまではpendingに持ち，IconCacheはDBより先にここを見る
+// ICON_PERSIST_ASYNC=0 なら従来通り登録のトランザクションで書く
+type IconPersister struct {
+	enabled bool
+	queue   chan string
+	pending map[string][]byte
+	Lock    sync.Mutex
+}
+
+var iconPersister = &IconPersister{
+	enabled: getEnv("ICON_PERSIST_ASYNC", "1") == "1",
+	queue:   make(chan string, iconPersistQueueSize),
+	pending: make(map[string][]byte),
+}
+
+func (ip *IconPersister) Enabled() bool {
+	return ip.enabled
+}
+
+// キューが詰まっていればfalseを返すので，呼び出し側でその場で書く
+func (ip *IconPersister) Enqueue(jiaIsuUUID string, image []byte) bool {
+	ip.Lock.Lock()
+	ip.pending[jiaIsuUUID] = image
+	ip.Lock.Unlock()
+	select {
+	case ip.queue <- jiaIsuUUID:
+		return true
+	default:
+		ip.done(jiaIsuUUID)
+		return false
+	}
+}
+
+func (ip *IconPersister) Pending(jiaIsuUUID string) ([]byte, bool) {
+	ip.Lock.Lock()
+	defer ip.Lock.Unlock()
+	image, ok := ip.pending[jiaIsuUUID]
+	return image, ok
+}
+
+func (ip *IconPersister) done(jiaIsuUUID string) {
+	ip.Lock.Lock()
+	defer ip.Lock.Unlock()
+	delete(ip.pending, jiaIsuUUID)
+}
+
+// 止めるときはキューに残っているものを書き切ってから戻る
+func (ip *IconPersister) Run(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case jiaIsuUUID := <-ip.queue:
+					ip.persist(jiaIsuUUID)
+				default:
+					return nil
+				}
+			}
+		case jiaIsuUUID := <-ip.queue:
+			ip.persist(jiaIsuUUID)
+		}
+	}
+}
+
+func (ip *IconPersister) persist(jiaIsuUUID string) {
+	image, ok := ip.Pending(jiaIsuUUID)
+	if !ok {
+		return
+	}
+	err := persistIcon(jiaIsuUUID, image)
+	if err != nil {
+		// 書けなかったものはpendingに残してメモリから返し続け，整合性チェック(isu_without_image)で気付けるようにする
+		workerLogger.Error().Err(err).Str("jia_isu_uuid", jiaIsuUUID).Msg("failed to persist icon")
+		return
+	}
+	ip.done(jiaIsuUUID)
+}
+
+func persistIcon(jiaIsuUUID string, image []byte) error {
+	_, err := getDB().Exec("UPDATE `isu` SET `image` = ? WHERE `jia_isu_uuid` = ?", image, jiaIsuUUID)
+	return err
+}
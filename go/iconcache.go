@@ -0,0 +1,177 @@
+package main
+
+import (
+	"container/list"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type iconCacheEntry struct {
+	jiaIsuUUID string
+	image      []byte
+}
+
+// ISUのアイコンをメモリ(LRU，容量上限あり)とディスクの2段でキャッシュする
+// メモリから追い出されたものはディスクから読むので，isuテーブルのBLOBはプロセス中に高々1回しか読まない
+type IconCache struct {
+	dir       string
+	budget    int
+	usedBytes int
+	lru       *list.List
+	elements  map[string]*list.Element
+	onDisk    map[string]struct{}
+	Lock      sync.Mutex
+}
+
+func NewIconCache(dir string, budget int) (*IconCache, error) {
+	// 前回のプロセスのファイルは/initialize前のものかもしれないので捨てる
+	err := os.RemoveAll(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &IconCache{
+		dir:      dir,
+		budget:   budget,
+		lru:      list.New(),
+		elements: make(map[string]*list.Element),
+		onDisk:   make(map[string]struct{}),
+	}, nil
+}
+
+func (ic *IconCache) Get(jiaIsuUUID string) ([]byte, error) {
+	ic.Lock.Lock()
+	defer ic.Lock.Unlock()
+
+	if elem, ok := ic.elements[jiaIsuUUID]; ok {
+		ic.lru.MoveToFront(elem)
+		return elem.Value.(*iconCacheEntry).image, nil
+	}
+
+	if _, ok := ic.onDisk[jiaIsuUUID]; ok {
+		image, err := os.ReadFile(ic.path(jiaIsuUUID))
+		if err == nil {
+			ic.putMemory(jiaIsuUUID, image)
+			return image, nil
+		}
+		delete(ic.onDisk, jiaIsuUUID)
+	}
+
+	// 登録直後でまだDBに書けていないもの
+	if image, ok := iconPersister.Pending(jiaIsuUUID); ok {
+		ic.put(jiaIsuUUID, image)
+		return image, nil
+	}
+
+	var image []byte
+	err := getDB().Get(&image, "SELECT `image` FROM `isu` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, sql.ErrNoRows
+		}
+		return nil, err
+	}
+	// 別のサーバーで登録され，まだ書き込まれていない
+	if image == nil {
+		return nil, errIconNotPersisted
+	}
+	ic.put(jiaIsuUUID, image)
+	return image, nil
+}
+
+// ディスク上のアイコンのパスを返す(X-Accel-Redirect/X-Sendfile用)
+// ディスクに書けていない場合はfalseを返すので，呼び出し側はGetした中身を返せばよい
+func (ic *IconCache) DiskPath(jiaIsuUUID string) (string, bool) {
+	ic.Lock.Lock()
+	defer ic.Lock.Unlock()
+	_, ok := ic.onDisk[jiaIsuUUID]
+	if !ok {
+		return "", false
+	}
+	return ic.path(jiaIsuUUID), true
+}
+
+func (ic *IconCache) Set(jiaIsuUUID string, image []byte) {
+	ic.Lock.Lock()
+	defer ic.Lock.Unlock()
+	ic.remove(jiaIsuUUID)
+	ic.put(jiaIsuUUID, image)
+}
+
+func (ic *IconCache) Forget(jiaIsuUUID string) {
+	ic.Lock.Lock()
+	defer ic.Lock.Unlock()
+	ic.remove(jiaIsuUUID)
+}
+
+func (ic *IconCache) Reset() {
+	ic.Lock.Lock()
+	defer ic.Lock.Unlock()
+	for jiaIsuUUID := range ic.onDisk {
+		os.Remove(ic.path(jiaIsuUUID))
+	}
+	ic.lru.Init()
+	ic.elements = make(map[string]*list.Element)
+	ic.onDisk = make(map[string]struct{})
+	ic.usedBytes = 0
+}
+
+// メモリ上のアイコンを古いものからtargetBytes以下になるまで捨てる(ディスクには残る)
+func (ic *IconCache) ShrinkMemory(targetBytes int) int {
+	ic.Lock.Lock()
+	defer ic.Lock.Unlock()
+	freed := 0
+	for ic.usedBytes > targetBytes && ic.lru.Len() > 0 {
+		entry := ic.lru.Remove(ic.lru.Back()).(*iconCacheEntry)
+		delete(ic.elements, entry.jiaIsuUUID)
+		ic.usedBytes -= len(entry.image)
+		freed += len(entry.image)
+	}
+	return freed
+}
+
+func (ic *IconCache) path(jiaIsuUUID string) string {
+	return filepath.Join(ic.dir, filepath.Base(jiaIsuUUID))
+}
+
+func (ic *IconCache) put(jiaIsuUUID string, image []byte) {
+	err := os.WriteFile(ic.path(jiaIsuUUID), image, 0644)
+	if err != nil {
+		systemLogger.Warn().Err(err).Msg("failed to write icon to disk cache")
+	} else {
+		ic.onDisk[jiaIsuUUID] = struct{}{}
+	}
+	ic.putMemory(jiaIsuUUID, image)
+}
+
+func (ic *IconCache) putMemory(jiaIsuUUID string, image []byte) {
+	if len(image) > ic.budget {
+		return
+	}
+	ic.elements[jiaIsuUUID] = ic.lru.PushFront(&iconCacheEntry{jiaIsuUUID: jiaIsuUUID, image: image})
+	ic.usedBytes += len(image)
+	for ic.usedBytes > ic.budget {
+		oldest := ic.lru.Back()
+		entry := ic.lru.Remove(oldest).(*iconCacheEntry)
+		delete(ic.elements, entry.jiaIsuUUID)
+		ic.usedBytes -= len(entry.image)
+	}
+}
+
+func (ic *IconCache) remove(jiaIsuUUID string) {
+	if elem, ok := ic.elements[jiaIsuUUID]; ok {
+		entry := ic.lru.Remove(elem).(*iconCacheEntry)
+		delete(ic.elements, jiaIsuUUID)
+		ic.usedBytes -= len(entry.image)
+	}
+	if _, ok := ic.onDisk[jiaIsuUUID]; ok {
+		os.Remove(ic.path(jiaIsuUUID))
+		delete(ic.onDisk, jiaIsuUUID)
+	}
+}
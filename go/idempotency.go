@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	headerIdempotencyKey      = "Idempotency-Key"
+	headerIdempotencyReplayed = "Idempotent-Replayed"
+	maxIdempotencyKeyLength   = 255
+)
+
+// 同じIdempotency-Keyのリクエストに前回のレスポンスをそのまま返す期間
+var idempotencyTTL = time.Duration(getEnvInt("IDEMPOTENCY_TTL_SECONDS", 600)) * time.Second
+
+type idempotentResponse struct {
+	done        bool
+	status      int
+	contentType string
+	body        []byte
+	expiresAt   time.Time
+}
+
+// タイムアウト後にクライアントがリトライしても，登録を2回行わないようにするためのレスポンスのキャッシュ
+// キーはユーザー毎に分ける．プロセス内にだけ持つので，POSTを受けるサーバーが1台であることが前提
+type IdempotencyCache struct {
+	cache map[string]*idempotentResponse
+	Lock  sync.Mutex
+}
+
+var idempotencyCache = &IdempotencyCache{cache: make(map[string]*idempotentResponse)}
+
+// 初めてのキーなら処理中として登録してnilを，処理中か処理済みなら記録してあるものを返す
+func (ic *IdempotencyCache) Begin(key string) *idempotentResponse {
+	ic.Lock.Lock()
+	defer ic.Lock.Unlock()
+	now := time.Now()
+	if res, ok := ic.cache[key]; ok {
+		if !res.done || now.Before(res.expiresAt) {
+			return res
+		}
+	}
+	// 期限切れのものはここでまとめて捨てる
+	for k, res := range ic.cache {
+		if res.done && !now.Before(res.expiresAt) {
+			delete(ic.cache, k)
+		}
+	}
+	ic.cache[key] = &idempotentResponse{}
+	return nil
+}
+
+func (ic *IdempotencyCache) Finish(key string, status int, contentType string, body []byte) {
+	ic.Lock.Lock()
+	defer ic.Lock.Unlock()
+	ic.cache[key] = &idempotentResponse{
+		done:        true,
+		status:      status,
+		contentType: contentType,
+		body:        body,
+		expiresAt:   time.Now().Add(idempotencyTTL),
+	}
+}
+
+// 失敗したものは覚えず，リトライで処理し直せるようにする
+func (ic *IdempotencyCache) Abort(key string) {
+	ic.Lock.Lock()
+	defer ic.Lock.Unlock()
+	delete(ic.cache, key)
+}
+
+func (ic *IdempotencyCache) Reset() {
+	ic.Lock.Lock()
+	defer ic.Lock.Unlock()
+	ic.cache = make(map[string]*idempotentResponse)
+}
+
+type responseRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	rr.body.Write(b)
+	return rr.ResponseWriter.Write(b)
+}
+
+// Idempotency-Keyの付いたPOSTについて，5xx以外のレスポンスを覚えておいてリトライに返す
+// キーがなければ何もしない
+func idempotencyMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			idempotencyKey := c.Request().Header.Get(headerIdempotencyKey)
+			if idempotencyKey == "" {
+				return next(c)
+			}
+			if len(idempotencyKey) > maxIdempotencyKeyLength {
+				return c.String(http.StatusBadRequest, "bad format: "+headerIdempotencyKey)
+			}
+			// サインインしていなければハンドラに401を返させる
+			sess, err := session.Get(sessionName, c)
+			if err != nil {
+				return next(c)
+			}
+			jiaUserID, ok := sess.Values["jia_user_id"].(string)
+			if !ok {
+				return next(c)
+			}
+
+			key := jiaUserID + "\x00" + c.Request().Method + " " + c.Path() + "\x00" + idempotencyKey
+			if res := idempotencyCache.Begin(key); res != nil {
+				if !res.done {
+					return c.String(http.StatusConflict, "request with the same idempotency key is in progress")
+				}
+				c.Response().Header().Set(headerIdempotencyReplayed, "true")
+				return c.Blob(res.status, res.contentType, res.body)
+			}
+
+			recorder := &responseRecorder{ResponseWriter: c.Response().Writer}
+			c.Response().Writer = recorder
+			err = next(c)
+			status := c.Response().Status
+			if err != nil || status >= http.StatusInternalServerError {
+				idempotencyCache.Abort(key)
+				return err
+			}
+			idempotencyCache.Finish(key, status, c.Response().Header().Get(echo.HeaderContentType), recorder.body.Bytes())
+			return nil
+		}
+	}
+}
+
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
+
+// 要素毎に書き出すレスポンスもそのまま流す
+func (rr *responseRecorder) Flush() {
+	if f, ok := rr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
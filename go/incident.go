@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	eventTypeIncidentOpened   = "incident.opened"
+	eventTypeIncidentResolved = "incident.resolved"
+
+	incidentListLimit = 100
+)
+
+type Incident struct {
+	ID         int64        `db:"id"           json:"id"`
+	JIAIsuUUID string       `db:"jia_isu_uuid" json:"jia_isu_uuid"`
+	Level      string       `db:"level"        json:"level"`
+	StartedAt  time.Time    `db:"started_at"   json:"-"`
+	ResolvedAt sql.NullTime `db:"resolved_at"  json:"-"`
+}
+
+// 遷移を検知した時点ではまだ書き込んでいないので，イベントで送るものにはidがない
+type IncidentResponse struct {
+	ID         int64  `json:"id,omitempty"`
+	JIAIsuUUID string `json:"jia_isu_uuid"`
+	Level      string `json:"level"`
+	StartedAt  int64  `json:"started_at"`
+	ResolvedAt *int64 `json:"resolved_at"`
+}
+
+func (i Incident) Response() IncidentResponse {
+	res := IncidentResponse{
+		ID:         i.ID,
+		JIAIsuUUID: i.JIAIsuUUID,
+		Level:      i.Level,
+		StartedAt:  i.StartedAt.Unix(),
+	}
+	if i.ResolvedAt.Valid {
+		resolvedAt := i.ResolvedAt.Time.Unix()
+		res.ResolvedAt = &resolvedAt
+	}
+	return res
+}
+
+type incidentState struct {
+	timestamp time.Time
+	// 直近のコンディションのレベル．再起動やForgetの直後は分からないので空
+	level string
+	open  *Incident
+	// ミュート期間中に始まったインシデントは解決しても通知しない
+	silent bool
+}
+
+// 書き込み待ちのインシデントのキー．ISU毎にstarted_atは一意なので，idの代わりにこれで行を特定する
+type incidentKey struct {
+	jiaIsuUUID string
+	startedAt  int64
+}
+
+// ISU毎の直近の状態をメモリに持ち，レベルの遷移からインシデントを開閉する
+// 遷移の判定はflushの中でメモリだけで行い，DBへの書き込みはwriteScheduledがまとめて1文で行う
+type IncidentTracker struct {
+	states map[string]*incidentState
+	// 未解決のインシデントを一度読み込んだか
+	loaded bool
+	// Forgetされ，次に見たときにDBから読み直すISU -> Forgetされた順番(staleSeq)
+	// DBを読んでいる間にもう一度Forgetされたものは，読み終えても読み直す対象に残す
+	stale    map[string]uint64
+	staleSeq uint64
+	// 書き込み待ちのインシデントの最新の状態
+	pending map[incidentKey]Incident
+	Lock    sync.Mutex
+	// 書き込み中にReplaceや/initializeがDBを書き換えないようにする．Lockより先に取る
+	writeLock sync.Mutex
+}
+
+var incidentTracker = NewIncidentTracker()
+
+// 1文でupsertする行数の上限
+const incidentWriteBatchSize = 1000
+
+func NewIncidentTracker() *IncidentTracker {
+	return &IncidentTracker{
+		states:  make(map[string]*incidentState),
+		stale:   make(map[string]uint64),
+		pending: make(map[incidentKey]Incident),
+	}
+}
+
+// 書き込み待ちのものも捨てるので，DBを作り直す前に呼ぶ
+func (it *IncidentTracker) Reset() {
+	it.writeLock.Lock()
+	defer it.writeLock.Unlock()
+	it.Lock.Lock()
+	defer it.Lock.Unlock()
+	it.states = make(map[string]*incidentState)
+	it.loaded = false
+	it.stale = make(map[string]uint64)
+	it.pending = make(map[incidentKey]Incident)
+}
+
+func (it *IncidentTracker) Forget(jiaIsuUUID string) {
+	it.Lock.Lock()
+	defer it.Lock.Unlock()
+	it.forget(jiaIsuUUID)
+}
+
+// 最初の読み込みの最中でも，読み終えた後に読み直すよう覚えておく
+func (it *IncidentTracker) forget(jiaIsuUUID string) {
+	delete(it.states, jiaIsuUUID)
+	it.staleSeq++
+	it.stale[jiaIsuUUID] = it.staleSeq
+}
+
+// INSERTしたコンディションを時刻順に流してインシデントを更新する
+// 既に見た時刻より古いコンディションは遷移の判定には使わない
+// イベントの送信はISUの取得やEventHubのロックを伴うので，Lockを放してから行う
+func (it *IncidentTracker) Observe(conds []IsuCondition) error {
+	events, err := it.observe(conds)
+	for _, event := range events {
+		publishIsuEvent(event.eventType, event.jiaIsuUUID, event.data)
+	}
+	return err
+}
+
+// Lockを放した後に送るイベント
+type pendingIsuEvent struct {
+	eventType  string
+	jiaIsuUUID string
+	data       interface{}
+}
+
+// レベルが変わったときのイベントの中身
+type ConditionLevelChangedResponse struct {
+	JIAIsuUUID     string `json:"jia_isu_uuid"`
+	Timestamp      int64  `json:"timestamp"`
+	IsSitting      bool   `json:"is_sitting"`
+	Condition      string `json:"condition"`
+	ConditionLevel string `json:"condition_level"`
+	PreviousLevel  string `json:"previous_level"`
+	Message        string `json:"message"`
+}
+
+func (it *IncidentTracker) observe(conds []IsuCondition) ([]pendingIsuEvent, error) {
+	byIsu := map[string][]IsuCondition{}
+	for _, cond := range conds {
+		byIsu[cond.JIAIsuUUID] = append(byIsu[cond.JIAIsuUUID], cond)
+	}
+
+	// DBはLockを取らずに読む．Reset(/initializeなど)はflushLockを取るので，この間には割り込まない
+	err := it.load(byIsu)
+	if err != nil {
+		return nil, err
+	}
+	it.Lock.Lock()
+	defer it.Lock.Unlock()
+	events := []pendingIsuEvent{}
+	for jiaIsuUUID, isuConds := range byIsu {
+		sort.Slice(isuConds, func(i, j int) bool {
+			return isuConds[i].Timestamp.Before(isuConds[j].Timestamp)
+		})
+		state, ok := it.states[jiaIsuUUID]
+		if !ok {
+			state = &incidentState{}
+			it.states[jiaIsuUUID] = state
+		}
+		for _, cond := range isuConds {
+			if !cond.Timestamp.After(state.timestamp) {
+				continue
+			}
+			state.timestamp = cond.Timestamp
+			// 投稿毎ではなく，前のコンディションとレベルが変わったときだけ通知する
+			if state.level != "" && state.level != cond.Level && !cond.Muted {
+				events = append(events, pendingIsuEvent{
+					eventType:  eventTypeConditionLevelChanged,
+					jiaIsuUUID: cond.JIAIsuUUID,
+					data: ConditionLevelChangedResponse{
+						JIAIsuUUID:     cond.JIAIsuUUID,
+						Timestamp:      cond.Timestamp.Unix(),
+						IsSitting:      cond.IsSitting,
+						Condition:      cond.Condition,
+						ConditionLevel: cond.Level,
+						PreviousLevel:  state.level,
+						Message:        cond.Message,
+					},
+				})
+			}
+			state.level = cond.Level
+			events = it.transition(state, cond, events)
+		}
+	}
+	return events, nil
+}
+
+// 遷移の判定に使う未解決のインシデントを読む
+// 最初は全ISU分を1クエリで読み，以降はForgetされたISUのうちbyIsuにあるものだけを1クエリで読み直す
+// DBを読む間はLockを放し，読んだ結果を入れるときだけ取る
+func (it *IncidentTracker) load(byIsu map[string][]IsuCondition) error {
+	it.Lock.Lock()
+	full := !it.loaded
+	// 読み直すISU -> 読み始めた時点のstaleの値
+	targets := map[string]uint64{}
+	if !full {
+		for jiaIsuUUID := range byIsu {
+			if seq, ok := it.stale[jiaIsuUUID]; ok {
+				targets[jiaIsuUUID] = seq
+			}
+		}
+	}
+	staleSeq := it.staleSeq
+	it.Lock.Unlock()
+	if !full && len(targets) == 0 {
+		return nil
+	}
+
+	open := []Incident{}
+	if full {
+		err := getPriorityDB().Select(&open, "SELECT * FROM `isu_incident` WHERE `resolved_at` IS NULL ORDER BY `started_at`")
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+	} else {
+		jiaIsuUUIDs := make([]string, 0, len(targets))
+		for jiaIsuUUID := range targets {
+			jiaIsuUUIDs = append(jiaIsuUUIDs, jiaIsuUUID)
+		}
+		query, args, err := sqlx.In(
+			"SELECT * FROM `isu_incident` WHERE `jia_isu_uuid` IN (?) AND `resolved_at` IS NULL ORDER BY `started_at`",
+			jiaIsuUUIDs,
+		)
+		if err != nil {
+			return err
+		}
+		err = getPriorityDB().Select(&open, query, args...)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+	}
+
+	it.Lock.Lock()
+	defer it.Lock.Unlock()
+	if full {
+		it.states = make(map[string]*incidentState, len(open))
+		for i := range open {
+			it.states[open[i].JIAIsuUUID] = &incidentState{timestamp: open[i].StartedAt, open: &open[i]}
+		}
+		it.loaded = true
+		for jiaIsuUUID, seq := range it.stale {
+			if seq <= staleSeq {
+				delete(it.stale, jiaIsuUUID)
+			}
+		}
+		return nil
+	}
+
+	for jiaIsuUUID, seq := range targets {
+		it.states[jiaIsuUUID] = &incidentState{}
+		if it.stale[jiaIsuUUID] == seq {
+			delete(it.stale, jiaIsuUUID)
+		}
+	}
+	for i := range open {
+		it.states[open[i].JIAIsuUUID] = &incidentState{timestamp: open[i].StartedAt, open: &open[i]}
+	}
+	// まだ書き込んでいないものはDBより新しい
+	for _, incident := range it.pending {
+		state, ok := it.states[incident.JIAIsuUUID]
+		if _, target := targets[incident.JIAIsuUUID]; !ok || !target {
+			continue
+		}
+		if state.open != nil && !incident.StartedAt.After(state.open.StartedAt) {
+			continue
+		}
+		if incident.ResolvedAt.Valid {
+			if incident.ResolvedAt.Time.After(state.timestamp) {
+				state.open = nil
+				state.timestamp = incident.ResolvedAt.Time
+			}
+			continue
+		}
+		open := incident
+		state.open = &open
+		state.timestamp = incident.StartedAt
+	}
+	return nil
+}
+
+// criticalになったときに開き，critical以外に戻ったときに閉じる
+func (it *IncidentTracker) transition(state *incidentState, cond IsuCondition, events []pendingIsuEvent) []pendingIsuEvent {
+	critical := cond.Level == conditionLevelCritical
+	switch {
+	case state.open == nil && critical:
+		state.open = &Incident{JIAIsuUUID: cond.JIAIsuUUID, Level: cond.Level, StartedAt: cond.Timestamp}
+		state.silent = cond.Muted
+		it.enqueue(*state.open)
+		if !state.silent {
+			events = append(events, pendingIsuEvent{eventTypeIncidentOpened, cond.JIAIsuUUID, state.open.Response()})
+		}
+		reportCache.Forget(cond.JIAIsuUUID)
+
+	case state.open != nil && !critical:
+		state.open.ResolvedAt = sql.NullTime{Time: cond.Timestamp, Valid: true}
+		it.enqueue(*state.open)
+		if !state.silent {
+			events = append(events, pendingIsuEvent{eventTypeIncidentResolved, cond.JIAIsuUUID, state.open.Response()})
+		}
+		reportCache.Forget(cond.JIAIsuUUID)
+		state.open = nil
+	}
+	return events
+}
+
+func (it *IncidentTracker) enqueue(incident Incident) {
+	it.pending[incidentKey{jiaIsuUUID: incident.JIAIsuUUID, startedAt: incident.StartedAt.Unix()}] = incident
+}
+
+func (it *IncidentTracker) writeScheduled(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// 止める前に書き込み待ちのものを書き出す
+			err := it.Flush()
+			if err != nil {
+				workerLogger.Error().Err(err).Msg("failed to write incidents")
+			}
+			return
+		case <-ticker.C:
+			if dbSupervisor.Paused() {
+				continue
+			}
+			err := it.Flush()
+			if err != nil {
+				workerLogger.Error().Err(err).Msg("failed to write incidents")
+			}
+		}
+	}
+}
+
+// 書き込み待ちのインシデントを(jia_isu_uuid, started_at)のupsertでまとめて書く
+// 失敗したものは，その間に新しい状態が積まれていなければ次の回に書き直す
+func (it *IncidentTracker) Flush() error {
+	it.writeLock.Lock()
+	defer it.writeLock.Unlock()
+	it.Lock.Lock()
+	pending := it.pending
+	it.pending = make(map[incidentKey]Incident)
+	it.Lock.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	incidents := make([]Incident, 0, len(pending))
+	for _, incident := range pending {
+		incidents = append(incidents, incident)
+	}
+	var err error
+	for start := 0; start < len(incidents); start += incidentWriteBatchSize {
+		end := min(start+incidentWriteBatchSize, len(incidents))
+		_, err = getPriorityDB().NamedExec(
+			"INSERT INTO `isu_incident` (`jia_isu_uuid`, `level`, `started_at`, `resolved_at`)"+
+				" VALUES (:jia_isu_uuid, :level, :started_at, :resolved_at)"+
+				" ON DUPLICATE KEY UPDATE `level` = VALUES(`level`), `resolved_at` = VALUES(`resolved_at`)",
+			incidents[start:end],
+		)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		return nil
+	}
+
+	it.Lock.Lock()
+	defer it.Lock.Unlock()
+	for key, incident := range pending {
+		if _, ok := it.pending[key]; !ok {
+			it.pending[key] = incident
+		}
+	}
+	return fmt.Errorf("db error: %v", err)
+}
+
+func publishIsuEvent(eventType string, jiaIsuUUID string, data interface{}) {
+	isu, err := isuCache.Get(jiaIsuUUID)
+	if err != nil {
+		workerLogger.Warn().Err(err).Str("jia_isu_uuid", jiaIsuUUID).Str("type", eventType).Msg("failed to get isu for event")
+		return
+	}
+	publishEvent(IsuEvent{
+		Type:       eventType,
+		Timestamp:  time.Now().Unix(),
+		JIAUserID:  isu.JIAUserID,
+		JIAIsuUUID: jiaIsuUUID,
+		Data:       data,
+	})
+}
+
+// GET /api/isu/:jia_isu_uuid/incidents
+// ISUのインシデントを新しい順に取得
+func getIsuIncidents(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	allowed, err := authorizeIsu(jiaUserID, jiaIsuUUID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if !allowed {
+		return c.String(http.StatusNotFound, "not found: isu")
+	}
+
+	incidents := []Incident{}
+	err = getDB().Select(
+		&incidents,
+		"SELECT * FROM `isu_incident` WHERE `jia_isu_uuid` = ? ORDER BY `started_at` DESC LIMIT ?",
+		jiaIsuUUID, incidentListLimit,
+	)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res := make([]IncidentResponse, 0, len(incidents))
+	for _, incident := range incidents {
+		res = append(res, incident.Response())
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+type userIncident struct {
+	Incident
+	IsuName string `db:"isu_name"`
+}
+
+type UserIncidentResponse struct {
+	IncidentResponse
+	IsuName string `json:"isu_name"`
+}
+
+// GET /api/incidents?open=true
+// 自分のすべてのISUのインシデントを新しい順に取得．open=trueなら未解決のものだけ
+func getIncidents(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	query := "SELECT `i`.*, `isu`.`name` AS `isu_name` FROM `isu_incident` `i`" +
+		" JOIN `isu` ON `isu`.`jia_isu_uuid` = `i`.`jia_isu_uuid`" +
+		" WHERE `isu`.`jia_user_id` = ?"
+	if c.QueryParam("open") == "true" {
+		query += " AND `i`.`resolved_at` IS NULL"
+	}
+	query += " ORDER BY `i`.`started_at` DESC LIMIT ?"
+
+	incidents := []userIncident{}
+	err = getDB().Select(&incidents, query, jiaUserID, incidentListLimit)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res := make([]UserIncidentResponse, 0, len(incidents))
+	for _, incident := range incidents {
+		res = append(res, UserIncidentResponse{IncidentResponse: incident.Response(), IsuName: incident.IsuName})
+	}
+	return c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const indexBuildProgressInterval = 2 * time.Second
+
+// 初期データを入れた後に張るインデックス
+// 空のテーブルに張ってからINSERTするより，入れ終わってからまとめて作る方が速い
+type RequiredIndex struct {
+	Table   string
+	Name    string
+	Columns []string
+}
+
+var requiredIndexes = []RequiredIndex{
+	{Table: "isu_condition", Name: "idx_isu_level_timestamp", Columns: []string{"jia_isu_uuid", "level", "timestamp"}},
+	{Table: "isu_condition", Name: "idx_isu_sequence", Columns: []string{"jia_isu_uuid", "sequence"}},
+}
+
+// SKIP_INDEX_BUILD=1 なら確認も作成もしない(手で張る場合など)
+var skipIndexBuild = getEnv("SKIP_INDEX_BUILD", "0") == "1"
+
+func ensureIndexes(ctx context.Context) error {
+	if skipIndexBuild {
+		systemLogger.Info().Msg("index build skipped")
+		return nil
+	}
+	for _, index := range requiredIndexes {
+		var count int
+		err := getDB().GetContext(
+			ctx,
+			&count,
+			"SELECT COUNT(*) FROM `information_schema`.`STATISTICS` WHERE `TABLE_SCHEMA` = DATABASE() AND `TABLE_NAME` = ? AND `INDEX_NAME` = ?",
+			index.Table, index.Name,
+		)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		if count > 0 {
+			confirmedIndexes.Add(index.Name)
+			continue
+		}
+		err = buildIndex(ctx, index)
+		if err != nil {
+			return fmt.Errorf("build %v.%v: %w", index.Table, index.Name, err)
+		}
+		confirmedIndexes.Add(index.Name)
+	}
+	return nil
+}
+
+// 読み書きを止めないようINPLACEで作る．生成列を含むなどでINPLACEにできない場合は，DBに方法を任せて作り直す
+func buildIndex(ctx context.Context, index RequiredIndex) error {
+	columns := "`" + strings.Join(index.Columns, "`, `") + "`"
+	stmt := fmt.Sprintf("ALTER TABLE `%v` ADD INDEX `%v` (%v)", index.Table, index.Name, columns)
+
+	start := time.Now()
+	systemLogger.Info().Str("table", index.Table).Str("index", index.Name).Msg("building index")
+	progressCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	go logIndexBuildProgress(progressCtx, index)
+
+	_, err := getDB().ExecContext(ctx, stmt+", ALGORITHM=INPLACE, LOCK=NONE")
+	if err != nil {
+		systemLogger.Warn().Err(err).Str("index", index.Name).Msg("online index build is not supported: falling back")
+		_, err = getDB().ExecContext(ctx, stmt)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+	}
+	systemLogger.Info().
+		Str("table", index.Table).
+		Str("index", index.Name).
+		Dur("elapsed", time.Since(start)).
+		Msg("index built")
+	return nil
+}
+
+// MariaDBはALTER TABLEの進み具合をPROCESSLISTのPROGRESS(%)に出すので，それをログに流す
+// 取れないDBでは何も出さない
+func logIndexBuildProgress(ctx context.Context, index RequiredIndex) {
+	ticker := time.NewTicker(indexBuildProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			var progress float64
+			err := getDB().GetContext(
+				ctx,
+				&progress,
+				"SELECT `PROGRESS` FROM `information_schema`.`PROCESSLIST` WHERE `INFO` LIKE ? LIMIT 1",
+				"ALTER TABLE `"+index.Table+"` ADD INDEX `"+index.Name+"`%",
+			)
+			if err != nil {
+				continue
+			}
+			systemLogger.Info().Str("index", index.Name).Float64("progress", progress).Msg("building index")
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const headerIngestLag = "X-Ingest-Lag"
+
+var (
+	// 書き込みの遅れがこれを超えたら，受け付けはするがRetry-Afterで次の送信を遅らせるよう伝える
+	ingestLagSoftLimit = time.Duration(getEnvInt("INGEST_LAG_SOFT_LIMIT_MS", 1000)) * time.Millisecond
+	// これを超えたら受け付けずに503を返す(0なら返さない)
+	ingestLagHardLimit = time.Duration(getEnvInt("INGEST_LAG_HARD_LIMIT_MS", 10000)) * time.Millisecond
+)
+
+// 現在の書き込みの遅れをヘッダーで返す．受け付けてよければtrue
+// 503のときのRetry-Afterには遅れと同じだけの幅で揺らぎを足し，ISUの再送が一度に戻ってこないようにする
+func applyIngestBackpressure(c echo.Context) bool {
+	lag := insertQueue.Lag()
+	header := c.Response().Header()
+	header.Set(headerIngestLag, strconv.FormatInt(lag.Milliseconds(), 10))
+
+	retryAfter := int(math.Ceil(lag.Seconds()))
+	if ingestLagHardLimit > 0 && lag > ingestLagHardLimit {
+		header.Set(echo.HeaderRetryAfter, strconv.Itoa(retryAfter+rand.Intn(retryAfter+1)))
+		return false
+	}
+	if lag > ingestLagSoftLimit {
+		header.Set(echo.HeaderRetryAfter, strconv.Itoa(retryAfter))
+	}
+	return true
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func FuzzValidConditionFormat(f *testing.F) {
+	f.Add("is_dirty=true,is_overweight=false,is_broken=true")
+	f.Add("is_dirty=false,is_overweight=false,is_broken=false")
+	f.Add("is_dirty=true,is_overweight=true,is_broken=true,")
+	f.Add("is_dirty=true,is_overweight=true")
+	f.Add("is_dirty=")
+	f.Add("is_dirty=true")
+	f.Add("")
+
+	f.Fuzz(func(t *testing.T, condition string) {
+		if !isValidConditionFormat(condition) {
+			return
+		}
+		// 通ったものは3つのキーがこの順で並び，値はtrueかfalseだけ
+		parts := strings.Split(condition, ",")
+		if len(parts) != 3 {
+			t.Fatalf("accepted %q with %d fields", condition, len(parts))
+		}
+		for i, key := range []string{"is_dirty", "is_overweight", "is_broken"} {
+			value, ok := strings.CutPrefix(parts[i], key+"=")
+			if !ok || (value != "true" && value != "false") {
+				t.Fatalf("accepted %q with field %q", condition, parts[i])
+			}
+		}
+		_, err := calculateConditionLevel(condition, nil)
+		if err != nil {
+			t.Fatalf("accepted %q but level failed: %v", condition, err)
+		}
+	})
+}
+
+func FuzzConditionLevel(f *testing.F) {
+	f.Add("is_dirty=false,is_overweight=false,is_broken=false")
+	f.Add("is_dirty=true,is_overweight=false,is_broken=false")
+	f.Add("is_dirty=true,is_overweight=true,is_broken=true")
+	f.Add("=true=true=true=true")
+	f.Add("")
+
+	f.Fuzz(func(t *testing.T, condition string) {
+		level, err := calculateConditionLevel(condition, nil)
+		warnCount := strings.Count(condition, "=true")
+		switch {
+		case warnCount == 0:
+			if err != nil || level != conditionLevelInfo {
+				t.Fatalf("%q: got (%q, %v), want info", condition, level, err)
+			}
+		case warnCount <= 2:
+			if err != nil || level != conditionLevelWarning {
+				t.Fatalf("%q: got (%q, %v), want warning", condition, level, err)
+			}
+		case warnCount == 3:
+			if err != nil || level != conditionLevelCritical {
+				t.Fatalf("%q: got (%q, %v), want critical", condition, level, err)
+			}
+		default:
+			if err == nil {
+				t.Fatalf("%q: got %q, want error", condition, level)
+			}
+		}
+	})
+}
+
+// kindでjia_user_idの型を変える．0:文字列 1:数値 2:なし 3:null 4:配列
+func FuzzJiaUserIDFromClaims(f *testing.F) {
+	f.Add(uint8(0), "isucon")
+	f.Add(uint8(0), "")
+	f.Add(uint8(0), strings.Repeat("あ", jiaUserIDMaxLength+1))
+	f.Add(uint8(0), "\xff\xfe")
+	f.Add(uint8(1), "1")
+	f.Add(uint8(2), "")
+	f.Add(uint8(3), "")
+	f.Add(uint8(4), "isucon")
+
+	f.Fuzz(func(t *testing.T, kind uint8, value string) {
+		claims := jwt.MapClaims{}
+		switch kind % 5 {
+		case 0:
+			claims["jia_user_id"] = value
+		case 1:
+			claims["jia_user_id"] = float64(len(value))
+		case 3:
+			claims["jia_user_id"] = nil
+		case 4:
+			claims["jia_user_id"] = []interface{}{value}
+		}
+
+		jiaUserID, err := jiaUserIDFromClaims(claims)
+		if err != nil {
+			return
+		}
+		if kind%5 != 0 {
+			t.Fatalf("accepted non-string claim %#v", claims["jia_user_id"])
+		}
+		if jiaUserID != value {
+			t.Fatalf("got %q, want %q", jiaUserID, value)
+		}
+		if jiaUserID == "" || !utf8.ValidString(jiaUserID) || utf8.RuneCountInString(jiaUserID) > jiaUserIDMaxLength {
+			t.Fatalf("accepted invalid jia_user_id %q", jiaUserID)
+		}
+	})
+}
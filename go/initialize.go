@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync"
+)
+
+// 実行中の/initializeの結果．後から来た呼び出しはdoneを待って同じ結果を返す
+type initializeRun struct {
+	done   chan struct{}
+	status int
+}
+
+// ベンチマーカーがタイムアウトして/initializeを呼び直しても，init.shを重ねて流さない
+type InitializeGuard struct {
+	running *initializeRun
+	Lock    sync.Mutex
+}
+
+var initializeGuard = &InitializeGuard{}
+
+// 実行中のものがあればその結果を待ち，なければfnを実行する
+// 終わった後に来た呼び出しは，新しく実行し直す
+func (ig *InitializeGuard) Do(fn func() int) int {
+	ig.Lock.Lock()
+	if run := ig.running; run != nil {
+		ig.Lock.Unlock()
+		<-run.done
+		return run.status
+	}
+	run := &initializeRun{done: make(chan struct{})}
+	ig.running = run
+	ig.Lock.Unlock()
+
+	defer func() {
+		ig.Lock.Lock()
+		ig.running = nil
+		ig.Lock.Unlock()
+		close(run.done)
+	}()
+	run.status = fn()
+	return run.status
+}
+
+// 書き込み待ちのコンディションとインシデントは作り直す前のDBに対するものなので捨てる
+// 呼び出し側はflushLockを取り，DBを作り直し終わるまで書き出しを止めておく
+func discardInsertQueue() {
+	discarded := insertQueue.PopAll()
+	insertQueue.Done()
+	// 書き込み待ちのインシデントも同じく捨て，書き込み中のものは終わるのを待つ
+	incidentTracker.Reset()
+	if len(discarded) > 0 {
+		systemLogger.Info().Int("conditions", len(discarded)).Msg("discarded queued conditions on reset")
+	}
+}
+
+// DBを作り直したときに，メモリ上に残っている古い状態をすべて捨てる
+func resetInMemoryState() {
+	isuCache.Reset()
+	userCache.Reset()
+	isuConditionCache.Reset()
+	configCache.Reset()
+	iconCache.Reset()
+	metrics.Reset()
+	usageStats.Reset()
+	shedStats.Reset()
+	eventHub.Reset()
+	incidentTracker.Reset()
+	reportCache.Reset()
+	isuSettingsCache.Reset()
+	muteCache.Reset()
+	userIsuListCache.Reset()
+	userTrendCache.Reset()
+	idempotencyCache.Reset()
+	routeCache.Reset()
+	graphEmptyCache.Reset()
+	isuAuthCache.Reset()
+	characterMembership.Reset()
+	levelSelectivity.Reset()
+	// 次の計算(SRVNO=1)か配布までは空のトレンドを返す
+	trendCache.Set([]TrendResponse{})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/goccy/go-json"
+
+	"github.com/labstack/echo/v4"
+)
+
+const integritySampleLimit = 10
+
+var checkIntegrityFlag = flag.Bool("check-integrity", false, "check database integrity, print the report and exit")
+
+type integrityCheck struct {
+	name        string
+	countQuery  string
+	sampleQuery string
+}
+
+// 各チェックは「問題のある行」を数えるクエリと，その例を返すクエリの組
+var integrityChecks = []integrityCheck{
+	{
+		name:        "orphan_isu_condition",
+		countQuery:  "SELECT COUNT(DISTINCT `c`.`jia_isu_uuid`) FROM `isu_condition` `c` LEFT JOIN `isu` `i` ON `c`.`jia_isu_uuid` = `i`.`jia_isu_uuid` WHERE `i`.`id` IS NULL",
+		sampleQuery: "SELECT DISTINCT `c`.`jia_isu_uuid` FROM `isu_condition` `c` LEFT JOIN `isu` `i` ON `c`.`jia_isu_uuid` = `i`.`jia_isu_uuid` WHERE `i`.`id` IS NULL LIMIT ?",
+	},
+	{
+		name:        "isu_without_user",
+		countQuery:  "SELECT COUNT(*) FROM `isu` `i` LEFT JOIN `user` `u` ON `i`.`jia_user_id` = `u`.`jia_user_id` WHERE `u`.`jia_user_id` IS NULL",
+		sampleQuery: "SELECT `i`.`jia_isu_uuid` FROM `isu` `i` LEFT JOIN `user` `u` ON `i`.`jia_user_id` = `u`.`jia_user_id` WHERE `u`.`jia_user_id` IS NULL LIMIT ?",
+	},
+	{
+		name:        "isu_without_character",
+		countQuery:  "SELECT COUNT(*) FROM `isu` WHERE `character` IS NULL OR `character` = ''",
+		sampleQuery: "SELECT `jia_isu_uuid` FROM `isu` WHERE `character` IS NULL OR `character` = '' LIMIT ?",
+	},
+	{
+		name:        "isu_without_image",
+		countQuery:  "SELECT COUNT(*) FROM `isu` WHERE `image` IS NULL",
+		sampleQuery: "SELECT `jia_isu_uuid` FROM `isu` WHERE `image` IS NULL LIMIT ?",
+	},
+	{
+		name:        "invalid_condition_format",
+		countQuery:  "SELECT COUNT(*) FROM `isu_condition` WHERE `condition` NOT REGEXP '^is_dirty=(true|false),is_overweight=(true|false),is_broken=(true|false)$'",
+		sampleQuery: "SELECT CONCAT(`jia_isu_uuid`, '@', `timestamp`) FROM `isu_condition` WHERE `condition` NOT REGEXP '^is_dirty=(true|false),is_overweight=(true|false),is_broken=(true|false)$' LIMIT ?",
+	},
+	{
+		name:        "missing_jia_service_url",
+		countQuery:  "SELECT 1 - COUNT(*) FROM `isu_association_config` WHERE `name` = 'jia_service_url'",
+		sampleQuery: "SELECT 'jia_service_url' FROM DUAL WHERE NOT EXISTS (SELECT 1 FROM `isu_association_config` WHERE `name` = 'jia_service_url') LIMIT ?",
+	},
+}
+
+type IntegrityIssue struct {
+	Check   string   `json:"check"`
+	Count   int      `json:"count"`
+	Samples []string `json:"samples"`
+}
+
+type IntegrityReport struct {
+	OK        bool             `json:"ok"`
+	CheckedAt time.Time        `json:"checked_at"`
+	Elapsed   string           `json:"elapsed"`
+	Issues    []IntegrityIssue `json:"issues"`
+}
+
+// DBの整合性を検査する
+func checkIntegrity() (IntegrityReport, error) {
+	start := time.Now()
+	report := IntegrityReport{
+		OK:        true,
+		CheckedAt: start,
+		Issues:    []IntegrityIssue{},
+	}
+	for _, check := range integrityChecks {
+		var count int
+		err := getDB().Get(&count, check.countQuery)
+		if err != nil {
+			return report, fmt.Errorf("%v: db error: %v", check.name, err)
+		}
+		if count == 0 {
+			continue
+		}
+		samples := []string{}
+		err = getDB().Select(&samples, check.sampleQuery, integritySampleLimit)
+		if err != nil {
+			return report, fmt.Errorf("%v: db error: %v", check.name, err)
+		}
+		report.OK = false
+		report.Issues = append(report.Issues, IntegrityIssue{
+			Check:   check.name,
+			Count:   count,
+			Samples: samples,
+		})
+	}
+	report.Elapsed = time.Since(start).String()
+	return report, nil
+}
+
+// GET /internal/integrity
+// DBの整合性を検査した結果を取得
+func getIntegrity(c echo.Context) error {
+	report, err := checkIntegrity()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, report)
+}
+
+// ./isucondition -check-integrity
+// サーバーを起動せずに検査だけ行う．問題があれば終了コード1を返す
+func runIntegrityCLI() int {
+	conn := NewMySQLConnectionEnv()
+	currentMySQLConnectionData.Store(conn)
+	newDB, err := conn.ConnectDB()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to connect db: %v\n", err)
+		return 2
+	}
+	currentDB.Store(newDB)
+	defer newDB.Close()
+
+	report, err := checkIntegrity()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(report)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if !report.OK {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,34 @@
+// Package timeutil はグラフなどで使う時間のバケット分けを，UNIX秒の整数演算で行う
+//
+// バケットはすべてUTC基準の絶対時間で切る．time.Truncateと同じく時差やロケーションは見ないので，
+// 夏時間の切り替えがあっても1時間のバケットが0時間や2時間になることはない．
+// そのかわり「1日」は暦の日付ではなく，起点から24時間(24バケット)を指す．
+// 時差が1時間の倍数でないロケーション(+05:30など)では，バケットの境界は現地時刻の正時にならない．
+package timeutil
+
+import "time"
+
+const secondsPerHour = int64(time.Hour / time.Second)
+
+// UNIX秒が何番目の1時間に入るか(1970-01-01T00:00:00Zからの時間数，負の時刻は切り下げ)
+func HourIndex(unix int64) int64 {
+	return floorDiv(unix, secondsPerHour)
+}
+
+// 1時間のバケットの始まりのUNIX秒
+func HourStart(hourIndex int64) int64 {
+	return hourIndex * secondsPerHour
+}
+
+// UNIX秒をその1時間の始まりに切り下げる(time.Truncate(time.Hour)と同じ結果)
+func TruncateHour(unix int64) int64 {
+	return HourStart(HourIndex(unix))
+}
+
+func floorDiv(a int64, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
@@ -0,0 +1,89 @@
+package timeutil
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestTruncateHour(t *testing.T) {
+	tokyo := mustLoadLocation(t, "Asia/Tokyo")
+	newYork := mustLoadLocation(t, "America/New_York")
+
+	tests := []struct {
+		name string
+		in   time.Time
+		want string // バケットの始まりを入力と同じロケーションで表したもの
+	}{
+		{"tokyo/start of day", time.Date(2024, 1, 1, 0, 0, 0, 0, tokyo), "2024-01-01T00:00:00+09:00"},
+		{"tokyo/end of day", time.Date(2024, 1, 1, 23, 59, 59, 0, tokyo), "2024-01-01T23:00:00+09:00"},
+		{"tokyo/one second before hour", time.Date(2024, 1, 1, 8, 59, 59, 0, tokyo), "2024-01-01T08:00:00+09:00"},
+		{"tokyo/utc midnight", time.Date(2024, 1, 1, 9, 0, 0, 0, tokyo), "2024-01-01T09:00:00+09:00"},
+		{"tokyo/before epoch", time.Date(1969, 12, 31, 23, 30, 0, 0, tokyo), "1969-12-31T23:00:00+09:00"},
+
+		// 2024-03-10 02:00 ESTに03:00 EDTへ進む
+		{"new york/before spring forward", time.Date(2024, 3, 10, 1, 59, 59, 0, newYork), "2024-03-10T01:00:00-05:00"},
+		{"new york/after spring forward", time.Date(2024, 3, 10, 3, 0, 0, 0, newYork), "2024-03-10T03:00:00-04:00"},
+		{"new york/hour after spring forward", time.Date(2024, 3, 10, 3, 30, 0, 0, newYork), "2024-03-10T03:00:00-04:00"},
+
+		// 2024-11-03 02:00 EDTに01:00 ESTへ戻る．01時台は2回ある
+		{"new york/first 1am", time.Date(2024, 11, 3, 5, 30, 0, 0, time.UTC).In(newYork), "2024-11-03T01:00:00-04:00"},
+		{"new york/second 1am", time.Date(2024, 11, 3, 6, 30, 0, 0, time.UTC).In(newYork), "2024-11-03T01:00:00-05:00"},
+		{"new york/after fall back", time.Date(2024, 11, 3, 2, 0, 0, 0, newYork), "2024-11-03T02:00:00-05:00"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := TruncateHour(tt.in.Unix())
+			if want := tt.in.Truncate(time.Hour).Unix(); got != want {
+				t.Fatalf("TruncateHour(%v) = %d, time.Truncate = %d", tt.in, got, want)
+			}
+			if s := time.Unix(got, 0).In(tt.in.Location()).Format(time.RFC3339); s != tt.want {
+				t.Fatalf("TruncateHour(%v) = %v, want %v", tt.in, s, tt.want)
+			}
+		})
+	}
+}
+
+// 夏時間の切り替えがある日も，1時間のバケットはすべて3600秒で，現地の1日は23個か25個になる
+func TestHourIndexAcrossDST(t *testing.T) {
+	newYork := mustLoadLocation(t, "America/New_York")
+
+	tests := []struct {
+		name string
+		day  time.Time
+		want int64
+	}{
+		{"spring forward", time.Date(2024, 3, 10, 0, 0, 0, 0, newYork), 23},
+		{"fall back", time.Date(2024, 11, 3, 0, 0, 0, 0, newYork), 25},
+		{"normal day", time.Date(2024, 6, 1, 0, 0, 0, 0, newYork), 24},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := tt.day.Unix()
+			end := tt.day.AddDate(0, 0, 1).Unix()
+			if n := HourIndex(end) - HourIndex(start); n != tt.want {
+				t.Fatalf("got %d buckets, want %d", n, tt.want)
+			}
+			for idx := HourIndex(start); idx < HourIndex(end); idx++ {
+				ts := HourStart(idx)
+				if want := time.Unix(ts, 0).Truncate(time.Hour).Unix(); ts != want {
+					t.Fatalf("bucket %d starts at %d, time.Truncate = %d", idx, ts, want)
+				}
+				if HourStart(idx+1)-ts != secondsPerHour {
+					t.Fatalf("bucket %d is not one hour long", idx)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+)
+
+type isuAuthEntry struct {
+	allowed   bool
+	expiresAt time.Time
+}
+
+// (ユーザー, ISU)毎に，そのユーザーがISUを見てよいか
+// ISU毎のユーザー向けAPIはすべてauthorizeIsuを通すので，共有などで見てよい人が増える場合もここだけ変えればよい
+type IsuAuthCache struct {
+	// jia_isu_uuid -> jia_user_id -> 結果
+	cache map[string]map[string]isuAuthEntry
+	Lock  sync.Mutex
+}
+
+var isuAuthCache = &IsuAuthCache{cache: make(map[string]map[string]isuAuthEntry)}
+
+func (ac *IsuAuthCache) Get(jiaUserID string, jiaIsuUUID string) (bool, bool) {
+	ac.Lock.Lock()
+	defer ac.Lock.Unlock()
+	entry, ok := ac.cache[jiaIsuUUID][jiaUserID]
+	if !ok || cacheExpired(entry.expiresAt) {
+		return false, false
+	}
+	return entry.allowed, true
+}
+
+func (ac *IsuAuthCache) Set(jiaUserID string, jiaIsuUUID string, allowed bool) {
+	ac.Lock.Lock()
+	defer ac.Lock.Unlock()
+	users, ok := ac.cache[jiaIsuUUID]
+	if !ok {
+		users = make(map[string]isuAuthEntry)
+		ac.cache[jiaIsuUUID] = users
+	}
+	users[jiaUserID] = isuAuthEntry{allowed: allowed, expiresAt: cacheExpiresAt()}
+}
+
+// ISUの登録・削除や持ち主の変更のときに呼ぶ
+func (ac *IsuAuthCache) Forget(jiaIsuUUID string) {
+	ac.Lock.Lock()
+	defer ac.Lock.Unlock()
+	delete(ac.cache, jiaIsuUUID)
+}
+
+func (ac *IsuAuthCache) Reset() {
+	ac.Lock.Lock()
+	defer ac.Lock.Unlock()
+	ac.cache = make(map[string]map[string]isuAuthEntry)
+}
+
+// ユーザーがISUを見てよいか．存在しないISUもfalse(404)にする
+// 存在しないISUはこの後に登録されることがあるので，結果を覚えない
+func authorizeIsu(jiaUserID string, jiaIsuUUID string) (bool, error) {
+	if allowed, ok := isuAuthCache.Get(jiaUserID, jiaIsuUUID); ok {
+		return allowed, nil
+	}
+	isu, err := isuCache.Get(jiaIsuUUID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	allowed := isu.JIAUserID == jiaUserID
+	isuAuthCache.Set(jiaUserID, jiaIsuUUID, allowed)
+	return allowed, nil
+}
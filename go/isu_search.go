@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// GETとPOSTでサーバーが分かれているので，登録直後のISUが検索に出ない時間を短くするためTTLは短く固定する
+const userIsuListCacheTTL = time.Second
+
+var isuNameUnique = getEnv("ISU_NAME_UNIQUE", "0") == "1"
+
+type userIsuListCacheEntry struct {
+	isuList   []IsuMeta
+	expiresAt time.Time
+}
+
+// ユーザー毎のISUの一覧(id降順)
+type UserIsuListCache struct {
+	cache map[string]userIsuListCacheEntry
+	Lock  sync.Mutex
+}
+
+var userIsuListCache = &UserIsuListCache{cache: make(map[string]userIsuListCacheEntry)}
+
+func (uc *UserIsuListCache) Get(jiaUserID string) ([]IsuMeta, error) {
+	uc.Lock.Lock()
+	entry, ok := uc.cache[jiaUserID]
+	uc.Lock.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.isuList, nil
+	}
+
+	isuList := []IsuMeta{}
+	err := getDB().Select(
+		&isuList,
+		"SELECT `id`, `jia_isu_uuid`, `name`, `character` FROM `isu` WHERE `jia_user_id` = ? ORDER BY `id` DESC",
+		jiaUserID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	uc.Set(jiaUserID, isuList)
+	return isuList, nil
+}
+
+func (uc *UserIsuListCache) Set(jiaUserID string, isuList []IsuMeta) {
+	uc.Lock.Lock()
+	defer uc.Lock.Unlock()
+	uc.cache[jiaUserID] = userIsuListCacheEntry{isuList: isuList, expiresAt: time.Now().Add(userIsuListCacheTTL)}
+}
+
+func (uc *UserIsuListCache) Forget(jiaUserID string) {
+	uc.Lock.Lock()
+	defer uc.Lock.Unlock()
+	delete(uc.cache, jiaUserID)
+}
+
+func (uc *UserIsuListCache) Reset() {
+	uc.Lock.Lock()
+	defer uc.Lock.Unlock()
+	uc.cache = make(map[string]userIsuListCacheEntry)
+}
+
+// GET /api/isu/search?name=
+// 自分のISUを名前の前方一致(大文字小文字を区別しない)で検索
+func searchIsu(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	name := c.QueryParam("name")
+	if name == "" {
+		return c.String(http.StatusBadRequest, "missing: name")
+	}
+
+	isuList, err := userIsuListCache.Get(jiaUserID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	prefix := strings.ToLower(name)
+	res := []IsuMeta{}
+	for _, isu := range isuList {
+		if strings.HasPrefix(strings.ToLower(isu.Name), prefix) {
+			res = append(res, isu)
+		}
+	}
+	return c.JSON(http.StatusOK, res)
+}
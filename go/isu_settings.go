@@ -0,0 +1,309 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+var conditionNames = []string{"is_dirty", "is_overweight", "is_broken"}
+
+// ISU毎のコンディションレベルの判定ルールの上書き
+type IsuSettings struct {
+	// このうちどれか一つでもtrueならcritical
+	CriticalConditions []string `json:"critical_conditions"`
+	// レベルの判定に数えない
+	IgnoredConditions []string `json:"ignored_conditions"`
+}
+
+type isuSettingsRow struct {
+	JIAIsuUUID         string `db:"jia_isu_uuid"`
+	CriticalConditions string `db:"critical_conditions"`
+	IgnoredConditions  string `db:"ignored_conditions"`
+}
+
+func splitConditionNames(csv string) []string {
+	if csv == "" {
+		return []string{}
+	}
+	return strings.Split(csv, ",")
+}
+
+func (s *IsuSettings) validate() error {
+	for _, names := range [][]string{s.CriticalConditions, s.IgnoredConditions} {
+		for _, name := range names {
+			if !contains(conditionNames, name) {
+				return fmt.Errorf("unknown condition: %v", name)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *IsuSettings) isEmpty() bool {
+	return len(s.CriticalConditions) == 0 && len(s.IgnoredConditions) == 0
+}
+
+func (s *IsuSettings) conditionLevel(condition string) (string, error) {
+	warnCount := 0
+	for _, condStr := range strings.Split(condition, ",") {
+		name, value, ok := strings.Cut(condStr, "=")
+		if !ok {
+			return "", fmt.Errorf("unexpected condition: %v", condStr)
+		}
+		if value != "true" || contains(s.IgnoredConditions, name) {
+			continue
+		}
+		if contains(s.CriticalConditions, name) {
+			return conditionLevelCritical, nil
+		}
+		warnCount++
+	}
+	switch warnCount {
+	case 0:
+		return conditionLevelInfo, nil
+	case 1, 2:
+		return conditionLevelWarning, nil
+	case 3:
+		return conditionLevelCritical, nil
+	default:
+		return "", fmt.Errorf("unexpected warn count")
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// 上書きがないISUはnilを入れておく
+type IsuSettingsCache struct {
+	cache *Cache[string, *IsuSettings]
+}
+
+var isuSettingsCache = NewIsuSettingsCache(getEnvInt("ISU_SETTINGS_CACHE_MAX_ENTRIES", 0))
+
+func NewIsuSettingsCache(maxEntries int) *IsuSettingsCache {
+	return &IsuSettingsCache{cache: NewCache[string, *IsuSettings](profile.CacheTTL, maxEntries)}
+}
+
+func (r isuSettingsRow) settings() *IsuSettings {
+	return &IsuSettings{
+		CriticalConditions: splitConditionNames(r.CriticalConditions),
+		IgnoredConditions:  splitConditionNames(r.IgnoredConditions),
+	}
+}
+
+// 上書きがないISUはnilを返す
+func (sc *IsuSettingsCache) Get(jiaIsuUUID string) (*IsuSettings, error) {
+	return sc.cache.GetOrLoad(jiaIsuUUID, func(jiaIsuUUID string) (*IsuSettings, error) {
+		var row isuSettingsRow
+		err := getDB().Get(&row, "SELECT `jia_isu_uuid`, `critical_conditions`, `ignored_conditions` FROM `isu_settings` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return row.settings(), nil
+	})
+}
+
+// 複数のISUの分を，キャッシュにないものだけ1クエリで読む．上書きがないISUはmapの値がnil
+func (sc *IsuSettingsCache) GetMany(jiaIsuUUIDs []string) (map[string]*IsuSettings, error) {
+	return sc.cache.GetOrLoadMany(jiaIsuUUIDs, func(jiaIsuUUIDs []string) (map[string]*IsuSettings, error) {
+		query, args, err := sqlx.In("SELECT `jia_isu_uuid`, `critical_conditions`, `ignored_conditions` FROM `isu_settings` WHERE `jia_isu_uuid` IN (?)", jiaIsuUUIDs)
+		if err != nil {
+			return nil, err
+		}
+		rows := []isuSettingsRow{}
+		err = getDB().Select(&rows, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		res := make(map[string]*IsuSettings, len(rows))
+		for _, row := range rows {
+			res[row.JIAIsuUUID] = row.settings()
+		}
+		return res, nil
+	})
+}
+
+func (sc *IsuSettingsCache) Set(jiaIsuUUID string, settings *IsuSettings) {
+	sc.cache.Set(jiaIsuUUID, settings)
+}
+
+// DBを読まずにキャッシュにあるものだけ返す．上書きがないISUは(nil, true)
+func (sc *IsuSettingsCache) Peek(jiaIsuUUID string) (*IsuSettings, bool) {
+	return sc.cache.Peek(jiaIsuUUID)
+}
+
+func (sc *IsuSettingsCache) Forget(jiaIsuUUID string) {
+	sc.cache.Forget(jiaIsuUUID)
+}
+
+func (sc *IsuSettingsCache) Reset() {
+	sc.cache.Reset()
+}
+
+// DBのlevel列は既定のルールで生成されるので，上書きがあるISUはここで計算し直す
+func applyIsuSettings(cond *IsuCondition) error {
+	settings, err := isuSettingsCache.Get(cond.JIAIsuUUID)
+	if err != nil {
+		return err
+	}
+	return settings.apply(cond)
+}
+
+// 上書きがない(nil)なら何もしない
+func (s *IsuSettings) apply(cond *IsuCondition) error {
+	if s == nil {
+		return nil
+	}
+	var err error
+	cond.Level, err = s.conditionLevel(cond.Condition)
+	return err
+}
+
+// 上書きがあるISUはDBのlevel列で絞り込めないので，新しい順に読みながらレベルを計算して絞り込む
+func selectIsuConditionsWithSettings(
+	db *sqlx.DB,
+	jiaIsuUUID string,
+	endTime time.Time,
+	conditionLevel map[string]interface{},
+	startTime time.Time,
+	limit int,
+	settings *IsuSettings,
+) ([]IsuCondition, error) {
+	allLevels := []string{conditionLevelInfo, conditionLevelWarning, conditionLevelCritical}
+	q, args, err := buildIsuConditionsQuery(jiaIsuUUID, endTime, allLevels, startTime, 0, true)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Queryx(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	conditions := []IsuCondition{}
+	for len(conditions) < limit && rows.Next() {
+		var cond IsuCondition
+		err = rows.StructScan(&cond)
+		if err != nil {
+			return nil, err
+		}
+		cond.Level, err = settings.conditionLevel(cond.Condition)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := conditionLevel[cond.Level]; ok {
+			conditions = append(conditions, cond)
+		}
+	}
+	return conditions, rows.Err()
+}
+
+// GET /api/isu/:jia_isu_uuid/settings
+// ISUのコンディションレベルの判定ルールを取得
+func getIsuSettings(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	allowed, err := authorizeIsu(jiaUserID, jiaIsuUUID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if !allowed {
+		return c.String(http.StatusNotFound, "not found: isu")
+	}
+
+	settings, err := isuSettingsCache.Get(jiaIsuUUID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if settings == nil {
+		settings = &IsuSettings{CriticalConditions: []string{}, IgnoredConditions: []string{}}
+	}
+	return c.JSON(http.StatusOK, settings)
+}
+
+// PUT /api/isu/:jia_isu_uuid/settings
+// ISUのコンディションレベルの判定ルールを上書き(両方空なら既定のルールに戻す)
+func putIsuSettings(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	allowed, err := authorizeIsu(jiaUserID, jiaIsuUUID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if !allowed {
+		return c.String(http.StatusNotFound, "not found: isu")
+	}
+
+	settings := IsuSettings{}
+	err = c.Bind(&settings)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad request body")
+	}
+	err = settings.validate()
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	if settings.isEmpty() {
+		_, err = getDB().Exec("DELETE FROM `isu_settings` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
+	} else {
+		_, err = getDB().Exec(
+			"INSERT INTO `isu_settings` (`jia_isu_uuid`, `critical_conditions`, `ignored_conditions`) VALUES (?, ?, ?)"+
+				"	ON DUPLICATE KEY UPDATE `critical_conditions` = VALUES(`critical_conditions`), `ignored_conditions` = VALUES(`ignored_conditions`)",
+			jiaIsuUUID, strings.Join(settings.CriticalConditions, ","), strings.Join(settings.IgnoredConditions, ","),
+		)
+	}
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if settings.isEmpty() {
+		isuSettingsCache.Set(jiaIsuUUID, nil)
+	} else {
+		isuSettingsCache.Set(jiaIsuUUID, &settings)
+	}
+	// キャッシュ済みの最新のコンディションは古いルールでレベルが付いている
+	isuConditionCache.Forget(jiaIsuUUID)
+	routeCache.Bust(graphRoutePolicy.Name, jiaIsuUUID)
+	// 他のサーバーは設定，最新のコンディション，グラフを読み直す
+	broadcastCacheInvalidation(CacheInvalidation{JIAIsuUUIDs: []string{jiaIsuUUID}})
+	return c.NoContent(http.StatusNoContent)
+}
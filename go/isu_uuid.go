@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+const isuUUIDLength = 36
+
+// jia_isu_uuidを8-4-4-4-12の16進数として検証し，小文字にそろえる
+// MySQLの照合順序では大文字小文字を区別しないので，そろえないと同じISUがキャッシュに別々に載る
+func canonicalIsuUUID(s string) (string, bool) {
+	if len(s) != isuUUIDLength {
+		return "", false
+	}
+	b := []byte(s)
+	for i, ch := range b {
+		switch i {
+		case 8, 13, 18, 23:
+			if ch != '-' {
+				return "", false
+			}
+			continue
+		}
+		switch {
+		case '0' <= ch && ch <= '9', 'a' <= ch && ch <= 'f':
+		case 'A' <= ch && ch <= 'F':
+			b[i] = ch + ('a' - 'A')
+		default:
+			return "", false
+		}
+	}
+	return string(b), true
+}
+
+// パスのjia_isu_uuidを正規化する．形式が違うものは存在しないISUと同じく404にして，DBまで届かせない
+func isuUUIDParamMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			names := c.ParamNames()
+			for i, name := range names {
+				if name != "jia_isu_uuid" {
+					continue
+				}
+				values := append([]string{}, c.ParamValues()...)
+				jiaIsuUUID, ok := canonicalIsuUUID(values[i])
+				if !ok {
+					return c.String(http.StatusNotFound, "not found: isu")
+				}
+				values[i] = jiaIsuUUID
+				c.SetParamValues(values...)
+			}
+			return next(c)
+		}
+	}
+}
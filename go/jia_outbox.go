@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	eventTypeIsuActivated = "isu.activated"
+
+	activationOutboxBatchSize = 10
+)
+
+// JIAのサービスが202以外を返した
+type JIAServiceError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *JIAServiceError) Error() string {
+	return fmt.Sprintf("JIAService returned error: status code %v, message: %v", e.StatusCode, e.Body)
+}
+
+type PostIsuResponse struct {
+	IsuMeta
+	// JIAのサービスが落ちていて有効化を後回しにした場合はtrue(characterは有効化まで空)
+	ActivationPending bool `json:"activation_pending"`
+}
+
+// JIAのサービスでISUを有効化し，ISUの性格を得る
+// 呼ぶ前にjiaCircuitBreaker.Allowを確かめること．結果はここでブレーカーに記録する
+func activateIsu(jiaIsuUUID string, requestID string) (*IsuFromJIA, error) {
+	isuFromJIA, err := requestActivation(jiaIsuUUID, requestID)
+	var jiaErr *JIAServiceError
+	if err != nil && (!errors.As(err, &jiaErr) || jiaErr.StatusCode >= http.StatusInternalServerError) {
+		jiaCircuitBreaker.Failure()
+	} else {
+		jiaCircuitBreaker.Success()
+	}
+	return isuFromJIA, err
+}
+
+func requestActivation(jiaIsuUUID string, requestID string) (*IsuFromJIA, error) {
+	targetURL := getJIAServiceURL() + "/api/activate"
+	body := JIAServiceRequest{postIsuConditionTargetBaseURL(), jiaIsuUUID}
+	bodysonic, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := outbound(outboundJIA).Do(func() (*http.Request, error) {
+		reqJIA, err := http.NewRequest(http.MethodPost, targetURL, bytes.NewReader(bodysonic))
+		if err != nil {
+			return nil, err
+		}
+		reqJIA.Header.Set("Content-Type", "application/json")
+		reqJIA.Header.Set(echo.HeaderXRequestID, requestID)
+		return reqJIA, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to request JIAService: %w", err)
+	}
+	defer res.Body.Close()
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request JIAService: %w", err)
+	}
+
+	if res.StatusCode != http.StatusAccepted {
+		return nil, &JIAServiceError{StatusCode: res.StatusCode, Body: string(resBody)}
+	}
+
+	var isuFromJIA IsuFromJIA
+	err = json.Unmarshal(resBody, &isuFromJIA)
+	if err != nil {
+		return nil, err
+	}
+	return &isuFromJIA, nil
+}
+
+// ブレーカーが開いている間に登録されたISUを，JIAのサービスが戻ってから有効化する
+func activationOutboxScheduled(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := drainActivationOutbox()
+			if err != nil {
+				workerLogger.Error().Err(err).Msg("failed to drain activation outbox")
+			}
+		}
+	}
+}
+
+func drainActivationOutbox() error {
+	jiaIsuUUIDs := []string{}
+	err := getDB().Select(
+		&jiaIsuUUIDs,
+		"SELECT `jia_isu_uuid` FROM `isu_activation_outbox` ORDER BY `created_at` LIMIT ?",
+		activationOutboxBatchSize,
+	)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	for _, jiaIsuUUID := range jiaIsuUUIDs {
+		if !jiaCircuitBreaker.Allow() {
+			return nil
+		}
+		isuFromJIA, err := activateIsu(jiaIsuUUID, "")
+		if err != nil {
+			var jiaErr *JIAServiceError
+			if errors.As(err, &jiaErr) && jiaErr.StatusCode < http.StatusInternalServerError {
+				// JIA側に拒否されたものは何度試しても同じなので諦める
+				workerLogger.Error().Err(err).Str("jia_isu_uuid", jiaIsuUUID).Msg("activation rejected")
+				_, err = getDB().Exec("DELETE FROM `isu_activation_outbox` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
+				if err != nil {
+					return fmt.Errorf("db error: %v", err)
+				}
+				continue
+			}
+			return err
+		}
+
+		tx, err := getDB().Beginx()
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		_, err = tx.Exec("UPDATE `isu` SET `character` = ? WHERE `jia_isu_uuid` = ?", isuFromJIA.Character, jiaIsuUUID)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("db error: %v", err)
+		}
+		_, err = tx.Exec("DELETE FROM `isu_activation_outbox` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("db error: %v", err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+
+		isuCache.Forget(jiaIsuUUID)
+		isu, err := isuCache.Get(jiaIsuUUID)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		characterMembership.Add(*isu)
+		broadcastCacheInvalidation(CacheInvalidation{JIAIsuUUIDs: []string{jiaIsuUUID}})
+		publishEvent(IsuEvent{
+			Type:       eventTypeIsuActivated,
+			Timestamp:  time.Now().Unix(),
+			JIAUserID:  isu.JIAUserID,
+			JIAIsuUUID: jiaIsuUUID,
+			Data:       isu,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	mysqlErrNumParseError   = 1064
+	mysqlErrNumNotSupported = 1235
+)
+
+// ウィンドウ関数が使えないDB(MySQL 5.7等)だと分かったら，以降はGROUP BY + MAXの方を使う
+var windowFunctionUnsupported atomic.Bool
+
+// 複数のISUの最新のコンディションを1クエリで取る．jiaIsuUUIDsがnilなら全ISU分
+// コンディションが1件もないISUは結果に含まれない
+func fetchLatestConditions(jiaIsuUUIDs []string) ([]IsuCondition, error) {
+	if jiaIsuUUIDs != nil && len(jiaIsuUUIDs) == 0 {
+		return []IsuCondition{}, nil
+	}
+	var conds []IsuCondition
+	var err error
+	if !windowFunctionUnsupported.Load() {
+		conds, err = fetchLatestConditionsByWindow(jiaIsuUUIDs)
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && (mysqlErr.Number == mysqlErrNumParseError || mysqlErr.Number == mysqlErrNumNotSupported) {
+			windowFunctionUnsupported.Store(true)
+			workerLogger.Warn().Err(err).Msg("window functions are not supported: falling back to GROUP BY")
+			conds, err = fetchLatestConditionsByGroupBy(jiaIsuUUIDs)
+		}
+	} else {
+		conds, err = fetchLatestConditionsByGroupBy(jiaIsuUUIDs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// ISU毎に引かず，キャッシュにない分をまとめて1回で読む
+	jiaIsuUUIDs = make([]string, 0, len(conds))
+	for _, cond := range conds {
+		jiaIsuUUIDs = append(jiaIsuUUIDs, cond.JIAIsuUUID)
+	}
+	settings, err := isuSettingsCache.GetMany(jiaIsuUUIDs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range conds {
+		err = settings[conds[i].JIAIsuUUID].apply(&conds[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return conds, nil
+}
+
+func fetchLatestConditionsByWindow(jiaIsuUUIDs []string) ([]IsuCondition, error) {
+	where, args := latestConditionFilter(jiaIsuUUIDs)
+	q, args, err := sqlx.In(
+		"SELECT `jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`, `message_code`, `level` FROM ("+
+			"	SELECT `jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`, `message_code`, `level`,"+
+			"	ROW_NUMBER() OVER (PARTITION BY `jia_isu_uuid` ORDER BY `timestamp` DESC) AS `rn`"+
+			"	FROM `isu_condition`"+where+
+			") `ranked` WHERE `rn` = 1",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	conds := []IsuCondition{}
+	err = getDB().Select(&conds, getDB().Rebind(q), args...)
+	if err != nil {
+		return nil, err
+	}
+	return conds, nil
+}
+
+func fetchLatestConditionsByGroupBy(jiaIsuUUIDs []string) ([]IsuCondition, error) {
+	where, args := latestConditionFilter(jiaIsuUUIDs)
+	q, args, err := sqlx.In(
+		"SELECT `c`.`jia_isu_uuid`, `c`.`timestamp`, `c`.`is_sitting`, `c`.`condition`, `c`.`message`, `c`.`message_code`, `c`.`level` FROM `isu_condition` `c`"+
+			"	JOIN (SELECT `jia_isu_uuid`, MAX(`timestamp`) AS `timestamp` FROM `isu_condition`"+where+" GROUP BY `jia_isu_uuid`) `latest`"+
+			"	USING (`jia_isu_uuid`, `timestamp`)",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	conds := []IsuCondition{}
+	err = getDB().Select(&conds, getDB().Rebind(q), args...)
+	if err != nil {
+		return nil, err
+	}
+	return conds, nil
+}
+
+func latestConditionFilter(jiaIsuUUIDs []string) (string, []interface{}) {
+	if jiaIsuUUIDs == nil {
+		return "", nil
+	}
+	return " WHERE `jia_isu_uuid` IN (?)", []interface{}{jiaIsuUUIDs}
+}
+
+// キャッシュにないものだけまとめてDBから取る
+// コンディションがないISUは結果のmapに含まれない(キャッシュにはnilとして覚える)
+// 読んでいる間にINSERTでForgetされたものは，読み込みの結果で上書きしない
+func (cc *IsuConditionCache) GetMulti(jiaIsuUUIDs []string) (map[string]*IsuCondition, error) {
+	conds, err := cc.cache.GetOrLoadMany(jiaIsuUUIDs, func(misses []string) (map[string]*IsuCondition, error) {
+		latest, err := fetchLatestConditions(misses)
+		if err != nil {
+			return nil, fmt.Errorf("db error: %v", err)
+		}
+		res := make(map[string]*IsuCondition, len(latest))
+		for i := range latest {
+			res[latest[i].JIAIsuUUID] = &latest[i]
+		}
+		return res, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]*IsuCondition, len(conds))
+	for jiaIsuUUID, cond := range conds {
+		if cond != nil {
+			res[jiaIsuUUID] = cond
+		}
+	}
+	return res, nil
+}
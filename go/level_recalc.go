@@ -0,0 +1,246 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const levelRecalcBatchSize = 10000
+
+// 判定ルール(isu_settings)を変えたあとに，過去のコンディションのレベルから作ったものを作り直すジョブ
+// levelは生成列とGO側の計算で読むときに決まるので，作り直すのはレベルから派生して保存しているインシデントだけ
+type LevelRecalcJob struct {
+	progress LevelRecalcProgress
+	Lock     sync.Mutex
+}
+
+type LevelRecalcProgress struct {
+	Running    bool      `json:"running"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	TotalIsus  int       `json:"total_isus"`
+	DoneIsus   int       `json:"done_isus"`
+	Conditions int64     `json:"conditions"`
+	Incidents  int64     `json:"incidents"`
+	Error      string    `json:"error,omitempty"`
+}
+
+var levelRecalcJob = &LevelRecalcJob{}
+
+func (j *LevelRecalcJob) Progress() LevelRecalcProgress {
+	j.Lock.Lock()
+	defer j.Lock.Unlock()
+	return j.progress
+}
+
+func (j *LevelRecalcJob) update(f func(p *LevelRecalcProgress)) {
+	j.Lock.Lock()
+	defer j.Lock.Unlock()
+	f(&j.progress)
+}
+
+// 実行中ならfalse
+func (j *LevelRecalcJob) Start(jiaIsuUUIDs []string) bool {
+	j.Lock.Lock()
+	defer j.Lock.Unlock()
+	if j.progress.Running {
+		return false
+	}
+	j.progress = LevelRecalcProgress{
+		Running:   true,
+		StartedAt: time.Now(),
+		TotalIsus: len(jiaIsuUUIDs),
+	}
+	go j.run(jiaIsuUUIDs)
+	return true
+}
+
+func (j *LevelRecalcJob) run(jiaIsuUUIDs []string) {
+	var err error
+	for _, jiaIsuUUID := range jiaIsuUUIDs {
+		var conditions, incidents int
+		conditions, incidents, err = recalculateIsuIncidents(jiaIsuUUID)
+		if err != nil {
+			err = fmt.Errorf("%v: %w", jiaIsuUUID, err)
+			break
+		}
+		j.update(func(p *LevelRecalcProgress) {
+			p.DoneIsus++
+			p.Conditions += int64(conditions)
+			p.Incidents += int64(incidents)
+		})
+	}
+
+	progress := LevelRecalcProgress{}
+	j.update(func(p *LevelRecalcProgress) {
+		p.Running = false
+		p.FinishedAt = time.Now()
+		if err != nil {
+			p.Error = err.Error()
+		}
+		progress = *p
+	})
+	workerLogger.Info().
+		Int("done_isus", progress.DoneIsus).
+		Int64("incidents", progress.Incidents).
+		Dur("elapsed", progress.FinishedAt.Sub(progress.StartedAt)).
+		AnErr("error", err).
+		Msg("level recalculation finished")
+}
+
+// IncidentTracker.transitionと同じ規則で，時刻順のコンディションからインシデントを組み立てる
+type incidentBuilder struct {
+	jiaIsuUUID string
+	settings   *IsuSettings
+	incidents  []Incident
+	// 未解決のインシデントのincidents内の位置(なければ-1)
+	open       int
+	last       time.Time
+	conditions int
+}
+
+func (b *incidentBuilder) add(timestamp time.Time, condition string) error {
+	level, err := calculateConditionLevel(condition, b.settings)
+	if err != nil {
+		return err
+	}
+	b.last = timestamp
+	b.conditions++
+	critical := level == conditionLevelCritical
+	switch {
+	case b.open < 0 && critical:
+		b.incidents = append(b.incidents, Incident{JIAIsuUUID: b.jiaIsuUUID, Level: level, StartedAt: timestamp})
+		b.open = len(b.incidents) - 1
+	case b.open >= 0 && !critical:
+		b.incidents[b.open].ResolvedAt = sql.NullTime{Time: timestamp, Valid: true}
+		b.open = -1
+	}
+	return nil
+}
+
+// 前回読んだところより後のコンディションをbatch毎に読んで流す
+func (b *incidentBuilder) scan() error {
+	for {
+		rows := []struct {
+			Timestamp time.Time `db:"timestamp"`
+			Condition string    `db:"condition"`
+		}{}
+		err := getDB().Select(
+			&rows,
+			"SELECT `timestamp`, `condition` FROM `isu_condition` WHERE `jia_isu_uuid` = ? AND `timestamp` > ? ORDER BY `timestamp` LIMIT ?",
+			b.jiaIsuUUID, b.last, levelRecalcBatchSize,
+		)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		for _, row := range rows {
+			err = b.add(row.Timestamp, row.Condition)
+			if err != nil {
+				return err
+			}
+		}
+		if len(rows) < levelRecalcBatchSize {
+			return nil
+		}
+	}
+}
+
+// 大半はロックを取らずに読み，最後に追いついた分だけIncidentTrackerのロック中に読んで入れ替える
+func recalculateIsuIncidents(jiaIsuUUID string) (int, int, error) {
+	settings, err := isuSettingsCache.Get(jiaIsuUUID)
+	if err != nil {
+		return 0, 0, fmt.Errorf("db error: %v", err)
+	}
+	b := &incidentBuilder{jiaIsuUUID: jiaIsuUUID, settings: settings, open: -1}
+	err = b.scan()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	err = incidentTracker.Replace(jiaIsuUUID, func() ([]Incident, error) {
+		err := b.scan()
+		if err != nil {
+			return nil, err
+		}
+		return b.incidents, nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	reportCache.Forget(jiaIsuUUID)
+	isuConditionCache.Forget(jiaIsuUUID)
+	return b.conditions, len(b.incidents), nil
+}
+
+// ISUのインシデントをbuildの結果で置き換える．途中でObserveや書き込みが割り込まないようロックしたまま行い，
+// 次のObserveでは置き換えたあとのDBの状態から続ける
+func (it *IncidentTracker) Replace(jiaIsuUUID string, build func() ([]Incident, error)) error {
+	it.writeLock.Lock()
+	defer it.writeLock.Unlock()
+	it.Lock.Lock()
+	defer it.Lock.Unlock()
+	incidents, err := build()
+	if err != nil {
+		return err
+	}
+
+	tx, err := getDB().Beginx()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM `isu_incident` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	if len(incidents) > 0 {
+		_, err = tx.NamedExec(
+			"INSERT INTO `isu_incident` (`jia_isu_uuid`, `level`, `started_at`, `resolved_at`)"+
+				" VALUES (:jia_isu_uuid, :level, :started_at, :resolved_at)",
+			incidents,
+		)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	// 書き込み待ちのものは置き換える前の判定によるものなので捨てる
+	for key := range it.pending {
+		if key.jiaIsuUUID == jiaIsuUUID {
+			delete(it.pending, key)
+		}
+	}
+	it.forget(jiaIsuUUID)
+	return nil
+}
+
+// POST /internal/jobs/level-recalc?jia_isu_uuid=
+// インシデントの作り直しを裏で始める．jia_isu_uuidを省略すると全てのISUが対象
+func postLevelRecalc(c echo.Context) error {
+	jiaIsuUUIDs := c.QueryParams()["jia_isu_uuid"]
+	if len(jiaIsuUUIDs) == 0 {
+		err := getDB().Select(&jiaIsuUUIDs, "SELECT `jia_isu_uuid` FROM `isu` ORDER BY `id`")
+		if err != nil {
+			c.Logger().Errorf("db error: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+	if !levelRecalcJob.Start(jiaIsuUUIDs) {
+		return c.String(http.StatusConflict, "level recalculation is already running")
+	}
+	return c.JSON(http.StatusAccepted, levelRecalcJob.Progress())
+}
+
+// GET /internal/jobs/level-recalc
+// インシデントの作り直しの進み具合
+func getLevelRecalc(c echo.Context) error {
+	return c.JSON(http.StatusOK, levelRecalcJob.Progress())
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net"
+)
+
+// 受け付けた接続のソケットオプション
+// 書き込みのバッファリングはnet/httpが接続毎のbufio.Writerでレスポンス単位に行っているので，
+// ここではさらにバッファを重ねず(レスポンスの終わりが分からずフラッシュできない)，カーネル側のバッファとNagleだけ調整する
+type ListenerOptions struct {
+	// TCPのみ．falseにすると小さい書き込みをまとめて送る
+	NoDelay bool
+	// 0ならOSの既定値のまま
+	ReadBuffer  int
+	WriteBuffer int
+}
+
+var listenerOptions = ListenerOptions{
+	NoDelay:     getEnv("LISTENER_NODELAY", "1") != "0",
+	ReadBuffer:  getEnvInt("LISTENER_READ_BUFFER", 0),
+	WriteBuffer: getEnvInt("LISTENER_WRITE_BUFFER", 0),
+}
+
+type tunedListener struct {
+	net.Listener
+	options ListenerOptions
+}
+
+func newTunedListener(l net.Listener, options ListenerOptions) net.Listener {
+	return &tunedListener{Listener: l, options: options}
+}
+
+func (l *tunedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	// オプションの設定に失敗しても接続自体は使えるので，ログだけ出す
+	err = l.tune(conn)
+	if err != nil {
+		systemLogger.Warn().Err(err).Msg("failed to set socket options")
+	}
+	return conn, nil
+}
+
+func (l *tunedListener) tune(conn net.Conn) error {
+	type bufferSetter interface {
+		SetReadBuffer(bytes int) error
+		SetWriteBuffer(bytes int) error
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		err := tcpConn.SetNoDelay(l.options.NoDelay)
+		if err != nil {
+			return err
+		}
+	}
+	bs, ok := conn.(bufferSetter)
+	if !ok {
+		return nil
+	}
+	if l.options.ReadBuffer > 0 {
+		err := bs.SetReadBuffer(l.options.ReadBuffer)
+		if err != nil {
+			return err
+		}
+	}
+	if l.options.WriteBuffer > 0 {
+		err := bs.SetWriteBuffer(l.options.WriteBuffer)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"github.com/rs/zerolog"
+)
+
+const (
+	logModuleAPI    = "api"
+	logModuleWorker = "worker"
+	logModuleSystem = "system"
+)
+
+var (
+	logRegistry  = NewLogRegistry(io.MultiWriter(os.Stderr, recentLogs), getEnv("LOG_FORMAT", "text"), getEnv("LOG_LEVEL", "info"), getEnvInt("LOG_SAMPLE_BURST", 10))
+	apiLogger    = logRegistry.Module(logModuleAPI)
+	workerLogger = logRegistry.Module(logModuleWorker)
+	systemLogger = logRegistry.Module(logModuleSystem)
+)
+
+// モジュール毎にレベルを持つロガー
+// レベル未満のイベントはnilを返すので，zerolog側で何もせず捨てられる
+type ModuleLogger struct {
+	zl    zerolog.Logger
+	level *atomic.Int32
+}
+
+func (l *ModuleLogger) Enabled(lvl zerolog.Level) bool {
+	return lvl >= zerolog.Level(l.level.Load())
+}
+
+func (l *ModuleLogger) event(lvl zerolog.Level) *zerolog.Event {
+	if !l.Enabled(lvl) {
+		return nil
+	}
+	return l.zl.WithLevel(lvl)
+}
+
+func (l *ModuleLogger) Debug() *zerolog.Event { return l.event(zerolog.DebugLevel) }
+func (l *ModuleLogger) Info() *zerolog.Event  { return l.event(zerolog.InfoLevel) }
+func (l *ModuleLogger) Warn() *zerolog.Event  { return l.event(zerolog.WarnLevel) }
+func (l *ModuleLogger) Error() *zerolog.Event { return l.event(zerolog.ErrorLevel) }
+func (l *ModuleLogger) Fatal() *zerolog.Event { return l.zl.Fatal() }
+
+type LogRegistry struct {
+	root         zerolog.Logger
+	defaultLevel zerolog.Level
+	levels       map[string]zerolog.Level
+	modules      map[string]*ModuleLogger
+	samplers     []*LogSampler
+	sampleBurst  int
+	Lock         sync.Mutex
+}
+
+// levelSpecは "info" や "api=warn,worker=debug" の形式
+// sampleBurstは同一のwarn/errorログを1周期あたり何件まで出すか(0以下で間引かない)
+func NewLogRegistry(w io.Writer, format string, levelSpec string, sampleBurst int) *LogRegistry {
+	if format != "json" {
+		w = zerolog.ConsoleWriter{Out: w, NoColor: true, TimeFormat: "15:04:05.000"}
+	}
+	r := &LogRegistry{
+		root:         zerolog.New(w).With().Timestamp().Logger(),
+		defaultLevel: zerolog.InfoLevel,
+		levels:       make(map[string]zerolog.Level),
+		modules:      make(map[string]*ModuleLogger),
+		sampleBurst:  sampleBurst,
+	}
+	for _, spec := range strings.Split(levelSpec, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		name, levelStr, found := strings.Cut(spec, "=")
+		if !found {
+			name, levelStr = "", name
+		}
+		lvl, err := zerolog.ParseLevel(levelStr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid LOG_LEVEL %q: %v\n", spec, err)
+			continue
+		}
+		if name == "" || name == "*" {
+			r.defaultLevel = lvl
+		} else {
+			r.levels[name] = lvl
+		}
+	}
+	return r
+}
+
+func (r *LogRegistry) Module(name string) *ModuleLogger {
+	r.Lock.Lock()
+	defer r.Lock.Unlock()
+	l, ok := r.modules[name]
+	if !ok {
+		lvl, ok := r.levels[name]
+		if !ok {
+			lvl = r.defaultLevel
+		}
+		zl := r.root.With().Str("module", name).Logger()
+		if r.sampleBurst > 0 {
+			sampler := NewLogSampler(zl, r.sampleBurst)
+			r.samplers = append(r.samplers, sampler)
+			zl = zl.Hook(sampler)
+		}
+		l = &ModuleLogger{
+			zl:    zl,
+			level: &atomic.Int32{},
+		}
+		l.level.Store(int32(lvl))
+		r.modules[name] = l
+	}
+	return l
+}
+
+func (r *LogRegistry) SetLevel(name string, lvl zerolog.Level) error {
+	r.Lock.Lock()
+	l, ok := r.modules[name]
+	r.Lock.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown log module: %v", name)
+	}
+	l.level.Store(int32(lvl))
+	return nil
+}
+
+func (r *LogRegistry) Levels() map[string]string {
+	r.Lock.Lock()
+	defer r.Lock.Unlock()
+	res := make(map[string]string, len(r.modules))
+	for name, l := range r.modules {
+		res[name] = zerolog.Level(l.level.Load()).String()
+	}
+	return res
+}
+
+func (r *LogRegistry) flushSamplersScheduled(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.Lock.Lock()
+			samplers := r.samplers
+			r.Lock.Unlock()
+			for _, sampler := range samplers {
+				sampler.Flush()
+			}
+		}
+	}
+}
+
+// メッセージはエラーの中身やIDで毎回変わるので，ログを出した箇所で数える
+type logSampleKey struct {
+	level  zerolog.Level
+	caller uintptr
+}
+
+type logSampleCount struct {
+	n int
+	// 周期内で最初に出たもの．間引いた件数と一緒に出す
+	message string
+	caller  string
+}
+
+// ベンチマーク中に同じエラーが大量に出てログI/OがCPUを食うのを防ぐため，
+// 同じ箇所からのwarn/errorは1周期あたりburst件までにして残りは件数だけ集計する
+type LogSampler struct {
+	zl     zerolog.Logger
+	burst  int
+	counts map[logSampleKey]*logSampleCount
+	Lock   sync.Mutex
+}
+
+func NewLogSampler(zl zerolog.Logger, burst int) *LogSampler {
+	return &LogSampler{
+		zl:     zl,
+		burst:  burst,
+		counts: make(map[logSampleKey]*logSampleCount),
+	}
+}
+
+func (s *LogSampler) Run(e *zerolog.Event, level zerolog.Level, message string) {
+	if level < zerolog.WarnLevel {
+		return
+	}
+	frame := logCallSite()
+	key := logSampleKey{level: level, caller: frame.PC}
+	s.Lock.Lock()
+	count, ok := s.counts[key]
+	if !ok {
+		count = &logSampleCount{message: message, caller: filepath.Base(frame.File) + ":" + strconv.Itoa(frame.Line)}
+		s.counts[key] = count
+	}
+	count.n++
+	n := count.n
+	s.Lock.Unlock()
+	if n > s.burst {
+		e.Discard()
+	}
+}
+
+// zerologとロガーのアダプタの中を飛ばした，ログを出した箇所
+func logCallSite() runtime.Frame {
+	var pcs [32]uintptr
+	n := runtime.Callers(3, pcs[:])
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		if !isLoggerFrame(frame.Function) || !more {
+			return frame
+		}
+	}
+}
+
+// go testではmainパッケージの関数名がmain.ではなくモジュールのパスで始まるので，型の部分で見る
+func isLoggerFrame(function string) bool {
+	if strings.HasPrefix(function, "github.com/rs/zerolog.") {
+		return true
+	}
+	for _, method := range []string{".(*echoLogger).", ".(*ModuleLogger).", ".(*LogSampler)."} {
+		if strings.Contains(function, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// 周期内に間引いた件数を "suppressed N similar" として出力する
+func (s *LogSampler) Flush() {
+	s.Lock.Lock()
+	counts := s.counts
+	s.counts = make(map[logSampleKey]*logSampleCount)
+	s.Lock.Unlock()
+	for key, count := range counts {
+		if count.n <= s.burst {
+			continue
+		}
+		suppressed := count.n - s.burst
+		s.zl.WithLevel(key.level).
+			Str("sampled_message", count.message).
+			Str("caller", count.caller).
+			Int("suppressed", suppressed).
+			Msgf("suppressed %d similar", suppressed)
+	}
+}
+
+type LogLevelRequest struct {
+	Module string `json:"module"`
+	Level  string `json:"level"`
+}
+
+// GET /internal/log/level
+// モジュール毎のログレベルを取得
+func getLogLevel(c echo.Context) error {
+	return c.JSON(http.StatusOK, logRegistry.Levels())
+}
+
+// PUT /internal/log/level
+// モジュール毎のログレベルを実行中に変更
+func putLogLevel(c echo.Context) error {
+	var request LogLevelRequest
+	err := c.Bind(&request)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad request body")
+	}
+	lvl, err := zerolog.ParseLevel(request.Level)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad format: level")
+	}
+	err = logRegistry.SetLevel(request.Module, lvl)
+	if err != nil {
+		return c.String(http.StatusNotFound, "not found: module")
+	}
+	return c.JSON(http.StatusOK, logRegistry.Levels())
+}
+
+// echo.Loggerを満たすアダプタ
+// echo本体とc.Logger()からのログもModuleLoggerに流す
+type echoLogger struct {
+	l      *ModuleLogger
+	prefix string
+	// リクエスト毎のロガーだけが持つ．zerologのコンテキストは作らず，出力するときにだけ足す
+	requestID string
+}
+
+func newEchoLogger(l *ModuleLogger) *echoLogger {
+	return &echoLogger{l: l}
+}
+
+func (el *echoLogger) WithRequestID(requestID string) *echoLogger {
+	return &echoLogger{l: el.l, prefix: el.prefix, requestID: requestID}
+}
+
+func (el *echoLogger) annotate(e *zerolog.Event) *zerolog.Event {
+	if el.requestID != "" {
+		e = e.Str("request_id", el.requestID)
+	}
+	return e
+}
+
+func (el *echoLogger) Output() io.Writer {
+	return el.l.zl
+}
+
+func (el *echoLogger) SetOutput(w io.Writer) {
+	el.l = &ModuleLogger{zl: el.l.zl.Output(w), level: el.l.level}
+}
+
+func (el *echoLogger) Prefix() string {
+	return el.prefix
+}
+
+func (el *echoLogger) SetPrefix(p string) {
+	el.prefix = p
+}
+
+func (el *echoLogger) Level() log.Lvl {
+	switch zerolog.Level(el.l.level.Load()) {
+	case zerolog.DebugLevel, zerolog.TraceLevel:
+		return log.DEBUG
+	case zerolog.InfoLevel:
+		return log.INFO
+	case zerolog.WarnLevel:
+		return log.WARN
+	case zerolog.ErrorLevel:
+		return log.ERROR
+	default:
+		return log.OFF
+	}
+}
+
+func (el *echoLogger) SetLevel(v log.Lvl) {
+	var lvl zerolog.Level
+	switch v {
+	case log.DEBUG:
+		lvl = zerolog.DebugLevel
+	case log.INFO:
+		lvl = zerolog.InfoLevel
+	case log.WARN:
+		lvl = zerolog.WarnLevel
+	case log.ERROR:
+		lvl = zerolog.ErrorLevel
+	default:
+		lvl = zerolog.Disabled
+	}
+	el.l.level.Store(int32(lvl))
+}
+
+func (el *echoLogger) SetHeader(h string) {}
+
+func (el *echoLogger) print(e *zerolog.Event, i ...interface{}) {
+	if e == nil {
+		return
+	}
+	el.annotate(e).Msg(fmt.Sprint(i...))
+}
+
+func (el *echoLogger) printf(e *zerolog.Event, format string, args ...interface{}) {
+	if e == nil {
+		return
+	}
+	el.annotate(e).Msg(fmt.Sprintf(format, args...))
+}
+
+func (el *echoLogger) printj(e *zerolog.Event, j log.JSON) {
+	if e == nil {
+		return
+	}
+	el.annotate(e).Fields(map[string]interface{}(j)).Send()
+}
+
+func (el *echoLogger) Print(i ...interface{}) { el.print(el.l.Info(), i...) }
+func (el *echoLogger) Printf(format string, args ...interface{}) {
+	el.printf(el.l.Info(), format, args...)
+}
+func (el *echoLogger) Printj(j log.JSON)      { el.printj(el.l.Info(), j) }
+func (el *echoLogger) Debug(i ...interface{}) { el.print(el.l.Debug(), i...) }
+func (el *echoLogger) Debugf(format string, args ...interface{}) {
+	el.printf(el.l.Debug(), format, args...)
+}
+func (el *echoLogger) Debugj(j log.JSON)     { el.printj(el.l.Debug(), j) }
+func (el *echoLogger) Info(i ...interface{}) { el.print(el.l.Info(), i...) }
+func (el *echoLogger) Infof(format string, args ...interface{}) {
+	el.printf(el.l.Info(), format, args...)
+}
+func (el *echoLogger) Infoj(j log.JSON)      { el.printj(el.l.Info(), j) }
+func (el *echoLogger) Warn(i ...interface{}) { el.print(el.l.Warn(), i...) }
+func (el *echoLogger) Warnf(format string, args ...interface{}) {
+	el.printf(el.l.Warn(), format, args...)
+}
+func (el *echoLogger) Warnj(j log.JSON)       { el.printj(el.l.Warn(), j) }
+func (el *echoLogger) Error(i ...interface{}) { el.print(el.l.Error(), i...) }
+func (el *echoLogger) Errorf(format string, args ...interface{}) {
+	el.printf(el.l.Error(), format, args...)
+}
+func (el *echoLogger) Errorj(j log.JSON)      { el.printj(el.l.Error(), j) }
+func (el *echoLogger) Fatal(i ...interface{}) { el.print(el.l.Fatal(), i...) }
+func (el *echoLogger) Fatalf(format string, args ...interface{}) {
+	el.printf(el.l.Fatal(), format, args...)
+}
+func (el *echoLogger) Fatalj(j log.JSON) { el.printj(el.l.Fatal(), j) }
+
+func (el *echoLogger) Panic(i ...interface{}) {
+	msg := fmt.Sprint(i...)
+	el.annotate(el.l.zl.Error()).Msg(msg)
+	panic(msg)
+}
+
+func (el *echoLogger) Panicf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	el.annotate(el.l.zl.Error()).Msg(msg)
+	panic(msg)
+}
+
+func (el *echoLogger) Panicj(j log.JSON) {
+	el.annotate(el.l.zl.Error()).Fields(map[string]interface{}(j)).Send()
+	panic(j)
+}
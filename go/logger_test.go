@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// 同じ箇所からのログは中身が違っても同じものとして間引き，箇所が違えば別々に数える
+func TestLogSamplerKeysOnCallSite(t *testing.T) {
+	var buf bytes.Buffer
+	registry := NewLogRegistry(&buf, "json", "info", 2)
+	el := newEchoLogger(registry.Module("api")).WithRequestID("req-1")
+
+	for i := 0; i < 5; i++ {
+		el.Errorf("db error: %v", i)
+	}
+	el.Errorf("other error")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines before flush, want 3:\n%s", len(lines), buf.String())
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, `"request_id":"req-1"`) {
+			t.Fatalf("missing request_id: %s", line)
+		}
+	}
+
+	buf.Reset()
+	for _, sampler := range registry.samplers {
+		sampler.Flush()
+	}
+	out := buf.String()
+	if strings.Count(out, "suppressed") == 0 || !strings.Contains(out, `"suppressed":3`) || !strings.Contains(out, "logger_test.go:") {
+		t.Fatalf("unexpected flush output: %s", out)
+	}
+	if strings.Contains(out, "other error") {
+		t.Fatalf("flushed a call site that was not sampled: %s", out)
+	}
+}
@@ -1,10 +1,11 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"database/sql"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"net"
@@ -12,22 +13,25 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"os/exec"
+	"os/signal"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/felixge/fgprof"
 	"github.com/go-sql-driver/mysql"
 	"github.com/goccy/go-json"
 	"github.com/gorilla/sessions"
+	"github.com/isucon/isucon11-qualify/isucondition/internal/timeutil"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
-	"github.com/labstack/echo/v4/middleware"
-	"github.com/labstack/gommon/log"
 	"golang.org/x/exp/maps"
 )
 
@@ -38,6 +42,10 @@ const (
 	jiaJWTSigningKeyPath        = "../ec256-public.pem"
 	defaultIconFilePath         = "../NoImage.jpg"
 	defaultJIAServiceURL        = "http://localhost:5000"
+	configNameJIAServiceURL     = "jia_service_url"
+	iconSendfileModeAccel       = "accel"
+	iconSendfileModeSendfile    = "sendfile"
+	iconAccelRedirectPrefix     = "/_icons/"
 	mysqlErrNumDuplicateEntry   = 1062
 	conditionLevelInfo          = "info"
 	conditionLevelWarning       = "warning"
@@ -45,20 +53,39 @@ const (
 	scoreConditionLevelInfo     = 3
 	scoreConditionLevelWarning  = 2
 	scoreConditionLevelCritical = 1
+	trendDefaultPerPage         = 20
+	trendMaxPerPage             = 100
+	headerTotalCount            = "X-Total-Count"
+	// user.jia_user_idの長さ(VARCHAR(255))
+	jiaUserIDMaxLength = 255
+	// SIGTERMを受けてから，処理中のリクエストとキューの書き出しを待つ時間
+	shutdownTimeout = 10 * time.Second
 )
 
 var (
-	db                  *sqlx.DB
-	mySQLConnectionData *MySQLConnectionEnv
+	// DBの切り替え(dbsupervisor.go)とリクエストが並行して読むので，getDB/getMySQLConnectionEnvから読む
+	currentDB                  atomic.Pointer[sqlx.DB]
+	currentMySQLConnectionData atomic.Pointer[MySQLConnectionEnv]
 
 	jiaJWTSigningKey *ecdsa.PublicKey
 
-	postIsuConditionTargetBaseURL string // JIAへのactivate時に登録する，ISUがconditionを送る先のURL
-	isuCache                      *IsuCache
-	userCache                     *UserCache
-	isuConditionCache             *IsuConditionCache
-	defaultIcon                   []byte
-	unixDomainSockPath            = "/tmp/isucondition.sock"
+	// JIAへのactivate時に登録する，ISUがconditionを送る先のURL
+	postIsuConditionTargetBaseURL = sync.OnceValue(func() string {
+		return os.Getenv("POST_ISUCONDITION_TARGET_BASE_URL")
+	})
+
+	isuCache           *IsuCache
+	userCache          *UserCache
+	isuConditionCache  *IsuConditionCache
+	configCache        *ConfigCache
+	iconCache          *IconCache
+	defaultIcon        []byte
+	unixDomainSockPath = "/tmp/isucondition.sock"
+	iconSendfileMode   = getEnv("ICON_SENDFILE", "") // "accel"(nginx) / "sendfile"(apache等) / ""(無効)
+
+	initializeLock sync.Mutex
+	// /initializeでDBを作り直している間は，キューの書き出しを止める
+	flushLock sync.Mutex
 )
 
 type Config struct {
@@ -66,11 +93,11 @@ type Config struct {
 	URL  string `db:"url"`
 }
 
-type Isu struct {
+// isuの行のうちimage以外．数MBになりうるimageはアイコンを返すとき(iconcache.go)だけ読む
+type IsuMeta struct {
 	ID         int    `db:"id"           json:"id"`
 	JIAIsuUUID string `db:"jia_isu_uuid" json:"jia_isu_uuid"`
 	Name       string `db:"name"         json:"name"`
-	Image      []byte `db:"image"        json:"-"`
 	Character  string `db:"character"    json:"character"`
 	JIAUserID  string `db:"jia_user_id"  json:"-"`
 }
@@ -95,6 +122,12 @@ type IsuCondition struct {
 	Condition  string    `db:"condition"`
 	Message    string    `db:"message"`
 	Level      string    `db:"level"`
+	// 機械向けのメッセージの種類(デバイスが送ってこなければ空)
+	MessageCode string `db:"message_code"`
+	// デバイスが振る通し番号(送ってこなければNULL)．欠けの検出に使う
+	Sequence sql.NullInt64 `db:"sequence"`
+	// ミュート期間中に受け取ったものはtrue(DBには保存しない)
+	Muted bool `db:"-"`
 }
 
 type MySQLConnectionEnv struct {
@@ -124,6 +157,11 @@ type GraphResponse struct {
 	ConditionTimestamps []int64         `json:"condition_timestamps"`
 }
 
+type GraphCompareResponse struct {
+	Current  []GraphResponse `json:"current"`
+	Previous []GraphResponse `json:"previous"`
+}
+
 type GraphDataPoint struct {
 	Score      int                  `json:"score"`
 	Percentage ConditionsPercentage `json:"percentage"`
@@ -151,6 +189,9 @@ type GetIsuConditionResponse struct {
 	Condition      string `json:"condition"`
 	ConditionLevel string `json:"condition_level"`
 	Message        string `json:"message"`
+	MessageCode    string `json:"message_code,omitempty"`
+	// Accept-Languageに対応する翻訳がある場合だけ入る
+	LocalizedMessage string `json:"localized_message,omitempty"`
 }
 
 type TrendResponse struct {
@@ -169,7 +210,11 @@ type PostIsuConditionRequest struct {
 	IsSitting bool   `json:"is_sitting"`
 	Condition string `json:"condition"`
 	Message   string `json:"message"`
-	Timestamp int64  `json:"timestamp"`
+	// 任意．翻訳に使う
+	MessageCode string `json:"message_code"`
+	Timestamp   int64  `json:"timestamp"`
+	// 任意．ISU毎に単調増加する通し番号
+	Sequence *int64 `json:"sequence"`
 }
 
 type JIAServiceRequest struct {
@@ -178,19 +223,20 @@ type JIAServiceRequest struct {
 }
 
 type IsuConditionCache struct {
-	cache map[string]*IsuCondition
-	Lock  sync.Mutex
+	cache *Cache[string, *IsuCondition]
+}
+
+func NewIsuConditionCache(maxEntries int) *IsuConditionCache {
+	return &IsuConditionCache{cache: NewCache[string, *IsuCondition](profile.CacheTTL, maxEntries)}
 }
 
+// コンディションがなければsql.ErrNoRowsを返す
 func (cc *IsuConditionCache) Get(jiaIsuUUID string) (*IsuCondition, error) {
-	cc.Lock.Lock()
-	defer cc.Lock.Unlock()
-	cond, ok := cc.cache[jiaIsuUUID]
-	if !ok {
+	cond, err := cc.cache.GetOrLoad(jiaIsuUUID, func(jiaIsuUUID string) (*IsuCondition, error) {
 		var i IsuCondition
-		err := db.Get(
+		err := getDB().Get(
 			&i,
-			"SELECT  `jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`, `level` FROM `isu_condition` WHERE `jia_isu_uuid` = ? ORDER BY `timestamp` DESC LIMIT 1",
+			"SELECT  `jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`, `message_code`, `level` FROM `isu_condition` WHERE `jia_isu_uuid` = ? ORDER BY `timestamp` DESC LIMIT 1",
 			jiaIsuUUID,
 		)
 		if err != nil {
@@ -199,32 +245,53 @@ func (cc *IsuConditionCache) Get(jiaIsuUUID string) (*IsuCondition, error) {
 			}
 			return nil, err
 		}
-		cc.cache[jiaIsuUUID] = &i
+		err = applyIsuSettings(&i)
+		if err != nil {
+			return nil, err
+		}
 		return &i, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// GetMultiでコンディションがないと分かったもの
+	if cond == nil {
+		return nil, sql.ErrNoRows
 	}
 	return cond, nil
 }
 
+func (cc *IsuConditionCache) Set(cond *IsuCondition) {
+	cc.cache.Set(cond.JIAIsuUUID, cond)
+}
+
+// DBを読まずにキャッシュにあるものだけ返す．コンディションがないと分かっているISUはnilを返す
+func (cc *IsuConditionCache) Peek(jiaIsuUUID string) (*IsuCondition, bool) {
+	return cc.cache.Peek(jiaIsuUUID)
+}
+
+func (cc *IsuConditionCache) Reset() {
+	cc.cache.Reset()
+}
+
 func (cc *IsuConditionCache) Forget(jiaIsuUUID string) {
-	cc.Lock.Lock()
-	defer cc.Lock.Unlock()
-	delete(cc.cache, jiaIsuUUID)
+	cc.cache.Forget(jiaIsuUUID)
 }
 
 type IsuCache struct {
-	cache map[string]*Isu
-	Lock  sync.Mutex
+	cache *Cache[string, *IsuMeta]
 }
 
-func (ic *IsuCache) Get(jiaIsuUUID string) (*Isu, error) {
-	ic.Lock.Lock()
-	defer ic.Lock.Unlock()
-	isu, ok := ic.cache[jiaIsuUUID]
-	if !ok {
-		var i Isu
-		err := db.Get(
+func NewIsuCache(maxEntries int) *IsuCache {
+	return &IsuCache{cache: NewCache[string, *IsuMeta](profile.CacheTTL, maxEntries)}
+}
+
+func (ic *IsuCache) Get(jiaIsuUUID string) (*IsuMeta, error) {
+	return ic.cache.GetOrLoad(jiaIsuUUID, func(jiaIsuUUID string) (*IsuMeta, error) {
+		var i IsuMeta
+		err := getDB().Get(
 			&i,
-			"SELECT `id`, `jia_isu_uuid`, `name`, `image`, `character`, `jia_user_id` FROM `isu` WHERE `jia_isu_uuid` = ?",
+			"SELECT `id`, `jia_isu_uuid`, `name`, `character`, `jia_user_id` FROM `isu` WHERE `jia_isu_uuid` = ?",
 			jiaIsuUUID,
 		)
 		if err != nil {
@@ -233,69 +300,225 @@ func (ic *IsuCache) Get(jiaIsuUUID string) (*Isu, error) {
 			}
 			return nil, err
 		}
-		ic.cache[jiaIsuUUID] = &i
 		return &i, nil
-	}
-	return isu, nil
+	})
+}
+
+// DBを読まずにキャッシュにあるものだけ返す
+func (ic *IsuCache) Peek(jiaIsuUUID string) (*IsuMeta, bool) {
+	return ic.cache.Peek(jiaIsuUUID)
+}
+
+// キャッシュにあるISUのUUIDを最大n件返す(順序は不定)
+func (ic *IsuCache) Keys(n int) []string {
+	return ic.cache.Keys(n)
+}
+
+func (ic *IsuCache) Reset() {
+	ic.cache.Reset()
 }
 
 func (ic *IsuCache) Forget(jiaIsuUUID string) {
-	ic.Lock.Lock()
-	defer ic.Lock.Unlock()
-	delete(ic.cache, jiaIsuUUID)
+	ic.cache.Forget(jiaIsuUUID)
 }
 
+// 登録済みのユーザーだけを覚える(登録されていないユーザーは毎回DBを見る)
 type UserCache struct {
-	cache map[string]struct{}
-	Lock  sync.Mutex
+	cache *Cache[string, struct{}]
+}
+
+func NewUserCache(maxEntries int) *UserCache {
+	return &UserCache{cache: NewCache[string, struct{}](profile.CacheTTL, maxEntries)}
 }
 
 func (uc *UserCache) Get(jiaUserID string) (bool, error) {
-	uc.Lock.Lock()
-	defer uc.Lock.Unlock()
-	_, ok := uc.cache[jiaUserID]
-	if !ok {
+	_, err := uc.cache.GetOrLoad(jiaUserID, func(jiaUserID string) (struct{}, error) {
 		var count int
-		err := db.Get(&count, "SELECT 1 FROM `user` WHERE `jia_user_id` = ?",
+		err := getPriorityDB().Get(&count, "SELECT 1 FROM `user` WHERE `jia_user_id` = ?",
 			jiaUserID)
 		if err != nil {
-			return false, fmt.Errorf("db error: %v", err)
+			if errors.Is(err, sql.ErrNoRows) {
+				return struct{}{}, sql.ErrNoRows
+			}
+			return struct{}{}, fmt.Errorf("db error: %v", err)
 		}
 		if count == 0 {
-			return false, sql.ErrNoRows
+			return struct{}{}, sql.ErrNoRows
+		}
+		return struct{}{}, nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (uc *UserCache) Forget(jiaUserID string) {
+	uc.cache.Forget(jiaUserID)
+}
+
+func (uc *UserCache) Reset() {
+	uc.cache.Reset()
+}
+
+// DBはロックの外で読む．読んでいる間にSet/Resetされていたら，読んだものは古いかもしれないので入れない
+type ConfigCache struct {
+	cache map[string]string
+	// Set/Resetの度に増える
+	version uint64
+	Lock    sync.Mutex
+}
+
+func (cc *ConfigCache) Get(name string) (string, error) {
+	cc.Lock.Lock()
+	url, ok := cc.cache[name]
+	version := cc.version
+	cc.Lock.Unlock()
+	if ok {
+		return url, nil
+	}
+
+	var config Config
+	err := getDB().Get(
+		&config,
+		"SELECT * FROM `isu_association_config` WHERE `name` = ?",
+		name,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", sql.ErrNoRows
+		}
+		return "", err
+	}
+	cc.Lock.Lock()
+	defer cc.Lock.Unlock()
+	if cc.version == version {
+		cc.cache[name] = config.URL
+	}
+	return config.URL, nil
+}
+
+func (cc *ConfigCache) Set(name string, url string) {
+	cc.Lock.Lock()
+	defer cc.Lock.Unlock()
+	cc.cache[name] = url
+	cc.version++
+}
+
+func (cc *ConfigCache) Reset() {
+	cc.Lock.Lock()
+	defer cc.Lock.Unlock()
+	cc.cache = make(map[string]string)
+	cc.version++
+}
+
+// 他のサーバーで設定が書き換えられた場合に追従するため，定期的にDBから読み直す
+// 読んでいる間にこのサーバーでSetされたら入れ替えず，次の回に読み直す
+func (cc *ConfigCache) Reload() error {
+	cc.Lock.Lock()
+	version := cc.version
+	cc.Lock.Unlock()
+
+	configs := []Config{}
+	err := getDB().Select(&configs, "SELECT * FROM `isu_association_config`")
+	if err != nil {
+		return err
+	}
+	cache := make(map[string]string, len(configs))
+	for _, config := range configs {
+		cache[config.Name] = config.URL
+	}
+	cc.Lock.Lock()
+	defer cc.Lock.Unlock()
+	if cc.version == version {
+		cc.cache = cache
+	}
+	return nil
+}
+
+func watchConfigScheduled(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := configCache.Reload()
+			if err != nil {
+				workerLogger.Error().Err(err).Msg("failed to reload config")
+			}
 		}
-		uc.cache[jiaUserID] = struct{}{}
-		return true, nil
 	}
-	return ok, nil
 }
 
 type TrendCache struct {
-	res  []TrendResponse
-	Lock sync.Mutex
+	res []TrendResponse
+	// resをJSONにしたもの．リクエスト毎にエンコードしないよう，Setのときに1回だけ作る
+	body []byte
+	// Setの度に増える．スナップショットから戻したときはその続きから数える
+	version int64
+	Lock    sync.Mutex
 }
 
 func (tc *TrendCache) Get() []TrendResponse {
+	tc.Lock.Lock()
+	defer tc.Lock.Unlock()
 	return tc.res
 }
 
+func (tc *TrendCache) Bytes() []byte {
+	tc.Lock.Lock()
+	defer tc.Lock.Unlock()
+	return tc.body
+}
+
+func (tc *TrendCache) Version() int64 {
+	tc.Lock.Lock()
+	defer tc.Lock.Unlock()
+	return tc.version
+}
+
 func (tc *TrendCache) Set(res []TrendResponse) {
+	body, err := json.Marshal(res)
+	if err != nil {
+		workerLogger.Error().Err(err).Msg("failed to marshal trend")
+		return
+	}
+	tc.Lock.Lock()
+	tc.res = res
+	tc.body = body
+	tc.version++
+	version := tc.version
+	tc.Lock.Unlock()
+	routeCache.Bust(trendRoutePolicy.Name, "")
+	queueTrendSnapshot(version, body)
+}
+
+// 保存しておいたスナップショットに戻す
+func (tc *TrendCache) Restore(version int64, res []TrendResponse, body []byte) {
 	tc.Lock.Lock()
 	defer tc.Lock.Unlock()
 	tc.res = res
+	tc.body = body
+	tc.version = version
 }
 
 var trendCache *TrendCache
 
 func NewTrendCache() *TrendCache {
 	return &TrendCache{
-		res: make([]TrendResponse, 0, 1024),
+		res:  make([]TrendResponse, 0, 1024),
+		body: []byte("[]"),
 	}
 }
 
 type InsertQueue struct {
 	Queue []IsuCondition
-	Lock  sync.Mutex
+	// キューの先頭と，書き込み中のものが入った時刻．ここからの経過時間を書き込みの遅れとみなす
+	oldest   time.Time
+	inFlight time.Time
+	Lock     sync.Mutex
 }
 
 const queueSize = 10240
@@ -305,6 +528,9 @@ var insertQueue *InsertQueue
 func (iq *InsertQueue) Insert(conds []IsuCondition) {
 	iq.Lock.Lock()
 	defer iq.Lock.Unlock()
+	if len(iq.Queue) == 0 {
+		iq.oldest = time.Now()
+	}
 	iq.Queue = append(iq.Queue, conds...)
 }
 
@@ -313,9 +539,42 @@ func (iq *InsertQueue) PopAll() []IsuCondition {
 	defer iq.Lock.Unlock()
 	queue := iq.Queue
 	iq.Queue = make([]IsuCondition, 0, queueSize)
+	if len(queue) > 0 {
+		iq.inFlight = iq.oldest
+		iq.oldest = time.Time{}
+	}
 	return queue
 }
 
+// PopAllで取り出したものの書き込みが(成否によらず)終わった
+func (iq *InsertQueue) Done() {
+	iq.Lock.Lock()
+	defer iq.Lock.Unlock()
+	iq.inFlight = time.Time{}
+}
+
+// 受け付けてからまだ書き込めていないもののうち，最も古いものの経過時間
+func (iq *InsertQueue) Lag() time.Duration {
+	iq.Lock.Lock()
+	defer iq.Lock.Unlock()
+	oldest := iq.inFlight
+	if oldest.IsZero() || (!iq.oldest.IsZero() && iq.oldest.Before(oldest)) {
+		oldest = iq.oldest
+	}
+	if oldest.IsZero() {
+		return 0
+	}
+	return time.Since(oldest)
+}
+
+func getDB() *sqlx.DB {
+	return currentDB.Load()
+}
+
+func getMySQLConnectionEnv() *MySQLConnectionEnv {
+	return currentMySQLConnectionData.Load()
+}
+
 func NewQueue() *InsertQueue {
 	return &InsertQueue{
 		Queue: make([]IsuCondition, 0, queueSize),
@@ -325,11 +584,23 @@ func NewQueue() *InsertQueue {
 func getEnv(key string, defaultValue string) string {
 	val := os.Getenv(key)
 	if val != "" {
+		resolvedConfig.Record(key, val, false)
 		return val
 	}
+	resolvedConfig.Record(key, defaultValue, true)
 	return defaultValue
 }
 
+func getEnvInt(key string, defaultValue int) int {
+	val, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		resolvedConfig.Record(key, strconv.Itoa(defaultValue), true)
+		return defaultValue
+	}
+	resolvedConfig.Record(key, strconv.Itoa(val), false)
+	return val
+}
+
 func NewMySQLConnectionEnv() *MySQLConnectionEnv {
 	return &MySQLConnectionEnv{
 		Host:     getEnv("MYSQL_HOST", "127.0.0.1"),
@@ -373,29 +644,45 @@ func (j *JSONSerializer) Deserialize(c echo.Context, i interface{}) error {
 func init() {
 	key, err := os.ReadFile(jiaJWTSigningKeyPath)
 	if err != nil {
-		log.Fatalf("failed to read file: %v", err)
+		systemLogger.Fatal().Err(err).Str("path", jiaJWTSigningKeyPath).Msg("failed to read file")
 	}
 	jiaJWTSigningKey, err = jwt.ParseECPublicKeyFromPEM(key)
 	if err != nil {
-		log.Fatalf("failed to parse ECDSA public key: %v", err)
+		systemLogger.Fatal().Err(err).Msg("failed to parse ECDSA public key")
 	}
 
 	insertQueue = NewQueue()
 	trendCache = NewTrendCache()
+	err = loadTrendSnapshot()
+	if err != nil {
+		systemLogger.Warn().Err(err).Msg("failed to load trend snapshot")
+	}
 
 	defaultIcon, err = os.ReadFile(defaultIconFilePath)
 	if err != nil {
-		log.Fatalf("failed to read file: %v", err)
+		systemLogger.Fatal().Err(err).Str("path", defaultIconFilePath).Msg("failed to read file")
 	}
-
-	isuCache = &IsuCache{
-		cache: make(map[string]*Isu),
+	if defaultIconSet.Enabled() {
+		_, err = defaultIconSet.Reload()
+		if err != nil {
+			systemLogger.Error().Err(err).Str("dir", defaultIconSet.dir).Msg("failed to load default icons")
+		}
 	}
-	userCache = &UserCache{
-		cache: make(map[string]struct{}),
+
+	// 件数の上限は0なら無制限
+	isuCache = NewIsuCache(getEnvInt("ISU_CACHE_MAX_ENTRIES", 0))
+	userCache = NewUserCache(getEnvInt("USER_CACHE_MAX_ENTRIES", 0))
+	// 最新コンディションはForgetでしか消えず，長い負荷走行の間に増え続けるので既定で上限を設ける
+	isuConditionCache = NewIsuConditionCache(getEnvInt("ISU_CONDITION_CACHE_MAX_ENTRIES", 200000))
+	configCache = &ConfigCache{
+		cache: make(map[string]string),
 	}
-	isuConditionCache = &IsuConditionCache{
-		cache: make(map[string]*IsuCondition),
+	iconCache, err = NewIconCache(
+		getEnv("ICON_CACHE_DIR", "/tmp/isucondition-icons"),
+		getEnvInt("ICON_CACHE_BYTES", 64*1024*1024),
+	)
+	if err != nil {
+		systemLogger.Fatal().Err(err).Msg("failed to create icon cache")
 	}
 
 	http.DefaultTransport.(*http.Transport).MaxIdleConns = 0                // infinite
@@ -428,28 +715,101 @@ func newUnixDomainSockListener() (net.Listener, bool, error) {
 }
 
 func main() {
+	flag.Parse()
+	if *checkIntegrityFlag {
+		os.Exit(runIntegrityCLI())
+	}
+	tuneRuntime()
+
 	e := echo.New()
+	e.Logger = newEchoLogger(apiLogger)
 	e.JSONSerializer = &JSONSerializer{}
 	// e.JSONSerializer = fj4echo.New()
-	e.Use(middleware.Recover())
-	e.POST("/initialize", postInitialize)
-
-	e.Use(
-		session.Middleware(sessions.NewCookieStore([]byte(getEnv("SESSION_KEY", "isucondition")))),
+	e.Use(panicRecoverMiddleware())
+	e.Use(requestIDMiddleware())
+	e.Use(metricsMiddleware())
+	applyProfile(e)
+	if dir := os.Getenv("GOLDEN_RECORD_DIR"); dir != "" {
+		e.Use(goldenRecorderMiddleware(dir))
+	}
+	// 運用系: セッションもCSRF対策も不要
+	ops := e.Group("")
+	ops.POST("/initialize", postInitialize)
+	ops.GET("/internal/log/level", getLogLevel)
+	ops.GET("/internal/panics", getPanics)
+	ops.GET("/internal/workers", getWorkers)
+	ops.GET("/internal/topology", getTopology)
+	ops.GET("/internal/db/pools", getDBPools)
+	ops.GET("/internal/routing", getRouting)
+	ops.GET("/debug/config", getDebugConfig)
+	ops.GET("/internal/integrity", getIntegrity)
+	ops.GET("/internal/flags", getFeatureFlags)
+	ops.GET("/internal/shadow", getShadowStats)
+	ops.GET("/internal/usage", getUsage)
+	ops.GET("/internal/ingest/shed", getShedStats)
+	ops.GET("/internal/conditions/level_selectivity", getLevelSelectivity)
+	ops.POST("/internal/cache/verify", postCacheVerify)
+	ops.GET("/internal/backups", getBackups)
+	ops.GET("/internal/trend/stats", getTrendStats)
+	ops.GET("/internal/jobs/level-recalc", getLevelRecalc)
+	ops.GET("/internal/metrics", getMetrics)
+	ops.POST("/internal/metrics/save", postMetricsSave)
+	// 運用系のうちDBやサーバーの状態を書き換えるものと，データを持ち出せるもの: ADMIN_TOKENか同じホストからだけ受ける
+	// 他のサーバーから呼ばれるもの(キャッシュの破棄など)はADMIN_TOKENを設定しないと届かない
+	admin := e.Group("", adminAuthMiddleware())
+	admin.PUT("/internal/config/jia_service_url", putJIAServiceURL)
+	admin.POST("/internal/backups", postBackup)
+	admin.POST("/internal/backups/:name/restore", postRestore)
+	admin.POST("/internal/cache/invalidate", postCacheInvalidate)
+	admin.PUT("/internal/trend", putTrend)
+	admin.PUT("/internal/log/level", putLogLevel)
+	admin.GET("/internal/export/conditions", getConditionExport)
+	admin.POST("/internal/jobs/level-recalc", postLevelRecalc)
+	admin.PUT("/internal/flags/:name", putFeatureFlag)
+	admin.GET("/debug/lastpanics", getLastPanics)
+
+	// ISUからのコンディション送信: 最もリクエストが多いので余計なミドルウェアを通さない
+	ingest := e.Group("")
+	ingest.POST("/api/condition/:jia_isu_uuid", postIsuCondition)
+
+	// ログイン不要で見られるAPI
+	public := e.Group("/api")
+	public.GET("/trend", getTrend, routeCacheMiddleware(trendRoutePolicy))
+	public.HEAD("/trend", getTrend)
+
+	// ユーザー向けAPI: セッションを使う
+	user := e.Group("/api", append(sessionMiddlewares(), isuUUIDParamMiddleware())...)
+	user.POST("/auth", postAuthentication)
+	user.POST("/signout", postSignout)
+	user.GET("/user/me", getMe)
+	user.DELETE("/user/me", deleteMe)
+	user.GET("/user/me/usage", getMyUsage)
+	user.GET("/trend/mine", getMyTrend)
+	user.GET("/isu", getIsuList)
+	user.HEAD("/isu", getIsuList)
+	user.POST("/isu", postIsu, idempotencyMiddleware())
+	user.GET("/isu/search", searchIsu)
+	user.GET("/isu/transfers", getIsuTransfers)
+	user.POST("/isu/transfers/:transfer_id/accept", postIsuTransferAccept)
+	user.GET("/isu/:jia_isu_uuid", getIsuID)
+	user.GET("/isu/:jia_isu_uuid/icon", getIsuIcon)
+	user.HEAD("/isu/:jia_isu_uuid/icon", getIsuIcon)
+	user.GET(
+		"/isu/:jia_isu_uuid/graph", getIsuGraph,
+		routeCacheMiddleware(graphRoutePolicy), concurrencyLimitMiddleware(graphLimiter),
 	)
-
-	e.POST("/api/auth", postAuthentication)
-	e.POST("/api/signout", postSignout)
-	e.GET("/api/user/me", getMe)
-	e.GET("/api/isu", getIsuList)
-	e.POST("/api/isu", postIsu)
-	e.GET("/api/isu/:jia_isu_uuid", getIsuID)
-	e.GET("/api/isu/:jia_isu_uuid/icon", getIsuIcon)
-	e.GET("/api/isu/:jia_isu_uuid/graph", getIsuGraph)
-	e.GET("/api/condition/:jia_isu_uuid", getIsuConditions)
-	e.GET("/api/trend", getTrend)
-
-	e.POST("/api/condition/:jia_isu_uuid", postIsuCondition)
+	user.GET("/isu/:jia_isu_uuid/incidents", getIsuIncidents)
+	user.GET("/incidents", getIncidents)
+	user.GET("/isu/:jia_isu_uuid/gaps", getIsuGaps)
+	user.GET("/isu/:jia_isu_uuid/heatmap", getIsuHeatmap)
+	user.GET("/isu/:jia_isu_uuid/report", getIsuReport)
+	user.GET("/isu/:jia_isu_uuid/settings", getIsuSettings)
+	user.PUT("/isu/:jia_isu_uuid/settings", putIsuSettings)
+	user.GET("/isu/:jia_isu_uuid/mute", getIsuMute)
+	user.POST("/isu/:jia_isu_uuid/mute", postIsuMute)
+	user.POST("/isu/:jia_isu_uuid/transfer", postIsuTransfer)
+	user.GET("/condition/:jia_isu_uuid", getIsuConditions, concurrencyLimitMiddleware(conditionsLimiter))
+	user.GET("/events", getEvents)
 
 	// e.GET("/", getIndex)
 	// e.GET("/isu/:jia_isu_uuid", getIndex)
@@ -460,28 +820,122 @@ func main() {
 
 	http.DefaultServeMux.Handle("/debug/fgprof", fgprof.Handler())
 	go func() {
-		fmt.Println(http.ListenAndServe(":6060", nil))
+		err := http.ListenAndServe(":6060", nil)
+		systemLogger.Error().Err(err).Msg("pprof server stopped")
 	}()
-	mySQLConnectionData = NewMySQLConnectionEnv()
+	mySQLConnectionData := NewMySQLConnectionEnv()
+	currentMySQLConnectionData.Store(mySQLConnectionData)
 
-	var err error
-	db, err = mySQLConnectionData.ConnectDB()
+	newDB, err := mySQLConnectionData.ConnectDB()
+	if err != nil {
+		e.Logger.Fatalf("failed to connect db: %v", err)
+		return
+	}
+	currentDB.Store(newDB)
+	priorityDB, err := connectPriorityDB(mySQLConnectionData)
 	if err != nil {
 		e.Logger.Fatalf("failed to connect db: %v", err)
 		return
 	}
-	db.SetMaxOpenConns(1024)
-	db.SetMaxIdleConns(1024)
-	defer db.Close()
+	currentPriorityDB.Store(priorityDB)
+	err = checkSchema()
+	if err != nil {
+		systemLogger.Error().Err(err).Msg("schema check failed: run sql/init.sh")
+	}
+
+	settings := RecommendedSettings{
+		MaxOpenConns:  1024,
+		FlushInterval: time.Millisecond * 100,
+		TrendInterval: time.Millisecond * 100,
+	}
+	// STARTUP_PROBE=1 で計測結果と推奨設定をログに出し，=apply でそのまま適用する
+	if probeMode := os.Getenv("STARTUP_PROBE"); probeMode != "" {
+		result, err := runStartupProbe()
+		if err != nil {
+			systemLogger.Error().Err(err).Msg("startup probe failed")
+		} else {
+			recommended := result.Recommend()
+			systemLogger.Info().
+				Dur("db_round_trip", result.DBRoundTrip).
+				Float64("json_bytes_per_sec", result.JSONBytesPerSec).
+				Float64("disk_bytes_per_sec", result.DiskBytesPerSec).
+				Int("num_cpu", result.NumCPU).
+				Dur("elapsed", result.ProbeElapsedTime).
+				Int("recommended_max_open_conns", recommended.MaxOpenConns).
+				Dur("recommended_flush_interval", recommended.FlushInterval).
+				Dur("recommended_trend_interval", recommended.TrendInterval).
+				Bool("applied", probeMode == "apply").
+				Msg("startup probe")
+			if probeMode == "apply" {
+				settings = recommended
+			}
+		}
+	}
+	getDB().SetMaxOpenConns(settings.MaxOpenConns)
+	getDB().SetMaxIdleConns(settings.MaxOpenConns)
+	// 切り替え後のものを閉じる
+	defer func() {
+		getDB().Close()
+		currentPriorityDB.Load().Close()
+	}()
+
+	dbSupervisor = NewDBSupervisor(
+		parseDBHosts(os.Getenv("MYSQL_HOSTS"), mySQLConnectionData.Host),
+		getEnvInt("DB_FAILOVER_THRESHOLD", 3),
+		settings.MaxOpenConns,
+	)
+	workerManager.Go("db_supervisor", func(ctx context.Context) error {
+		dbSupervisor.superviseScheduled(ctx, time.Second)
+		return nil
+	})
 
-	postIsuConditionTargetBaseURL = os.Getenv("POST_ISUCONDITION_TARGET_BASE_URL")
-	if postIsuConditionTargetBaseURL == "" {
+	if postIsuConditionTargetBaseURL() == "" {
 		e.Logger.Fatalf("missing: POST_ISUCONDITION_TARGET_BASE_URL")
 		return
 	}
 
+	workerManager.Go("config_watcher", func(ctx context.Context) error {
+		watchConfigScheduled(ctx, time.Second*5)
+		return nil
+	})
+	workerManager.Go("trend_snapshot", func(ctx context.Context) error {
+		trendSnapshotScheduled(ctx, trendSnapshotInterval)
+		return nil
+	})
+	workerManager.Go("log_sampler", func(ctx context.Context) error {
+		logRegistry.flushSamplersScheduled(ctx, time.Second*10)
+		return nil
+	})
+	workerManager.Go("webhook", func(ctx context.Context) error {
+		webhookDispatcher.Run(ctx)
+		return nil
+	})
+	workerManager.Go("icon_persister", iconPersister.Run)
+	workerManager.Go("default_icon_reloader", func(ctx context.Context) error {
+		defaultIconSet.reloadScheduled(ctx, time.Second*5)
+		return nil
+	})
+	workerManager.Go("route_cache_sweeper", func(ctx context.Context) error {
+		routeCache.sweepScheduled(ctx, time.Second*10)
+		return nil
+	})
+	workerManager.Go("memory_guard", func(ctx context.Context) error {
+		memoryGuardScheduled(ctx, time.Second, uint64(getEnvInt("MEMORY_GUARD_BYTES", 0)))
+		return nil
+	})
+
 	if os.Getenv("SRVNO") == "1" {
-		go insertIsuConditionScheduled(time.Millisecond * 100)
+		// 前回の/initializeの途中で落ちた場合などに備えて，足りないインデックスを裏で張る
+		workerManager.Go("index_builder", ensureIndexes)
+		// condition_flushより先に登録し，止めるときはflushで積まれたものを書き出してから止める
+		workerManager.Go("incident_writer", func(ctx context.Context) error {
+			incidentTracker.writeScheduled(ctx, settings.FlushInterval)
+			return nil
+		})
+		workerManager.Go("condition_flush", func(ctx context.Context) error {
+			insertIsuConditionScheduled(ctx, settings.FlushInterval)
+			return nil
+		})
 		listener, isUnixDomainSock, err := newUnixDomainSockListener()
 		if err != nil {
 			e.Logger.Fatalf("failed to create unix domain socket listener: %v", err)
@@ -489,13 +943,79 @@ func main() {
 		}
 
 		if isUnixDomainSock {
-			e.Listener = listener
+			e.Listener = newTunedListener(listener, listenerOptions)
+		}
+		warm := func() {
+			start := time.Now()
+			err := warmTrendCache()
+			if err != nil {
+				systemLogger.Error().Err(err).Msg("failed to warm trend cache")
+			} else {
+				systemLogger.Info().Dur("elapsed", time.Since(start)).Msg("trend cache warmed")
+			}
+		}
+		// スナップショットがあればそれを返しながら裏で計算し，なければ計算し終わるまで待つ
+		if trendCache.Version() > 0 {
+			go warm()
+		} else {
+			warm()
+		}
+		workerManager.Go("trend", func(ctx context.Context) error {
+			calculateTrendScheduled(ctx, settings.TrendInterval)
+			return nil
+		})
+		workerManager.Go("trend_distributor", trendDistributor.Run)
+		workerManager.Go("activation_outbox", func(ctx context.Context) error {
+			activationOutboxScheduled(ctx, time.Second)
+			return nil
+		})
+		if addr := os.Getenv("UDP_INGEST_ADDR"); addr != "" {
+			workerManager.Go("udp_ingest", func(ctx context.Context) error {
+				return serveUDPIngest(ctx, addr)
+			})
 		}
-		go calculateTrendScheduled(time.Millisecond * 100)
 	}
 
 	serverPort := fmt.Sprintf(":%v", getEnv("SERVER_APP_PORT", "3000"))
-	e.Logger.Fatal(e.Start(serverPort))
+	if e.Listener == nil {
+		listener, err := net.Listen("tcp", serverPort)
+		if err != nil {
+			e.Logger.Fatalf("failed to listen: %v", err)
+			return
+		}
+		e.Listener = newTunedListener(listener, listenerOptions)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		err := e.Start(serverPort)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			e.Logger.Fatal(err)
+		}
+	}()
+	<-ctx.Done()
+
+	// 先にリクエストの受け付けを止めてから，キューの書き出しなどを済ませてワーカーを止める
+	systemLogger.Info().Msg("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = e.Shutdown(shutdownCtx)
+	if err != nil {
+		systemLogger.Error().Err(err).Msg("failed to shut down server")
+	}
+	err = workerManager.Shutdown(shutdownCtx)
+	if err != nil {
+		systemLogger.Error().Err(err).Msg("failed to stop workers")
+	}
+}
+
+func sessionMiddlewares() []echo.MiddlewareFunc {
+	middlewares := []echo.MiddlewareFunc{
+		session.Middleware(sessions.NewCookieStore([]byte(getEnv("SESSION_KEY", "isucondition")))),
+		usageMiddleware(),
+	}
+	return append(middlewares, profileSessionMiddlewares()...)
 }
 
 func getUserIDFromSession(c echo.Context) (string, int, error) {
@@ -506,15 +1026,19 @@ func getUserIDFromSession(c echo.Context) (string, int, error) {
 	}
 	_jiaUserID, ok := session.Values["jia_user_id"]
 	if !ok {
-		c.Logger().Errorf("no session")
+		c.Logger().Debugf("no session")
 		return "", http.StatusUnauthorized, fmt.Errorf("no session")
 	}
 
-	jiaUserID := _jiaUserID.(string)
+	jiaUserID, ok := _jiaUserID.(string)
+	if !ok {
+		return "", http.StatusUnauthorized, fmt.Errorf("invalid session")
+	}
+	c.Set(contextKeyJIAUserID, jiaUserID)
 
 	if _, err := userCache.Get(jiaUserID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			c.Logger().Errorf("not found: user")
+			c.Logger().Debugf("not found: user")
 			return "", http.StatusUnauthorized, fmt.Errorf("not found: user")
 		}
 		c.Logger().Errorf("db error: %v", err)
@@ -524,75 +1048,110 @@ func getUserIDFromSession(c echo.Context) (string, int, error) {
 	return jiaUserID, 0, nil
 }
 
-func getJIAServiceURL(tx *sqlx.Tx) string {
-	var config Config
-	err := tx.Get(
-		&config,
-		"SELECT * FROM `isu_association_config` WHERE `name` = ?",
-		"jia_service_url",
-	)
+func getJIAServiceURL() string {
+	url, err := configCache.Get(configNameJIAServiceURL)
 	if err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
-			log.Print(err)
+			apiLogger.Error().Err(err).Msg("failed to get jia_service_url")
 		}
 		return defaultJIAServiceURL
 	}
-	return config.URL
+	return url
 }
 
-// POST /initialize
-// サービスを初期化
-func postInitialize(c echo.Context) error {
+func setJIAServiceURL(url string) error {
+	_, err := getDB().Exec(
+		"INSERT INTO `isu_association_config` (`name`, `url`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `url` = VALUES(`url`)",
+		configNameJIAServiceURL,
+		url,
+	)
+	if err != nil {
+		return err
+	}
+	configCache.Set(configNameJIAServiceURL, url)
+	return nil
+}
+
+// PUT /internal/config/jia_service_url
+// 全体を初期化せずにJIAのURLだけを差し替える
+func putJIAServiceURL(c echo.Context) error {
 	var request InitializeRequest
 	err := c.Bind(&request)
-	if err != nil {
+	if err != nil || request.JIAServiceURL == "" {
 		return c.String(http.StatusBadRequest, "bad request body")
 	}
 
-	cmd := exec.Command("../sql/init.sh")
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stderr
-	err = cmd.Run()
+	err = setJIAServiceURL(request.JIAServiceURL)
 	if err != nil {
-		c.Logger().Errorf("exec init.sh error: %v", err)
+		c.Logger().Errorf("db error : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	return c.NoContent(http.StatusNoContent)
+}
 
-	_, err = db.Exec(
-		"INSERT INTO `isu_association_config` (`name`, `url`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `url` = VALUES(`url`)",
-		"jia_service_url",
-		request.JIAServiceURL,
+// isu_condition.levelが生成列になっているか確認する
+// 古いスキーマのままだとlevelを書かないINSERTが失敗するので，起動時に気付けるようにする
+func checkSchema() error {
+	var extra string
+	err := getDB().Get(
+		&extra,
+		"SELECT `EXTRA` FROM `information_schema`.`COLUMNS` WHERE `TABLE_SCHEMA` = DATABASE() AND `TABLE_NAME` = 'isu_condition' AND `COLUMN_NAME` = 'level'",
 	)
 	if err != nil {
-		c.Logger().Errorf("db error : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return fmt.Errorf("db error: %v", err)
 	}
+	if !strings.Contains(strings.ToUpper(extra), "VIRTUAL") && !strings.Contains(strings.ToUpper(extra), "STORED") {
+		return fmt.Errorf("isu_condition.level is not a generated column")
+	}
+	return nil
+}
 
-	conds := []IsuCondition{}
-	err = db.Select(
-		&conds,
-		"SELECT `jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`, `level` FROM `isu_condition`",
-	)
+// POST /initialize
+// サービスを初期化
+func postInitialize(c echo.Context) error {
+	var request InitializeRequest
+	err := c.Bind(&request)
 	if err != nil {
-		c.Logger().Errorf("db error : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return c.String(http.StatusBadRequest, "bad request body")
 	}
-	for _, cond := range conds {
-		cond.Level, err = calculateConditionLevel(cond.Condition)
+
+	// ベンチマーカーのリトライで/initializeが並行に呼ばれた場合は，実行中のものの結果を待って返す
+	status := initializeGuard.Do(func() int {
+		// バックアップ・復元と交錯しないようにする
+		initializeLock.Lock()
+		defer initializeLock.Unlock()
+		flushLock.Lock()
+		defer flushLock.Unlock()
+		discardInsertQueue()
+
+		cmd := exec.Command("../sql/init.sh")
+		cmd.Stderr = os.Stderr
+		cmd.Stdout = os.Stderr
+		err := cmd.Run()
 		if err != nil {
-			c.Logger().Errorf("failed to calculate condition level: %v", err)
-			return c.NoContent(http.StatusInternalServerError)
+			c.Logger().Errorf("exec init.sh error: %v", err)
+			return http.StatusInternalServerError
 		}
-		_, err = db.Exec(
-			"UPDATE `isu_condition` SET `level` = ? WHERE `jia_isu_uuid` = ? AND `timestamp` = ?",
-			cond.Level,
-			cond.JIAIsuUUID,
-			cond.Timestamp,
-		)
+		err = ensureIndexes(c.Request().Context())
+		if err != nil {
+			c.Logger().Errorf("failed to build indexes: %v", err)
+			return http.StatusInternalServerError
+		}
+
+		// levelはisu_conditionの生成列としてDB側で計算されるので，ここで埋め直す必要はない
+		resetInMemoryState()
+		err = setJIAServiceURL(request.JIAServiceURL)
 		if err != nil {
 			c.Logger().Errorf("db error : %v", err)
-			return c.NoContent(http.StatusInternalServerError)
+			return http.StatusInternalServerError
 		}
+		// 他のサーバーも作り直したDBと食い違わないようにする
+		broadcastReset()
+		scheduleCacheVerify()
+		return http.StatusOK
+	})
+	if status != http.StatusOK {
+		return c.NoContent(status)
 	}
 
 	return c.JSON(http.StatusOK, InitializeResponse{
@@ -629,16 +1188,12 @@ func postAuthentication(c echo.Context) error {
 		c.Logger().Errorf("invalid JWT payload")
 		return c.NoContent(http.StatusInternalServerError)
 	}
-	jiaUserIDVar, ok := claims["jia_user_id"]
-	if !ok {
-		return c.String(http.StatusBadRequest, "invalid JWT payload")
-	}
-	jiaUserID, ok := jiaUserIDVar.(string)
-	if !ok {
+	jiaUserID, err := jiaUserIDFromClaims(claims)
+	if err != nil {
 		return c.String(http.StatusBadRequest, "invalid JWT payload")
 	}
 
-	_, err = db.Exec("INSERT IGNORE INTO user (`jia_user_id`) VALUES (?)", jiaUserID)
+	_, err = getPriorityDB().Exec("INSERT IGNORE INTO user (`jia_user_id`) VALUES (?)", jiaUserID)
 	if err != nil {
 		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
@@ -663,6 +1218,18 @@ func postAuthentication(c echo.Context) error {
 	return c.NoContent(http.StatusOK)
 }
 
+// user.jia_user_idに入らないものはDBに渡す前に弾く
+func jiaUserIDFromClaims(claims jwt.MapClaims) (string, error) {
+	jiaUserID, ok := claims["jia_user_id"].(string)
+	if !ok {
+		return "", fmt.Errorf("jia_user_id is not a string")
+	}
+	if jiaUserID == "" || utf8.RuneCountInString(jiaUserID) > jiaUserIDMaxLength || !utf8.ValidString(jiaUserID) {
+		return "", fmt.Errorf("invalid jia_user_id")
+	}
+	return jiaUserID, nil
+}
+
 // POST /api/signout
 // サインアウト
 func postSignout(c echo.Context) error {
@@ -676,23 +1243,26 @@ func postSignout(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	sess, err := session.Get(sessionName, c)
+	err = expireSession(c)
 	if err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
+	return c.NoContent(http.StatusOK)
+}
+
+// セッションのクッキーを消す
+func expireSession(c echo.Context) error {
+	sess, err := session.Get(sessionName, c)
+	if err != nil {
+		return err
+	}
 	sess.Options = &sessions.Options{MaxAge: -1, Path: "/"}
 	sess.Options.Secure = false
 	sess.Options.HttpOnly = true
 	sess.Options.SameSite = http.SameSiteLaxMode
-	err = sess.Save(c.Request(), c.Response())
-	if err != nil {
-		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-
-	return c.NoContent(http.StatusOK)
+	return sess.Save(c.Request(), c.Response())
 }
 
 // GET /api/user/me
@@ -713,6 +1283,7 @@ func getMe(c echo.Context) error {
 }
 
 // GET /api/isu
+// HEAD /api/isu
 // ISUの一覧を取得
 func getIsuList(c echo.Context) error {
 	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
@@ -725,6 +1296,15 @@ func getIsuList(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
+	var fields isuListFields
+	var condFields conditionFields
+	if param := c.QueryParam("fields"); param != "" {
+		fields, condFields, err = parseIsuListFields(param)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "bad format: fields")
+		}
+	}
+
 	// tx, err := db.Beginx()
 	// if err != nil {
 	// 	c.Logger().Errorf("db error: %v", err)
@@ -735,25 +1315,29 @@ func getIsuList(c echo.Context) error {
 
 	stmt := "SELECT `id`, `jia_isu_uuid`, `name`, `character` FROM `isu` WHERE `jia_user_id` = ? ORDER BY `id` DESC"
 
-	isuList := []Isu{}
+	isuList := []IsuMeta{}
 
-	err = db.Select(&isuList, stmt, jiaUserID)
+	err = getDB().Select(&isuList, stmt, jiaUserID)
 	if err != nil {
 		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	// 一覧は登録直後に変わるので常にDBから読み，検索用に覚えておく
+	userIsuListCache.Set(jiaUserID, isuList)
+
+	jiaIsuUUIDs := make([]string, 0, len(isuList))
+	for _, isu := range isuList {
+		jiaIsuUUIDs = append(jiaIsuUUIDs, isu.JIAIsuUUID)
+	}
+	lastConditions, err := isuConditionCache.GetMulti(jiaIsuUUIDs)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
 
 	responseList := make([]GetIsuListResponse, 0, len(isuList))
-	found := true
 	for _, isu := range isuList {
-		lastCondition, err := isuConditionCache.Get(isu.JIAIsuUUID)
-		if err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				found = false
-			} else {
-				return c.NoContent(http.StatusInternalServerError)
-			}
-		}
+		lastCondition, found := lastConditions[isu.JIAIsuUUID]
 		var formattedCondition *GetIsuConditionResponse
 		if found {
 			formattedCondition = &GetIsuConditionResponse{
@@ -783,7 +1367,10 @@ func getIsuList(c echo.Context) error {
 	// 	return c.NoContent(http.StatusInternalServerError)
 	// }
 
-	return c.JSON(http.StatusOK, responseList)
+	if fields != 0 {
+		return respondIsuListFields(c, responseList, fields, condFields)
+	}
+	return respondJSONArray(c, http.StatusOK, responseList)
 }
 
 // POST /api/isu
@@ -801,8 +1388,18 @@ func postIsu(c echo.Context) error {
 
 	useDefaultImage := false
 
+	// 形式の違うものはJIAのサービスに判断させるため，そのまま通す
 	jiaIsuUUID := c.FormValue("jia_isu_uuid")
-	isuName := c.FormValue("isu_name")
+	if canonical, ok := canonicalIsuUUID(jiaIsuUUID); ok {
+		jiaIsuUUID = canonical
+	}
+	isuName, truncated, err := sanitizeText(c.FormValue("isu_name"), isuNameMaxLength)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad format: isu_name")
+	}
+	if truncated {
+		c.Response().Header().Set(headerTextTruncated, "true")
+	}
 	fh, err := c.FormFile("image")
 	if err != nil {
 		if !errors.Is(err, http.ErrMissingFile) {
@@ -830,16 +1427,34 @@ func postIsu(c echo.Context) error {
 		}
 	}
 
-	tx, err := db.Beginx()
+	tx, err := getDB().Beginx()
 	if err != nil {
 		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 	defer tx.Rollback()
 
+	// 同じユーザーが同じ名前のISUを登録できないようにする(ISU_NAME_UNIQUE=1のときだけ)
+	if isuNameUnique {
+		var exists int
+		err = tx.Get(&exists, "SELECT COUNT(*) FROM `isu` WHERE `jia_user_id` = ? AND `name` = ? FOR UPDATE", jiaUserID, isuName)
+		if err != nil {
+			c.Logger().Errorf("db error: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if exists > 0 {
+			return c.String(http.StatusConflict, "duplicated: isu_name")
+		}
+	}
+
+	// 非同期で書く場合は，数MBになりうるBLOBを登録のトランザクションに載せない
+	persistedImage := image
+	if iconPersister.Enabled() {
+		persistedImage = nil
+	}
 	_, err = tx.Exec("INSERT INTO `isu`"+
 		"	(`jia_isu_uuid`, `name`, `image`, `jia_user_id`) VALUES (?, ?, ?, ?)",
-		jiaIsuUUID, isuName, image, jiaUserID)
+		jiaIsuUUID, isuName, persistedImage, jiaUserID)
 	if err != nil {
 		mysqlErr, ok := err.(*mysql.MySQLError)
 
@@ -851,49 +1466,32 @@ func postIsu(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	targetURL := getJIAServiceURL(tx) + "/api/activate"
-	body := JIAServiceRequest{postIsuConditionTargetBaseURL, jiaIsuUUID}
-	bodysonic, err := json.Marshal(body)
-	if err != nil {
-		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-
-	reqJIA, err := http.NewRequest(http.MethodPost, targetURL, bytes.NewBuffer(bodysonic))
-	if err != nil {
-		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-
-	reqJIA.Header.Set("Content-Type", "application/json")
-	res, err := http.DefaultClient.Do(reqJIA)
-	if err != nil {
-		return c.NoContent(http.StatusInternalServerError)
-	}
-	defer res.Body.Close()
-
-	resBody, err := io.ReadAll(res.Body)
-	if err != nil {
-		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-
-	if res.StatusCode != http.StatusAccepted {
-		c.Logger().
-			Errorf("JIAService returned error: status code %v, message: %v", res.StatusCode, string(resBody))
-		return c.String(res.StatusCode, "JIAService returned error")
-	}
-
-	var isuFromJIA IsuFromJIA
-	err = json.Unmarshal(resBody, &isuFromJIA)
-	if err != nil {
-		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
+	// JIAのサービスが落ちている間は有効化を後回しにして，ハンドラがJIAの応答待ちで詰まらないようにする
+	character := ""
+	activationPending := !jiaCircuitBreaker.Allow()
+	if activationPending {
+		_, err = tx.Exec("INSERT INTO `isu_activation_outbox` (`jia_isu_uuid`) VALUES (?)", jiaIsuUUID)
+		if err != nil {
+			c.Logger().Errorf("db error: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	} else {
+		isuFromJIA, err := activateIsu(jiaIsuUUID, getRequestID(c))
+		if err != nil {
+			var jiaErr *JIAServiceError
+			if errors.As(err, &jiaErr) {
+				c.Logger().Error(err)
+				return c.String(jiaErr.StatusCode, "JIAService returned error")
+			}
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		character = isuFromJIA.Character
 	}
 
 	_, err = tx.Exec(
 		"UPDATE `isu` SET `character` = ? WHERE  `jia_isu_uuid` = ?",
-		isuFromJIA.Character,
+		character,
 		jiaIsuUUID,
 	)
 	if err != nil {
@@ -901,7 +1499,7 @@ func postIsu(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	var isu Isu
+	var isu IsuMeta
 	err = tx.Get(
 		&isu,
 		"SELECT `id`, `jia_isu_uuid`, `name`, `character`, `jia_user_id` FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ?",
@@ -920,6 +1518,30 @@ func postIsu(c echo.Context) error {
 	}
 
 	isuCache.Forget(jiaIsuUUID)
+	isuAuthCache.Forget(jiaIsuUUID)
+	userIsuListCache.Forget(jiaUserID)
+	userTrendCache.Forget(jiaUserID)
+	characterMembership.Add(isu)
+	// トレンドを計算するサーバーにも新しいISUを知らせる
+	broadcastCacheInvalidation(CacheInvalidation{JIAIsuUUIDs: []string{jiaIsuUUID}})
+	iconCache.Set(jiaIsuUUID, image)
+	if iconPersister.Enabled() && !iconPersister.Enqueue(jiaIsuUUID, image) {
+		err = persistIcon(jiaIsuUUID, image)
+		if err != nil {
+			c.Logger().Errorf("db error: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+	publishEvent(IsuEvent{
+		Type:       eventTypeIsuRegistered,
+		Timestamp:  time.Now().Unix(),
+		JIAUserID:  jiaUserID,
+		JIAIsuUUID: jiaIsuUUID,
+		Data:       isu,
+	})
+	if activationPending {
+		return c.JSON(http.StatusAccepted, PostIsuResponse{IsuMeta: isu, ActivationPending: true})
+	}
 	return c.JSON(http.StatusCreated, isu)
 }
 
@@ -950,6 +1572,15 @@ func getIsuID(c echo.Context) error {
 	// 	return c.NoContent(http.StatusInternalServerError)
 	// }
 
+	allowed, err := authorizeIsu(jiaUserID, jiaIsuUUID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if !allowed {
+		return c.String(http.StatusNotFound, "not found: isu")
+	}
+
 	isu, err := isuCache.Get(jiaIsuUUID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -958,14 +1589,11 @@ func getIsuID(c echo.Context) error {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
-
-	if isu.JIAUserID != jiaUserID {
-		return c.String(http.StatusNotFound, "not found: isu")
-	}
 	return c.JSON(http.StatusOK, isu)
 }
 
 // GET /api/isu/:jia_isu_uuid/icon
+// HEAD /api/isu/:jia_isu_uuid/icon
 // ISUのアイコンを取得
 func getIsuIcon(c echo.Context) error {
 	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
@@ -980,24 +1608,76 @@ func getIsuIcon(c echo.Context) error {
 
 	jiaIsuUUID := c.Param("jia_isu_uuid")
 
-	isu, err := isuCache.Get(jiaIsuUUID)
+	allowed, err := authorizeIsu(jiaUserID, jiaIsuUUID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if !allowed {
+		return c.String(http.StatusNotFound, "not found: isu")
+	}
+
+	image, err := iconCache.Get(jiaIsuUUID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return c.String(http.StatusNotFound, "not found: isu")
 		}
+		if errors.Is(err, errIconNotPersisted) {
+			c.Response().Header().Set(echo.HeaderRetryAfter, "1")
+			return c.String(http.StatusServiceUnavailable, "icon is not ready")
+		}
 
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	image, replaced, err := characterDefaultIcon(jiaIsuUUID, image)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
 
-	if isu.JIAUserID != jiaUserID {
-		return c.String(http.StatusNotFound, "not found: isu")
+	contentType := iconContentType(image)
+	c.Response().Header().Set(echo.HeaderContentType, contentType)
+	c.Response().Header().Set("X-Content-Type-Options", "nosniff")
+
+	// HEADはContent-Lengthだけ返せばよいので，nginxには渡さない
+	if c.Request().Method == http.MethodHead {
+		return writeBlob(c, http.StatusOK, contentType, image)
+	}
+
+	// nginxと同じホストで動いている場合は，ファイルの送信をnginxに任せる
+	// ディスクにあるのは差し替える前のNoImage.jpgなので，差し替えたものは自分で返す
+	sendfileMode := iconSendfileMode
+	if !featureFlags.Enabled(flagIconSendfile) || replaced {
+		sendfileMode = ""
+	}
+	switch sendfileMode {
+	case iconSendfileModeAccel:
+		if _, ok := iconCache.DiskPath(jiaIsuUUID); ok {
+			c.Response().Header().Set("X-Accel-Redirect", iconAccelRedirectPrefix+jiaIsuUUID)
+			return c.NoContent(http.StatusOK)
+		}
+	case iconSendfileModeSendfile:
+		if path, ok := iconCache.DiskPath(jiaIsuUUID); ok {
+			c.Response().Header().Set("X-Sendfile", path)
+			return c.NoContent(http.StatusOK)
+		}
 	}
 
-	return c.Blob(http.StatusOK, "", isu.Image)
+	return writeBlob(c, http.StatusOK, contentType, image)
 }
 
-// GET /api/isu/:jia_isu_uuid/graph
+// アイコンの中身からContent-Typeを判定する
+// 画像以外と判定されたものはブラウザに解釈させないようにoctet-streamで返す
+func iconContentType(image []byte) string {
+	contentType := http.DetectContentType(image)
+	if !strings.HasPrefix(contentType, "image/") {
+		return echo.MIMEOctetStream
+	}
+	return contentType
+}
+
+// GET /api/isu/:jia_isu_uuid/graph?datetime=&compare_previous=
 // ISUのコンディショングラフ描画のための情報を取得
 func getIsuGraph(c echo.Context) error {
 	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
@@ -1019,7 +1699,7 @@ func getIsuGraph(c echo.Context) error {
 	if err != nil {
 		return c.String(http.StatusBadRequest, "bad format: datetime")
 	}
-	date := time.Unix(datetimeInt64, 0).Truncate(time.Hour)
+	date := time.Unix(timeutil.TruncateHour(datetimeInt64), 0)
 
 	// tx, err := db.Beginx()
 	// if err != nil {
@@ -1043,17 +1723,12 @@ func getIsuGraph(c echo.Context) error {
 	// 	return c.String(http.StatusNotFound, "not found: isu")
 	// }
 
-	isu, err := isuCache.Get(jiaIsuUUID)
+	allowed, err := authorizeIsu(jiaUserID, jiaIsuUUID)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return c.String(http.StatusNotFound, "not found: isu")
-		}
-
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
-
-	if isu.JIAUserID != jiaUserID {
+	if !allowed {
 		return c.String(http.StatusNotFound, "not found: isu")
 	}
 
@@ -1063,13 +1738,24 @@ func getIsuGraph(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
+	// 前日比を描くために，直前の24時間分も同じレスポンスで返す
+	// 集計済みのテーブルはないので，当日分と同じくisu_conditionから作る
+	if c.QueryParam("compare_previous") == "true" {
+		previous, err := generateIsuGraphResponse(jiaIsuUUID, date.Add(-24*time.Hour))
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		return c.JSON(http.StatusOK, GraphCompareResponse{Current: res, Previous: previous})
+	}
+
 	// err = tx.Commit()
 	// if err != nil {
 	// 	c.Logger().Errorf("db error: %v", err)
 	// 	return c.NoContent(http.StatusInternalServerError)
 	// }
 	//
-	return c.JSON(http.StatusOK, res)
+	return respondJSONArray(c, http.StatusOK, res)
 }
 
 // グラフのデータ点を一日分生成
@@ -1078,69 +1764,46 @@ func generateIsuGraphResponse(
 	jiaIsuUUID string,
 	graphDate time.Time,
 ) ([]GraphResponse, error) {
-	dataPoints := []GraphDataPointWithInfo{}
-	conditionsInThisHour := []IsuCondition{}
-	timestampsInThisHour := []int64{}
-	var startTimeInThisHour time.Time
-	var condition IsuCondition
-
-	rows, err := db.Queryx(
-		"SELECT `jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`, `level` FROM `isu_condition` WHERE `jia_isu_uuid` = ? AND ? <= timestamp AND timestamp < ? ORDER BY `timestamp` ASC",
-		jiaIsuUUID,
-		graphDate,
-		graphDate.Add(time.Hour*24),
-	)
+	graphDate, endTime := graphWindow(graphDate)
+
+	settings, err := isuSettingsCache.Get(jiaIsuUUID)
 	if err != nil {
 		return nil, fmt.Errorf("db error: %v", err)
 	}
 
-	for rows.Next() {
-		err = rows.StructScan(&condition)
-		if err != nil {
-			return nil, err
-		}
-
-		truncatedConditionTime := condition.Timestamp.Truncate(time.Hour)
-		if truncatedConditionTime != startTimeInThisHour {
-			if len(conditionsInThisHour) > 0 {
-				data, err := calculateGraphDataPoint(conditionsInThisHour)
-				if err != nil {
-					return nil, err
-				}
-
-				dataPoints = append(dataPoints,
-					GraphDataPointWithInfo{
-						JIAIsuUUID:          jiaIsuUUID,
-						StartAt:             startTimeInThisHour,
-						Data:                data,
-						ConditionTimestamps: timestampsInThisHour,
-					})
-			}
+	if graphEmptyCache.Empty(jiaIsuUUID, graphDate) {
+		return emptyIsuGraphResponse(graphDate), nil
+	}
+	version := graphEmptyCache.Version(jiaIsuUUID)
 
-			startTimeInThisHour = truncatedConditionTime
-			conditionsInThisHour = []IsuCondition{}
-			timestampsInThisHour = []int64{}
-		}
-		conditionsInThisHour = append(conditionsInThisHour, condition)
-		timestampsInThisHour = append(timestampsInThisHour, condition.Timestamp.Unix())
+	var dataPoints []GraphDataPointWithInfo
+	// 判定ルールの上書きがなければDBのlevel列がそのまま使えるので，SQLで集計して行を転送しない
+	if settings == nil && featureFlags.Enabled(flagGraphSQLAggregation) {
+		dataPoints, err = aggregateIsuGraphDataPoints(jiaIsuUUID, graphDate, endTime)
+	} else {
+		dataPoints, err = scanIsuGraphDataPoints(jiaIsuUUID, graphDate, endTime, settings)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(dataPoints) == 0 {
+		graphEmptyCache.SetEmpty(jiaIsuUUID, graphDate, version)
+		return emptyIsuGraphResponse(graphDate), nil
 	}
+	return buildIsuGraphResponse(graphDate, dataPoints), nil
+}
 
-	if len(conditionsInThisHour) > 0 {
-		data, err := calculateGraphDataPoint(conditionsInThisHour)
-		if err != nil {
-			return nil, err
-		}
+// 起点を正時にそろえた，グラフの対象の[start, end)
+// コンディションは正時に切り下げてバケットに入れるので，起点がずれているとどのバケットにも入らない
+func graphWindow(graphDate time.Time) (time.Time, time.Time) {
+	start := time.Unix(timeutil.TruncateHour(graphDate.Unix()), 0)
+	return start, start.Add(time.Hour * graphWindowHours)
+}
 
-		dataPoints = append(dataPoints,
-			GraphDataPointWithInfo{
-				JIAIsuUUID:          jiaIsuUUID,
-				StartAt:             startTimeInThisHour,
-				Data:                data,
-				ConditionTimestamps: timestampsInThisHour,
-			})
-	}
+// 時刻順の1時間毎のデータ点を，データのない時間も含めたgraphWindowHours個のバケットに並べる
+func buildIsuGraphResponse(graphDate time.Time, dataPoints []GraphDataPointWithInfo) []GraphResponse {
+	graphDate, endTime := graphWindow(graphDate)
 
-	endTime := graphDate.Add(time.Hour * 24)
 	startIndex := len(dataPoints)
 	endNextIndex := len(dataPoints)
 	for i, graph := range dataPoints {
@@ -1157,11 +1820,11 @@ func generateIsuGraphResponse(
 		filteredDataPoints = dataPoints[startIndex:endNextIndex]
 	}
 
-	responseList := []GraphResponse{}
+	responseList := make([]GraphResponse, 0, graphWindowHours)
 	index := 0
 	thisTime := graphDate
 
-	for thisTime.Before(graphDate.Add(time.Hour * 24)) {
+	for thisTime.Before(endTime) {
 		var data *GraphDataPoint
 		timestamps := []int64{}
 
@@ -1186,65 +1849,206 @@ func generateIsuGraphResponse(
 		thisTime = thisTime.Add(time.Hour)
 	}
 
-	return responseList, nil
+	return responseList
 }
 
-// 複数のISUのコンディションからグラフの一つのデータ点を計算
-func calculateGraphDataPoint(isuConditions []IsuCondition) (GraphDataPoint, error) {
-	conditionsCount := map[string]int{"is_broken": 0, "is_dirty": 0, "is_overweight": 0}
-	rawScore := 0
-	for _, condition := range isuConditions {
-		badConditionsCount := 0
+// コンディションを1行ずつ読み，1時間毎に集計する
+// 行をStructScanせず，使い回す変数に読む．グラフに使わないjia_isu_uuidとmessageは読まない
+func scanIsuGraphDataPoints(jiaIsuUUID string, graphDate time.Time, endTime time.Time, settings *IsuSettings) ([]GraphDataPointWithInfo, error) {
+	rows, err := getDB().Query(
+		"SELECT `timestamp`, `is_sitting`, `condition` FROM `isu_condition`"+isuConditionRangeHint()+
+			" WHERE `jia_isu_uuid` = ? AND ? <= timestamp AND timestamp < ? ORDER BY `timestamp` ASC",
+		jiaIsuUUID,
+		graphDate,
+		endTime,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	defer rows.Close()
 
-		if !isValidConditionFormat(condition.Condition) {
-			return GraphDataPoint{}, fmt.Errorf("invalid condition format")
+	builder := newGraphDataPointsBuilder(jiaIsuUUID, settings)
+	var timestamp time.Time
+	var isSitting bool
+	var condition sql.RawBytes
+	for rows.Next() {
+		err = rows.Scan(&timestamp, &isSitting, &condition)
+		if err != nil {
+			return nil, err
+		}
+		err = builder.add(timestamp.Unix(), isSitting, condition)
+		if err != nil {
+			return nil, err
 		}
+	}
 
-		for _, condStr := range strings.Split(condition.Condition, ",") {
-			keyValue := strings.Split(condStr, "=")
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
 
-			conditionName := keyValue[0]
-			if keyValue[1] == "true" {
-				conditionsCount[conditionName] += 1
-				badConditionsCount++
-			}
-		}
+	return builder.finish(), nil
+}
 
-		if badConditionsCount >= 3 {
-			rawScore += scoreConditionLevelCritical
-		} else if badConditionsCount >= 1 {
-			rawScore += scoreConditionLevelWarning
-		} else {
-			rawScore += scoreConditionLevelInfo
-		}
+// 時刻順に渡されたコンディションを1時間毎のデータ点にまとめる
+type graphDataPointsBuilder struct {
+	jiaIsuUUID string
+	infos      *graphConditionInfos
+	dataPoints []GraphDataPointWithInfo
+	hour       graphHourAccumulator
+	hourIndex  int64
+	timestamps []int64
+}
+
+func newGraphDataPointsBuilder(jiaIsuUUID string, settings *IsuSettings) *graphDataPointsBuilder {
+	return &graphDataPointsBuilder{
+		jiaIsuUUID: jiaIsuUUID,
+		infos:      newGraphConditionInfos(settings),
+		dataPoints: []GraphDataPointWithInfo{},
+		timestamps: []int64{},
+	}
+}
+
+// conditionは呼び出しの間だけ有効なものでよい(判定はinfosに文字列としてコピーしたものを使う)
+func (b *graphDataPointsBuilder) add(unix int64, isSitting bool, condition []byte) error {
+	hourIndex := timeutil.HourIndex(unix)
+	if b.hour.count > 0 && hourIndex != b.hourIndex {
+		b.appendDataPoint()
+	}
+	b.hourIndex = hourIndex
+
+	info, err := b.infos.lookupBytes(condition)
+	if err != nil {
+		return err
+	}
+	b.hour.add(isSitting, info)
+	b.timestamps = append(b.timestamps, unix)
+	return nil
+}
+
+func (b *graphDataPointsBuilder) appendDataPoint() {
+	b.dataPoints = append(b.dataPoints,
+		GraphDataPointWithInfo{
+			JIAIsuUUID:          b.jiaIsuUUID,
+			StartAt:             time.Unix(timeutil.HourStart(b.hourIndex), 0),
+			Data:                b.hour.dataPoint(),
+			ConditionTimestamps: b.timestamps,
+		})
+	b.hour = graphHourAccumulator{}
+	b.timestamps = []int64{}
+}
+
+func (b *graphDataPointsBuilder) finish() []GraphDataPointWithInfo {
+	if b.hour.count > 0 {
+		b.appendDataPoint()
 	}
+	return b.dataPoints
+}
+
+// conditionの文字列から分かる，グラフの集計に使う値
+type graphConditionInfo struct {
+	isBroken     bool
+	isOverweight bool
+	isDirty      bool
+	score        int
+}
+
+// conditionの文字列は8通りしかないので，一度判定したものを使い回す
+type graphConditionInfos struct {
+	settings *IsuSettings
+	infos    map[string]graphConditionInfo
+}
+
+func newGraphConditionInfos(settings *IsuSettings) *graphConditionInfos {
+	return &graphConditionInfos{settings: settings, infos: make(map[string]graphConditionInfo, 8)}
+}
+
+// 見つかった場合は文字列に変換しない(map[string(b)]はコピーしない)
+func (gi *graphConditionInfos) lookupBytes(condition []byte) (graphConditionInfo, error) {
+	if info, ok := gi.infos[string(condition)]; ok {
+		return info, nil
+	}
+	return gi.lookup(string(condition))
+}
 
-	sittingCount := 0
-	for _, condition := range isuConditions {
-		if condition.IsSitting {
-			sittingCount++
+func (gi *graphConditionInfos) lookup(condition string) (graphConditionInfo, error) {
+	if info, ok := gi.infos[condition]; ok {
+		return info, nil
+	}
+	if !isValidConditionFormat(condition) {
+		return graphConditionInfo{}, fmt.Errorf("invalid condition format")
+	}
+
+	info := graphConditionInfo{}
+	for _, condStr := range strings.Split(condition, ",") {
+		conditionName, value, _ := strings.Cut(condStr, "=")
+		if value != "true" {
+			continue
+		}
+		switch conditionName {
+		case "is_broken":
+			info.isBroken = true
+		case "is_overweight":
+			info.isOverweight = true
+		case "is_dirty":
+			info.isDirty = true
 		}
 	}
 
-	isuConditionsLength := len(isuConditions)
+	level, err := calculateConditionLevel(condition, gi.settings)
+	if err != nil {
+		return graphConditionInfo{}, err
+	}
+	switch level {
+	case conditionLevelCritical:
+		info.score = scoreConditionLevelCritical
+	case conditionLevelWarning:
+		info.score = scoreConditionLevelWarning
+	default:
+		info.score = scoreConditionLevelInfo
+	}
+	gi.infos[condition] = info
+	return info, nil
+}
 
-	score := rawScore * 100 / 3 / isuConditionsLength
+// グラフの一つのデータ点のための件数
+type graphHourAccumulator struct {
+	count             int
+	sittingCount      int
+	isBrokenCount     int
+	isOverweightCount int
+	isDirtyCount      int
+	rawScore          int
+}
 
-	sittingPercentage := sittingCount * 100 / isuConditionsLength
-	isBrokenPercentage := conditionsCount["is_broken"] * 100 / isuConditionsLength
-	isOverweightPercentage := conditionsCount["is_overweight"] * 100 / isuConditionsLength
-	isDirtyPercentage := conditionsCount["is_dirty"] * 100 / isuConditionsLength
+func (a *graphHourAccumulator) add(isSitting bool, info graphConditionInfo) {
+	a.count++
+	if isSitting {
+		a.sittingCount++
+	}
+	if info.isBroken {
+		a.isBrokenCount++
+	}
+	if info.isOverweight {
+		a.isOverweightCount++
+	}
+	if info.isDirty {
+		a.isDirtyCount++
+	}
+	a.rawScore += info.score
+}
 
-	dataPoint := GraphDataPoint{
-		Score: score,
+// countが0のときに呼ばないこと
+func (a *graphHourAccumulator) dataPoint() GraphDataPoint {
+	return GraphDataPoint{
+		Score: a.rawScore * 100 / 3 / a.count,
 		Percentage: ConditionsPercentage{
-			Sitting:      sittingPercentage,
-			IsBroken:     isBrokenPercentage,
-			IsOverweight: isOverweightPercentage,
-			IsDirty:      isDirtyPercentage,
+			Sitting:      a.sittingCount * 100 / a.count,
+			IsBroken:     a.isBrokenCount * 100 / a.count,
+			IsOverweight: a.isOverweightCount * 100 / a.count,
+			IsDirty:      a.isDirtyCount * 100 / a.count,
 		},
 	}
-	return dataPoint, nil
 }
 
 // GET /api/condition/:jia_isu_uuid
@@ -1276,7 +2080,11 @@ func getIsuConditions(c echo.Context) error {
 	}
 	conditionLevel := map[string]interface{}{}
 	for _, level := range strings.Split(conditionLevelCSV, ",") {
-		conditionLevel[level] = struct{}{}
+		// 存在しないレベルはどのコンディションにも一致しないので，クエリに渡さない
+		switch level {
+		case conditionLevelInfo, conditionLevelWarning, conditionLevelCritical:
+			conditionLevel[level] = struct{}{}
+		}
 	}
 
 	startTimeStr := c.QueryParam("start_time")
@@ -1288,35 +2096,74 @@ func getIsuConditions(c echo.Context) error {
 		}
 		startTime = time.Unix(startTimeInt64, 0)
 	}
+	var fields conditionFields
+	if param := c.QueryParam("fields"); param != "" {
+		fields, err = parseConditionFields(param)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "bad format: fields")
+		}
+	}
 
-	var isuName string
-	err = db.Get(&isuName,
-		"SELECT name FROM `isu` WHERE `jia_isu_uuid` = ? AND `jia_user_id` = ?",
-		jiaIsuUUID, jiaUserID,
-	)
+	allowed, err := authorizeIsu(jiaUserID, jiaIsuUUID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if !allowed {
+		return c.String(http.StatusNotFound, "not found: isu")
+	}
+	isu, err := isuCache.Get(jiaIsuUUID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return c.String(http.StatusNotFound, "not found: isu")
 		}
 
-		c.Logger().Errorf("db error: %v", err)
+		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	isuName := isu.Name
+
+	c.Response().Header().Add(echo.HeaderVary, "Accept-Language")
+	applyConditionCacheHeaders(c)
 
+	pushdown := featureFlags.EnabledFor(flagConditionQueryPushdown, jiaIsuUUID)
 	conditionsResponse, err := getIsuConditionsFromDB(
-		db,
+		getDB(),
 		jiaIsuUUID,
 		endTime,
 		conditionLevel,
 		startTime,
 		conditionLimit,
 		isuName,
+		pushdown,
 	)
 	if err != nil {
 		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
-	return c.JSON(http.StatusOK, conditionsResponse)
+
+	// もう一方のクエリでも結果が同じになるかを裏で確かめる
+	if featureFlags.EnabledFor(flagShadowConditionQuery, getRequestID(c)) {
+		runShadow(flagShadowConditionQuery, conditionsResponse, func() (interface{}, error) {
+			return getIsuConditionsFromDB(
+				getDB(),
+				jiaIsuUUID,
+				endTime,
+				conditionLevel,
+				startTime,
+				conditionLimit,
+				isuName,
+				!pushdown,
+			)
+		})
+	}
+
+	// shadowとの比較は翻訳前のレスポンスで行う
+	localizeConditions(conditionsResponse, negotiateLanguage(c.Request().Header.Get("Accept-Language")))
+	if fields != 0 {
+		return respondConditionFields(c, conditionsResponse, fields)
+	}
+	return respondJSONArray(c, http.StatusOK, conditionsResponse)
 }
 
 // ISUのコンディションをDBから取得
@@ -1328,74 +2175,148 @@ func getIsuConditionsFromDB(
 	startTime time.Time,
 	limit int,
 	isuName string,
+	pushdown bool,
 ) ([]*GetIsuConditionResponse, error) {
 	conditions := []IsuCondition{}
 
 	levels := maps.Keys(conditionLevel)
-	if startTime.IsZero() {
-		q, args, err := sqlx.In(
-			"SELECT `jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`, `level`  FROM `isu_condition` WHERE `jia_isu_uuid` = ?"+
-				"	AND `timestamp` < ?"+
-				"	AND `level` IN (?) "+
-				"	ORDER BY `timestamp` DESC "+
-				"	LIMIT ?",
-			jiaIsuUUID,
-			endTime,
-			levels,
-			limit,
-		)
+	// sqlx.Inは空のスライスを渡すとエラーになるので，一致するものがない場合はクエリを投げずに返す
+	if len(levels) == 0 {
+		return []*GetIsuConditionResponse{}, nil
+	}
+	settings, err := isuSettingsCache.Get(jiaIsuUUID)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	if settings != nil {
+		conditions, err = selectIsuConditionsWithSettings(db, jiaIsuUUID, endTime, conditionLevel, startTime, limit, settings)
 		if err != nil {
 			return nil, fmt.Errorf("db error: %v", err)
 		}
-		q = db.Rebind(q)
-		err = db.Select(&conditions, q, args...)
+	} else if len(levels) < 3 && pushdown && featureFlags.EnabledFor(flagConditionLevelGoFilter, jiaIsuUUID) {
+		conditions, err = selectIsuConditionsByLevel(db, jiaIsuUUID, endTime, conditionLevel, levels, startTime, limit)
 		if err != nil {
 			return nil, fmt.Errorf("db error: %v", err)
 		}
 	} else {
-		q, args, err := sqlx.In(
-			"SELECT `jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`, `level`  FROM `isu_condition` WHERE `jia_isu_uuid` = ?"+
-				"	AND `timestamp` < ?"+
-				"	AND ? <= `timestamp`"+
-				"	AND `level` IN (?) "+
-				"	ORDER BY `timestamp` DESC "+
-				"	LIMIT ?",
-			jiaIsuUUID, endTime, startTime, levels, limit,
-		)
+		q, args, err := buildIsuConditionsQuery(jiaIsuUUID, endTime, levels, startTime, limit, pushdown)
 		if err != nil {
 			return nil, fmt.Errorf("db error: %v", err)
 		}
-		q = db.Rebind(q)
 		err = db.Select(&conditions, q, args...)
 		if err != nil {
 			return nil, fmt.Errorf("db error: %v", err)
 		}
 	}
 
-	conditionsResponse := []*GetIsuConditionResponse{}
-	for _, c := range conditions {
-		cLevel := c.Level
-		data := GetIsuConditionResponse{
-			JIAIsuUUID:     c.JIAIsuUUID,
-			IsuName:        isuName,
-			Timestamp:      c.Timestamp.Unix(),
-			IsSitting:      c.IsSitting,
-			Condition:      c.Condition,
-			ConditionLevel: cLevel,
-			Message:        c.Message,
+	conditionsResponse := make([]*GetIsuConditionResponse, 0, len(conditions))
+	for i := range conditions {
+		conditionsResponse = append(conditionsResponse, newGetIsuConditionResponse(&conditions[i], isuName))
+	}
+
+	return conditionsResponse, nil
+}
+
+func newGetIsuConditionResponse(c *IsuCondition, isuName string) *GetIsuConditionResponse {
+	return &GetIsuConditionResponse{
+		JIAIsuUUID:     c.JIAIsuUUID,
+		IsuName:        isuName,
+		Timestamp:      c.Timestamp.Unix(),
+		IsSitting:      c.IsSitting,
+		Condition:      c.Condition,
+		ConditionLevel: c.Level,
+		Message:        c.Message,
+		MessageCode:    c.MessageCode,
+	}
+}
+
+// コンディション取得の条件をまとめてWHERE句に組み立てる
+// 全レベル指定時はlevelの条件が絞り込みにならないので付けず，主キー(jia_isu_uuid, timestamp)だけでLIMITまで読めるようにする
+// レベルで絞る場合は(jia_isu_uuid, level, timestamp)のインデックスが使われる
+// limitが0ならLIMITを付けない
+func buildIsuConditionsQuery(
+	jiaIsuUUID string,
+	endTime time.Time,
+	levels []string,
+	startTime time.Time,
+	limit int,
+	pushdown bool,
+) (string, []interface{}, error) {
+	args := []interface{}{jiaIsuUUID, endTime}
+	key := isuConditionsQueryKey{hint: isuConditionRangeHint()}
+	if !startTime.IsZero() {
+		key.hasStartTime = true
+		args = append(args, startTime)
+	}
+	if len(levels) < 3 || !pushdown {
+		if len(levels) == 0 {
+			return "", nil, fmt.Errorf("empty levels")
+		}
+		key.levelCount = len(levels)
+		key.hint = isuConditionLevelHint()
+		for _, level := range levels {
+			args = append(args, level)
 		}
-		conditionsResponse = append(conditionsResponse, &data)
 	}
+	if limit > 0 {
+		key.hasLimit = true
+		args = append(args, limit)
+	}
+
+	return isuConditionsQueryCache.Get(key), args, nil
+}
 
-	if len(conditionsResponse) > limit {
-		conditionsResponse = conditionsResponse[:limit]
+// levelの個数・startTimeとLIMITの有無・ヒントが同じならSQLは同じなので，sqlx.InとRebindを毎回通さずに使い回す
+type isuConditionsQueryKey struct {
+	// levelで絞らない場合は0
+	levelCount   int
+	hasStartTime bool
+	hasLimit     bool
+	hint         string
+}
+
+type IsuConditionsQueryCache struct {
+	cache map[isuConditionsQueryKey]string
+	Lock  sync.Mutex
+}
+
+var isuConditionsQueryCache = &IsuConditionsQueryCache{cache: make(map[isuConditionsQueryKey]string)}
+
+func (qc *IsuConditionsQueryCache) Get(key isuConditionsQueryKey) string {
+	qc.Lock.Lock()
+	defer qc.Lock.Unlock()
+	q, ok := qc.cache[key]
+	if !ok {
+		q = generateIsuConditionsQuery(key)
+		qc.cache[key] = q
 	}
+	return q
+}
 
-	return conditionsResponse, nil
+func generateIsuConditionsQuery(key isuConditionsQueryKey) string {
+	where := []string{"`jia_isu_uuid` = ?", "`timestamp` < ?"}
+	if key.hasStartTime {
+		where = append(where, "? <= `timestamp`")
+	}
+	if key.levelCount > 0 {
+		where = append(where, "`level` IN ("+strings.TrimSuffix(strings.Repeat("?, ", key.levelCount), ", ")+")")
+	}
+	q := "SELECT `jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`, `message_code`, `level` FROM `isu_condition`" + key.hint +
+		"	WHERE " + strings.Join(where, " AND ") +
+		"	ORDER BY `timestamp` DESC"
+	if key.hasLimit {
+		q += "	LIMIT ?"
+	}
+	return sqlx.Rebind(sqlx.BindType("mysql"), q)
 }
 
 // ISUのコンディションの文字列からコンディションレベルを計算
-func calculateConditionLevel(condition string) (string, error) {
+// settingsがあればISU毎の判定ルールを使う
+func calculateConditionLevel(condition string, settings *IsuSettings) (string, error) {
+	if settings != nil {
+		return settings.conditionLevel(condition)
+	}
+
 	var conditionLevel string
 
 	warnCount := strings.Count(condition, "=true")
@@ -1413,101 +2334,196 @@ func calculateConditionLevel(condition string) (string, error) {
 	return conditionLevel, nil
 }
 
-// GET /api/trend
+// GET /api/trend?page=&per_page=
+// HEAD /api/trend
 // ISUの性格毎の最新のコンディション情報
+// page/per_pageを指定した場合は，性格名の順のスナップショットの一部を返し，全体の件数をヘッダーで返す
 func getTrend(c echo.Context) error {
-	res := trendCache.Get()
-	return c.JSON(http.StatusOK, res)
+	if c.QueryParam("page") == "" && c.QueryParam("per_page") == "" {
+		return writeBlob(c, http.StatusOK, echo.MIMEApplicationJSON, trendCache.Bytes())
+	}
+
+	page, err := parsePositiveIntParam(c.QueryParam("page"), 1)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad format: page")
+	}
+	perPage, err := parsePositiveIntParam(c.QueryParam("per_page"), trendDefaultPerPage)
+	if err != nil || perPage > trendMaxPerPage {
+		return c.String(http.StatusBadRequest, "bad format: per_page")
+	}
+
+	trend := trendCache.Get()
+	start := min((page-1)*perPage, len(trend))
+	end := min(start+perPage, len(trend))
+	c.Response().Header().Set(headerTotalCount, strconv.Itoa(len(trend)))
+	return c.JSON(http.StatusOK, trend[start:end])
 }
 
+// 空なら defaultValue，1以上の整数でなければエラー
+func parsePositiveIntParam(s string, defaultValue int) (int, error) {
+	if s == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if n < 1 {
+		return 0, fmt.Errorf("must be positive: %v", n)
+	}
+	return n, nil
+}
+
+// 性格の一覧が取れなければnilを返す．性格毎の失敗はその性格だけ前回の結果を使い，残りは計算し直す
 func calculateTrend() []TrendResponse {
-	characterList := []Isu{}
-	err := db.Select(&characterList, "SELECT `character` FROM `isu` GROUP BY `character`")
+	characterList, err := characterMembership.Characters()
 	if err != nil {
-		log.Errorf("db error: %v", err)
+		workerLogger.Error().Err(err).Msg("db error")
+		trendStats.Failed(err)
 		return nil
 	}
 
+	previous := map[string]TrendResponse{}
+	for _, trend := range trendCache.Get() {
+		previous[trend.Character] = trend
+	}
 	res := []TrendResponse{}
+	failed := []string{}
 
 	for _, character := range characterList {
-		isuList := []Isu{}
-		err = db.Select(
-			&isuList,
-			"SELECT `id`, `jia_isu_uuid` FROM `isu` WHERE `character` = ?",
-			character.Character,
-		)
+		trend, err := calculateCharacterTrend(character)
 		if err != nil {
-			log.Errorf("db error: %v", err)
-			return nil
+			workerLogger.Error().Err(err).Str("character", character).Msg("db error")
+			failed = append(failed, character)
+			trendStats.CharacterFailed(character, err)
+			if trend, ok := previous[character]; ok {
+				res = append(res, trend)
+			}
+			continue
 		}
+		res = append(res, trend)
+	}
+	trendStats.Completed(failed)
 
-		characterInfoIsuConditions := []*TrendCondition{}
-		characterWarningIsuConditions := []*TrendCondition{}
-		characterCriticalIsuConditions := []*TrendCondition{}
+	return res
+}
 
-		for _, isu := range isuList {
-			cond, err := isuConditionCache.Get(isu.JIAIsuUUID)
-			if err != nil {
-				if errors.Is(err, sql.ErrNoRows) {
-					continue
-				} else {
-					log.Errorf("db error: %v", err)
-					return nil
-				}
-			}
+func calculateCharacterTrend(character string) (TrendResponse, error) {
+	isuList, err := characterMembership.Members(character)
+	if err != nil {
+		return TrendResponse{}, err
+	}
+	return buildCharacterTrend(character, isuList, trendStats)
+}
 
-			conditionLevel := cond.Level
-			trendCondition := TrendCondition{
-				ID:        isu.ID,
-				Timestamp: cond.Timestamp.Unix(),
-			}
-			switch conditionLevel {
-			case "info":
-				characterInfoIsuConditions = append(characterInfoIsuConditions, &trendCondition)
-			case "warning":
-				characterWarningIsuConditions = append(
-					characterWarningIsuConditions,
-					&trendCondition,
-				)
-			case "critical":
-				characterCriticalIsuConditions = append(
-					characterCriticalIsuConditions,
-					&trendCondition,
-				)
-			}
+// 同じ性格のISUの最新のコンディションから，その性格のトレンドを作る
+// statsがnilならミュートが引けなかったことを数えない(ユーザー毎のトレンドなど)
+func buildCharacterTrend(character string, isuList []IsuMeta, stats *TrendStats) (TrendResponse, error) {
+	characterInfoIsuConditions := []*TrendCondition{}
+	characterWarningIsuConditions := []*TrendCondition{}
+	characterCriticalIsuConditions := []*TrendCondition{}
+
+	jiaIsuUUIDs := make([]string, 0, len(isuList))
+	for _, isu := range isuList {
+		jiaIsuUUIDs = append(jiaIsuUUIDs, isu.JIAIsuUUID)
+	}
+	conds, err := isuConditionCache.GetMulti(jiaIsuUUIDs)
+	if err != nil {
+		return TrendResponse{}, err
+	}
+	// ミュートが引けなくても，ISUは除外せずに載せる
+	mutes, err := muteCache.GetMany(jiaIsuUUIDs)
+	if err != nil {
+		workerLogger.Error().Err(err).Str("character", character).Msg("db error")
+		if stats != nil {
+			stats.LookupFailed(err)
 		}
+	}
 
-		sort.Slice(characterInfoIsuConditions, func(i, j int) bool {
-			return characterInfoIsuConditions[i].Timestamp > characterInfoIsuConditions[j].Timestamp
-		})
-		sort.Slice(characterWarningIsuConditions, func(i, j int) bool {
-			return characterWarningIsuConditions[i].Timestamp > characterWarningIsuConditions[j].Timestamp
-		})
-		sort.Slice(characterCriticalIsuConditions, func(i, j int) bool {
-			return characterCriticalIsuConditions[i].Timestamp > characterCriticalIsuConditions[j].Timestamp
-		})
+	for _, isu := range isuList {
+		cond, ok := conds[isu.JIAIsuUUID]
+		if !ok {
+			continue
+		}
+		if mutes[isu.JIAIsuUUID].ExcludedFromTrend(cond.Timestamp) {
+			continue
+		}
 
-		res = append(res,
-			TrendResponse{
-				Character: character.Character,
-				Info:      characterInfoIsuConditions,
-				Warning:   characterWarningIsuConditions,
-				Critical:  characterCriticalIsuConditions,
-			})
+		conditionLevel := cond.Level
+		trendCondition := TrendCondition{
+			ID:        isu.ID,
+			Timestamp: cond.Timestamp.Unix(),
+		}
+		switch conditionLevel {
+		case "info":
+			characterInfoIsuConditions = append(characterInfoIsuConditions, &trendCondition)
+		case "warning":
+			characterWarningIsuConditions = append(
+				characterWarningIsuConditions,
+				&trendCondition,
+			)
+		case "critical":
+			characterCriticalIsuConditions = append(
+				characterCriticalIsuConditions,
+				&trendCondition,
+			)
+		}
 	}
 
-	return res
+	sortTrendConditions(characterInfoIsuConditions)
+	sortTrendConditions(characterWarningIsuConditions)
+	sortTrendConditions(characterCriticalIsuConditions)
+
+	return TrendResponse{
+		Character: character,
+		Info:      characterInfoIsuConditions,
+		Warning:   characterWarningIsuConditions,
+		Critical:  characterCriticalIsuConditions,
+	}, nil
+}
+
+// 新しい順に並べる．同じ時刻のものはisu_id順にしてレスポンスを決定的にする
+func sortTrendConditions(conditions []*TrendCondition) {
+	sort.Slice(conditions, func(i, j int) bool {
+		if conditions[i].Timestamp != conditions[j].Timestamp {
+			return conditions[i].Timestamp > conditions[j].Timestamp
+		}
+		return conditions[i].ID < conditions[j].ID
+	})
+}
+
+// 起動直後に空のトレンドを返さないよう，最新のコンディションを一括で読んでトレンドを作っておく
+func warmTrendCache() error {
+	conds, err := fetchLatestConditions(nil)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	for i := range conds {
+		isuConditionCache.Set(&conds[i])
+	}
+	trend := calculateTrend()
+	if trend == nil {
+		return fmt.Errorf("failed to calculate trend")
+	}
+	trendCache.Set(trend)
+	return nil
 }
 
-func calculateTrendScheduled(interval time.Duration) {
+func calculateTrendScheduled(ctx context.Context, interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 	for {
 		select {
+		case <-ctx.Done():
+			return
 		case <-ticker.C:
+			// 失敗したときは前回のトレンドを返し続ける
 			trend := calculateTrend()
+			if trend == nil {
+				continue
+			}
 			trendCache.Set(trend)
+			distributeTrend(trend)
 		}
 	}
 }
@@ -1526,14 +2542,28 @@ func postIsuCondition(c echo.Context) error {
 	if jiaIsuUUID == "" {
 		return c.String(http.StatusBadRequest, "missing: jia_isu_uuid")
 	}
+	jiaIsuUUID, ok := canonicalIsuUUID(jiaIsuUUID)
+	if !ok {
+		return c.String(http.StatusNotFound, "not found: isu")
+	}
+	setIsuRouteHeader(c, jiaIsuUUID)
 
 	req := []PostIsuConditionRequest{}
-	err := c.Bind(&req)
+	var err error
+	if isProtobufRequest(c) {
+		req, err = bindConditionBatch(c)
+	} else {
+		err = c.Bind(&req)
+	}
 	if err != nil {
 		return c.String(http.StatusBadRequest, "bad request body")
 	} else if len(req) == 0 {
 		return c.String(http.StatusBadRequest, "bad request body")
 	}
+	// 落としたコンディションの数を記録するため，ボディを読んでから判定する
+	if !applyIngestBackpressure(c) {
+		return shedConditions(c, jiaIsuUUID, len(req))
+	}
 	//
 	// tx, err := db.Beginx()
 	// if err != nil {
@@ -1560,6 +2590,17 @@ func postIsuCondition(c echo.Context) error {
 	// 	return c.String(http.StatusNotFound, "not found: isu")
 	// }
 
+	settings, err := isuSettingsCache.Get(jiaIsuUUID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	mutes, err := muteCache.Get(jiaIsuUUID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
 	conds := make([]IsuCondition, 0, len(req))
 
 	for _, cond := range req {
@@ -1568,18 +2609,39 @@ func postIsuCondition(c echo.Context) error {
 		if !isValidConditionFormat(cond.Condition) {
 			return c.String(http.StatusBadRequest, "bad request body")
 		}
-		level, err := calculateConditionLevel(cond.Condition)
+		if len(cond.MessageCode) > maxMessageCodeLength {
+			return c.String(http.StatusBadRequest, "bad request body")
+		}
+		message, truncated, err := sanitizeText(cond.Message, messageMaxLength)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "bad request body")
+		}
+		if truncated {
+			c.Logger().Warnf("truncated condition message: jia_isu_uuid=%v", jiaIsuUUID)
+			c.Response().Header().Set(headerTextTruncated, "true")
+		}
+		level, err := calculateConditionLevel(cond.Condition, settings)
 		if err != nil {
 			c.Logger().Error(err)
 			return c.NoContent(http.StatusInternalServerError)
 		}
+		var sequence sql.NullInt64
+		if cond.Sequence != nil {
+			if *cond.Sequence < 0 {
+				return c.String(http.StatusBadRequest, "bad request body")
+			}
+			sequence = sql.NullInt64{Int64: *cond.Sequence, Valid: true}
+		}
 		conds = append(conds, IsuCondition{
-			JIAIsuUUID: jiaIsuUUID,
-			Timestamp:  timestamp,
-			IsSitting:  cond.IsSitting,
-			Condition:  cond.Condition,
-			Message:    cond.Message,
-			Level:      level,
+			JIAIsuUUID:  jiaIsuUUID,
+			Timestamp:   timestamp,
+			IsSitting:   cond.IsSitting,
+			Condition:   cond.Condition,
+			Message:     message,
+			Level:       level,
+			MessageCode: cond.MessageCode,
+			Sequence:    sequence,
+			Muted:       mutes.Muted(timestamp),
 		})
 	}
 	insertQueue.Insert(conds)
@@ -1623,7 +2685,7 @@ func isValidConditionFormat(conditionStr string) bool {
 		}
 
 		if idxKeys < (len(keys) - 1) {
-			if conditionStr[idxCondStr] != ',' {
+			if idxCondStr >= len(conditionStr) || conditionStr[idxCondStr] != ',' {
 				return false
 			}
 			idxCondStr++
@@ -1633,30 +2695,71 @@ func isValidConditionFormat(conditionStr string) bool {
 	return (idxCondStr == len(conditionStr))
 }
 
-func insertIsuConditionScheduled(interval time.Duration) {
+func insertIsuConditionScheduled(ctx context.Context, interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 	for {
 		select {
+		case <-ctx.Done():
+			// 止める前にキューに残っているものを書き出す
+			err := flushInsertQueue()
+			if err != nil {
+				workerLogger.Error().Err(err).Msg("failed to insert isu condition")
+			}
+			return
 		case <-ticker.C:
-			q := insertQueue.PopAll()
-			if len(q) == 0 {
+			// DBの切り替え中はキューに溜めたままにする
+			if dbSupervisor.Paused() {
 				continue
 			}
-
-			for _, cond := range q {
-				isuConditionCache.Forget(cond.JIAIsuUUID)
-			}
-			_, err := db.NamedExec("INSERT INTO `isu_condition`"+
-				"	(`jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`, `level`)"+
-				"	VALUES (:jia_isu_uuid, :timestamp, :is_sitting, :condition, :message, :level)", q)
+			err := flushInsertQueue()
 			if err != nil {
-				log.Printf("failed to insert isu condition: %v", err)
+				workerLogger.Error().Err(err).Msg("failed to insert isu condition")
 			}
 		}
 	}
 }
 
+// キューに溜まったコンディションをまとめてINSERTする
+func flushInsertQueue() error {
+	flushLock.Lock()
+	defer flushLock.Unlock()
+	q := insertQueue.PopAll()
+	if len(q) == 0 {
+		return nil
+	}
+	defer insertQueue.Done()
+
+	for _, cond := range q {
+		isuConditionCache.Forget(cond.JIAIsuUUID)
+		routeCache.Bust(graphRoutePolicy.Name, cond.JIAIsuUUID)
+	}
+	var err error
+	if useConditionLoadData(len(q)) {
+		err = loadIsuConditions(getPriorityDB(), q)
+		if err != nil {
+			// local_infileが無効なDBなどでは，通常のINSERTでやり直す
+			systemLogger.Warn().Err(err).Int("conditions", len(q)).Msg("load data failed, falling back to insert")
+			err = insertIsuConditions(getPriorityDB(), q)
+		}
+	} else {
+		err = insertIsuConditions(getPriorityDB(), q)
+	}
+	if err != nil {
+		return fmt.Errorf("insert %d conditions: %w", len(q), err)
+	}
+	for _, cond := range q {
+		graphEmptyCache.Observe(cond.JIAIsuUUID, cond.Timestamp)
+	}
+
+	// 遷移の判定だけを行い，インシデントの書き込みはincident_writerに任せる
+	err = incidentTracker.Observe(q)
+	if err != nil {
+		return fmt.Errorf("update incidents: %w", err)
+	}
+	return nil
+}
+
 // func getIndex(c echo.Context) error {
 // 	return c.File(frontendContentsPath + "/index.html")
 // }
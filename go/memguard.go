@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"runtime/debug"
+	rtmetrics "runtime/metrics"
+	"time"
+)
+
+const memoryGuardHeapMetric = "/memory/classes/heap/objects:bytes"
+
+// ヒープがlimitBytesを超えたら，作り直せるキャッシュから順に捨ててOOMを避ける
+// MEMORY_GUARD_BYTES=0(デフォルト)なら何もしない
+func memoryGuardScheduled(ctx context.Context, interval time.Duration, limitBytes uint64) {
+	if limitBytes == 0 {
+		return
+	}
+	sample := []rtmetrics.Sample{{Name: memoryGuardHeapMetric}}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rtmetrics.Read(sample)
+			heap := sample[0].Value.Uint64()
+			if heap < limitBytes {
+				continue
+			}
+			relieveMemoryPressure(heap, limitBytes)
+		}
+	}
+}
+
+func relieveMemoryPressure(heap uint64, limitBytes uint64) {
+	// アイコンはディスクにも残っているので最初に捨てる
+	freedIcons := iconCache.ShrinkMemory(0)
+	// 最新コンディションとISUの情報はDBから引き直せる
+	isuConditionCache.Reset()
+	isuCache.Reset()
+	debug.FreeOSMemory()
+
+	sample := []rtmetrics.Sample{{Name: memoryGuardHeapMetric}}
+	rtmetrics.Read(sample)
+	systemLogger.Warn().
+		Uint64("heap_bytes", heap).
+		Uint64("limit_bytes", limitBytes).
+		Int("freed_icon_bytes", freedIcons).
+		Uint64("heap_bytes_after", sample[0].Value.Uint64()).
+		Msg("memory pressure: evicted caches")
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/labstack/echo/v4"
+)
+
+var latencyBuckets = []time.Duration{
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2 * time.Second,
+	5 * time.Second,
+}
+
+const (
+	// 前回のビルドと比べてこれ以上悪化したら回帰とみなす
+	regressionP95Ratio       = 1.2
+	regressionRPSRatio       = 0.9
+	regressionErrorRateDelta = 0.01
+	regressionScoreRatio     = 0.95
+)
+
+// 全リクエストで更新するので，ロックを取らずに加算する
+type RouteMetrics struct {
+	Count        atomic.Int64
+	Errors       atomic.Int64
+	ClientErrors atomic.Int64
+	// ナノ秒
+	TotalLatency atomic.Int64
+	Buckets      []atomic.Int64
+}
+
+// ベンチマーク1回分のルート毎の集計
+type MetricsSnapshot struct {
+	Build     string                  `json:"build"`
+	StartedAt time.Time               `json:"started_at"`
+	Seconds   float64                 `json:"seconds"`
+	Score     int                     `json:"score,omitempty"`
+	Routes    map[string]RouteSummary `json:"routes"`
+}
+
+type RouteSummary struct {
+	Count        int64   `json:"count"`
+	Errors       int64   `json:"errors"`
+	ClientErrors int64   `json:"client_errors"`
+	RPS          float64 `json:"rps"`
+	AvgMillis    float64 `json:"avg_ms"`
+	P95Millis    float64 `json:"p95_ms"`
+}
+
+type Regression struct {
+	Route    string  `json:"route"`
+	Metric   string  `json:"metric"`
+	Previous float64 `json:"previous"`
+	Current  float64 `json:"current"`
+}
+
+type RegressionReport struct {
+	PreviousBuild string       `json:"previous_build"`
+	CurrentBuild  string       `json:"current_build"`
+	Regressions   []Regression `json:"regressions"`
+}
+
+// /initializeから次の/initializeまでの集計
+// Resetは新しいものに差し替えるだけなので，Observeはどちらに足してもよく，ロックは要らない
+type metricsPeriod struct {
+	startedAt time.Time
+	// route -> *RouteMetrics
+	routes sync.Map
+	// 最後にリクエストを受けた時刻(UnixNano)．ベンチマークの後に保存してもRPSが薄まらないよう，ここまでで割る
+	lastObserved atomic.Int64
+}
+
+type Metrics struct {
+	current atomic.Pointer[metricsPeriod]
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{}
+	m.Reset()
+	return m
+}
+
+var (
+	metrics           = NewMetrics()
+	metricsBuild      = readBuildRevision()
+	metricsHistoryDir = getEnv("METRICS_HISTORY_DIR", "/tmp/isucondition-metrics")
+)
+
+// ビルドを区別する名前．コミットされていない変更を含むビルドや，VCSの情報がないビルドは
+// 同じ名前にならないよう，実行ファイルのハッシュを付ける
+func readBuildRevision() string {
+	revision, modified := "unknown", false
+	info, ok := debug.ReadBuildInfo()
+	if ok {
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				revision = setting.Value
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+	}
+	if revision != "unknown" && !modified {
+		return revision
+	}
+	if modified {
+		revision += "-dirty"
+	}
+	if hash, err := executableHash(); err == nil {
+		revision += "." + hash
+	}
+	return revision
+}
+
+func executableHash() (string, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12], nil
+}
+
+func metricsMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+			if err != nil {
+				c.Error(err)
+			}
+			metrics.Observe(c.Request().Method+" "+c.Path(), c.Response().Status, time.Since(start))
+			return nil
+		}
+	}
+}
+
+func (m *Metrics) Observe(route string, status int, latency time.Duration) {
+	bucket := sort.Search(len(latencyBuckets), func(i int) bool {
+		return latency <= latencyBuckets[i]
+	})
+
+	period := m.current.Load()
+	v, ok := period.routes.Load(route)
+	if !ok {
+		v, _ = period.routes.LoadOrStore(route, &RouteMetrics{Buckets: make([]atomic.Int64, len(latencyBuckets)+1)})
+	}
+	rm := v.(*RouteMetrics)
+	rm.Count.Add(1)
+	if status >= 500 {
+		rm.Errors.Add(1)
+	} else if status >= 400 {
+		rm.ClientErrors.Add(1)
+	}
+	rm.TotalLatency.Add(int64(latency))
+	rm.Buckets[bucket].Add(1)
+	period.lastObserved.Store(time.Now().UnixNano())
+}
+
+// ベンチマークは/initializeから始まるので，そこで集計をリセットする
+func (m *Metrics) Reset() {
+	m.current.Store(&metricsPeriod{startedAt: time.Now()})
+}
+
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	period := m.current.Load()
+	end := time.Now()
+	if last := period.lastObserved.Load(); last != 0 {
+		end = time.Unix(0, last)
+	}
+	seconds := end.Sub(period.startedAt).Seconds()
+	snapshot := MetricsSnapshot{
+		Build:     metricsBuild,
+		StartedAt: period.startedAt,
+		Seconds:   seconds,
+		Routes:    map[string]RouteSummary{},
+	}
+	period.routes.Range(func(key, value interface{}) bool {
+		rm := value.(*RouteMetrics)
+		count := rm.Count.Load()
+		if count == 0 {
+			return true
+		}
+		buckets := make([]int64, len(rm.Buckets))
+		for i := range rm.Buckets {
+			buckets[i] = rm.Buckets[i].Load()
+		}
+		summary := RouteSummary{
+			Count:        count,
+			Errors:       rm.Errors.Load(),
+			ClientErrors: rm.ClientErrors.Load(),
+			AvgMillis:    float64(time.Duration(rm.TotalLatency.Load()).Microseconds()) / 1000 / float64(count),
+			P95Millis:    bucketPercentile(buckets, count, 0.95),
+		}
+		if seconds > 0 {
+			summary.RPS = float64(count) / seconds
+		}
+		snapshot.Routes[key.(string)] = summary
+		return true
+	})
+	return snapshot
+}
+
+// ヒストグラムからパーセンタイルを求める(バケットの上端で近似)
+func bucketPercentile(buckets []int64, count int64, p float64) float64 {
+	threshold := int64(float64(count) * p)
+	var acc int64
+	for i, n := range buckets {
+		acc += n
+		if acc > threshold {
+			if i >= len(latencyBuckets) {
+				break
+			}
+			return float64(latencyBuckets[i].Microseconds()) / 1000
+		}
+	}
+	return float64(latencyBuckets[len(latencyBuckets)-1].Microseconds()) / 1000
+}
+
+func (s MetricsSnapshot) errorRate(route string) float64 {
+	r := s.Routes[route]
+	if r.Count == 0 {
+		return 0
+	}
+	return float64(r.Errors) / float64(r.Count)
+}
+
+// 前回のビルドのスナップショットと比べて悪化したルートを列挙する
+func compareSnapshots(prev MetricsSnapshot, cur MetricsSnapshot) RegressionReport {
+	report := RegressionReport{
+		PreviousBuild: prev.Build,
+		CurrentBuild:  cur.Build,
+		Regressions:   []Regression{},
+	}
+	if prev.Score > 0 && cur.Score > 0 && float64(cur.Score) < float64(prev.Score)*regressionScoreRatio {
+		report.Regressions = append(report.Regressions, Regression{
+			Metric: "score", Previous: float64(prev.Score), Current: float64(cur.Score),
+		})
+	}
+
+	routes := make([]string, 0, len(prev.Routes))
+	for route := range prev.Routes {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	for _, route := range routes {
+		p := prev.Routes[route]
+		c, ok := cur.Routes[route]
+		if !ok {
+			continue
+		}
+		if c.P95Millis > p.P95Millis*regressionP95Ratio {
+			report.Regressions = append(report.Regressions, Regression{
+				Route: route, Metric: "p95_ms", Previous: p.P95Millis, Current: c.P95Millis,
+			})
+		}
+		if c.RPS < p.RPS*regressionRPSRatio {
+			report.Regressions = append(report.Regressions, Regression{
+				Route: route, Metric: "rps", Previous: p.RPS, Current: c.RPS,
+			})
+		}
+		if cur.errorRate(route) > prev.errorRate(route)+regressionErrorRateDelta {
+			report.Regressions = append(report.Regressions, Regression{
+				Route: route, Metric: "error_rate", Previous: prev.errorRate(route), Current: cur.errorRate(route),
+			})
+		}
+	}
+	return report
+}
+
+// 別のビルドで保存された最新のスナップショットを読む
+func loadPreviousSnapshot(build string) (MetricsSnapshot, bool, error) {
+	files, err := filepath.Glob(filepath.Join(metricsHistoryDir, "*.json"))
+	if err != nil {
+		return MetricsSnapshot{}, false, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(files)))
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return MetricsSnapshot{}, false, err
+		}
+		var snapshot MetricsSnapshot
+		err = json.Unmarshal(b, &snapshot)
+		if err != nil {
+			return MetricsSnapshot{}, false, fmt.Errorf("%v: %w", file, err)
+		}
+		if snapshot.Build != build {
+			return snapshot, true, nil
+		}
+	}
+	return MetricsSnapshot{}, false, nil
+}
+
+func saveSnapshot(snapshot MetricsSnapshot) error {
+	err := os.MkdirAll(metricsHistoryDir, 0755)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	// ファイル名の順で新しいものを探すので，UTCで揃える
+	name := snapshot.StartedAt.UTC().Format("20060102-150405") + "-" + snapshot.Build + ".json"
+	return os.WriteFile(filepath.Join(metricsHistoryDir, name), b, 0644)
+}
+
+// GET /internal/metrics
+// 直近の/initialize以降のルート毎の集計を取得
+func getMetrics(c echo.Context) error {
+	return c.JSON(http.StatusOK, metrics.Snapshot())
+}
+
+// POST /internal/metrics/save?score=
+// 集計を保存し，前回のビルドと比べた回帰を返す
+func postMetricsSave(c echo.Context) error {
+	snapshot := metrics.Snapshot()
+	if scoreStr := c.QueryParam("score"); scoreStr != "" {
+		score, err := strconv.Atoi(scoreStr)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "bad format: score")
+		}
+		snapshot.Score = score
+	}
+
+	prev, found, err := loadPreviousSnapshot(snapshot.Build)
+	if err != nil {
+		c.Logger().Errorf("failed to load metrics history: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	err = saveSnapshot(snapshot)
+	if err != nil {
+		c.Logger().Errorf("failed to save metrics: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if !found {
+		return c.JSON(http.StatusOK, RegressionReport{CurrentBuild: snapshot.Build, Regressions: []Regression{}})
+	}
+
+	report := compareSnapshots(prev, snapshot)
+	for _, r := range report.Regressions {
+		systemLogger.Warn().
+			Str("route", r.Route).
+			Str("metric", r.Metric).
+			Float64("previous", r.Previous).
+			Float64("current", r.Current).
+			Str("previous_build", report.PreviousBuild).
+			Msg("regression detected")
+	}
+	return c.JSON(http.StatusOK, report)
+}
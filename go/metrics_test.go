@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMetricsObserveConcurrent(t *testing.T) {
+	m := NewMetrics()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				status := 200
+				if j%10 == 0 {
+					status = 500
+				}
+				m.Observe("POST /api/condition/:jia_isu_uuid", status, time.Duration(j%7)*time.Millisecond)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	r := m.Snapshot().Routes["POST /api/condition/:jia_isu_uuid"]
+	if r.Count != 8000 || r.Errors != 800 {
+		t.Fatalf("count=%d errors=%d, want 8000 and 800", r.Count, r.Errors)
+	}
+
+	m.Reset()
+	if n := len(m.Snapshot().Routes); n != 0 {
+		t.Fatalf("%d routes after reset, want 0", n)
+	}
+}
+
+// 保存したスナップショットを別のビルドから読み，悪化を検出できる
+func TestMetricsCompareAcrossBuilds(t *testing.T) {
+	dir := metricsHistoryDir
+	metricsHistoryDir = t.TempDir()
+	t.Cleanup(func() { metricsHistoryDir = dir })
+	started := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	prev := MetricsSnapshot{
+		Build:     "aaaa",
+		StartedAt: started,
+		Score:     1000,
+		Routes: map[string]RouteSummary{
+			"GET /api/trend": {Count: 100, RPS: 10, P95Millis: 10},
+		},
+	}
+	if err := saveSnapshot(prev); err != nil {
+		t.Fatal(err)
+	}
+
+	// 同じビルドのものしかなければ比べない
+	if _, found, err := loadPreviousSnapshot("aaaa"); err != nil || found {
+		t.Fatalf("same build: found=%v err=%v, want not found", found, err)
+	}
+
+	cur := MetricsSnapshot{
+		Build:     "bbbb",
+		StartedAt: started.Add(time.Hour),
+		Score:     900,
+		Routes: map[string]RouteSummary{
+			"GET /api/trend": {Count: 100, Errors: 5, RPS: 10, P95Millis: 50},
+		},
+	}
+	loaded, found, err := loadPreviousSnapshot(cur.Build)
+	if err != nil || !found || loaded.Build != "aaaa" {
+		t.Fatalf("got (%v, %v, %v), want build aaaa", loaded.Build, found, err)
+	}
+	if err := saveSnapshot(cur); err != nil {
+		t.Fatal(err)
+	}
+
+	report := compareSnapshots(loaded, cur)
+	got := map[string]bool{}
+	for _, r := range report.Regressions {
+		got[r.Metric] = true
+	}
+	for _, metric := range []string{"score", "p95_ms", "error_rate"} {
+		if !got[metric] {
+			t.Fatalf("%v regression not reported: %+v", metric, report.Regressions)
+		}
+	}
+	if got["rps"] {
+		t.Fatalf("unexpected rps regression: %+v", report.Regressions)
+	}
+
+	// 同じビルドで保存し直しても，比べるのは別のビルドの最新のもの
+	loaded, found, err = loadPreviousSnapshot("bbbb")
+	if err != nil || !found || loaded.Build != "aaaa" {
+		t.Fatalf("got (%v, %v, %v), want build aaaa", loaded.Build, found, err)
+	}
+}
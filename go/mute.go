@@ -0,0 +1,221 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const maxMuteDuration = 7 * 24 * time.Hour
+
+// アラートを止める期間
+// ISUの時刻は実時間とずれているので，コンディションのtimestampと比べる
+type MuteWindow struct {
+	ID               int64     `db:"id"`
+	JIAIsuUUID       string    `db:"jia_isu_uuid"`
+	StartAt          time.Time `db:"start_at"`
+	EndAt            time.Time `db:"end_at"`
+	ExcludeFromTrend bool      `db:"exclude_from_trend"`
+}
+
+type MuteWindowResponse struct {
+	ID               int64 `json:"id"`
+	StartAt          int64 `json:"start_at"`
+	EndAt            int64 `json:"end_at"`
+	ExcludeFromTrend bool  `json:"exclude_from_trend"`
+}
+
+type PostMuteRequest struct {
+	StartAt          int64 `json:"start_at"`
+	EndAt            int64 `json:"end_at"`
+	ExcludeFromTrend bool  `json:"exclude_from_trend"`
+}
+
+func (w MuteWindow) covers(timestamp time.Time) bool {
+	return !timestamp.Before(w.StartAt) && timestamp.Before(w.EndAt)
+}
+
+func (w MuteWindow) Response() MuteWindowResponse {
+	return MuteWindowResponse{
+		ID:               w.ID,
+		StartAt:          w.StartAt.Unix(),
+		EndAt:            w.EndAt.Unix(),
+		ExcludeFromTrend: w.ExcludeFromTrend,
+	}
+}
+
+// ISUのミュート期間(start_at順)
+type MuteWindows []MuteWindow
+
+// timestampがミュート期間に入っているか
+func (ws MuteWindows) Muted(timestamp time.Time) bool {
+	for _, w := range ws {
+		if w.covers(timestamp) {
+			return true
+		}
+	}
+	return false
+}
+
+// timestampのコンディションをトレンドから外すか
+func (ws MuteWindows) ExcludedFromTrend(timestamp time.Time) bool {
+	for _, w := range ws {
+		if w.ExcludeFromTrend && w.covers(timestamp) {
+			return true
+		}
+	}
+	return false
+}
+
+type MuteCache struct {
+	cache *Cache[string, MuteWindows]
+}
+
+var muteCache = NewMuteCache(getEnvInt("MUTE_CACHE_MAX_ENTRIES", 0))
+
+func NewMuteCache(maxEntries int) *MuteCache {
+	return &MuteCache{cache: NewCache[string, MuteWindows](profile.CacheTTL, maxEntries)}
+}
+
+func (mc *MuteCache) Get(jiaIsuUUID string) (MuteWindows, error) {
+	return mc.cache.GetOrLoad(jiaIsuUUID, func(jiaIsuUUID string) (MuteWindows, error) {
+		windows := MuteWindows{}
+		err := getDB().Select(&windows, "SELECT * FROM `isu_mute` WHERE `jia_isu_uuid` = ? ORDER BY `start_at`", jiaIsuUUID)
+		if err != nil {
+			return nil, err
+		}
+		return windows, nil
+	})
+}
+
+// 複数のISUの分を，キャッシュにないものだけ1クエリで読む
+func (mc *MuteCache) GetMany(jiaIsuUUIDs []string) (map[string]MuteWindows, error) {
+	return mc.cache.GetOrLoadMany(jiaIsuUUIDs, func(jiaIsuUUIDs []string) (map[string]MuteWindows, error) {
+		query, args, err := sqlx.In("SELECT * FROM `isu_mute` WHERE `jia_isu_uuid` IN (?) ORDER BY `start_at`", jiaIsuUUIDs)
+		if err != nil {
+			return nil, err
+		}
+		windows := []MuteWindow{}
+		err = getDB().Select(&windows, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		res := make(map[string]MuteWindows, len(jiaIsuUUIDs))
+		for _, jiaIsuUUID := range jiaIsuUUIDs {
+			res[jiaIsuUUID] = MuteWindows{}
+		}
+		for _, w := range windows {
+			res[w.JIAIsuUUID] = append(res[w.JIAIsuUUID], w)
+		}
+		return res, nil
+	})
+}
+
+func (mc *MuteCache) Forget(jiaIsuUUID string) {
+	mc.cache.Forget(jiaIsuUUID)
+}
+
+func (mc *MuteCache) Reset() {
+	mc.cache.Reset()
+}
+
+// timestampがミュート期間に入っているか
+// 1リクエストで複数のコンディションを見るときは，Getで一度だけ引いてMuteWindows.Mutedを使う
+func (mc *MuteCache) Muted(jiaIsuUUID string, timestamp time.Time) (bool, error) {
+	windows, err := mc.Get(jiaIsuUUID)
+	if err != nil {
+		return false, err
+	}
+	return windows.Muted(timestamp), nil
+}
+
+// GET /api/isu/:jia_isu_uuid/mute
+// ISUのミュート期間の一覧を取得
+func getIsuMute(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	allowed, err := authorizeIsu(jiaUserID, jiaIsuUUID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if !allowed {
+		return c.String(http.StatusNotFound, "not found: isu")
+	}
+
+	windows, err := muteCache.Get(jiaIsuUUID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	res := make([]MuteWindowResponse, 0, len(windows))
+	for _, w := range windows {
+		res = append(res, w.Response())
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// POST /api/isu/:jia_isu_uuid/mute
+// ISUのミュート期間を追加
+// 期間中のcriticalなコンディションではインシデントの通知を出さず，exclude_from_trendならトレンドにも出さない
+func postIsuMute(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	allowed, err := authorizeIsu(jiaUserID, jiaIsuUUID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if !allowed {
+		return c.String(http.StatusNotFound, "not found: isu")
+	}
+
+	req := PostMuteRequest{}
+	err = c.Bind(&req)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad request body")
+	}
+	startAt := time.Unix(req.StartAt, 0)
+	endAt := time.Unix(req.EndAt, 0)
+	if !endAt.After(startAt) || endAt.Sub(startAt) > maxMuteDuration {
+		return c.String(http.StatusBadRequest, "bad request body")
+	}
+
+	result, err := getDB().Exec(
+		"INSERT INTO `isu_mute` (`jia_isu_uuid`, `start_at`, `end_at`, `exclude_from_trend`) VALUES (?, ?, ?, ?)",
+		jiaIsuUUID, startAt, endAt, req.ExcludeFromTrend,
+	)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	muteCache.Forget(jiaIsuUUID)
+
+	window := MuteWindow{ID: id, JIAIsuUUID: jiaIsuUUID, StartAt: startAt, EndAt: endAt, ExcludeFromTrend: req.ExcludeFromTrend}
+	return c.JSON(http.StatusCreated, window.Response())
+}
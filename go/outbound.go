@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	outboundJIA     = "jia"
+	outboundWebhook = "webhook"
+	outboundTrend   = "trend"
+	outboundPeer    = "peer"
+)
+
+// 外部への呼び出し毎のタイムアウトとリトライの方針
+type OutboundPolicy struct {
+	Timeout time.Duration
+	// 最初の1回に加えて何回までやり直すか
+	Retries int
+	// n回目のやり直しの前にBackoff*2^(n-1)待つ
+	Backoff time.Duration
+	// 待ち時間を±Jitterの割合でばらつかせる(0〜1)
+	Jitter float64
+}
+
+var defaultOutboundPolicies = map[string]OutboundPolicy{
+	// 有効化はユーザーのリクエストを待たせるので，やり直さずブレーカーに任せる
+	outboundJIA:     {Timeout: 5 * time.Second, Retries: 0, Backoff: 100 * time.Millisecond, Jitter: 0.2},
+	outboundWebhook: {Timeout: 3 * time.Second, Retries: 2, Backoff: 200 * time.Millisecond, Jitter: 0.2},
+	// トレンドは次の周期でまた送るのでやり直さない
+	outboundTrend: {Timeout: time.Second, Retries: 0},
+	outboundPeer:  {Timeout: time.Second, Retries: 2, Backoff: 100 * time.Millisecond, Jitter: 0.2},
+}
+
+// OUTBOUND_POLICIES=jia:timeout=2s,retries=1;webhook:backoff=500ms のように既定値を部分的に上書きする
+func parseOutboundPolicies(spec string) (map[string]OutboundPolicy, error) {
+	policies := make(map[string]OutboundPolicy, len(defaultOutboundPolicies))
+	for name, policy := range defaultOutboundPolicies {
+		policies[name] = policy
+	}
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, params, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid outbound policy: %v", entry)
+		}
+		policy := policies[name]
+		for _, param := range strings.Split(params, ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if !ok {
+				return nil, fmt.Errorf("invalid outbound policy: %v", entry)
+			}
+			var err error
+			switch key {
+			case "timeout":
+				policy.Timeout, err = time.ParseDuration(value)
+			case "retries":
+				policy.Retries, err = strconv.Atoi(value)
+			case "backoff":
+				policy.Backoff, err = time.ParseDuration(value)
+			case "jitter":
+				policy.Jitter, err = strconv.ParseFloat(value, 64)
+			default:
+				err = fmt.Errorf("unknown key: %v", key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid outbound policy %v: %w", entry, err)
+			}
+		}
+		policies[name] = policy
+	}
+	return policies, nil
+}
+
+// 方針に従って外部へのHTTPリクエストを送る
+type OutboundExecutor struct {
+	name   string
+	policy OutboundPolicy
+	client *http.Client
+}
+
+var outboundExecutors = newOutboundExecutors(getEnv("OUTBOUND_POLICIES", ""))
+
+func newOutboundExecutors(spec string) map[string]*OutboundExecutor {
+	policies, err := parseOutboundPolicies(spec)
+	if err != nil {
+		systemLogger.Error().Err(err).Msg("failed to parse OUTBOUND_POLICIES: using defaults")
+		policies = defaultOutboundPolicies
+	}
+	executors := make(map[string]*OutboundExecutor, len(policies))
+	for name, policy := range policies {
+		executors[name] = &OutboundExecutor{
+			name:   name,
+			policy: policy,
+			client: &http.Client{Timeout: policy.Timeout},
+		}
+	}
+	return executors
+}
+
+func outbound(name string) *OutboundExecutor {
+	return outboundExecutors[name]
+}
+
+// 通信エラーと5xxのときだけやり直す．最後の5xxはそのまま返すので，呼び出し側でステータスを見ること
+// ボディを送り直すため，リクエストは毎回newRequestで作る
+func (oe *OutboundExecutor) Do(newRequest func() (*http.Request, error)) (*http.Response, error) {
+	var res *http.Response
+	var err error
+	for attempt := 0; attempt <= oe.policy.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(oe.backoff(attempt))
+		}
+		var req *http.Request
+		req, err = newRequest()
+		if err != nil {
+			return nil, err
+		}
+		res, err = oe.client.Do(req)
+		if err == nil && res.StatusCode < http.StatusInternalServerError {
+			return res, nil
+		}
+		if attempt < oe.policy.Retries {
+			if err == nil {
+				io.Copy(io.Discard, res.Body)
+				res.Body.Close()
+			}
+			workerLogger.Debug().Str("outbound", oe.name).Int("attempt", attempt+1).Msg("retrying outbound request")
+		}
+	}
+	return res, err
+}
+
+func (oe *OutboundExecutor) backoff(attempt int) time.Duration {
+	d := oe.policy.Backoff << (attempt - 1)
+	if oe.policy.Jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * oe.policy.Jitter * float64(d))
+	}
+	return d
+}
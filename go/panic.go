@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const panicDumpInterval = time.Minute
+
+// ルート毎のpanic回数とダンプの出力時刻，直近のpanicの詳細
+type PanicStats struct {
+	dumpDir  string
+	counts   map[string]int
+	lastDump map[string]time.Time
+	// 古いものから順に，最大maxRecent件
+	recent    []PanicRecord
+	maxRecent int
+	Lock      sync.Mutex
+}
+
+// /debug/lastpanicsで返すpanicの詳細
+type PanicRecord struct {
+	Time      time.Time         `json:"time"`
+	Route     string            `json:"route"`
+	Method    string            `json:"method"`
+	URI       string            `json:"uri"`
+	RequestID string            `json:"request_id"`
+	RemoteIP  string            `json:"remote_ip"`
+	Headers   map[string]string `json:"headers"`
+	Value     string            `json:"value"`
+	Stack     string            `json:"stack"`
+	// panicの直前までにこのプロセスで出たログ(ワーカーの失敗やDBの切り替えなど)
+	RecentEvents []string `json:"recent_events"`
+	DumpPath     string   `json:"dump_path,omitempty"`
+}
+
+func NewPanicStats(dumpDir string, maxRecent int) *PanicStats {
+	return &PanicStats{
+		dumpDir:   dumpDir,
+		counts:    make(map[string]int),
+		lastDump:  make(map[string]time.Time),
+		maxRecent: maxRecent,
+	}
+}
+
+var panicStats = NewPanicStats(getEnv("PANIC_DUMP_DIR", "/tmp/isucondition-panics"), getEnvInt("PANIC_RECENT_SIZE", 16))
+
+// ログの出力をそのまま流し込み，直近の行を覚えておく
+// ベンチマーク中のpanicを後から調べるとき，その前に何が起きていたかをpanicの記録に添える
+type RecentLogs struct {
+	lines    []string
+	maxLines int
+	Lock     sync.Mutex
+}
+
+var recentLogs = &RecentLogs{maxLines: getEnvInt("PANIC_RECENT_EVENTS", 100)}
+
+func (rl *RecentLogs) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\n")
+	rl.Lock.Lock()
+	defer rl.Lock.Unlock()
+	if len(rl.lines) >= rl.maxLines && len(rl.lines) > 0 {
+		rl.lines = append(rl.lines[:0], rl.lines[1:]...)
+	}
+	if rl.maxLines > 0 {
+		rl.lines = append(rl.lines, line)
+	}
+	return len(p), nil
+}
+
+func (rl *RecentLogs) Lines() []string {
+	rl.Lock.Lock()
+	defer rl.Lock.Unlock()
+	return append([]string{}, rl.lines...)
+}
+
+// middleware.Recoverの代わりに，panicしたリクエストだけ500にして他のリクエストには影響させない
+// どのルートで何が起きたかを後から追えるよう，ルート毎に回数を数えてダンプを残す
+func panicRecoverMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			defer func() {
+				r := recover()
+				if r == nil {
+					return
+				}
+				if r == http.ErrAbortHandler {
+					panic(r)
+				}
+				stack := debug.Stack()
+				route := c.Request().Method + " " + c.Path()
+				dumpPath := panicStats.Record(route, c, r, stack)
+				c.Logger().Errorf("[PANIC RECOVER] route=%v value=%v dump=%v\n%s", route, r, dumpPath, stack)
+				err = c.NoContent(http.StatusInternalServerError)
+			}()
+			return next(c)
+		}
+	}
+}
+
+// panicを記録し，ダンプを書いた場合はそのパスを返す
+// 詳細は常にメモリに残し，同じルートが連続でpanicしてもディスクを埋めないよう，ダンプはルート毎に一定間隔に1回まで
+func (ps *PanicStats) Record(route string, c echo.Context, value interface{}, stack []byte) string {
+	// panicのログより前のものを添えるので，ここで取っておく
+	events := recentLogs.Lines()
+
+	ps.Lock.Lock()
+	ps.counts[route]++
+	now := time.Now()
+	shouldDump := now.Sub(ps.lastDump[route]) >= panicDumpInterval
+	if shouldDump {
+		ps.lastDump[route] = now
+	}
+	ps.Lock.Unlock()
+
+	path := ""
+	if shouldDump {
+		var err error
+		path, err = ps.writeDump(now, route, c, value, stack)
+		if err != nil {
+			c.Logger().Errorf("failed to write panic dump: %v", err)
+			path = ""
+		}
+	}
+
+	req := c.Request()
+	ps.addRecent(PanicRecord{
+		Time:         now,
+		Route:        route,
+		Method:       req.Method,
+		URI:          req.RequestURI,
+		RequestID:    getRequestID(c),
+		RemoteIP:     c.RealIP(),
+		Headers:      panicHeaders(req.Header),
+		Value:        fmt.Sprint(value),
+		Stack:        string(stack),
+		RecentEvents: events,
+		DumpPath:     path,
+	})
+	return path
+}
+
+func (ps *PanicStats) addRecent(record PanicRecord) {
+	ps.Lock.Lock()
+	defer ps.Lock.Unlock()
+	if ps.maxRecent <= 0 {
+		return
+	}
+	if len(ps.recent) >= ps.maxRecent {
+		ps.recent = append(ps.recent[:0], ps.recent[1:]...)
+	}
+	ps.recent = append(ps.recent, record)
+}
+
+// 新しいものから順に返す
+func (ps *PanicStats) Recent() []PanicRecord {
+	ps.Lock.Lock()
+	defer ps.Lock.Unlock()
+	res := make([]PanicRecord, 0, len(ps.recent))
+	for i := len(ps.recent) - 1; i >= 0; i-- {
+		res = append(res, ps.recent[i])
+	}
+	return res
+}
+
+// 認証情報は残さない
+func panicHeaders(header http.Header) map[string]string {
+	res := make(map[string]string, len(header))
+	for key, values := range header {
+		if key == "Cookie" || key == "Authorization" || key == headerAdminToken {
+			continue
+		}
+		res[key] = strings.Join(values, ", ")
+	}
+	return res
+}
+
+func (ps *PanicStats) writeDump(now time.Time, route string, c echo.Context, value interface{}, stack []byte) (string, error) {
+	err := os.MkdirAll(ps.dumpDir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	req := c.Request()
+	fmt.Fprintf(&b, "time: %v\n", now.Format(time.RFC3339Nano))
+	fmt.Fprintf(&b, "route: %v\n", route)
+	fmt.Fprintf(&b, "uri: %v\n", req.RequestURI)
+	fmt.Fprintf(&b, "request_id: %v\n", getRequestID(c))
+	fmt.Fprintf(&b, "panic: %v\n", value)
+	b.WriteString("\nheaders:\n")
+	for key, value := range panicHeaders(req.Header) {
+		fmt.Fprintf(&b, "  %v: %v\n", key, value)
+	}
+	fmt.Fprintf(&b, "\nstack:\n%s\n", stack)
+
+	all := make([]byte, 1024*1024)
+	all = all[:runtime.Stack(all, true)]
+	fmt.Fprintf(&b, "\nall goroutines:\n%s\n", all)
+
+	name := fmt.Sprintf("%v-%v.txt", now.Format("20060102-150405.000"), strings.NewReplacer("/", "_", ":", "", " ", "_").Replace(route))
+	path := filepath.Join(ps.dumpDir, name)
+	err = os.WriteFile(path, []byte(b.String()), 0644)
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func (ps *PanicStats) Counts() map[string]int {
+	ps.Lock.Lock()
+	defer ps.Lock.Unlock()
+	res := make(map[string]int, len(ps.counts))
+	for route, count := range ps.counts {
+		res[route] = count
+	}
+	return res
+}
+
+// GET /internal/panics
+// ルート毎のpanic回数を取得
+func getPanics(c echo.Context) error {
+	return c.JSON(http.StatusOK, panicStats.Counts())
+}
+
+// GET /debug/lastpanics
+// 直近のpanicのスタック，リクエスト，その前のログを新しい順に取得
+func getLastPanics(c echo.Context) error {
+	return c.JSON(http.StatusOK, panicStats.Recent())
+}
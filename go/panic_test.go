@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// panicしたリクエストは500になり，スタックとリクエスト，その前のログが/debug/lastpanicsに残る
+func TestPanicRecoverRecordsRecent(t *testing.T) {
+	stats := panicStats
+	panicStats = NewPanicStats(t.TempDir(), 2)
+	defer func() { panicStats = stats }()
+
+	e := echo.New()
+	e.Use(panicRecoverMiddleware())
+	e.GET("/api/isu/:jia_isu_uuid/graph", func(c echo.Context) error {
+		panic("graph math")
+	})
+
+	recentLogs.Write([]byte("db failover started\n"))
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/api/isu/abc/graph?datetime=1", nil)
+		req.Header.Set("Cookie", "isucondition_go=secret")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != http.StatusInternalServerError {
+			t.Fatalf("got %d, want %d", rec.Code, http.StatusInternalServerError)
+		}
+	}
+
+	recent := panicStats.Recent()
+	if len(recent) != 2 {
+		t.Fatalf("got %d records, want 2", len(recent))
+	}
+	r := recent[0]
+	if r.Route != "GET /api/isu/:jia_isu_uuid/graph" || r.URI != "/api/isu/abc/graph?datetime=1" || r.Value != "graph math" {
+		t.Fatalf("unexpected record: %+v", r)
+	}
+	if !strings.Contains(r.Stack, "panic_test.go") {
+		t.Fatalf("stack does not point at the handler:\n%s", r.Stack)
+	}
+	if _, ok := r.Headers["Cookie"]; ok {
+		t.Fatal("cookie was recorded")
+	}
+	found := false
+	for _, line := range r.RecentEvents {
+		if line == "db failover started" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("recent events do not include earlier logs: %v", r.RecentEvents)
+	}
+	if panicStats.Counts()[r.Route] != 3 {
+		t.Fatalf("count %d, want 3", panicStats.Counts()[r.Route])
+	}
+}
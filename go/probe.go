@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+const (
+	probeDBRoundTrips = 100
+	probeJSONRounds   = 1000
+	probeDiskBytes    = 16 * 1024 * 1024
+)
+
+// 起動時に計測したマシンの性能
+type ProbeResult struct {
+	DBRoundTrip      time.Duration
+	JSONBytesPerSec  float64
+	DiskBytesPerSec  float64
+	NumCPU           int
+	ProbeElapsedTime time.Duration
+}
+
+// 計測結果から導いた推奨設定
+type RecommendedSettings struct {
+	MaxOpenConns  int
+	FlushInterval time.Duration
+	TrendInterval time.Duration
+}
+
+// 競技環境のマシンはまちまちなので，起動時にDB・JSON・ディスクを軽く計測して設定の目安を出す
+func runStartupProbe() (ProbeResult, error) {
+	start := time.Now()
+	res := ProbeResult{NumCPU: runtime.NumCPU()}
+
+	var err error
+	res.DBRoundTrip, err = probeDBRoundTrip()
+	if err != nil {
+		return res, fmt.Errorf("db probe: %w", err)
+	}
+	res.JSONBytesPerSec, err = probeJSONEncode()
+	if err != nil {
+		return res, fmt.Errorf("json probe: %w", err)
+	}
+	res.DiskBytesPerSec, err = probeDiskWrite()
+	if err != nil {
+		return res, fmt.Errorf("disk probe: %w", err)
+	}
+
+	res.ProbeElapsedTime = time.Since(start)
+	return res, nil
+}
+
+func probeDBRoundTrip() (time.Duration, error) {
+	var one int
+	start := time.Now()
+	for i := 0; i < probeDBRoundTrips; i++ {
+		err := getDB().Get(&one, "SELECT 1")
+		if err != nil {
+			return 0, err
+		}
+	}
+	return time.Since(start) / probeDBRoundTrips, nil
+}
+
+func probeJSONEncode() (float64, error) {
+	conds := make([]*GetIsuConditionResponse, conditionLimit)
+	for i := range conds {
+		conds[i] = &GetIsuConditionResponse{
+			JIAIsuUUID:     "0694e4d7-dfce-4aec-b7ca-887ac42cfb8f",
+			IsuName:        "probe",
+			Timestamp:      time.Now().Unix(),
+			Condition:      "is_dirty=true,is_overweight=false,is_broken=false",
+			ConditionLevel: conditionLevelWarning,
+			Message:        "probe",
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	var total int
+	start := time.Now()
+	for i := 0; i < probeJSONRounds; i++ {
+		buf.Reset()
+		err := enc.Encode(conds)
+		if err != nil {
+			return 0, err
+		}
+		total += buf.Len()
+	}
+	return float64(total) / time.Since(start).Seconds(), nil
+}
+
+func probeDiskWrite() (float64, error) {
+	f, err := os.CreateTemp("", "isucondition-probe-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	chunk := make([]byte, 1024*1024)
+	start := time.Now()
+	for written := 0; written < probeDiskBytes; written += len(chunk) {
+		_, err = f.Write(chunk)
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = f.Sync()
+	if err != nil {
+		return 0, err
+	}
+	return float64(probeDiskBytes) / time.Since(start).Seconds(), nil
+}
+
+func (r ProbeResult) Recommend() RecommendedSettings {
+	// DBが遠いほど1リクエストあたりコネクションを長く掴むので，並列度を上げる
+	maxOpenConns := r.NumCPU * 64 * int(r.DBRoundTrip/(500*time.Microsecond)+1)
+	maxOpenConns = min(max(maxOpenConns, 64), 1024)
+
+	// 1回のバルクINSERTにかかる時間の目安に合わせてフラッシュ間隔を決める
+	flushInterval := r.DBRoundTrip * 200
+	if r.DiskBytesPerSec < 50*1024*1024 {
+		flushInterval *= 2
+	}
+	flushInterval = min(max(flushInterval, 50*time.Millisecond), 500*time.Millisecond)
+
+	// JSONが遅いマシンではトレンドの再計算を間引く
+	trendInterval := 100 * time.Millisecond
+	if r.JSONBytesPerSec < 50*1024*1024 {
+		trendInterval = 500 * time.Millisecond
+	}
+
+	return RecommendedSettings{
+		MaxOpenConns:  maxOpenConns,
+		FlushInterval: flushInterval,
+		TrendInterval: trendInterval,
+	}
+}
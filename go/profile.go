@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// 競技向けの挙動と本番向けの挙動をまとめて切り替えるプロファイル
+// 競技環境の環境変数ファイルはリポジトリ外にあるため，BENCH_MODE未指定時は競技向けとし，
+// BENCH_MODE=0 で本番向けの設定になる
+type Profile struct {
+	BenchMode bool
+	// エラーをプレーンテキストで返す(falseならechoのJSONエラー)
+	PlainTextErrors bool
+	// セッションを使うAPIにCSRF対策を入れる
+	CSRF bool
+	// キャッシュのTTL(0なら無期限)
+	CacheTTL time.Duration
+	// アクセスログを出す
+	AccessLog bool
+}
+
+var profile = NewProfile(getEnv("BENCH_MODE", "1") != "0")
+
+func NewProfile(benchMode bool) *Profile {
+	if benchMode {
+		return &Profile{
+			BenchMode:       true,
+			PlainTextErrors: true,
+			CSRF:            false,
+			CacheTTL:        0,
+			AccessLog:       false,
+		}
+	}
+	return &Profile{
+		BenchMode:       false,
+		PlainTextErrors: false,
+		CSRF:            true,
+		CacheTTL:        time.Minute,
+		AccessLog:       true,
+	}
+}
+
+func cacheExpiresAt() time.Time {
+	if profile.CacheTTL <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(profile.CacheTTL)
+}
+
+func cacheExpired(expiresAt time.Time) bool {
+	return !expiresAt.IsZero() && time.Now().After(expiresAt)
+}
+
+// プロファイルに応じたミドルウェアとエラーハンドラをechoに設定する
+func applyProfile(e *echo.Echo) {
+	if profile.PlainTextErrors {
+		e.HTTPErrorHandler = plainTextErrorHandler
+	}
+	if profile.AccessLog {
+		e.Use(accessLogMiddleware())
+	}
+}
+
+// セッションを使うルートグループに追加するミドルウェア
+func profileSessionMiddlewares() []echo.MiddlewareFunc {
+	if !profile.CSRF {
+		return nil
+	}
+	return []echo.MiddlewareFunc{csrfMiddleware()}
+}
+
+// セッションを作る前のログインと，消すだけのサインアウトはトークンを求めない
+var csrfExemptPaths = map[string]struct{}{
+	"/api/auth":    {},
+	"/api/signout": {},
+}
+
+// ダブルサブミット方式．名前はフロントエンドのaxiosの既定に合わせてあり，
+// axiosは同じオリジンへのリクエストでXSRF-TOKENのCookieを読んでX-XSRF-TOKENヘッダーに付ける
+// そのためCookieはJSから読めるようにしておく
+func csrfMiddleware() echo.MiddlewareFunc {
+	return middleware.CSRFWithConfig(middleware.CSRFConfig{
+		Skipper: func(c echo.Context) bool {
+			_, ok := csrfExemptPaths[c.Path()]
+			return ok
+		},
+		TokenLookup:    "header:X-XSRF-TOKEN",
+		CookieName:     "XSRF-TOKEN",
+		CookiePath:     "/",
+		CookieHTTPOnly: false,
+		CookieSameSite: http.SameSiteLaxMode,
+	})
+}
+
+func plainTextErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+	code := http.StatusInternalServerError
+	message := http.StatusText(code)
+	if he, ok := err.(*echo.HTTPError); ok {
+		code = he.Code
+		if m, ok := he.Message.(string); ok {
+			message = m
+		} else {
+			message = http.StatusText(code)
+		}
+	}
+	if code >= http.StatusInternalServerError {
+		c.Logger().Error(err)
+	}
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(code)
+	} else {
+		err = c.String(code, message)
+	}
+	if err != nil {
+		c.Logger().Error(err)
+	}
+}
+
+func accessLogMiddleware() echo.MiddlewareFunc {
+	return middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
+		LogMethod:    true,
+		LogURI:       true,
+		LogStatus:    true,
+		LogLatency:   true,
+		LogRequestID: true,
+		LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
+			apiLogger.Info().
+				Str("method", v.Method).
+				Str("uri", v.URI).
+				Int("status", v.Status).
+				Dur("latency", v.Latency).
+				Str("request_id", v.RequestID).
+				Msg("access")
+			return nil
+		},
+	})
+}
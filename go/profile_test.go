@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// BENCH_MODE=0のCSRF対策で，フロントエンドと同じ手順(GETで受けたCookieをヘッダーに載せる)なら通ることを確かめる
+func newCSRFTestServer() *echo.Echo {
+	e := echo.New()
+	ok := func(c echo.Context) error {
+		return c.NoContent(http.StatusNoContent)
+	}
+	user := e.Group("/api", csrfMiddleware())
+	user.POST("/auth", ok)
+	user.POST("/signout", ok)
+	user.GET("/user/me", ok)
+	user.POST("/isu", ok)
+	return e
+}
+
+func serveCSRFTest(e *echo.Echo, method, path string, cookie *http.Cookie, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	if token != "" {
+		req.Header.Set("X-XSRF-TOKEN", token)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCSRFMiddleware(t *testing.T) {
+	e := newCSRFTestServer()
+
+	// ログインとサインアウトはトークンなしで通る
+	for _, path := range []string{"/api/auth", "/api/signout"} {
+		rec := serveCSRFTest(e, http.MethodPost, path, nil, "")
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("POST %s without token: got %d, want %d", path, rec.Code, http.StatusNoContent)
+		}
+	}
+
+	// それ以外の書き込みはトークンがなければ通さない
+	rec := serveCSRFTest(e, http.MethodPost, "/api/isu", nil, "")
+	if rec.Code == http.StatusNoContent {
+		t.Fatalf("POST /api/isu without token: got %d", rec.Code)
+	}
+
+	// GETで受けたCookieはJSから読め，その値をヘッダーに載せれば通る
+	rec = serveCSRFTest(e, http.MethodGet, "/api/user/me", nil, "")
+	var cookie *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "XSRF-TOKEN" {
+			cookie = c
+		}
+	}
+	if cookie == nil || cookie.Value == "" {
+		t.Fatalf("GET /api/user/me did not set XSRF-TOKEN: %v", rec.Result().Cookies())
+	}
+	if cookie.HttpOnly {
+		t.Fatal("XSRF-TOKEN must be readable from the frontend")
+	}
+	rec = serveCSRFTest(e, http.MethodPost, "/api/isu", cookie, cookie.Value)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("POST /api/isu with token: got %d, want %d", rec.Code, http.StatusNoContent)
+	}
+
+	// Cookieと違う値は通さない
+	rec = serveCSRFTest(e, http.MethodPost, "/api/isu", cookie, "forged")
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("POST /api/isu with wrong token: got %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"sync"
+)
+
+// isu_conditionの範囲検索は，データの偏りによってPRIMARY(jia_isu_uuid, timestamp)と
+// idx_isu_level_timestampの間で実行計画が入れ替わることがあるので，condition_index_hintsが有効ならFORCE INDEXで固定する
+// FORCE INDEXは存在しないインデックスを指定するとエラーになるので，ensureIndexesで確かめたものだけ指定する
+type ConfirmedIndexes struct {
+	names map[string]bool
+	Lock  sync.Mutex
+}
+
+var confirmedIndexes = &ConfirmedIndexes{names: make(map[string]bool)}
+
+func (ci *ConfirmedIndexes) Add(name string) {
+	ci.Lock.Lock()
+	defer ci.Lock.Unlock()
+	ci.names[name] = true
+}
+
+func (ci *ConfirmedIndexes) Has(name string) bool {
+	ci.Lock.Lock()
+	defer ci.Lock.Unlock()
+	return ci.names[name]
+}
+
+// jia_isu_uuidとtimestampの範囲で引くクエリ向け．FROM `isu_condition` の直後に付ける
+func isuConditionRangeHint() string {
+	if !featureFlags.Enabled(flagConditionIndexHints) {
+		return ""
+	}
+	return " FORCE INDEX (PRIMARY)"
+}
+
+// levelでも絞るクエリ向け．インデックスがまだなければPRIMARYに固定する
+func isuConditionLevelHint() string {
+	if !featureFlags.Enabled(flagConditionIndexHints) {
+		return ""
+	}
+	if !confirmedIndexes.Has("idx_isu_level_timestamp") {
+		return " FORCE INDEX (PRIMARY)"
+	}
+	return " FORCE INDEX (`idx_isu_level_timestamp`)"
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/jmoiron/sqlx"
+)
+
+// POSTとflush，キャッシュとトレンドの読み書き，DBの切り替えを同時に走らせる
+// 競合はgo test -raceで検出させ，ここでは取りこぼしや壊れた値がないことだけを確かめる
+//
+//	go test -race -run Concurrent .
+const (
+	raceWriters    = 8
+	raceBatches    = 200
+	raceBatchSize  = 10
+	raceReaders    = 4
+	raceIterations = 2000
+)
+
+func TestConcurrentInsertQueue(t *testing.T) {
+	iq := NewQueue()
+	batch := benchConditions(raceBatchSize)
+
+	var writers sync.WaitGroup
+	for w := 0; w < raceWriters; w++ {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			for i := 0; i < raceBatches; i++ {
+				iq.Insert(batch)
+			}
+		}()
+	}
+
+	// flushの代わりに取り出し続け，書き込みが終わった扱いにする
+	stop := make(chan struct{})
+	popped := make(chan int)
+	go func() {
+		n := 0
+		for {
+			select {
+			case <-stop:
+				n += len(iq.PopAll())
+				iq.Done()
+				popped <- n
+				return
+			default:
+			}
+			n += len(iq.PopAll())
+			iq.Lag()
+			iq.Done()
+		}
+	}()
+
+	writers.Wait()
+	close(stop)
+	if n := <-popped; n != raceWriters*raceBatches*raceBatchSize {
+		t.Fatalf("popped %d conditions, want %d", n, raceWriters*raceBatches*raceBatchSize)
+	}
+	if lag := iq.Lag(); lag != 0 {
+		t.Fatalf("lag after drain: %v", lag)
+	}
+}
+
+func TestConcurrentIsuConditionCache(t *testing.T) {
+	// 上限を小さくして，読み書きの最中にLRUの追い出しも起こす
+	cc := NewIsuConditionCache(benchIsus / 10)
+
+	var wg sync.WaitGroup
+	for r := 0; r < raceReaders; r++ {
+		wg.Add(3)
+		go func(r int) {
+			defer wg.Done()
+			for i := 0; i < raceIterations; i++ {
+				cond := benchCondition(r*raceIterations + i)
+				cc.Set(&cond)
+				if i%7 == 0 {
+					cc.Forget(cond.JIAIsuUUID)
+				}
+			}
+		}(r)
+		go func(r int) {
+			defer wg.Done()
+			for i := 0; i < raceIterations; i++ {
+				uuid := benchUUID(i % benchIsus)
+				cond, ok := cc.Peek(uuid)
+				if ok && cond.JIAIsuUUID != uuid {
+					t.Errorf("Peek(%v) returned %v", uuid, cond.JIAIsuUUID)
+					return
+				}
+			}
+		}(r)
+		// DBの代わりの読み込みで，GetOrLoadの読み込み中にSet/Forgetが割り込む場合
+		go func(r int) {
+			defer wg.Done()
+			for i := 0; i < raceIterations; i++ {
+				uuid := benchUUID((r + i) % benchIsus)
+				cond, err := cc.cache.GetOrLoad(uuid, func(uuid string) (*IsuCondition, error) {
+					cond := benchCondition(i)
+					cond.JIAIsuUUID = uuid
+					return &cond, nil
+				})
+				if err != nil || cond.JIAIsuUUID != uuid {
+					t.Errorf("GetOrLoad(%v) returned (%v, %v)", uuid, cond, err)
+					return
+				}
+			}
+		}(r)
+	}
+	wg.Wait()
+	if n := cc.cache.Len(); n > benchIsus/10 {
+		t.Fatalf("cache holds %d entries, cap is %d", n, benchIsus/10)
+	}
+}
+
+func TestConcurrentTrendCache(t *testing.T) {
+	// スナップショットのファイルには書かない
+	snapshotPath := trendSnapshotPath
+	trendSnapshotPath = ""
+	defer func() { trendSnapshotPath = snapshotPath }()
+
+	tc := NewTrendCache()
+	trend := benchTrend()[:2]
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < raceIterations/10; i++ {
+			tc.Set(trend)
+		}
+	}()
+	for r := 0; r < raceReaders; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var last int64
+			for i := 0; i < raceIterations; i++ {
+				version := tc.Version()
+				if version < last {
+					t.Errorf("version went back from %d to %d", last, version)
+					return
+				}
+				last = version
+				if res := tc.Get(); len(res) != 0 && len(res) != len(trend) {
+					t.Errorf("got %d characters, want %d", len(res), len(trend))
+					return
+				}
+				if i%100 == 0 && !json.Valid(tc.Bytes()) {
+					t.Error("trend body is not valid JSON")
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if v := tc.Version(); v != raceIterations/10 {
+		t.Fatalf("version %d, want %d", v, raceIterations/10)
+	}
+}
+
+// フェイルオーバーでDBと接続先を差し替える間も，ハンドラやワーカーは読み続ける
+func TestConcurrentDBSwap(t *testing.T) {
+	oldDB := currentDB.Load()
+	oldConn := currentMySQLConnectionData.Load()
+	defer func() {
+		currentDB.Store(oldDB)
+		currentMySQLConnectionData.Store(oldConn)
+	}()
+	currentDB.Store(&sqlx.DB{})
+	currentMySQLConnectionData.Store(&MySQLConnectionEnv{Host: "db0"})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < raceIterations; i++ {
+			currentMySQLConnectionData.Store(&MySQLConnectionEnv{Host: "db" + strconv.Itoa(i%3)})
+			currentDB.Store(&sqlx.DB{})
+		}
+	}()
+	for r := 0; r < raceReaders; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < raceIterations; i++ {
+				if getDB() == nil {
+					t.Error("getDB returned nil")
+					return
+				}
+				if host := getMySQLConnectionEnv().Host; len(host) != 3 {
+					t.Errorf("unexpected host %q", host)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
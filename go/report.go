@@ -0,0 +1,222 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultReportPeriod = 24 * time.Hour
+	maxReportPeriod     = 90 * 24 * time.Hour
+	// 期間の終端は最新のコンディションの時刻なので，TTLなしでキャッシュすると古い集計を返し続けてしまう
+	reportCacheTTL = 10 * time.Second
+)
+
+type IsuReport struct {
+	JIAIsuUUID string `json:"jia_isu_uuid"`
+	Period     string `json:"period"`
+	From       int64  `json:"from"`
+	To         int64  `json:"to"`
+	// インシデント(critical)が起きていなかった時間の割合(%)
+	Availability float64 `json:"availability"`
+	Incidents    int     `json:"incidents"`
+	Criticals    int     `json:"criticals"`
+	// criticalなインシデントの発生間隔の平均(秒)，2回未満ならnull
+	MeanTimeBetweenCriticals *float64 `json:"mean_time_between_criticals"`
+	// 解決済みインシデントの発生から解決までの平均(秒)，解決済みがなければnull
+	MeanTimeToRecovery *float64 `json:"mean_time_to_recovery"`
+}
+
+type reportCacheEntry struct {
+	report    IsuReport
+	expiresAt time.Time
+}
+
+type ReportCache struct {
+	cache map[string]map[string]reportCacheEntry
+	Lock  sync.Mutex
+}
+
+var reportCache = &ReportCache{cache: make(map[string]map[string]reportCacheEntry)}
+
+func (rc *ReportCache) Get(jiaIsuUUID string, period string) (IsuReport, bool) {
+	rc.Lock.Lock()
+	defer rc.Lock.Unlock()
+	entry, ok := rc.cache[jiaIsuUUID][period]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return IsuReport{}, false
+	}
+	return entry.report, true
+}
+
+func (rc *ReportCache) Set(report IsuReport) {
+	rc.Lock.Lock()
+	defer rc.Lock.Unlock()
+	reports, ok := rc.cache[report.JIAIsuUUID]
+	if !ok {
+		reports = make(map[string]reportCacheEntry)
+		rc.cache[report.JIAIsuUUID] = reports
+	}
+	reports[report.Period] = reportCacheEntry{report: report, expiresAt: time.Now().Add(reportCacheTTL)}
+}
+
+func (rc *ReportCache) Forget(jiaIsuUUID string) {
+	rc.Lock.Lock()
+	defer rc.Lock.Unlock()
+	delete(rc.cache, jiaIsuUUID)
+}
+
+func (rc *ReportCache) Reset() {
+	rc.Lock.Lock()
+	defer rc.Lock.Unlock()
+	rc.cache = make(map[string]map[string]reportCacheEntry)
+}
+
+// "24h"のようなtime.Durationの書式に加えて"7d"のような日数を受け付ける
+func parseReportPeriod(s string) (time.Duration, error) {
+	if s == "" {
+		return defaultReportPeriod, nil
+	}
+	var period time.Duration
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		period = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		period, err = time.ParseDuration(s)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if period <= 0 || period > maxReportPeriod {
+		return 0, errors.New("period out of range")
+	}
+	return period, nil
+}
+
+func buildIsuReport(jiaIsuUUID string, periodName string, period time.Duration, now time.Time) (IsuReport, error) {
+	from := now.Add(-period)
+	incidents := []Incident{}
+	err := getDB().Select(
+		&incidents,
+		"SELECT * FROM `isu_incident` WHERE `jia_isu_uuid` = ? AND `started_at` < ? AND (`resolved_at` IS NULL OR `resolved_at` > ?) ORDER BY `started_at`",
+		jiaIsuUUID, now, from,
+	)
+	if err != nil {
+		return IsuReport{}, err
+	}
+
+	report := IsuReport{
+		JIAIsuUUID: jiaIsuUUID,
+		Period:     periodName,
+		From:       from.Unix(),
+		To:         now.Unix(),
+		Incidents:  len(incidents),
+	}
+
+	var downtime, recoveryTotal time.Duration
+	var recovered int
+	var lastCritical time.Time
+	var criticalGapTotal time.Duration
+	for _, incident := range incidents {
+		end := now
+		if incident.ResolvedAt.Valid {
+			end = incident.ResolvedAt.Time
+			recoveryTotal += end.Sub(incident.StartedAt)
+			recovered++
+		}
+		if end.After(now) {
+			end = now
+		}
+		downtime += end.Sub(maxTime(incident.StartedAt, from))
+
+		if incident.Level == conditionLevelCritical {
+			if report.Criticals > 0 {
+				criticalGapTotal += incident.StartedAt.Sub(lastCritical)
+			}
+			lastCritical = incident.StartedAt
+			report.Criticals++
+		}
+	}
+
+	report.Availability = 100 * (1 - downtime.Seconds()/period.Seconds())
+	if report.Criticals >= 2 {
+		mtbc := criticalGapTotal.Seconds() / float64(report.Criticals-1)
+		report.MeanTimeBetweenCriticals = &mtbc
+	}
+	if recovered > 0 {
+		mttr := recoveryTotal.Seconds() / float64(recovered)
+		report.MeanTimeToRecovery = &mttr
+	}
+	return report, nil
+}
+
+func maxTime(a time.Time, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// GET /api/isu/:jia_isu_uuid/report?period=
+// ISUのインシデントから稼働率・critical発生間隔・復旧時間を集計
+func getIsuReport(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	periodName := c.QueryParam("period")
+	period, err := parseReportPeriod(periodName)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad format: period")
+	}
+	if periodName == "" {
+		periodName = defaultReportPeriod.String()
+	}
+
+	allowed, err := authorizeIsu(jiaUserID, jiaIsuUUID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if !allowed {
+		return c.String(http.StatusNotFound, "not found: isu")
+	}
+
+	if report, ok := reportCache.Get(jiaIsuUUID, periodName); ok {
+		return c.JSON(http.StatusOK, report)
+	}
+	// ISUの時刻は実時間とずれているので，最新のコンディションの時刻を期間の終端にする
+	now := time.Now()
+	latest, err := isuConditionCache.Get(jiaIsuUUID)
+	if err == nil {
+		now = latest.Timestamp
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	report, err := buildIsuReport(jiaIsuUUID, periodName, period, now)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	reportCache.Set(report)
+	return c.JSON(http.StatusOK, report)
+}
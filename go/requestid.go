@@ -0,0 +1,29 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// X-Request-IDを払い出し(またはnginx等から引き継ぎ)，レスポンスヘッダとログに載せる
+func requestIDMiddleware() echo.MiddlewareFunc {
+	return middleware.RequestIDWithConfig(middleware.RequestIDConfig{
+		RequestIDHandler: func(c echo.Context, requestID string) {
+			c.SetLogger(newRequestLogger(c.Echo().Logger, requestID))
+		},
+	})
+}
+
+// ログにリクエストIDを入れることで，複数サーバーにまたがる1回の登録フローを追えるようにする
+// IDはログを出したときにだけ付けるので，ログを出さないリクエストではロガーの分の割り当てだけで済む
+func newRequestLogger(base echo.Logger, requestID string) echo.Logger {
+	if el, ok := base.(*echoLogger); ok {
+		return el.WithRequestID(requestID)
+	}
+	return base
+}
+
+// 外部へのリクエストにもリクエストIDを引き継ぐ
+func getRequestID(c echo.Context) string {
+	return c.Response().Header().Get(echo.HeaderXRequestID)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const headerRouteCache = "X-Route-Cache"
+
+// ルート毎のレスポンスのキャッシュの方針
+// Varyは(消すときの単位, その中のキー, キャッシュしてよいか)を返す
+type RouteCachePolicy struct {
+	Name string
+	TTL  time.Duration
+	Vary func(c echo.Context) (group string, key string, ok bool)
+}
+
+var (
+	// 計算済みのトレンドは全員に同じものを返す(ページの指定だけで変わる)
+	trendRoutePolicy = RouteCachePolicy{
+		Name: "trend",
+		TTL:  time.Duration(getEnvInt("ROUTE_CACHE_TREND_TTL_MS", 500)) * time.Millisecond,
+		Vary: func(c echo.Context) (string, string, bool) {
+			return "", c.QueryParam("page") + "\x00" + c.QueryParam("per_page"), true
+		},
+	}
+	// ISUと日時毎．別のユーザーのレスポンスを返さないようユーザーもキーに入れる
+	// ヒットしたときもハンドラと同じく，ユーザーの存在とISUの持ち主を確かめる(だめならハンドラに任せてエラーを返させる)
+	graphRoutePolicy = RouteCachePolicy{
+		Name: "graph",
+		TTL:  time.Duration(getEnvInt("ROUTE_CACHE_GRAPH_TTL_MS", 1000)) * time.Millisecond,
+		Vary: func(c echo.Context) (string, string, bool) {
+			jiaUserID, _, err := getUserIDFromSession(c)
+			if err != nil {
+				return "", "", false
+			}
+			jiaIsuUUID := c.Param("jia_isu_uuid")
+			allowed, err := authorizeIsu(jiaUserID, jiaIsuUUID)
+			if err != nil || !allowed {
+				return "", "", false
+			}
+			key := jiaUserID + "\x00" + c.QueryParam("datetime") + "\x00" + c.QueryParam("compare_previous")
+			return jiaIsuUUID, key, true
+		},
+	}
+)
+
+type routeCacheEntry struct {
+	status int
+	// ハンドラが付けたヘッダー(件数など)もそのまま返す
+	header    http.Header
+	body      []byte
+	expiresAt time.Time
+}
+
+type RouteCache struct {
+	// ポリシー名+グループ -> キー -> レスポンス
+	cache map[string]map[string]routeCacheEntry
+	Lock  sync.Mutex
+}
+
+var routeCache = &RouteCache{cache: make(map[string]map[string]routeCacheEntry)}
+
+func routeCacheGroup(name, group string) string {
+	return name + "\x00" + group
+}
+
+func (rc *RouteCache) Get(name, group, key string) (routeCacheEntry, bool) {
+	rc.Lock.Lock()
+	defer rc.Lock.Unlock()
+	g := routeCacheGroup(name, group)
+	entry, ok := rc.cache[g][key]
+	if !ok {
+		return routeCacheEntry{}, false
+	}
+	if time.Now().After(entry.expiresAt) {
+		rc.delete(g, key)
+		return routeCacheEntry{}, false
+	}
+	return entry, true
+}
+
+// 空になったグループも消す．呼び出し側はLockを持っていること
+func (rc *RouteCache) delete(g string, key string) {
+	delete(rc.cache[g], key)
+	if len(rc.cache[g]) == 0 {
+		delete(rc.cache, g)
+	}
+}
+
+func (rc *RouteCache) Set(name, group, key string, entry routeCacheEntry) {
+	rc.Lock.Lock()
+	defer rc.Lock.Unlock()
+	g := routeCacheGroup(name, group)
+	entries, ok := rc.cache[g]
+	if !ok {
+		entries = make(map[string]routeCacheEntry)
+		rc.cache[g] = entries
+	}
+	// 期限切れのものはグループに書くときにまとめて捨てる
+	now := time.Now()
+	for k, e := range entries {
+		if now.After(e.expiresAt) {
+			delete(entries, k)
+		}
+	}
+	entries[key] = entry
+}
+
+// 期限切れのものと空になったグループを捨てる
+// 一度書かれたきり読まれも書かれもしないグループ(ISU毎)はSetやGetでは消えないので，定期的に呼ぶ
+func (rc *RouteCache) Sweep() {
+	rc.Lock.Lock()
+	defer rc.Lock.Unlock()
+	now := time.Now()
+	for g, entries := range rc.cache {
+		for k, e := range entries {
+			if now.After(e.expiresAt) {
+				delete(entries, k)
+			}
+		}
+		if len(entries) == 0 {
+			delete(rc.cache, g)
+		}
+	}
+}
+
+func (rc *RouteCache) sweepScheduled(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rc.Sweep()
+		}
+	}
+}
+
+// 元のデータが変わったときに呼ぶ
+func (rc *RouteCache) Bust(name, group string) {
+	rc.Lock.Lock()
+	defer rc.Lock.Unlock()
+	delete(rc.cache, routeCacheGroup(name, group))
+}
+
+func (rc *RouteCache) Reset() {
+	rc.Lock.Lock()
+	defer rc.Lock.Unlock()
+	rc.cache = make(map[string]map[string]routeCacheEntry)
+}
+
+// GETの200のレスポンスをポリシーに従って覚えておき，期限内は同じものを返す
+func routeCacheMiddleware(policy RouteCachePolicy) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if c.Request().Method != http.MethodGet {
+				return next(c)
+			}
+			group, key, ok := policy.Vary(c)
+			if !ok {
+				return next(c)
+			}
+			if entry, ok := routeCache.Get(policy.Name, group, key); ok {
+				header := c.Response().Header()
+				for k, v := range entry.header {
+					header[k] = v
+				}
+				header.Set(headerRouteCache, "HIT")
+				return writeBlob(c, entry.status, entry.header.Get(echo.HeaderContentType), entry.body)
+			}
+
+			recorder := &responseRecorder{ResponseWriter: c.Response().Writer}
+			c.Response().Writer = recorder
+			c.Response().Header().Set(headerRouteCache, "MISS")
+			err := next(c)
+			if err != nil || c.Response().Status != http.StatusOK {
+				return err
+			}
+			header := c.Response().Header().Clone()
+			header.Del(headerRouteCache)
+			header.Del(echo.HeaderContentLength)
+			header.Del(echo.HeaderXRequestID)
+			header.Del(echo.HeaderSetCookie)
+			routeCache.Set(policy.Name, group, key, routeCacheEntry{
+				status:    c.Response().Status,
+				header:    header,
+				body:      recorder.body.Bytes(),
+				expiresAt: time.Now().Add(policy.TTL),
+			})
+			return nil
+		}
+	}
+}
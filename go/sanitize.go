@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	textOverflowReject   = "reject"
+	textOverflowTruncate = "truncate"
+
+	// 切り詰めた場合にレスポンスに付けるヘッダ
+	headerTextTruncated = "X-Isucondition-Truncated"
+)
+
+var (
+	// 既定はDBの列(VARCHAR(255))に収まる長さ
+	messageMaxLength = getEnvInt("MESSAGE_MAX_LENGTH", 255)
+	isuNameMaxLength = getEnvInt("ISU_NAME_MAX_LENGTH", 255)
+	// 長すぎる文字列を弾く(reject)か切り詰める(truncate)か
+	textOverflowMode = getEnv("TEXT_OVERFLOW", textOverflowTruncate)
+
+	errTextTooLong = errors.New("text too long")
+)
+
+// 不正なUTF-8を置換文字にし，改行とタブ以外の制御文字を取り除いたうえで長さを制限する
+// 切り詰めた場合はtruncated=true，rejectモードで長すぎる場合はerrTextTooLongを返す
+func sanitizeText(s string, maxLength int) (sanitized string, truncated bool, err error) {
+	if !utf8.ValidString(s) {
+		s = strings.ToValidUTF8(s, string(utf8.RuneError))
+	}
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\n' && r != '\t' {
+			return -1
+		}
+		return r
+	}, s)
+
+	if utf8.RuneCountInString(s) <= maxLength {
+		return s, false, nil
+	}
+	if textOverflowMode == textOverflowReject {
+		return "", false, errTextTooLong
+	}
+	runes := 0
+	for i := range s {
+		if runes == maxLength {
+			return s[:i], true, nil
+		}
+		runes++
+	}
+	return s, false, nil
+}
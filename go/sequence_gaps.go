@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 返す欠けの最大数(新しいものから)
+const sequenceGapListLimit = 100
+
+type SequenceGap struct {
+	// この番号の次から
+	After int64 `json:"after"`
+	// この番号の前まで
+	Before  int64 `json:"before"`
+	Missing int64 `json:"missing"`
+}
+
+type GetIsuGapsResponse struct {
+	JIAIsuUUID string `json:"jia_isu_uuid"`
+	// 通し番号付きで受け取った数(重複は除く)
+	Received int64         `json:"received"`
+	First    *int64        `json:"first"`
+	Last     *int64        `json:"last"`
+	Missing  int64         `json:"missing"`
+	Gaps     []SequenceGap `json:"gaps"`
+}
+
+// 昇順の通し番号から欠けを数える．デバイスの再起動などで番号が戻った場合も並べ直して見るだけ
+func detectSequenceGaps(sequences []int64) GetIsuGapsResponse {
+	res := GetIsuGapsResponse{Gaps: []SequenceGap{}}
+	for i, sequence := range sequences {
+		if i > 0 && sequence == sequences[i-1] {
+			continue
+		}
+		res.Received++
+		if i == 0 {
+			continue
+		}
+		prev := sequences[i-1]
+		if sequence > prev+1 {
+			gap := SequenceGap{After: prev, Before: sequence, Missing: sequence - prev - 1}
+			res.Missing += gap.Missing
+			res.Gaps = append(res.Gaps, gap)
+		}
+	}
+	if len(sequences) > 0 {
+		res.First = &sequences[0]
+		res.Last = &sequences[len(sequences)-1]
+	}
+	if len(res.Gaps) > sequenceGapListLimit {
+		res.Gaps = res.Gaps[len(res.Gaps)-sequenceGapListLimit:]
+	}
+	return res
+}
+
+// GET /api/isu/:jia_isu_uuid/gaps
+// 通し番号付きで受け取ったコンディションの欠け(届かなかったもの，負荷が高いときに落としたもの)を取得
+func getIsuGaps(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	allowed, err := authorizeIsu(jiaUserID, jiaIsuUUID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if !allowed {
+		return c.String(http.StatusNotFound, "not found: isu")
+	}
+
+	sequences := []int64{}
+	err = getDB().Select(
+		&sequences,
+		"SELECT `sequence` FROM `isu_condition` WHERE `jia_isu_uuid` = ? AND `sequence` IS NOT NULL ORDER BY `sequence`",
+		jiaIsuUUID,
+	)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res := detectSequenceGaps(sequences)
+	res.JIAIsuUUID = jiaIsuUUID
+	return c.JSON(http.StatusOK, res)
+}
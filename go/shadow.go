@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+
+	"github.com/goccy/go-json"
+	"github.com/labstack/echo/v4"
+)
+
+const shadowDiffContext = 40
+
+type ShadowStat struct {
+	Compared   int64 `json:"compared"`
+	Mismatched int64 `json:"mismatched"`
+	Errors     int64 `json:"errors"`
+}
+
+type ShadowStats struct {
+	stats map[string]*ShadowStat
+	Lock  sync.Mutex
+}
+
+var shadowStats = &ShadowStats{stats: make(map[string]*ShadowStat)}
+
+func (ss *ShadowStats) record(name string, f func(stat *ShadowStat)) {
+	ss.Lock.Lock()
+	defer ss.Lock.Unlock()
+	stat, ok := ss.stats[name]
+	if !ok {
+		stat = &ShadowStat{}
+		ss.stats[name] = stat
+	}
+	f(stat)
+}
+
+func (ss *ShadowStats) Snapshot() map[string]ShadowStat {
+	ss.Lock.Lock()
+	defer ss.Lock.Unlock()
+	res := make(map[string]ShadowStat, len(ss.stats))
+	for name, stat := range ss.stats {
+		res[name] = *stat
+	}
+	return res
+}
+
+// 別の実装(shadow)をレスポンス返却後に裏で実行し，本番の結果(primary)とJSONで比較する
+// 新しいコードパスを本番のリクエストで検証するためのもので，shadow側の結果は捨てる
+func runShadow(name string, primary interface{}, shadow func() (interface{}, error)) {
+	primaryJSON, err := json.Marshal(primary)
+	if err != nil {
+		shadowStats.record(name, func(stat *ShadowStat) { stat.Errors++ })
+		return
+	}
+
+	go func() {
+		res, err := shadow()
+		if err != nil {
+			shadowStats.record(name, func(stat *ShadowStat) { stat.Errors++ })
+			workerLogger.Warn().Err(err).Str("shadow", name).Msg("shadow failed")
+			return
+		}
+		shadowJSON, err := json.Marshal(res)
+		if err != nil {
+			shadowStats.record(name, func(stat *ShadowStat) { stat.Errors++ })
+			return
+		}
+
+		if bytes.Equal(primaryJSON, shadowJSON) {
+			shadowStats.record(name, func(stat *ShadowStat) { stat.Compared++ })
+			return
+		}
+		shadowStats.record(name, func(stat *ShadowStat) {
+			stat.Compared++
+			stat.Mismatched++
+		})
+		offset := firstDiffOffset(primaryJSON, shadowJSON)
+		workerLogger.Warn().
+			Str("shadow", name).
+			Int("offset", offset).
+			Str("primary", diffSnippet(primaryJSON, offset)).
+			Str("shadow_response", diffSnippet(shadowJSON, offset)).
+			Msg("shadow response mismatch")
+	}()
+}
+
+func firstDiffOffset(a []byte, b []byte) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+func diffSnippet(b []byte, offset int) string {
+	start := max(offset-shadowDiffContext, 0)
+	end := min(offset+shadowDiffContext, len(b))
+	return string(b[start:end])
+}
+
+// GET /internal/shadow
+// シャドー実行の比較結果を取得
+func getShadowStats(c echo.Context) error {
+	return c.JSON(http.StatusOK, shadowStats.Snapshot())
+}
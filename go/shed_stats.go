@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const headerShedReadings = "X-Shed-Readings"
+
+// SHED_REPORT_HEADER=1 なら，落としたときの応答にそのISUで落とした累計のコンディション数を付ける
+var shedReportHeader = getEnv("SHED_REPORT_HEADER", "0") == "1"
+
+type IsuShedStat struct {
+	JIAIsuUUID string `json:"jia_isu_uuid"`
+	// 503で断ったリクエストの数
+	Requests int64 `json:"requests"`
+	// そのリクエストに入っていたコンディションの数
+	Readings   int64     `json:"readings"`
+	LastShedAt time.Time `json:"last_shed_at"`
+}
+
+type ShedStatsResponse struct {
+	Requests int64         `json:"requests"`
+	Readings int64         `json:"readings"`
+	Isus     []IsuShedStat `json:"isus"`
+}
+
+// 書き込みが遅れていて受け付けなかったコンディションのISU毎の数
+type ShedStats struct {
+	isus map[string]*IsuShedStat
+	Lock sync.Mutex
+}
+
+var shedStats = &ShedStats{isus: make(map[string]*IsuShedStat)}
+
+// 落とした後のそのISUの累計のコンディション数を返す
+func (ss *ShedStats) Record(jiaIsuUUID string, readings int) int64 {
+	ss.Lock.Lock()
+	defer ss.Lock.Unlock()
+	stat, ok := ss.isus[jiaIsuUUID]
+	if !ok {
+		stat = &IsuShedStat{JIAIsuUUID: jiaIsuUUID}
+		ss.isus[jiaIsuUUID] = stat
+	}
+	stat.Requests++
+	stat.Readings += int64(readings)
+	stat.LastShedAt = time.Now()
+	return stat.Readings
+}
+
+// 落とした数の多い順に返す
+func (ss *ShedStats) Snapshot() ShedStatsResponse {
+	ss.Lock.Lock()
+	res := ShedStatsResponse{Isus: make([]IsuShedStat, 0, len(ss.isus))}
+	for _, stat := range ss.isus {
+		res.Requests += stat.Requests
+		res.Readings += stat.Readings
+		res.Isus = append(res.Isus, *stat)
+	}
+	ss.Lock.Unlock()
+	sort.Slice(res.Isus, func(i, j int) bool {
+		if res.Isus[i].Readings != res.Isus[j].Readings {
+			return res.Isus[i].Readings > res.Isus[j].Readings
+		}
+		return res.Isus[i].JIAIsuUUID < res.Isus[j].JIAIsuUUID
+	})
+	return res
+}
+
+func (ss *ShedStats) Reset() {
+	ss.Lock.Lock()
+	defer ss.Lock.Unlock()
+	ss.isus = make(map[string]*IsuShedStat)
+}
+
+// 断ったことを記録して503を返す
+func shedConditions(c echo.Context, jiaIsuUUID string, readings int) error {
+	total := shedStats.Record(jiaIsuUUID, readings)
+	if shedReportHeader {
+		c.Response().Header().Set(headerShedReadings, strconv.FormatInt(total, 10))
+	}
+	return c.String(http.StatusServiceUnavailable, "ingest is lagging")
+}
+
+// GET /internal/ingest/shed
+// 書き込みの遅れで受け付けなかったコンディションの数をISU毎に取得
+func getShedStats(c echo.Context) error {
+	return c.JSON(http.StatusOK, shedStats.Snapshot())
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ?fields=timestamp,condition_level のように，返すフィールドを絞る
+// 絞ったときはリフレクションを使わず，フィールド毎に書き出すかどうかを切り替えながらJSONを組み立てる
+type conditionFields uint16
+
+const (
+	conditionFieldJIAIsuUUID conditionFields = 1 << iota
+	conditionFieldIsuName
+	conditionFieldTimestamp
+	conditionFieldIsSitting
+	conditionFieldCondition
+	conditionFieldConditionLevel
+	conditionFieldMessage
+	conditionFieldMessageCode
+	conditionFieldLocalizedMessage
+
+	conditionFieldAll = conditionFieldLocalizedMessage<<1 - 1
+)
+
+var conditionFieldNames = map[string]conditionFields{
+	"jia_isu_uuid":      conditionFieldJIAIsuUUID,
+	"isu_name":          conditionFieldIsuName,
+	"timestamp":         conditionFieldTimestamp,
+	"is_sitting":        conditionFieldIsSitting,
+	"condition":         conditionFieldCondition,
+	"condition_level":   conditionFieldConditionLevel,
+	"message":           conditionFieldMessage,
+	"message_code":      conditionFieldMessageCode,
+	"localized_message": conditionFieldLocalizedMessage,
+}
+
+type isuListFields uint8
+
+const (
+	isuListFieldID isuListFields = 1 << iota
+	isuListFieldJIAIsuUUID
+	isuListFieldName
+	isuListFieldCharacter
+	isuListFieldLatestIsuCondition
+)
+
+var isuListFieldNames = map[string]isuListFields{
+	"id":                   isuListFieldID,
+	"jia_isu_uuid":         isuListFieldJIAIsuUUID,
+	"name":                 isuListFieldName,
+	"character":            isuListFieldCharacter,
+	"latest_isu_condition": isuListFieldLatestIsuCondition,
+}
+
+const latestIsuConditionFieldPrefix = "latest_isu_condition."
+
+func splitFieldsParam(param string) []string {
+	names := []string{}
+	for _, name := range strings.Split(param, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func parseConditionFields(param string) (conditionFields, error) {
+	var fields conditionFields
+	for _, name := range splitFieldsParam(param) {
+		field, ok := conditionFieldNames[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown field: %v", name)
+		}
+		fields |= field
+	}
+	if fields == 0 {
+		return 0, fmt.Errorf("no fields")
+	}
+	return fields, nil
+}
+
+// latest_isu_condition.timestamp のようにして最新のコンディションのフィールドも絞れる
+// latest_isu_conditionだけを指定した場合はコンディションの全フィールドを返す
+func parseIsuListFields(param string) (isuListFields, conditionFields, error) {
+	var fields isuListFields
+	var condFields conditionFields
+	for _, name := range splitFieldsParam(param) {
+		if strings.HasPrefix(name, latestIsuConditionFieldPrefix) {
+			field, ok := conditionFieldNames[strings.TrimPrefix(name, latestIsuConditionFieldPrefix)]
+			if !ok {
+				return 0, 0, fmt.Errorf("unknown field: %v", name)
+			}
+			fields |= isuListFieldLatestIsuCondition
+			condFields |= field
+			continue
+		}
+		field, ok := isuListFieldNames[name]
+		if !ok {
+			return 0, 0, fmt.Errorf("unknown field: %v", name)
+		}
+		fields |= field
+		if field == isuListFieldLatestIsuCondition {
+			condFields = conditionFieldAll
+		}
+	}
+	if fields == 0 {
+		return 0, 0, fmt.Errorf("no fields")
+	}
+	return fields, condFields, nil
+}
+
+type jsonObjectWriter struct {
+	b     []byte
+	empty bool
+}
+
+func newJSONObjectWriter(b []byte) *jsonObjectWriter {
+	return &jsonObjectWriter{b: append(b, '{'), empty: true}
+}
+
+func (w *jsonObjectWriter) key(name string) {
+	if !w.empty {
+		w.b = append(w.b, ',')
+	}
+	w.empty = false
+	w.b = append(w.b, '"')
+	w.b = append(w.b, name...)
+	w.b = append(w.b, '"', ':')
+}
+
+func (w *jsonObjectWriter) String(name string, v string) {
+	w.key(name)
+	w.b = appendJSONString(w.b, v)
+}
+
+func (w *jsonObjectWriter) Int(name string, v int64) {
+	w.key(name)
+	w.b = strconv.AppendInt(w.b, v, 10)
+}
+
+func (w *jsonObjectWriter) Bool(name string, v bool) {
+	w.key(name)
+	w.b = strconv.AppendBool(w.b, v)
+}
+
+func (w *jsonObjectWriter) Null(name string) {
+	w.key(name)
+	w.b = append(w.b, "null"...)
+}
+
+func (w *jsonObjectWriter) Close() []byte {
+	return append(w.b, '}')
+}
+
+const hexDigits = "0123456789abcdef"
+
+func appendJSONString(b []byte, s string) []byte {
+	b = append(b, '"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				b = append(b, '\\', c)
+			case c == '\n':
+				b = append(b, '\\', 'n')
+			case c == '\r':
+				b = append(b, '\\', 'r')
+			case c == '\t':
+				b = append(b, '\\', 't')
+			case c < 0x20:
+				b = append(b, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+			default:
+				b = append(b, c)
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			b = append(b, "\ufffd"...)
+		} else {
+			b = append(b, s[i:i+size]...)
+		}
+		i += size
+	}
+	return append(b, '"')
+}
+
+func (r *GetIsuConditionResponse) appendJSON(b []byte, fields conditionFields) []byte {
+	w := newJSONObjectWriter(b)
+	if fields&conditionFieldJIAIsuUUID != 0 {
+		w.String("jia_isu_uuid", r.JIAIsuUUID)
+	}
+	if fields&conditionFieldIsuName != 0 {
+		w.String("isu_name", r.IsuName)
+	}
+	if fields&conditionFieldTimestamp != 0 {
+		w.Int("timestamp", r.Timestamp)
+	}
+	if fields&conditionFieldIsSitting != 0 {
+		w.Bool("is_sitting", r.IsSitting)
+	}
+	if fields&conditionFieldCondition != 0 {
+		w.String("condition", r.Condition)
+	}
+	if fields&conditionFieldConditionLevel != 0 {
+		w.String("condition_level", r.ConditionLevel)
+	}
+	if fields&conditionFieldMessage != 0 {
+		w.String("message", r.Message)
+	}
+	// 全部返すときと同じく，空なら省く
+	if fields&conditionFieldMessageCode != 0 && r.MessageCode != "" {
+		w.String("message_code", r.MessageCode)
+	}
+	if fields&conditionFieldLocalizedMessage != 0 && r.LocalizedMessage != "" {
+		w.String("localized_message", r.LocalizedMessage)
+	}
+	return w.Close()
+}
+
+func (r *GetIsuListResponse) appendJSON(b []byte, fields isuListFields, condFields conditionFields) []byte {
+	w := newJSONObjectWriter(b)
+	if fields&isuListFieldID != 0 {
+		w.Int("id", int64(r.ID))
+	}
+	if fields&isuListFieldJIAIsuUUID != 0 {
+		w.String("jia_isu_uuid", r.JIAIsuUUID)
+	}
+	if fields&isuListFieldName != 0 {
+		w.String("name", r.Name)
+	}
+	if fields&isuListFieldCharacter != 0 {
+		w.String("character", r.Character)
+	}
+	if fields&isuListFieldLatestIsuCondition != 0 {
+		if r.LatestIsuCondition == nil {
+			w.Null("latest_isu_condition")
+		} else {
+			w.key("latest_isu_condition")
+			w.b = r.LatestIsuCondition.appendJSON(w.b, condFields)
+		}
+	}
+	return w.Close()
+}
+
+func appendJSONArray[T any](items []T, appendItem func(b []byte, item T) []byte) []byte {
+	b := make([]byte, 0, 64*len(items)+2)
+	b = append(b, '[')
+	for i, item := range items {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = appendItem(b, item)
+	}
+	return append(b, ']')
+}
+
+func respondConditionFields(c echo.Context, conditions []*GetIsuConditionResponse, fields conditionFields) error {
+	b := appendJSONArray(conditions, func(b []byte, cond *GetIsuConditionResponse) []byte {
+		return cond.appendJSON(b, fields)
+	})
+	return writeBlob(c, http.StatusOK, echo.MIMEApplicationJSON, b)
+}
+
+func respondIsuListFields(c echo.Context, isuList []GetIsuListResponse, fields isuListFields, condFields conditionFields) error {
+	b := appendJSONArray(isuList, func(b []byte, isu GetIsuListResponse) []byte {
+		return isu.appendJSON(b, fields, condFields)
+	})
+	return writeBlob(c, http.StatusOK, echo.MIMEApplicationJSON, b)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ISU毎にコンディションを受けるサーバーを決めておき，前段のnginxに同じISUを同じサーバーへ振らせる
+// INGEST_SERVERS=http://192.168.0.11:3000,http://192.168.0.12:3000 (全サーバーで同じ並びにする)
+// SELF_URL=http://192.168.0.11:3000 はこのサーバーが並びのどれかを知るため
+// ランデブーハッシュなので，サーバーを足し引きしても移るのはそのサーバーの担当分だけ
+var (
+	ingestServers = parseURLList(getEnv("INGEST_SERVERS", ""))
+	selfURL       = strings.TrimSuffix(getEnv("SELF_URL", ""), "/")
+	// 担当外なのにこのサーバーに来たコンディション送信の数
+	misroutedConditionPosts atomic.Int64
+)
+
+const headerIsuRoute = "X-Isu-Route"
+
+type IsuRoute struct {
+	JIAIsuUUID string `json:"jia_isu_uuid"`
+	Server     string `json:"server"`
+}
+
+type GetRoutingResponse struct {
+	Servers        []string   `json:"servers"`
+	Self           string     `json:"self"`
+	MisroutedPosts int64      `json:"misrouted_posts"`
+	Routes         []IsuRoute `json:"routes"`
+}
+
+// INGEST_SERVERSがなければ空
+func ingestServerFor(jiaIsuUUID string) string {
+	var owner string
+	var best uint64
+	for _, server := range ingestServers {
+		h := fnv.New64a()
+		h.Write([]byte(server))
+		h.Write([]byte{0})
+		h.Write([]byte(jiaIsuUUID))
+		if score := h.Sum64(); owner == "" || score > best {
+			owner = server
+			best = score
+		}
+	}
+	return owner
+}
+
+// 担当外のコンディションも受け付けるが，振り分けの設定漏れに気付けるようにヘッダーで担当を返す
+func setIsuRouteHeader(c echo.Context, jiaIsuUUID string) {
+	owner := ingestServerFor(jiaIsuUUID)
+	if owner == "" {
+		return
+	}
+	c.Response().Header().Set(headerIsuRoute, owner)
+	if selfURL != "" && owner != selfURL {
+		misroutedConditionPosts.Add(1)
+	}
+}
+
+// GET /internal/routing?format=nginx
+// 登録済みのISUの担当サーバーを取得．format=nginxならmapディレクティブの中身をそのまま返す
+// 例: map $jia_isu_uuid $isu_upstream { default app1; include /etc/nginx/isu_routes.conf; }
+func getRouting(c echo.Context) error {
+	jiaIsuUUIDs := []string{}
+	err := getDB().Select(&jiaIsuUUIDs, "SELECT `jia_isu_uuid` FROM `isu` ORDER BY `jia_isu_uuid`")
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	routes := make([]IsuRoute, 0, len(jiaIsuUUIDs))
+	if len(ingestServers) > 0 {
+		for _, jiaIsuUUID := range jiaIsuUUIDs {
+			routes = append(routes, IsuRoute{JIAIsuUUID: jiaIsuUUID, Server: ingestServerFor(jiaIsuUUID)})
+		}
+	}
+
+	if c.QueryParam("format") == "nginx" {
+		var b strings.Builder
+		for _, route := range routes {
+			fmt.Fprintf(&b, "%v %v;\n", route.JIAIsuUUID, strings.TrimPrefix(route.Server, "http://"))
+		}
+		return c.String(http.StatusOK, b.String())
+	}
+	return c.JSON(http.StatusOK, GetRoutingResponse{
+		Servers:        ingestServers,
+		Self:           selfURL,
+		MisroutedPosts: misroutedConditionPosts.Load(),
+		Routes:         routes,
+	})
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/goccy/go-json"
+	"github.com/labstack/echo/v4"
+)
+
+// 配列をJSONで返す
+// HEADのときは正しいContent-Lengthを返すため，全体をエンコードしてから長さだけ書く
+func respondJSONArray[T any](c echo.Context, code int, items []T) error {
+	if c.Request().Method == http.MethodHead {
+		b, err := json.Marshal(items)
+		if err != nil {
+			return err
+		}
+		return writeBlob(c, code, echo.MIMEApplicationJSON, b)
+	}
+	return c.JSON(code, items)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// このサーバーのゾーン(ZONE=ap-northeast-1a など)と，他のサーバーのゾーン
+// 例: PEER_ZONES=http://192.168.0.12:3000=ap-northeast-1a,http://192.168.0.13:3000=ap-northeast-1c
+var (
+	serverZone = getEnv("ZONE", "")
+	peerZones  = parsePeerZones(getEnv("PEER_ZONES", ""))
+)
+
+type TopologyPeer struct {
+	URL      string `json:"url"`
+	Zone     string `json:"zone"`
+	SameZone bool   `json:"same_zone"`
+}
+
+type TopologyResponse struct {
+	SrvNo          string         `json:"srvno"`
+	Zone           string         `json:"zone"`
+	Roles          []string       `json:"roles"`
+	CachePeers     []TopologyPeer `json:"cache_peers"`
+	TrendFollowers []TopologyPeer `json:"trend_followers"`
+}
+
+func parsePeerZones(csv string) map[string]string {
+	zones := map[string]string{}
+	for _, entry := range strings.Split(csv, ",") {
+		url, zone, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || url == "" {
+			continue
+		}
+		zones[strings.TrimSuffix(url, "/")] = zone
+	}
+	return zones
+}
+
+// ゾーンが分からないものは別のゾーンとして扱う
+func isSameZone(peer string) bool {
+	return serverZone != "" && peerZones[peer] == serverZone
+}
+
+// 同じゾーンのサーバーに先に送り，全部終わってから他のゾーンに送る
+// ゾーンをまたぐ遅いリクエストに同じゾーンの分が待たされないようにする
+func forEachPeerByZone(peers []string, send func(peer string)) {
+	near := []string{}
+	far := []string{}
+	for _, peer := range peers {
+		if isSameZone(peer) {
+			near = append(near, peer)
+		} else {
+			far = append(far, peer)
+		}
+	}
+	for _, group := range [][]string{near, far} {
+		var wg sync.WaitGroup
+		for _, peer := range group {
+			wg.Add(1)
+			go func(peer string) {
+				defer wg.Done()
+				send(peer)
+			}(peer)
+		}
+		wg.Wait()
+	}
+}
+
+func topologyPeers(peers []string) []TopologyPeer {
+	res := make([]TopologyPeer, 0, len(peers))
+	for _, peer := range peers {
+		res = append(res, TopologyPeer{URL: peer, Zone: peerZones[peer], SameZone: isSameZone(peer)})
+	}
+	return res
+}
+
+// GET /internal/topology
+// このサーバーの役割とゾーン，通信する他のサーバーを取得
+func getTopology(c echo.Context) error {
+	srvNo := os.Getenv("SRVNO")
+	roles := []string{"api"}
+	if srvNo == "1" {
+		roles = append(roles, "condition_writer", "trend")
+	}
+	return c.JSON(http.StatusOK, TopologyResponse{
+		SrvNo:          srvNo,
+		Zone:           serverZone,
+		Roles:          roles,
+		CachePeers:     topologyPeers(cachePeers),
+		TrendFollowers: topologyPeers(trendFollowers),
+	})
+}
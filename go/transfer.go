@@ -0,0 +1,242 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	transferStatusPending   = "pending"
+	transferStatusAccepted  = "accepted"
+	transferStatusCancelled = "cancelled"
+
+	eventTypeIsuTransferRequested = "isu.transfer_requested"
+	eventTypeIsuTransferred       = "isu.transferred"
+)
+
+type IsuTransfer struct {
+	ID            int64     `db:"id"               json:"id"`
+	JIAIsuUUID    string    `db:"jia_isu_uuid"     json:"jia_isu_uuid"`
+	FromJIAUserID string    `db:"from_jia_user_id" json:"from_jia_user_id"`
+	ToJIAUserID   string    `db:"to_jia_user_id"   json:"to_jia_user_id"`
+	Status        string    `db:"status"           json:"status"`
+	CreatedAt     time.Time `db:"created_at"       json:"-"`
+	UpdatedAt     time.Time `db:"updated_at"       json:"-"`
+}
+
+type PostIsuTransferRequest struct {
+	ToJIAUserID string `json:"to_jia_user_id"`
+}
+
+// POST /api/isu/:jia_isu_uuid/transfer
+// ISUを別のユーザーに譲る申請をする(相手が承認するまで持ち主は変わらない)
+func postIsuTransfer(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	allowed, err := authorizeIsu(jiaUserID, jiaIsuUUID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if !allowed {
+		return c.String(http.StatusNotFound, "not found: isu")
+	}
+
+	req := PostIsuTransferRequest{}
+	err = c.Bind(&req)
+	if err != nil || req.ToJIAUserID == "" {
+		return c.String(http.StatusBadRequest, "bad request body")
+	}
+	if req.ToJIAUserID == jiaUserID {
+		return c.String(http.StatusBadRequest, "cannot transfer to yourself")
+	}
+	var userCount int
+	err = getDB().Get(&userCount, "SELECT COUNT(*) FROM `user` WHERE `jia_user_id` = ?", req.ToJIAUserID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if userCount == 0 {
+		return c.String(http.StatusNotFound, "not found: user")
+	}
+
+	tx, err := getDB().Beginx()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	// 申請中のものがあれば新しい申請で置き換える
+	_, err = tx.Exec(
+		"UPDATE `isu_transfer` SET `status` = ? WHERE `jia_isu_uuid` = ? AND `status` = ?",
+		transferStatusCancelled, jiaIsuUUID, transferStatusPending,
+	)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	result, err := tx.Exec(
+		"INSERT INTO `isu_transfer` (`jia_isu_uuid`, `from_jia_user_id`, `to_jia_user_id`, `status`) VALUES (?, ?, ?, ?)",
+		jiaIsuUUID, jiaUserID, req.ToJIAUserID, transferStatusPending,
+	)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	transfer := IsuTransfer{
+		ID:            id,
+		JIAIsuUUID:    jiaIsuUUID,
+		FromJIAUserID: jiaUserID,
+		ToJIAUserID:   req.ToJIAUserID,
+		Status:        transferStatusPending,
+	}
+	publishEvent(IsuEvent{
+		Type:       eventTypeIsuTransferRequested,
+		Timestamp:  time.Now().Unix(),
+		JIAUserID:  req.ToJIAUserID,
+		JIAIsuUUID: jiaIsuUUID,
+		Data:       transfer,
+	})
+	return c.JSON(http.StatusCreated, transfer)
+}
+
+// GET /api/isu/transfers
+// 自分宛ての承認待ちの移譲を取得
+func getIsuTransfers(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	transfers := []IsuTransfer{}
+	err = getDB().Select(
+		&transfers,
+		"SELECT * FROM `isu_transfer` WHERE `to_jia_user_id` = ? AND `status` = ? ORDER BY `id` DESC",
+		jiaUserID, transferStatusPending,
+	)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, transfers)
+}
+
+// POST /api/isu/transfers/:transfer_id/accept
+// 自分宛ての移譲を承認し，ISUの持ち主を自分にする
+func postIsuTransferAccept(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	transferID, err := strconv.ParseInt(c.Param("transfer_id"), 10, 64)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad format: transfer_id")
+	}
+
+	tx, err := getDB().Beginx()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var transfer IsuTransfer
+	err = tx.Get(&transfer, "SELECT * FROM `isu_transfer` WHERE `id` = ? FOR UPDATE", transferID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.String(http.StatusNotFound, "not found: transfer")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if transfer.ToJIAUserID != jiaUserID || transfer.Status != transferStatusPending {
+		return c.String(http.StatusNotFound, "not found: transfer")
+	}
+
+	// 申請後に持ち主が変わっていたら，その申請はもう無効
+	result, err := tx.Exec(
+		"UPDATE `isu` SET `jia_user_id` = ? WHERE `jia_isu_uuid` = ? AND `jia_user_id` = ?",
+		jiaUserID, transfer.JIAIsuUUID, transfer.FromJIAUserID,
+	)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if affected == 0 {
+		return c.String(http.StatusConflict, "isu owner has changed")
+	}
+	_, err = tx.Exec("UPDATE `isu_transfer` SET `status` = ? WHERE `id` = ?", transferStatusAccepted, transferID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	// 持ち主の判定はどのサーバーでもキャッシュしているので，他のサーバーにも捨てさせる
+	// 届くまでは前の持ち主が見られ，新しい持ち主は404になる
+	inv := CacheInvalidation{
+		JIAUserIDs:  []string{transfer.FromJIAUserID, jiaUserID},
+		JIAIsuUUIDs: []string{transfer.JIAIsuUUID},
+	}
+	invalidateCaches(inv)
+	broadcastCacheInvalidation(inv)
+
+	transfer.Status = transferStatusAccepted
+	for _, userID := range []string{transfer.FromJIAUserID, jiaUserID} {
+		publishEvent(IsuEvent{
+			Type:       eventTypeIsuTransferred,
+			Timestamp:  time.Now().Unix(),
+			JIAUserID:  userID,
+			JIAIsuUUID: transfer.JIAIsuUUID,
+			Data:       transfer,
+		})
+	}
+	return c.JSON(http.StatusOK, transfer)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// トレンドを計算するのはSRVNO=1のサーバーだけなので，GETを受ける他のサーバーへ計算結果を配る
+// 例: TREND_FOLLOWERS=http://192.168.0.203:3000
+// 受け取る側は運用系の認証を通すので，全サーバーで同じADMIN_TOKENを設定しておく
+var (
+	trendFollowers = parseURLList(getEnv("TREND_FOLLOWERS", ""))
+)
+
+func parseURLList(csv string) []string {
+	followers := []string{}
+	for _, follower := range strings.Split(csv, ",") {
+		follower = strings.TrimSpace(follower)
+		if follower != "" {
+			followers = append(followers, strings.TrimSuffix(follower, "/"))
+		}
+	}
+	return followers
+}
+
+// 配るのはtrend_distributorに任せ，トレンドの計算の間隔を送信で遅らせない
+// 前のものを送り終わる前に次が計算されたら，古い方は送らずに最新のものだけを送る
+type TrendDistributor struct {
+	latest chan []byte
+}
+
+var trendDistributor = &TrendDistributor{latest: make(chan []byte, 1)}
+
+func distributeTrend(trend []TrendResponse) {
+	// 計算に失敗した場合(nil)はフォロワー側の前回の結果を残す
+	if len(trendFollowers) == 0 || trend == nil || !featureFlags.Enabled(flagTrendDistribution) {
+		return
+	}
+	// Setのときにエンコード済みのものをそのまま送る
+	trendDistributor.Enqueue(trendCache.Bytes())
+}
+
+// 入れるのはトレンドを計算するワーカーだけなので，取り出してから入れ直せば必ず入る
+func (td *TrendDistributor) Enqueue(body []byte) {
+	select {
+	case <-td.latest:
+	default:
+	}
+	td.latest <- body
+}
+
+func (td *TrendDistributor) Run(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case body := <-td.latest:
+			forEachPeerByZone(trendFollowers, func(follower string) {
+				err := pushTrend(follower, body)
+				if err != nil {
+					workerLogger.Warn().Err(err).Str("follower", follower).Msg("failed to distribute trend")
+				}
+			})
+		}
+	}
+}
+
+func pushTrend(follower string, body []byte) error {
+	res, err := outbound(outboundTrend).Do(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPut, follower+"/internal/trend", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		setAdminToken(req)
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected status code: %v", res.StatusCode)
+	}
+	return nil
+}
+
+// PUT /internal/trend
+// SRVNO=1のサーバーで計算したトレンドを受け取る
+func putTrend(c echo.Context) error {
+	trend := []TrendResponse{}
+	err := c.Bind(&trend)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad request body")
+	}
+	trendCache.Set(trend)
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// 計算したトレンドをファイルに残しておき，再起動直後は最初の計算が終わるまでそれを返す
+// TREND_SNAPSHOT_PATH= で無効
+var trendSnapshotPath = getEnv("TREND_SNAPSHOT_PATH", "/tmp/isucondition-trend.json")
+
+type TrendSnapshot struct {
+	Version int64           `json:"version"`
+	SavedAt time.Time       `json:"saved_at"`
+	Trend   json.RawMessage `json:"trend"`
+}
+
+// TREND_SNAPSHOT_INTERVAL_MSに1回だけ，その間にSetされた最新のものを書く
+// トレンドは100ms毎に作り直されるので，Setの度にファイルに書くとエンコードとrenameが計算を遅らせる
+var trendSnapshotInterval = time.Duration(getEnvInt("TREND_SNAPSHOT_INTERVAL_MS", 1000)) * time.Millisecond
+
+var (
+	trendSnapshotLock sync.Mutex
+	// Setされた最新のもの
+	trendSnapshotPendingVersion int64
+	trendSnapshotPending        []byte
+	// ファイルに書いたもの
+	trendSnapshotVersion int64
+)
+
+// 書くのはtrend_snapshotのワーカーに任せ，ここでは最新のものを覚えるだけにする
+// Setが並行に呼ばれても，古いバージョンで新しいものを上書きしない
+func queueTrendSnapshot(version int64, body []byte) {
+	if trendSnapshotPath == "" {
+		return
+	}
+	trendSnapshotLock.Lock()
+	defer trendSnapshotLock.Unlock()
+	if version <= trendSnapshotPendingVersion {
+		return
+	}
+	trendSnapshotPendingVersion = version
+	trendSnapshotPending = body
+}
+
+// 前回書いてからSetされていれば書く．呼ぶのはtrend_snapshotのワーカーだけ
+func flushTrendSnapshot() error {
+	trendSnapshotLock.Lock()
+	version, body := trendSnapshotPendingVersion, trendSnapshotPending
+	saved := trendSnapshotVersion
+	trendSnapshotLock.Unlock()
+	if version <= saved {
+		return nil
+	}
+
+	err := saveTrendSnapshot(version, body)
+	if err != nil {
+		return err
+	}
+	trendSnapshotLock.Lock()
+	trendSnapshotVersion = version
+	trendSnapshotLock.Unlock()
+	return nil
+}
+
+// 止めるときは最後のものを書いてから戻る
+func trendSnapshotScheduled(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			err := flushTrendSnapshot()
+			if err != nil {
+				workerLogger.Warn().Err(err).Msg("failed to save trend snapshot")
+			}
+			return
+		case <-ticker.C:
+			err := flushTrendSnapshot()
+			if err != nil {
+				workerLogger.Warn().Err(err).Msg("failed to save trend snapshot")
+			}
+		}
+	}
+}
+
+// 一時ファイルに書いてからrenameするので，途中で落ちても壊れたファイルは残らない
+func saveTrendSnapshot(version int64, body []byte) error {
+	if trendSnapshotPath == "" {
+		return nil
+	}
+	b, err := json.Marshal(TrendSnapshot{Version: version, SavedAt: time.Now(), Trend: body})
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(trendSnapshotPath), ".trend-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(b)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), trendSnapshotPath)
+}
+
+// 起動時に前回のトレンドを読み込む．ファイルがなければ何もしない
+func loadTrendSnapshot() error {
+	if trendSnapshotPath == "" {
+		return nil
+	}
+	b, err := os.ReadFile(trendSnapshotPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	snapshot := TrendSnapshot{}
+	err = json.Unmarshal(b, &snapshot)
+	if err != nil {
+		return err
+	}
+	trend := []TrendResponse{}
+	err = json.Unmarshal(snapshot.Trend, &trend)
+	if err != nil {
+		return err
+	}
+
+	trendSnapshotLock.Lock()
+	trendSnapshotPendingVersion = snapshot.Version
+	trendSnapshotVersion = snapshot.Version
+	trendSnapshotLock.Unlock()
+	trendCache.Restore(snapshot.Version, trend, snapshot.Trend)
+	systemLogger.Info().
+		Int64("version", snapshot.Version).
+		Time("saved_at", snapshot.SavedAt).
+		Msg("trend snapshot loaded")
+	return nil
+}
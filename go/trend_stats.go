@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// トレンドの計算の成否．一部の性格だけ失敗した場合もアラートできるように数えておく
+type TrendStats struct {
+	stats TrendStat
+	Lock  sync.Mutex
+}
+
+type TrendStat struct {
+	Runs            int64            `json:"runs"`
+	Failures        int64            `json:"failures"`
+	PartialFailures int64            `json:"partial_failures"`
+	LookupFailures  int64            `json:"lookup_failures"`
+	CharacterErrors map[string]int64 `json:"character_errors"`
+	LastError       string           `json:"last_error,omitempty"`
+	LastErrorAt     time.Time        `json:"last_error_at,omitempty"`
+	// 直近の計算で前回の結果を使った性格
+	LastFailedCharacters []string `json:"last_failed_characters"`
+}
+
+var trendStats = NewTrendStats()
+
+func NewTrendStats() *TrendStats {
+	return &TrendStats{stats: TrendStat{
+		CharacterErrors:      map[string]int64{},
+		LastFailedCharacters: []string{},
+	}}
+}
+
+func (ts *TrendStats) recordError(err error) {
+	ts.stats.LastError = err.Error()
+	ts.stats.LastErrorAt = time.Now()
+}
+
+// 性格の一覧が取れず，計算全体を諦めた
+func (ts *TrendStats) Failed(err error) {
+	ts.Lock.Lock()
+	defer ts.Lock.Unlock()
+	ts.stats.Runs++
+	ts.stats.Failures++
+	ts.recordError(err)
+}
+
+func (ts *TrendStats) CharacterFailed(character string, err error) {
+	ts.Lock.Lock()
+	defer ts.Lock.Unlock()
+	ts.stats.CharacterErrors[character]++
+	ts.recordError(err)
+}
+
+func (ts *TrendStats) LookupFailed(err error) {
+	ts.Lock.Lock()
+	defer ts.Lock.Unlock()
+	ts.stats.LookupFailures++
+	ts.recordError(err)
+}
+
+func (ts *TrendStats) Completed(failedCharacters []string) {
+	ts.Lock.Lock()
+	defer ts.Lock.Unlock()
+	ts.stats.Runs++
+	if len(failedCharacters) > 0 {
+		ts.stats.PartialFailures++
+	}
+	ts.stats.LastFailedCharacters = failedCharacters
+}
+
+func (ts *TrendStats) Snapshot() TrendStat {
+	ts.Lock.Lock()
+	defer ts.Lock.Unlock()
+	stat := ts.stats
+	stat.CharacterErrors = make(map[string]int64, len(ts.stats.CharacterErrors))
+	for character, n := range ts.stats.CharacterErrors {
+		stat.CharacterErrors[character] = n
+	}
+	stat.LastFailedCharacters = append([]string{}, ts.stats.LastFailedCharacters...)
+	return stat
+}
+
+// GET /internal/trend/stats
+// トレンドの計算の失敗回数
+func getTrendStats(c echo.Context) error {
+	return c.JSON(http.StatusOK, trendStats.Snapshot())
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+)
+
+// TTLと件数の上限を持つキャッシュ．ttlが0以下なら期限切れにならず，maxEntriesが0以下なら件数の上限はない
+// 上限に達しているときに新しいキーを入れると，最も長く使われていないもの(LRU)を捨てる
+// GetOrLoadはロックを放して読み込み，同じキーの読み込みが同時に走っていればその結果を待つ
+type Cache[K comparable, V any] struct {
+	entries map[K]*list.Element
+	// 前ほど最近使ったもの．要素の値は*cacheEntry[K, V]
+	recency    *list.List
+	ttl        time.Duration
+	maxEntries int
+	// 読み込み中のキー．Set/Forget/Resetで外し，その間に読んだ古い値を入れないようにする
+	loading map[K]*cacheLoad[V]
+	// 期限の判定に使う時刻．差し替えて期限切れを再現できるようにしておく
+	now  func() time.Time
+	Lock sync.Mutex
+}
+
+type cacheEntry[K comparable, V any] struct {
+	key       K
+	value     V
+	expiresAt time.Time
+}
+
+type cacheLoad[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+// loadがpanicしたときに，待っている呼び出しへ返すエラー
+var errCacheLoadAborted = errors.New("cache load aborted")
+
+func NewCache[K comparable, V any](ttl time.Duration, maxEntries int) *Cache[K, V] {
+	return &Cache[K, V]{
+		entries:    make(map[K]*list.Element),
+		recency:    list.New(),
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		loading:    make(map[K]*cacheLoad[V]),
+		now:        time.Now,
+	}
+}
+
+func (c *Cache[K, V]) expired(entry *cacheEntry[K, V]) bool {
+	return !entry.expiresAt.IsZero() && c.now().After(entry.expiresAt)
+}
+
+// 期限内のものがあれば，最近使ったものにして返す
+func (c *Cache[K, V]) lookup(key K) (*cacheEntry[K, V], bool) {
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry[K, V])
+	if c.expired(entry) {
+		return nil, false
+	}
+	c.recency.MoveToFront(elem)
+	return entry, true
+}
+
+func (c *Cache[K, V]) set(key K, value V) {
+	var expiresAt time.Time
+	if c.ttl > 0 {
+		expiresAt = c.now().Add(c.ttl)
+	}
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*cacheEntry[K, V])
+		entry.value = value
+		entry.expiresAt = expiresAt
+		c.recency.MoveToFront(elem)
+		return
+	}
+	if c.maxEntries > 0 && len(c.entries) >= c.maxEntries {
+		c.delete(c.recency.Back())
+	}
+	c.entries[key] = c.recency.PushFront(&cacheEntry[K, V]{key: key, value: value, expiresAt: expiresAt})
+}
+
+func (c *Cache[K, V]) delete(elem *list.Element) {
+	if elem == nil {
+		return
+	}
+	c.recency.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry[K, V]).key)
+}
+
+// 期限切れのものは返さない
+func (c *Cache[K, V]) Peek(key K) (V, bool) {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	entry, ok := c.lookup(key)
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	return entry.value, true
+}
+
+// 読み込み中として登録する．呼び出し側はLockを持っていること
+func (c *Cache[K, V]) startLoad(key K) *cacheLoad[V] {
+	l := &cacheLoad[V]{done: make(chan struct{}), err: errCacheLoadAborted}
+	c.loading[key] = l
+	return l
+}
+
+// 読み込んだ値を入れて待っている呼び出しを起こす．呼び出し側はLockを持っていること
+// 途中でSet/Forget/Resetされていたら，読んだ値は古いかもしれないので入れない
+func (c *Cache[K, V]) finishLoad(key K, l *cacheLoad[V]) {
+	if c.loading[key] == l {
+		delete(c.loading, key)
+		if l.err == nil {
+			c.set(key, l.value)
+		}
+	}
+	close(l.done)
+}
+
+func (l *cacheLoad[V]) result() (V, error) {
+	<-l.done
+	if l.err != nil {
+		var zero V
+		return zero, l.err
+	}
+	return l.value, nil
+}
+
+// なければloadで読み込んで入れる．loadが失敗したものは入れない
+// loadはロックを放して呼ぶので，遅いDBでも他のキーの読み書きを止めない
+func (c *Cache[K, V]) GetOrLoad(key K, load func(key K) (V, error)) (V, error) {
+	c.Lock.Lock()
+	if entry, ok := c.lookup(key); ok {
+		c.Lock.Unlock()
+		return entry.value, nil
+	}
+	if l, ok := c.loading[key]; ok {
+		c.Lock.Unlock()
+		return l.result()
+	}
+	l := c.startLoad(key)
+	c.Lock.Unlock()
+
+	func() {
+		defer func() {
+			c.Lock.Lock()
+			defer c.Lock.Unlock()
+			c.finishLoad(key, l)
+		}()
+		l.value, l.err = load(key)
+	}()
+	return l.result()
+}
+
+// keysのうちないものをまとめてloadで読み込んで入れる．loadが返さなかったキーはゼロ値を入れる
+// 他の呼び出しが読み込み中のキーはその結果を待つ
+func (c *Cache[K, V]) GetOrLoadMany(keys []K, load func(keys []K) (map[K]V, error)) (map[K]V, error) {
+	res := make(map[K]V, len(keys))
+	mine := map[K]*cacheLoad[V]{}
+	others := map[K]*cacheLoad[V]{}
+	c.Lock.Lock()
+	for _, key := range keys {
+		if _, ok := res[key]; ok {
+			continue
+		}
+		if _, ok := mine[key]; ok {
+			continue
+		}
+		if entry, ok := c.lookup(key); ok {
+			res[key] = entry.value
+			continue
+		}
+		if l, ok := c.loading[key]; ok {
+			others[key] = l
+			continue
+		}
+		mine[key] = c.startLoad(key)
+	}
+	c.Lock.Unlock()
+
+	if len(mine) > 0 {
+		missing := make([]K, 0, len(mine))
+		for key := range mine {
+			missing = append(missing, key)
+		}
+		func() {
+			defer func() {
+				c.Lock.Lock()
+				defer c.Lock.Unlock()
+				for key, l := range mine {
+					c.finishLoad(key, l)
+				}
+			}()
+			values, err := load(missing)
+			for key, l := range mine {
+				l.value, l.err = values[key], err
+			}
+		}()
+	}
+
+	for _, loads := range []map[K]*cacheLoad[V]{mine, others} {
+		for key, l := range loads {
+			value, err := l.result()
+			if err != nil {
+				return nil, err
+			}
+			res[key] = value
+		}
+	}
+	return res, nil
+}
+
+func (c *Cache[K, V]) Set(key K, value V) {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	c.set(key, value)
+	delete(c.loading, key)
+}
+
+func (c *Cache[K, V]) Forget(key K) {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	c.delete(c.entries[key])
+	delete(c.loading, key)
+}
+
+func (c *Cache[K, V]) Reset() {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	c.entries = make(map[K]*list.Element)
+	c.recency.Init()
+	c.loading = make(map[K]*cacheLoad[V])
+}
+
+// キーを最大n件返す(順序は不定，期限切れのものも含む)
+func (c *Cache[K, V]) Keys(n int) []K {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	keys := make([]K, 0, min(n, len(c.entries)))
+	for key := range c.entries {
+		if len(keys) >= n {
+			break
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (c *Cache[K, V]) Len() int {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	return len(c.entries)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (fc *fakeClock) Now() time.Time {
+	return fc.now
+}
+
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.now = fc.now.Add(d)
+}
+
+func newTestCache(ttl time.Duration, maxEntries int) (*Cache[string, int], *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1600000000, 0)}
+	c := NewCache[string, int](ttl, maxEntries)
+	c.now = clock.Now
+	return c, clock
+}
+
+func TestCacheTTL(t *testing.T) {
+	c, clock := newTestCache(time.Minute, 0)
+	c.Set("a", 1)
+
+	clock.Advance(time.Minute)
+	if v, ok := c.Peek("a"); !ok || v != 1 {
+		t.Fatalf("at ttl: got (%v, %v), want (1, true)", v, ok)
+	}
+	clock.Advance(time.Nanosecond)
+	if _, ok := c.Peek("a"); ok {
+		t.Fatal("after ttl: still cached")
+	}
+
+	// 入れ直すと期限も延びる
+	c.Set("a", 2)
+	clock.Advance(30 * time.Second)
+	c.Set("a", 3)
+	clock.Advance(45 * time.Second)
+	if v, ok := c.Peek("a"); !ok || v != 3 {
+		t.Fatalf("after re-set: got (%v, %v), want (3, true)", v, ok)
+	}
+}
+
+func TestCacheNoTTL(t *testing.T) {
+	c, clock := newTestCache(0, 0)
+	c.Set("a", 1)
+	clock.Advance(365 * 24 * time.Hour)
+	if v, ok := c.Peek("a"); !ok || v != 1 {
+		t.Fatalf("got (%v, %v), want (1, true)", v, ok)
+	}
+}
+
+func TestCacheMaxEntries(t *testing.T) {
+	c, _ := newTestCache(0, 3)
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Set("c", 3)
+	// aを使ったので，次に追い出されるのはb
+	c.Peek("a")
+	c.Set("d", 4)
+
+	if c.Len() != 3 {
+		t.Fatalf("len %d, want 3", c.Len())
+	}
+	if _, ok := c.Peek("b"); ok {
+		t.Fatal("least recently used entry was not evicted")
+	}
+	for key, want := range map[string]int{"a": 1, "c": 3, "d": 4} {
+		if v, ok := c.Peek(key); !ok || v != want {
+			t.Fatalf("%v: got (%v, %v), want (%v, true)", key, v, ok, want)
+		}
+	}
+
+	// 既にあるキーを入れ直しても追い出さない
+	c.Set("a", 10)
+	if c.Len() != 3 {
+		t.Fatalf("len %d after overwrite, want 3", c.Len())
+	}
+}
+
+func TestCacheGetOrLoad(t *testing.T) {
+	c, clock := newTestCache(time.Minute, 0)
+	loads := 0
+	load := func(key string) (int, error) {
+		loads++
+		return len(key), nil
+	}
+
+	for i := 0; i < 3; i++ {
+		v, err := c.GetOrLoad("abc", load)
+		if err != nil || v != 3 {
+			t.Fatalf("got (%v, %v), want (3, nil)", v, err)
+		}
+	}
+	if loads != 1 {
+		t.Fatalf("loaded %d times, want 1", loads)
+	}
+
+	// 期限が切れたら読み直す
+	clock.Advance(time.Minute + time.Second)
+	_, err := c.GetOrLoad("abc", load)
+	if err != nil || loads != 2 {
+		t.Fatalf("after ttl: err=%v loads=%d, want 2 loads", err, loads)
+	}
+
+	// 失敗したものは入れず，次も読み込む
+	errLoad := errors.New("db down")
+	_, err = c.GetOrLoad("x", func(string) (int, error) { return 0, errLoad })
+	if !errors.Is(err, errLoad) {
+		t.Fatalf("got %v, want %v", err, errLoad)
+	}
+	if _, ok := c.Peek("x"); ok {
+		t.Fatal("failed load was cached")
+	}
+	v, err := c.GetOrLoad("x", load)
+	if err != nil || v != 1 {
+		t.Fatalf("retry: got (%v, %v), want (1, nil)", v, err)
+	}
+}
+
+// 同じキーの読み込みは1つにまとめ，読み込み中のSet/Forgetより古い値は入れない
+func TestCacheGetOrLoadConcurrent(t *testing.T) {
+	c, _ := newTestCache(0, 0)
+	var loads atomic.Int32
+	release := make(chan struct{})
+	started := make(chan struct{})
+	load := func(key string) (int, error) {
+		if loads.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		return 1, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]int, 8)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = c.GetOrLoad("a", load)
+		}(i)
+	}
+	<-started
+	// 読み込みの最中でも他のキーは止まらない
+	c.Set("b", 2)
+	// 読み込み中に新しい値が入った
+	c.Set("a", 5)
+	close(release)
+	wg.Wait()
+
+	if n := loads.Load(); n != 1 {
+		t.Fatalf("loaded %d times, want 1", n)
+	}
+	for i, v := range results {
+		if v != 1 && v != 5 {
+			t.Fatalf("result %d: got %v", i, v)
+		}
+	}
+	if v, _ := c.Peek("a"); v != 5 {
+		t.Fatalf("stale load overwrote Set: got %v, want 5", v)
+	}
+}
+
+func TestCacheGetOrLoadMany(t *testing.T) {
+	c, _ := newTestCache(0, 0)
+	c.Set("a", 1)
+	var requested [][]string
+	load := func(keys []string) (map[string]int, error) {
+		requested = append(requested, keys)
+		res := map[string]int{}
+		for _, key := range keys {
+			if key != "missing" {
+				res[key] = len(key)
+			}
+		}
+		return res, nil
+	}
+
+	res, err := c.GetOrLoadMany([]string{"a", "bb", "bb", "missing"}, load)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// キャッシュにあるものは読まず，重複は1回だけ読む
+	if len(requested) != 1 || len(requested[0]) != 2 {
+		t.Fatalf("loaded %v, want one call for [bb missing]", requested)
+	}
+	// loadが返さなかったキーはゼロ値
+	want := map[string]int{"a": 1, "bb": 2, "missing": 0}
+	for key, v := range want {
+		if res[key] != v {
+			t.Fatalf("%v: got %v, want %v", key, res[key], v)
+		}
+	}
+	if v, ok := c.Peek("missing"); !ok || v != 0 {
+		t.Fatalf("missing key: got (%v, %v), want (0, true)", v, ok)
+	}
+
+	_, err = c.GetOrLoadMany([]string{"a", "bb"}, load)
+	if err != nil || len(requested) != 1 {
+		t.Fatalf("second call loaded again: err=%v requested=%v", err, requested)
+	}
+
+	errLoad := errors.New("db down")
+	_, err = c.GetOrLoadMany([]string{"c"}, func([]string) (map[string]int, error) { return nil, errLoad })
+	if !errors.Is(err, errLoad) {
+		t.Fatalf("got %v, want %v", err, errLoad)
+	}
+	if _, ok := c.Peek("c"); ok {
+		t.Fatal("failed load was cached")
+	}
+}
+
+// loadがpanicしても，同じキーを待っている呼び出しが止まったままにならない
+func TestCacheGetOrLoadPanic(t *testing.T) {
+	c, _ := newTestCache(0, 0)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("panic was swallowed")
+			}
+		}()
+		c.GetOrLoad("a", func(string) (int, error) { panic("boom") })
+	}()
+	v, err := c.GetOrLoad("a", func(string) (int, error) { return 1, nil })
+	if err != nil || v != 1 {
+		t.Fatalf("after panic: got (%v, %v), want (1, nil)", v, err)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ベンチマーク中はメモリに余裕があるのでGCの頻度を下げる
+	benchGCPercent = 400
+	// cgroupのメモリ上限に対してGoのヒープに使わせる割合
+	memoryLimitRatio = 0.9
+)
+
+// コンテナのCPU・メモリ上限に合わせてGOMAXPROCSとGCを調整する
+// GOMAXPROCS/GOGC/GOMEMLIMITが環境変数で指定されている場合はそちらを優先する
+func tuneRuntime() {
+	event := systemLogger.Info()
+
+	if os.Getenv("GOMAXPROCS") == "" {
+		if quota, ok := readCgroupCPUQuota(); ok {
+			procs := max(int(math.Ceil(quota)), 1)
+			if procs < runtime.NumCPU() {
+				runtime.GOMAXPROCS(procs)
+			}
+		}
+	}
+	event = event.Int("gomaxprocs", runtime.GOMAXPROCS(0))
+
+	if os.Getenv("GOGC") == "" && profile.BenchMode {
+		debug.SetGCPercent(benchGCPercent)
+	}
+	gcPercent := debug.SetGCPercent(-1)
+	debug.SetGCPercent(gcPercent)
+	event = event.Int("gc_percent", gcPercent)
+
+	if os.Getenv("GOMEMLIMIT") == "" {
+		if limit, ok := readCgroupMemoryLimit(); ok {
+			debug.SetMemoryLimit(int64(float64(limit) * memoryLimitRatio))
+		}
+	}
+	event.Int64("memory_limit", debug.SetMemoryLimit(-1)).Msg("runtime tuned")
+}
+
+// cgroup v2のcpu.maxから使えるCPU数を読む
+func readCgroupCPUQuota() (float64, bool) {
+	b, err := os.ReadFile("/sys/fs/cgroup/cpu.max")
+	if err != nil {
+		return 0, false
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) != 2 || fields[0] == "max" {
+		return 0, false
+	}
+	quota, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, false
+	}
+	period, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || period == 0 {
+		return 0, false
+	}
+	return quota / period, true
+}
+
+// cgroup v2のmemory.maxからメモリ上限を読む
+func readCgroupMemoryLimit() (int64, bool) {
+	b, err := os.ReadFile("/sys/fs/cgroup/memory.max")
+	if err != nil {
+		return 0, false
+	}
+	value := strings.TrimSpace(string(b))
+	if value == "max" {
+		return 0, false
+	}
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return limit, true
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// UDPのコンディションのデータグラム
+//
+//	0-15  ISUのUUID(16バイトのバイナリ)
+//	16-23 timestamp(UNIX秒，ビッグエンディアンのint64)
+//	24    フラグ(bit0: is_sitting, bit1: is_dirty, bit2: is_overweight, bit3: is_broken)
+//	25    messageのバイト数
+//	26-   message
+const (
+	udpConditionHeaderSize = 26
+	udpMaxDatagramSize     = udpConditionHeaderSize + 255
+
+	udpFlagSitting    = 1 << 0
+	udpFlagDirty      = 1 << 1
+	udpFlagOverweight = 1 << 2
+	udpFlagBroken     = 1 << 3
+	udpFlagMask       = udpFlagSitting | udpFlagDirty | udpFlagOverweight | udpFlagBroken
+)
+
+var errInvalidDatagram = errors.New("invalid datagram")
+
+type udpCondition struct {
+	JIAIsuUUID string
+	Timestamp  time.Time
+	IsSitting  bool
+	Condition  string
+	Message    string
+}
+
+func parseUDPCondition(b []byte) (udpCondition, error) {
+	if len(b) < udpConditionHeaderSize {
+		return udpCondition{}, errInvalidDatagram
+	}
+	flags := b[24]
+	messageLength := int(b[25])
+	if flags&^udpFlagMask != 0 || len(b) != udpConditionHeaderSize+messageLength {
+		return udpCondition{}, errInvalidDatagram
+	}
+
+	condition := fmt.Sprintf("is_dirty=%v,is_overweight=%v,is_broken=%v",
+		flags&udpFlagDirty != 0, flags&udpFlagOverweight != 0, flags&udpFlagBroken != 0)
+	return udpCondition{
+		JIAIsuUUID: fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]),
+		Timestamp:  time.Unix(int64(binary.BigEndian.Uint64(b[16:24])), 0),
+		IsSitting:  flags&udpFlagSitting != 0,
+		Condition:  condition,
+		Message:    string(b[udpConditionHeaderSize:]),
+	}, nil
+}
+
+// 届かなくてもよいセンサー向けに，1データグラム1コンディションでUDPでも受け付ける
+// 応答は返さず，不正なものは捨てる．InsertQueueに入れるのでSRVNO=1のサーバーでだけ動かす
+func serveUDPIngest(ctx context.Context, addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// ReadFromはctxを見ないので，止めるときはソケットを閉じて抜けさせる
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	systemLogger.Info().Str("addr", addr).Msg("udp ingest listening")
+
+	buf := make([]byte, udpMaxDatagramSize+1)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		err = ingestUDPCondition(buf[:n])
+		if err != nil {
+			workerLogger.Warn().Err(err).Msg("dropped udp condition")
+		}
+	}
+}
+
+func ingestUDPCondition(b []byte) error {
+	cond, err := parseUDPCondition(b)
+	if err != nil {
+		return err
+	}
+	isu, err := isuCache.Get(cond.JIAIsuUUID)
+	if err != nil {
+		return fmt.Errorf("isu %v: %w", cond.JIAIsuUUID, err)
+	}
+	settings, err := isuSettingsCache.Get(isu.JIAIsuUUID)
+	if err != nil {
+		return err
+	}
+	message, _, err := sanitizeText(cond.Message, messageMaxLength)
+	if err != nil {
+		return err
+	}
+	level, err := calculateConditionLevel(cond.Condition, settings)
+	if err != nil {
+		return err
+	}
+	muted, err := muteCache.Muted(isu.JIAIsuUUID, cond.Timestamp)
+	if err != nil {
+		return err
+	}
+
+	isuCondition := IsuCondition{
+		JIAIsuUUID: isu.JIAIsuUUID,
+		Timestamp:  cond.Timestamp,
+		IsSitting:  cond.IsSitting,
+		Condition:  cond.Condition,
+		Message:    message,
+		Level:      level,
+		Muted:      muted,
+	}
+	insertQueue.Insert([]IsuCondition{isuCondition})
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const contextKeyJIAUserID = "jia_user_id"
+
+type RouteUsage struct {
+	Count    int64     `json:"count"`
+	Errors   int64     `json:"errors"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+type UserUsage struct {
+	JIAUserID string                 `json:"jia_user_id"`
+	Total     int64                  `json:"total"`
+	Routes    map[string]*RouteUsage `json:"routes"`
+}
+
+// ユーザー毎・ルート毎のAPI利用回数
+type UsageStats struct {
+	users map[string]*UserUsage
+	Lock  sync.Mutex
+}
+
+var usageStats = &UsageStats{users: make(map[string]*UserUsage)}
+
+// セッションから特定できたユーザーのリクエストだけを数える
+func usageMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			err := next(c)
+			jiaUserID, ok := c.Get(contextKeyJIAUserID).(string)
+			if !ok {
+				return err
+			}
+			status := c.Response().Status
+			if he, ok := err.(*echo.HTTPError); ok {
+				status = he.Code
+			}
+			usageStats.Record(jiaUserID, c.Request().Method+" "+c.Path(), status >= 400)
+			return err
+		}
+	}
+}
+
+func (us *UsageStats) Record(jiaUserID string, route string, failed bool) {
+	us.Lock.Lock()
+	defer us.Lock.Unlock()
+	user, ok := us.users[jiaUserID]
+	if !ok {
+		user = &UserUsage{JIAUserID: jiaUserID, Routes: make(map[string]*RouteUsage)}
+		us.users[jiaUserID] = user
+	}
+	usage, ok := user.Routes[route]
+	if !ok {
+		usage = &RouteUsage{}
+		user.Routes[route] = usage
+	}
+	user.Total++
+	usage.Count++
+	if failed {
+		usage.Errors++
+	}
+	usage.LastUsed = time.Now()
+}
+
+func copyUserUsage(user *UserUsage) UserUsage {
+	res := UserUsage{
+		JIAUserID: user.JIAUserID,
+		Total:     user.Total,
+		Routes:    make(map[string]*RouteUsage, len(user.Routes)),
+	}
+	for route, usage := range user.Routes {
+		u := *usage
+		res.Routes[route] = &u
+	}
+	return res
+}
+
+func (us *UsageStats) Get(jiaUserID string) UserUsage {
+	us.Lock.Lock()
+	defer us.Lock.Unlock()
+	user, ok := us.users[jiaUserID]
+	if !ok {
+		return UserUsage{JIAUserID: jiaUserID, Routes: map[string]*RouteUsage{}}
+	}
+	return copyUserUsage(user)
+}
+
+// 利用回数の多い順にlimit人分返す
+func (us *UsageStats) Top(limit int) []UserUsage {
+	us.Lock.Lock()
+	res := make([]UserUsage, 0, len(us.users))
+	for _, user := range us.users {
+		res = append(res, copyUserUsage(user))
+	}
+	us.Lock.Unlock()
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Total != res[j].Total {
+			return res[i].Total > res[j].Total
+		}
+		return res[i].JIAUserID < res[j].JIAUserID
+	})
+	if len(res) > limit {
+		res = res[:limit]
+	}
+	return res
+}
+
+func (us *UsageStats) Forget(jiaUserID string) {
+	us.Lock.Lock()
+	defer us.Lock.Unlock()
+	delete(us.users, jiaUserID)
+}
+
+func (us *UsageStats) Reset() {
+	us.Lock.Lock()
+	defer us.Lock.Unlock()
+	us.users = make(map[string]*UserUsage)
+}
+
+// GET /api/user/me/usage
+// サインインしている自分自身のAPI利用状況を取得
+func getMyUsage(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, usageStats.Get(jiaUserID))
+}
+
+// GET /internal/usage?limit=
+// API利用回数の多いユーザーを取得
+func getUsage(c echo.Context) error {
+	limit := 100
+	if limitStr := c.QueryParam("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			return c.String(http.StatusBadRequest, "bad format: limit")
+		}
+	}
+	return c.JSON(http.StatusOK, usageStats.Top(limit))
+}
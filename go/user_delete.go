@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const userDeleteBatchSize = 5000
+
+// ISUに紐づくデータを持つテーブル(jia_isu_uuid列で消す)
+var isuOwnedTables = []string{
+	"isu_condition",
+	"isu_incident",
+	"isu_settings",
+	"isu_mute",
+	"isu_activation_outbox",
+}
+
+type DeleteMeResponse struct {
+	DeletedIsus int              `json:"deleted_isus"`
+	DeletedRows map[string]int64 `json:"deleted_rows"`
+}
+
+// DELETE /api/user/me
+// ユーザーと，そのISU・アイコン・コンディションなどをすべて消す
+func deleteMe(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUIDs := []string{}
+	err = getDB().Select(&jiaIsuUUIDs, "SELECT `jia_isu_uuid` FROM `isu` WHERE `jia_user_id` = ?", jiaUserID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	// 先にユーザーとISU(アイコンを含む)を消して，以降のリクエストやコンディションの受け付けを止める
+	tx, err := getDB().Beginx()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM `isu` WHERE `jia_user_id` = ?", jiaUserID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	_, err = tx.Exec(
+		"DELETE FROM `isu_transfer` WHERE `from_jia_user_id` = ? OR `to_jia_user_id` = ?",
+		jiaUserID, jiaUserID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	_, err = tx.Exec("DELETE FROM `user` WHERE `jia_user_id` = ?", jiaUserID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	inv := CacheInvalidation{DeletedJIAUserIDs: []string{jiaUserID}, JIAIsuUUIDs: jiaIsuUUIDs}
+	invalidateCaches(inv)
+	broadcastCacheInvalidation(inv)
+
+	// キューに残っているコンディションを書き出してから消す(SRVNO=1以外ではキューは空)
+	err = flushInsertQueue()
+	if err != nil {
+		c.Logger().Error(err)
+	}
+	res := DeleteMeResponse{
+		DeletedIsus: len(jiaIsuUUIDs),
+		DeletedRows: make(map[string]int64, len(isuOwnedTables)),
+	}
+	for _, table := range isuOwnedTables {
+		deleted, err := deleteIsuRowsInBatches(table, jiaIsuUUIDs, func(deleted int64) {
+			c.Logger().Infof("deleting user data: jia_user_id=%v table=%v deleted=%v", jiaUserID, table, deleted)
+		})
+		res.DeletedRows[table] = deleted
+		if err != nil {
+			c.Logger().Errorf("db error: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	err = expireSession(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// 大量の行を1文で消すとロックが長引くので，batchSize件ずつ消して進み具合を知らせる
+func deleteIsuRowsInBatches(table string, jiaIsuUUIDs []string, progress func(deleted int64)) (int64, error) {
+	if len(jiaIsuUUIDs) == 0 {
+		return 0, nil
+	}
+	q, args, err := sqlx.In(
+		fmt.Sprintf("DELETE FROM `%v` WHERE `jia_isu_uuid` IN (?) LIMIT ?", table),
+		jiaIsuUUIDs, userDeleteBatchSize,
+	)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for {
+		result, err := getDB().Exec(getDB().Rebind(q), args...)
+		if err != nil {
+			return total, err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += affected
+		if affected < userDeleteBatchSize {
+			return total, nil
+		}
+		progress(total)
+	}
+}
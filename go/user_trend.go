@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 画面の自動更新で同じユーザーから続けて来るので，最新のコンディションのキャッシュから作ったものを少しだけ使い回す
+const userTrendCacheTTL = time.Second
+
+type userTrendCacheEntry struct {
+	trend     []TrendResponse
+	expiresAt time.Time
+}
+
+// ユーザー毎の，自分のISUだけのトレンド
+type UserTrendCache struct {
+	cache map[string]userTrendCacheEntry
+	Lock  sync.Mutex
+}
+
+var userTrendCache = &UserTrendCache{cache: make(map[string]userTrendCacheEntry)}
+
+func (uc *UserTrendCache) Get(jiaUserID string) ([]TrendResponse, error) {
+	uc.Lock.Lock()
+	entry, ok := uc.cache[jiaUserID]
+	uc.Lock.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.trend, nil
+	}
+
+	isuList, err := userIsuListCache.Get(jiaUserID)
+	if err != nil {
+		return nil, err
+	}
+	byCharacter := map[string][]IsuMeta{}
+	for _, isu := range isuList {
+		// 有効化待ちで性格が決まっていないものは全体のトレンドと同じく載せない
+		if isu.Character == "" {
+			continue
+		}
+		byCharacter[isu.Character] = append(byCharacter[isu.Character], isu)
+	}
+	characters := make([]string, 0, len(byCharacter))
+	for character := range byCharacter {
+		characters = append(characters, character)
+	}
+	sort.Strings(characters)
+
+	trend := make([]TrendResponse, 0, len(characters))
+	for _, character := range characters {
+		res, err := buildCharacterTrend(character, byCharacter[character], nil)
+		if err != nil {
+			return nil, err
+		}
+		trend = append(trend, res)
+	}
+
+	uc.Lock.Lock()
+	uc.cache[jiaUserID] = userTrendCacheEntry{trend: trend, expiresAt: time.Now().Add(userTrendCacheTTL)}
+	uc.Lock.Unlock()
+	return trend, nil
+}
+
+func (uc *UserTrendCache) Forget(jiaUserID string) {
+	uc.Lock.Lock()
+	defer uc.Lock.Unlock()
+	delete(uc.cache, jiaUserID)
+}
+
+func (uc *UserTrendCache) Reset() {
+	uc.Lock.Lock()
+	defer uc.Lock.Unlock()
+	uc.cache = make(map[string]userTrendCacheEntry)
+}
+
+// GET /api/trend/mine
+// 自分のISUだけの，性格毎の最新のコンディション情報
+func getMyTrend(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	trend, err := userTrendCache.Get(jiaUserID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, trend)
+}
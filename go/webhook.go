@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	"github.com/goccy/go-json"
+)
+
+const (
+	eventTypeIsuRegistered = "isu.registered"
+
+	webhookQueueSize = 1024
+)
+
+type IsuEvent struct {
+	Type       string      `json:"type"`
+	Timestamp  int64       `json:"timestamp"`
+	JIAUserID  string      `json:"jia_user_id"`
+	JIAIsuUUID string      `json:"jia_isu_uuid"`
+	Data       interface{} `json:"data,omitempty"`
+}
+
+// ISUの登録などのイベントを外部のURLへ非同期に通知する
+// WEBHOOK_URLS=http://a/hook,http://b/hook，WEBHOOK_SECRETがあればボディのHMAC-SHA256を署名として付ける
+type WebhookDispatcher struct {
+	urls   []string
+	secret []byte
+	queue  chan IsuEvent
+}
+
+var webhookDispatcher = NewWebhookDispatcher(
+	parseURLList(getEnv("WEBHOOK_URLS", "")),
+	getEnv("WEBHOOK_SECRET", ""),
+)
+
+func NewWebhookDispatcher(urls []string, secret string) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		urls:   urls,
+		secret: []byte(secret),
+		queue:  make(chan IsuEvent, webhookQueueSize),
+	}
+}
+
+// キューが詰まっている場合は捨てて，リクエストを待たせない
+func (wd *WebhookDispatcher) Enqueue(event IsuEvent) {
+	if len(wd.urls) == 0 {
+		return
+	}
+	select {
+	case wd.queue <- event:
+	default:
+		workerLogger.Warn().Str("type", event.Type).Str("jia_isu_uuid", event.JIAIsuUUID).Msg("webhook queue is full: dropped event")
+	}
+}
+
+func (wd *WebhookDispatcher) Run(ctx context.Context) {
+	if len(wd.urls) == 0 {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-wd.queue:
+			wd.deliver(event)
+		}
+	}
+}
+
+func (wd *WebhookDispatcher) deliver(event IsuEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		workerLogger.Error().Err(err).Msg("failed to marshal webhook event")
+		return
+	}
+	for _, url := range wd.urls {
+		err := wd.post(url, body)
+		if err != nil {
+			workerLogger.Error().Err(err).Str("url", url).Str("type", event.Type).Msg("failed to deliver webhook")
+		}
+	}
+}
+
+func (wd *WebhookDispatcher) post(url string, body []byte) error {
+	var signature string
+	if len(wd.secret) > 0 {
+		mac := hmac.New(sha256.New, wd.secret)
+		mac.Write(body)
+		signature = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	res, err := outbound(outboundWebhook).Do(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if signature != "" {
+			req.Header.Set("X-Isucondition-Signature", signature)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code: %v", res.StatusCode)
+	}
+	return nil
+}
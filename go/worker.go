@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	workerStatusRunning    = "running"
+	workerStatusRestarting = "restarting"
+	workerStatusStopped    = "stopped"
+
+	workerRestartBackoff    = time.Second
+	workerRestartBackoffMax = 30 * time.Second
+)
+
+// バックグラウンドで動かす処理．ctxが終わったら戻る
+// nilを返して戻ったものは(無効な設定などで)役目を終えたとみなし，エラーかpanicなら少し待って動かし直す
+type WorkerFunc func(ctx context.Context) error
+
+type WorkerHealth struct {
+	Name      string    `json:"name"`
+	Status    string    `json:"status"`
+	StartedAt time.Time `json:"started_at"`
+	Restarts  int       `json:"restarts"`
+	LastError string    `json:"last_error,omitempty"`
+	LastErrAt time.Time `json:"last_error_at,omitempty"`
+}
+
+type worker struct {
+	run    WorkerFunc
+	health WorkerHealth
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// バックグラウンドのgoroutineをまとめて持ち，登録した順に起動して逆順に止める
+// 後から登録したものほど先に登録したものに依存する(例: UDPの受信はフラッシュに，フラッシュはDBの監視に)
+type WorkerManager struct {
+	workers []*worker
+	Lock    sync.Mutex
+}
+
+var workerManager = &WorkerManager{}
+
+func (wm *WorkerManager) Go(name string, run WorkerFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &worker{
+		run:    run,
+		health: WorkerHealth{Name: name, Status: workerStatusRunning, StartedAt: time.Now()},
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	wm.Lock.Lock()
+	wm.workers = append(wm.workers, w)
+	wm.Lock.Unlock()
+	go wm.supervise(ctx, w)
+}
+
+func (wm *WorkerManager) supervise(ctx context.Context, w *worker) {
+	defer close(w.done)
+	backoff := workerRestartBackoff
+	for {
+		err := runWorker(ctx, w.run)
+		if ctx.Err() != nil || err == nil {
+			wm.update(w, func(h *WorkerHealth) { h.Status = workerStatusStopped })
+			return
+		}
+		workerLogger.Error().Err(err).Str("worker", w.health.Name).Dur("backoff", backoff).Msg("worker failed")
+		wm.update(w, func(h *WorkerHealth) {
+			h.Status = workerStatusRestarting
+			h.Restarts++
+			h.LastError = err.Error()
+			h.LastErrAt = time.Now()
+		})
+		select {
+		case <-ctx.Done():
+			wm.update(w, func(h *WorkerHealth) { h.Status = workerStatusStopped })
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, workerRestartBackoffMax)
+		wm.update(w, func(h *WorkerHealth) {
+			h.Status = workerStatusRunning
+			h.StartedAt = time.Now()
+		})
+	}
+}
+
+func runWorker(ctx context.Context, run WorkerFunc) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+	return run(ctx)
+}
+
+func (wm *WorkerManager) update(w *worker, f func(h *WorkerHealth)) {
+	wm.Lock.Lock()
+	defer wm.Lock.Unlock()
+	f(&w.health)
+}
+
+// 登録と逆の順に1つずつ止め，止まるのを待ってから次を止める
+func (wm *WorkerManager) Shutdown(ctx context.Context) error {
+	wm.Lock.Lock()
+	workers := append([]*worker{}, wm.workers...)
+	wm.Lock.Unlock()
+	for i := len(workers) - 1; i >= 0; i-- {
+		w := workers[i]
+		w.cancel()
+		select {
+		case <-w.done:
+		case <-ctx.Done():
+			return fmt.Errorf("worker %v did not stop: %w", w.health.Name, ctx.Err())
+		}
+	}
+	return nil
+}
+
+func (wm *WorkerManager) Health() []WorkerHealth {
+	wm.Lock.Lock()
+	defer wm.Lock.Unlock()
+	res := make([]WorkerHealth, 0, len(wm.workers))
+	for _, w := range wm.workers {
+		res = append(res, w.health)
+	}
+	return res
+}
+
+// GET /internal/workers
+// バックグラウンドの処理毎の状態
+func getWorkers(c echo.Context) error {
+	return c.JSON(http.StatusOK, workerManager.Health())
+}
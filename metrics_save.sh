@@ -0,0 +1,2 @@
+# ベンチマーク後に実行: ./metrics_save.sh <score>
+curl -s -X POST "http://localhost:3000/internal/metrics/save?score=${1:-0}" | tee ~/log/$(date +metrics-%m-%d-%H-%M -d "+9 hours").json
@@ -1,3 +1,8 @@
+DROP TABLE IF EXISTS `isu_activation_outbox`;
+DROP TABLE IF EXISTS `isu_transfer`;
+DROP TABLE IF EXISTS `isu_mute`;
+DROP TABLE IF EXISTS `isu_settings`;
+DROP TABLE IF EXISTS `isu_incident`;
 DROP TABLE IF EXISTS `isu_association_config`;
 DROP TABLE IF EXISTS `isu_condition`;
 DROP TABLE IF EXISTS `isu`;
@@ -22,9 +27,12 @@ CREATE TABLE `isu_condition` (
   `is_sitting` TINYINT(1) NOT NULL,
   `condition` VARCHAR(255) NOT NULL,
   `message` VARCHAR(255) NOT NULL,
+  -- 1_InitData.sqlはカラム名なしでこの並びのままINSERTしてもよいよう，元の定義で作る
+  -- level・message_code・sequenceは初期データを入れた後に2_Migration.sqlで作り直す
   `level` VARCHAR(255) NOT NULL,
   `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
   PRIMARY KEY(`jia_isu_uuid`, `timestamp`)
+  -- 二次インデックスは初期データを入れた後にアプリが張る(go/index_builder.go)
 ) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
 
 CREATE TABLE `user` (
@@ -36,3 +44,55 @@ CREATE TABLE `isu_association_config` (
   `name` VARCHAR(255) PRIMARY KEY,
   `url` VARCHAR(255) NOT NULL UNIQUE
 ) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+-- コンディションがinfo以外になってからinfoに戻るまでを1件のインシデントとする
+CREATE TABLE `isu_incident` (
+  `id` bigint AUTO_INCREMENT,
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `level` VARCHAR(16) NOT NULL,
+  `started_at` DATETIME NOT NULL,
+  `resolved_at` DATETIME DEFAULT NULL,
+  PRIMARY KEY(`id`),
+  UNIQUE KEY `idx_isu_started_at` (`jia_isu_uuid`, `started_at`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+-- ISU毎のコンディションレベルの判定ルールの上書き(カンマ区切りのコンディション名)
+CREATE TABLE `isu_settings` (
+  `jia_isu_uuid` CHAR(36) PRIMARY KEY,
+  `critical_conditions` VARCHAR(255) NOT NULL DEFAULT '',
+  `ignored_conditions` VARCHAR(255) NOT NULL DEFAULT '',
+  `updated_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+-- メンテナンス中などでアラートを止める期間(ISUの時刻で判定する)
+CREATE TABLE `isu_mute` (
+  `id` bigint AUTO_INCREMENT,
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `start_at` DATETIME NOT NULL,
+  `end_at` DATETIME NOT NULL,
+  `exclude_from_trend` TINYINT(1) NOT NULL DEFAULT 0,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`id`),
+  INDEX `idx_isu_end_at` (`jia_isu_uuid`, `end_at`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+-- ISUの持ち主の移譲．受け取る側が承認するまではpendingで，承認後もそのまま履歴として残す
+CREATE TABLE `isu_transfer` (
+  `id` bigint AUTO_INCREMENT,
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `from_jia_user_id` VARCHAR(255) NOT NULL,
+  `to_jia_user_id` VARCHAR(255) NOT NULL,
+  `status` VARCHAR(16) NOT NULL,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  `updated_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`id`),
+  INDEX `idx_to_status` (`to_jia_user_id`, `status`),
+  INDEX `idx_isu_status` (`jia_isu_uuid`, `status`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+-- JIAのサービスが落ちている間に登録され，まだ有効化していないISU
+CREATE TABLE `isu_activation_outbox` (
+  `jia_isu_uuid` CHAR(36) PRIMARY KEY,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  INDEX `idx_created_at` (`created_at`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
@@ -0,0 +1,15 @@
+-- 初期データ(1_InitData.sql)を入れた後に流す
+-- 初期データはlevelも書いてくるので，生成カラムへの置き換えはここで行う
+ALTER TABLE `isu_condition`
+  ADD COLUMN `message_code` VARCHAR(64) NOT NULL DEFAULT '' AFTER `message`,
+  -- デバイスが振る通し番号(送ってこなければNULL)
+  ADD COLUMN `sequence` BIGINT DEFAULT NULL AFTER `message_code`,
+  DROP COLUMN `level`,
+  -- conditionの"=true"の数から決まるレベル(0: info, 1-2: warning, 3: critical)
+  ADD COLUMN `level` VARCHAR(16) AS (
+    CASE (CHAR_LENGTH(`condition`) - CHAR_LENGTH(REPLACE(`condition`, '=true', ''))) DIV 5
+      WHEN 0 THEN 'info'
+      WHEN 3 THEN 'critical'
+      ELSE 'warning'
+    END
+  ) VIRTUAL AFTER `sequence`;